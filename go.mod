@@ -4,6 +4,7 @@ go 1.22
 
 require (
 	github.com/Masterminds/semver/v3 v3.3.1
+	github.com/andybalholm/brotli v1.1.1
 	github.com/evanw/esbuild v0.24.2
 	github.com/gorilla/websocket v1.5.3
 	github.com/ije/esbuild-internal v0.24.2
@@ -19,7 +20,6 @@ require (
 )
 
 require (
-	github.com/andybalholm/brotli v1.1.1 // indirect
 	github.com/rs/cors v1.11.1 // indirect
 	golang.org/x/crypto v0.32.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/log"
+)
+
+// the db key prefix of the last access time of the build artifacts, `#` is not allowed in the zone ids
+const gcAccessKeyPrefix = "#atime:"
+
+// the save path of the tree-shaken build of the `?exports` query, e.g. `react.mjs` -> `react_<hash>.mjs`
+var regexpTreeShakenSavePath = regexp.MustCompile(`_[\w-]{11}\.(mjs|css)$`)
+
+// ArtifactGC removes the build artifacts of the storage that have not been accessed within the retention period.
+// The files of a build (`.mjs`, `.css`, `.map`, `.integrity`, etc.) are removed together with the build meta in the
+// database, the builds are rebuilt on demand if they are requested again.
+type ArtifactGC struct {
+	db        DB
+	storage   storage.Storage
+	logger    *log.Logger
+	retention time.Duration
+	pinned    []string
+	lock      sync.Mutex
+	accessed  map[string]time.Time
+	running   atomic.Bool
+	stats     GCStats
+}
+
+// GCStats is the stats of the artifact GC that is exposed in the `/status.json`
+type GCStats struct {
+	Runs              int    `json:"runs"`
+	LastRunAt         string `json:"lastRunAt,omitempty"`
+	LastDuration      string `json:"lastDuration,omitempty"`
+	LastScannedFiles  int    `json:"lastScannedFiles"`
+	LastDeletedFiles  int    `json:"lastDeletedFiles"`
+	LastDeletedBytes  int64  `json:"lastDeletedBytes"`
+	LastError         string `json:"lastError,omitempty"`
+	TotalDeletedFiles int    `json:"totalDeletedFiles"`
+	TotalDeletedBytes int64  `json:"totalDeletedBytes"`
+}
+
+func NewArtifactGC(db DB, buildStorage storage.Storage, logger *log.Logger, options GCOptions) *ArtifactGC {
+	return &ArtifactGC{
+		db:        db,
+		storage:   buildStorage,
+		logger:    logger,
+		retention: time.Duration(options.Retention) * time.Second,
+		pinned:    options.Pinned,
+		accessed:  map[string]time.Time{},
+	}
+}
+
+// Serve runs the GC periodically in the background
+func (gc *ArtifactGC) Serve(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			gc.Run()
+		}
+	}()
+}
+
+// Touch records the access of the build artifact, the records are saved to the database in the next GC run.
+func (gc *ArtifactGC) Touch(savePath string) {
+	if gc == nil {
+		return
+	}
+	gc.lock.Lock()
+	gc.accessed[getArtifactGroup(savePath)] = time.Now()
+	gc.lock.Unlock()
+}
+
+// Stats returns the stats of the GC runs
+func (gc *ArtifactGC) Stats() GCStats {
+	gc.lock.Lock()
+	defer gc.lock.Unlock()
+	return gc.stats
+}
+
+// Run removes the stale build artifacts, it's skipped if the previous run is not finished.
+func (gc *ArtifactGC) Run() {
+	if !gc.running.CompareAndSwap(false, true) {
+		return
+	}
+	defer gc.running.Store(false)
+
+	startedAt := time.Now()
+	scanned, deleted, deletedBytes, err := gc.sweep(startedAt)
+
+	gc.lock.Lock()
+	gc.stats.Runs++
+	gc.stats.LastRunAt = startedAt.UTC().Format(http.TimeFormat)
+	gc.stats.LastDuration = time.Since(startedAt).String()
+	gc.stats.LastScannedFiles = scanned
+	gc.stats.LastDeletedFiles = deleted
+	gc.stats.LastDeletedBytes = deletedBytes
+	gc.stats.TotalDeletedFiles += deleted
+	gc.stats.TotalDeletedBytes += deletedBytes
+	gc.stats.LastError = ""
+	if err != nil {
+		gc.stats.LastError = err.Error()
+	}
+	gc.lock.Unlock()
+
+	if err != nil {
+		gc.logger.Errorf("gc: %v", err)
+	} else if deleted > 0 {
+		gc.logger.Infof("gc: removed %d stale files (%d KB) in %s", deleted, deletedBytes/1024, time.Since(startedAt))
+	}
+}
+
+func (gc *ArtifactGC) sweep(now time.Time) (scanned int, deleted int, deletedBytes int64, err error) {
+	// save the access records to the database
+	gc.lock.Lock()
+	accessed := gc.accessed
+	gc.accessed = map[string]time.Time{}
+	gc.lock.Unlock()
+	for group, t := range accessed {
+		err = gc.db.Put(gcAccessKeyPrefix+group, []byte(strconv.FormatInt(t.Unix(), 10)))
+		if err != nil {
+			return
+		}
+	}
+
+	keys, err := gc.storage.List("")
+	if err != nil {
+		return
+	}
+	groups := map[string][]string{}
+	for _, key := range keys {
+		if _, _, artifactPath, ok := splitArtifactSavePath(key); ok && !gc.isPinned(artifactPath) {
+			group := getArtifactGroup(key)
+			groups[group] = append(groups[group], key)
+		}
+	}
+
+	for group, files := range groups {
+		lastAccess := time.Time{}
+		if value, e := gc.db.Get(gcAccessKeyPrefix + group); e == nil && value != nil {
+			if i, e := strconv.ParseInt(string(value), 10, 64); e == nil {
+				lastAccess = time.Unix(i, 0)
+			}
+		}
+		var size int64
+		for _, key := range files {
+			scanned++
+			stat, e := gc.storage.Stat(key)
+			if e != nil {
+				if e != storage.ErrNotFound {
+					err = e
+					return
+				}
+				continue
+			}
+			if stat.ModTime().After(lastAccess) {
+				lastAccess = stat.ModTime()
+			}
+			// the shared blob is freed by the blob sweep below if it's not referenced anymore
+			if _, ok := stat.(storage.BlobStat); !ok {
+				size += stat.Size()
+			}
+		}
+		if now.Sub(lastAccess) < gc.retention {
+			continue
+		}
+		// the build may be accessed during the sweep
+		gc.lock.Lock()
+		_, touched := gc.accessed[group]
+		gc.lock.Unlock()
+		if touched {
+			continue
+		}
+		err = gc.storage.Delete(files...)
+		if err != nil {
+			return
+		}
+		if dbKey, ok := getBuildDBKey(group); ok {
+			gc.db.Delete(dbKey)
+			cacheLRU.Remove(dbKey)
+		}
+		gc.db.Delete(gcAccessKeyPrefix + group)
+		deleted += len(files)
+		deletedBytes += size
+	}
+
+	// remove the blobs of the dedupe storage that are not referenced by the remaining files,
+	// including the ones that are released by the `/purge` API
+	if sweeper, ok := gc.storage.(storage.BlobSweeper); ok {
+		blobs, blobBytes, e := sweeper.SweepBlobs()
+		if e != nil {
+			err = e
+			return
+		}
+		deleted += blobs
+		deletedBytes += blobBytes
+	}
+	return
+}
+
+// isPinned checks if the artifact path belongs to the packages that are listed in the `gc.pinned` config
+func (gc *ArtifactGC) isPinned(artifactPath string) bool {
+	for _, name := range gc.pinned {
+		if strings.HasPrefix(artifactPath, name+"@") || strings.HasPrefix(artifactPath, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArtifactSavePath splits the save path of the build artifact into the zone id, the `modules` or `types`
+// directory and the path in the directory, e.g. `example.com/modules/react@18.2.0/es2022/react.mjs`
+// -> `example.com`, `modules`, `react@18.2.0/es2022/react.mjs`
+func splitArtifactSavePath(savePath string) (zoneId string, dir string, artifactPath string, ok bool) {
+	dir, artifactPath, found := strings.Cut(savePath, "/")
+	if !found {
+		return
+	}
+	if dir != "modules" && dir != "types" {
+		zoneId = dir
+		dir, artifactPath, found = strings.Cut(artifactPath, "/")
+		if !found || (dir != "modules" && dir != "types") {
+			return
+		}
+	}
+	ok = artifactPath != ""
+	return
+}
+
+// isBuildArtifactPath checks if the artifact path is a build of a package, the results of the
+// `/transform` API and the `/x/` modules are named by the content hash
+func isBuildArtifactPath(dir string, artifactPath string) bool {
+	return dir == "modules" && !strings.HasPrefix(artifactPath, "transform/") && !strings.HasPrefix(artifactPath, "x/")
+}
+
+// getArtifactGroup returns the save path of the build that the artifact belongs to,
+// e.g. `modules/react@18.2.0/es2022/react.mjs.map` -> `modules/react@18.2.0/es2022/react.mjs`
+func getArtifactGroup(savePath string) string {
+	for _, ext := range []string{".integrity", ".map", ".LEGAL.txt", ".imports", ".rejected"} {
+		savePath = strings.TrimSuffix(savePath, ext)
+	}
+	if _, dir, artifactPath, ok := splitArtifactSavePath(savePath); ok && isBuildArtifactPath(dir, artifactPath) {
+		if loc := regexpTreeShakenSavePath.FindStringIndex(savePath); loc != nil {
+			savePath = savePath[:loc[0]] + ".mjs"
+		} else if strings.HasSuffix(savePath, ".css") {
+			savePath = strings.TrimSuffix(savePath, ".css") + ".mjs"
+		}
+	}
+	return savePath
+}
+
+// getBuildDBKey returns the database key of the build meta by the save path of the build,
+// it's the reverse of the `normalizeSavePath` function. The builds with the hashed build args
+// can not be reversed, the stale build meta is removed when the build is requested again.
+func getBuildDBKey(savePath string) (dbKey string, ok bool) {
+	zoneId, dir, artifactPath, ok := splitArtifactSavePath(savePath)
+	if !ok || !isBuildArtifactPath(dir, artifactPath) || !strings.HasSuffix(artifactPath, ".mjs") {
+		return "", false
+	}
+	segs := strings.Split(artifactPath, "/")
+	for _, seg := range segs {
+		if strings.HasPrefix(seg, "x-") && len(seg) == 42 {
+			return "", false
+		}
+	}
+	// restore the `*` prefix of the builds that external all dependencies, e.g. `react@18.2.0/ea/...` -> `*react@18.2.0/...`
+	if len(segs) > 2 && segs[1] == "ea" {
+		segs = append([]string{"*" + segs[0]}, segs[2:]...)
+	}
+	return zoneId + ":/" + strings.Join(segs, "/"), true
+}
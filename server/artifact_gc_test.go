@@ -0,0 +1,151 @@
+package server
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/log"
+)
+
+func TestArtifactGroup(t *testing.T) {
+	for _, tc := range []struct {
+		savePath string
+		group    string
+	}{
+		{"modules/react@18.2.0/es2022/react.mjs", "modules/react@18.2.0/es2022/react.mjs"},
+		{"modules/react@18.2.0/es2022/react.mjs.map", "modules/react@18.2.0/es2022/react.mjs"},
+		{"modules/react@18.2.0/es2022/react.mjs.LEGAL.txt", "modules/react@18.2.0/es2022/react.mjs"},
+		{"modules/react@18.2.0/es2022/react.css.integrity", "modules/react@18.2.0/es2022/react.mjs"},
+		{"modules/react@18.2.0/es2022/react_AAAAAAAAAAA.mjs", "modules/react@18.2.0/es2022/react.mjs"},
+		{"example.com/modules/react@18.2.0/es2022/react.css", "example.com/modules/react@18.2.0/es2022/react.mjs"},
+		{"modules/x/0123456789abcdef.css", "modules/x/0123456789abcdef.css"},
+		{"types/@types/react@18.2.0/index.d.ts", "types/@types/react@18.2.0/index.d.ts"},
+	} {
+		if group := getArtifactGroup(tc.savePath); group != tc.group {
+			t.Fatalf("getArtifactGroup(%q): expected %q, got %q", tc.savePath, tc.group, group)
+		}
+	}
+
+	for _, tc := range []struct {
+		savePath string
+		dbKey    string
+	}{
+		{"modules/react@18.2.0/es2022/react.mjs", ":/react@18.2.0/es2022/react.mjs"},
+		{"example.com/modules/react@18.2.0/es2022/react.mjs", "example.com:/react@18.2.0/es2022/react.mjs"},
+		{"modules/swr@1.3.0/ea/es2022/swr.mjs", ":/*swr@1.3.0/es2022/swr.mjs"},
+		{"modules/@scope/ea/pkg@1.0.0/es2022/pkg.mjs", ":/*@scope/pkg@1.0.0/es2022/pkg.mjs"},
+		{"modules/pkg@1.0.0/x-" + strings.Repeat("0", 40) + "/es2022/pkg.mjs", ""},
+		{"modules/transform/0123456789abcdef.mjs", ""},
+		{"types/@types/react@18.2.0/index.d.ts", ""},
+	} {
+		dbKey, _ := getBuildDBKey(tc.savePath)
+		if dbKey != tc.dbKey {
+			t.Fatalf("getBuildDBKey(%q): expected %q, got %q", tc.savePath, tc.dbKey, dbKey)
+		}
+	}
+}
+
+func TestArtifactGC(t *testing.T) {
+	wd := t.TempDir()
+	db, err := OpenDB(path.Join(wd, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	buildStorage, err := storage.NewFSStorage(&storage.StorageOptions{Type: "fs", Endpoint: path.Join(wd, "storage")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := log.New("file:" + path.Join(wd, "gc.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staleTime := time.Now().Add(-60 * 24 * time.Hour)
+	files := map[string]bool{
+		"modules/old@1.0.0/es2022/old.mjs":             true,
+		"modules/old@1.0.0/es2022/old.mjs.map":         true,
+		"modules/old@1.0.0/es2022/old.css":             true,
+		"types/old@1.0.0/index.d.ts":                   true,
+		"modules/touched@1.0.0/es2022/touched.mjs":     true,
+		"modules/touched@1.0.0/es2022/touched.mjs.map": true,
+		"modules/pinned@1.0.0/es2022/pinned.mjs":       true,
+		"modules/new@1.0.0/es2022/new.mjs":             false,
+		"example.com/modules/old@1.0.0/es2022/old.mjs": true,
+		"legacy/v135/old@1.0.0/es2022/old.js":          true,
+	}
+	for key, stale := range files {
+		err = buildStorage.Put(key, strings.NewReader("export default 1;"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stale {
+			err = os.Chtimes(path.Join(wd, "storage", key), staleTime, staleTime)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, key := range []string{":/old@1.0.0/es2022/old.mjs", ":/touched@1.0.0/es2022/touched.mjs", "example.com:/old@1.0.0/es2022/old.mjs"} {
+		err = db.Put(key, []byte("j\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gc := NewArtifactGC(db, buildStorage, logger, GCOptions{Retention: defaultGCRetention, Pinned: []string{"pinned"}})
+	gc.Touch("modules/touched@1.0.0/es2022/touched.mjs.map")
+	gc.Run()
+
+	for key, removed := range map[string]bool{
+		"modules/old@1.0.0/es2022/old.mjs":             true,
+		"modules/old@1.0.0/es2022/old.mjs.map":         true,
+		"modules/old@1.0.0/es2022/old.css":             true,
+		"types/old@1.0.0/index.d.ts":                   true,
+		"example.com/modules/old@1.0.0/es2022/old.mjs": true,
+		"modules/touched@1.0.0/es2022/touched.mjs":     false,
+		"modules/touched@1.0.0/es2022/touched.mjs.map": false,
+		"modules/pinned@1.0.0/es2022/pinned.mjs":       false,
+		"modules/new@1.0.0/es2022/new.mjs":             false,
+		"legacy/v135/old@1.0.0/es2022/old.js":          false,
+	} {
+		_, err := buildStorage.Stat(key)
+		if removed && err != storage.ErrNotFound {
+			t.Fatalf("%s should be removed", key)
+		}
+		if !removed && err != nil {
+			t.Fatalf("%s should be kept: %v", key, err)
+		}
+	}
+	for key, removed := range map[string]bool{
+		":/old@1.0.0/es2022/old.mjs":            true,
+		"example.com:/old@1.0.0/es2022/old.mjs": true,
+		":/touched@1.0.0/es2022/touched.mjs":    false,
+	} {
+		value, err := db.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != (value == nil) {
+			t.Fatalf("unexpected build meta of %s (removed: %v)", key, value == nil)
+		}
+	}
+
+	stats := gc.Stats()
+	if stats.Runs != 1 || stats.LastDeletedFiles != 5 || stats.TotalDeletedFiles != 5 || stats.LastDeletedBytes != 5*17 || stats.LastError != "" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// the access record is saved to the database, the touched build is kept in the next run
+	gc.Run()
+	if _, err := buildStorage.Stat("modules/touched@1.0.0/es2022/touched.mjs"); err != nil {
+		t.Fatalf("the touched build should be kept: %v", err)
+	}
+	if stats := gc.Stats(); stats.Runs != 2 || stats.LastDeletedFiles != 0 || stats.TotalDeletedFiles != 5 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
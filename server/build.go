@@ -12,11 +12,12 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/esm-dev/esm.sh/server/npm_replacements"
 	"github.com/esm-dev/esm.sh/server/storage"
 	esbuild "github.com/evanw/esbuild/pkg/api"
-	"github.com/ije/gox/log"
 	"github.com/ije/gox/set"
 	"github.com/ije/gox/utils"
 )
@@ -29,9 +30,15 @@ const (
 	BundleFalse
 )
 
+// BuildStage records the start time of a build stage
+type BuildStage struct {
+	name      string
+	startedAt time.Time
+}
+
 type BuildContext struct {
 	npmrc       *NpmRC
-	logger      *log.Logger
+	logger      Logger
 	db          DB
 	storage     storage.Storage
 	esm         EsmPath
@@ -40,11 +47,14 @@ type BuildContext struct {
 	externalAll bool
 	target      string
 	dev         bool
+	cssExports  []string // builds the package CSS that is tree-shaken by the `?exports` query
 	wd          string
 	pkgJson     *PackageJSON
 	path        string
 	rawPath     string
 	status      string
+	stages      []BuildStage
+	stagesLock  sync.Mutex
 	splitting   *set.ReadOnlySet[string]
 	esmImports  [][2]string
 	cjsRequires [][3]string
@@ -56,6 +66,12 @@ var (
 	regexpVarDecl          = regexp.MustCompile(`var ([\w$]+)\s*=\s*[\w$]+$`)
 )
 
+// the error message of the builds that exceed the `maxBuildInputSize` limit
+const (
+	errBuildInputTooLarge   = "build input is too large, the limit is"
+	errUnsupportedES5Syntax = "unsupported es5 syntax"
+)
+
 var loaders = map[string]esbuild.Loader{
 	".js":     esbuild.LoaderJS,
 	".mjs":    esbuild.LoaderJS,
@@ -91,6 +107,33 @@ func (ctx *BuildContext) Path() string {
 	return ctx.path
 }
 
+// setStatus updates the build status and records the start time of the new stage
+func (ctx *BuildContext) setStatus(status string) {
+	ctx.stagesLock.Lock()
+	defer ctx.stagesLock.Unlock()
+	ctx.status = status
+	ctx.stages = append(ctx.stages, BuildStage{name: status, startedAt: time.Now()})
+}
+
+// diagnose returns the current stage and how long each stage took
+func (ctx *BuildContext) diagnose() string {
+	ctx.stagesLock.Lock()
+	defer ctx.stagesLock.Unlock()
+	buf := strings.Builder{}
+	fmt.Fprintf(&buf, "build: %s\n", ctx.Path())
+	fmt.Fprintf(&buf, "stage: %s\n", ctx.status)
+	for i, stage := range ctx.stages {
+		var d time.Duration
+		if i+1 < len(ctx.stages) {
+			d = ctx.stages[i+1].startedAt.Sub(stage.startedAt)
+		} else {
+			d = time.Since(stage.startedAt)
+		}
+		fmt.Fprintf(&buf, "  - %s: %v\n", stage.name, d.Round(time.Millisecond))
+	}
+	return buf.String()
+}
+
 func (ctx *BuildContext) Exists() (meta *BuildMeta, ok bool, err error) {
 	key := ctx.npmrc.zoneId + ":" + ctx.Path()
 	meta, err = withLRUCache(key, func() (*BuildMeta, error) {
@@ -124,6 +167,9 @@ func (ctx *BuildContext) Build() (meta *BuildMeta, err error) {
 	if ctx.target == "types" {
 		return ctx.buildTypes()
 	}
+	if len(ctx.cssExports) > 0 {
+		return ctx.buildTreeShakenCSSFile()
+	}
 
 	// check previous build
 	meta, ok, err := ctx.Exists()
@@ -132,7 +178,7 @@ func (ctx *BuildContext) Build() (meta *BuildMeta, err error) {
 	}
 
 	// install the package
-	ctx.status = "install"
+	ctx.setStatus("install")
 	err = ctx.install()
 	if err != nil {
 		return
@@ -144,18 +190,27 @@ func (ctx *BuildContext) Build() (meta *BuildMeta, err error) {
 		return
 	}
 
-	// analyze splitting modules
-	ctx.status = "analyze"
-	err = ctx.analyzeSplitting()
-	if err != nil {
-		return
-	}
+	if len(ctx.args.entries) > 0 {
+		// build the barrel module of the `?entries` query
+		ctx.setStatus("build")
+		meta, err = ctx.buildBarrel()
+		if err != nil {
+			return
+		}
+	} else {
+		// analyze splitting modules
+		ctx.setStatus("analyze")
+		err = ctx.analyzeSplitting()
+		if err != nil {
+			return
+		}
 
-	// build the module
-	ctx.status = "build"
-	meta, _, err = ctx.buildModule(false)
-	if err != nil {
-		return
+		// build the module
+		ctx.setStatus("build")
+		meta, _, err = ctx.buildModule(false)
+		if err != nil {
+			return
+		}
 	}
 
 	// save the build result to the storage
@@ -176,7 +231,7 @@ func (ctx *BuildContext) buildPath() {
 
 	esm := ctx.esm
 	if ctx.target == "types" {
-		if strings.HasSuffix(esm.SubPath, ".d.ts") {
+		if endsWith(esm.SubPath, ".d.ts", ".d.mts", ".d.cts") {
 			ctx.path = fmt.Sprintf(
 				"/%s%s/%s%s",
 				asteriskPrefix,
@@ -220,12 +275,19 @@ func (ctx *BuildContext) buildPath() {
 		ctx.target,
 		name,
 	)
+	if len(ctx.cssExports) > 0 {
+		ctx.path = getTreeShakenCSSPath(ctx.path, ctx.cssExports)
+	}
 }
 
 func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, includes [][2]string, err error) {
 	entry := ctx.resolveEntry(ctx.esm)
 	if entry.isEmpty() {
-		err = errors.New("could not resolve build entry")
+		if ctx.esm.SubModuleName == "" {
+			err = errors.New("package has no entry point")
+		} else {
+			err = errors.New("could not resolve build entry")
+		}
 		return
 	}
 
@@ -259,7 +321,7 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 	}
 
 	// json module
-	if strings.HasSuffix(entry.main, ".json") {
+	if endsWith(entry.main, ".json", ".json5", ".jsonc") {
 		if analyzeMode {
 			return
 		}
@@ -271,8 +333,29 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 		}
 		buffer, recycle := NewBuffer()
 		defer recycle()
-		buffer.WriteString("export default ")
-		buffer.Write(jsonData)
+		if strings.HasSuffix(entry.main, ".json") {
+			buffer.WriteString("export default ")
+			buffer.Write(jsonData)
+		} else {
+			// convert JSON5/JSONC to JSON, and export the top-level keys of the object as named exports
+			jsonData, err = json5ToJSON(jsonData)
+			if err != nil {
+				return
+			}
+			ret := esbuild.Transform(string(jsonData), esbuild.TransformOptions{
+				Loader:            esbuild.LoaderJSON,
+				Format:            esbuild.FormatESModule,
+				Target:            targets[ctx.target],
+				MinifyWhitespace:  config.Minify && !ctx.dev,
+				MinifyIdentifiers: config.Minify && !ctx.dev,
+				MinifySyntax:      config.Minify && !ctx.dev,
+			})
+			if len(ret.Errors) > 0 {
+				err = errors.New("esbuild: " + ret.Errors[0].Text)
+				return
+			}
+			buffer.Write(ret.Code)
+		}
 		err = ctx.storage.Put(ctx.getSavepath(), buffer)
 		if err != nil {
 			ctx.logger.Errorf("storage.put(%s): %v", ctx.getSavepath(), err)
@@ -293,6 +376,7 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 		if err != nil {
 			return
 		}
+		meta.Entry = entry.main
 	}
 
 	// cjs reexport
@@ -317,11 +401,13 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 		if err != nil {
 			return
 		}
+		entryMain := meta.Entry
 		entry = b.resolveEntry(dep)
 		meta, _, _, err = b.lexer(&entry)
 		if err != nil {
 			return
 		}
+		meta.Entry = entryMain
 		importUrl := ctx.getImportPath(dep, ctx.getBuildArgsPrefix(false), ctx.externalAll)
 		buf := bytes.NewBuffer(nil)
 		fmt.Fprintf(buf, `export * from "%s";`, importUrl)
@@ -355,7 +441,12 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 		buf, recycle := NewBuffer()
 		defer recycle()
 		fmt.Fprintf(buf, `import * as cjsm from "%s";`, entrySpecifier)
-		if len(cjsExports) > 0 {
+		if ctx.target == "es5" {
+			// esbuild can not lower the destructuring declarations to es5
+			for _, name := range cjsExports {
+				fmt.Fprintf(buf, `export var %s = cjsm.%s;`, name, name)
+			}
+		} else if len(cjsExports) > 0 {
 			fmt.Fprintf(buf, `export const { %s } = cjsm;`, strings.Join(cjsExports, ","))
 		}
 		buf.WriteString("export default cjsm.default ?? cjsm;")
@@ -367,6 +458,9 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 
 	browserExclude := map[string]*set.Set[string]{}
 	implicitExternal := set.New[string]()
+	skippedCSS := set.New[string]()
+	appliedAlias := set.New[string]()
+	selfExternal := ctx.args.external.Has(ctx.esm.PkgName)
 	pkgSideEffects := esbuild.SideEffectsTrue
 	if ctx.pkgJson.SideEffectsFalse {
 		pkgSideEffects = esbuild.SideEffectsFalse
@@ -379,6 +473,16 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 			}
 		}
 	}
+	// the importer name in the build errors, e.g. "app-pkg/track.js"
+	importerName := func(importer string) string {
+		if importer == "" || importer == stdin.Sourcefile {
+			return ctx.esm.Specifier()
+		}
+		if s, ok := strings.CutPrefix(importer, path.Join(ctx.wd, "node_modules")+"/"); ok {
+			return s
+		}
+		return importer
+	}
 	esmifyPlugin := esbuild.Plugin{
 		Name: "esmify",
 		Setup: func(build esbuild.PluginBuild) {
@@ -387,7 +491,8 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 				esbuild.OnResolveOptions{Filter: ".*"},
 				func(args esbuild.OnResolveArgs) (esbuild.OnResolveResult, error) {
 					// entry point
-					if args.Path == entryPoint || args.Path == entrySpecifier {
+					// the package's own entry that is imported by other modules of the package is external with `?external=self`
+					if args.Path == entryPoint || (args.Path == entrySpecifier && !(selfExternal && args.Importer != "" && args.Importer != stdin.Sourcefile)) {
 						path := args.Path
 						if path == entrySpecifier {
 							path = entryModuleFilename
@@ -401,6 +506,11 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 						return esbuild.OnResolveResult{Path: path}, nil
 					}
 
+					// fail the build if the import is denied by the `denyImports` config
+					if isImportDenied(args.Path) {
+						return esbuild.OnResolveResult{}, fmt.Errorf("import \"%s\" is denied (imported by %s)", args.Path, importerName(args.Importer))
+					}
+
 					// ban file: imports
 					if strings.HasPrefix(args.Path, "file:") {
 						return esbuild.OnResolveResult{
@@ -417,6 +527,23 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 						}, nil
 					}
 
+					// skip CSS imports with `?no-css`, the host app provides the styles
+					if ctx.args.noCSS {
+						if pathname, _ := utils.SplitByFirstByte(args.Path, '?'); strings.HasSuffix(pathname, ".css") {
+							if isRelPathSpecifier(pathname) {
+								pkgDir := path.Join(ctx.wd, "node_modules", ctx.esm.PkgName)
+								if filename := path.Join(args.ResolveDir, pathname); strings.HasPrefix(filename, pkgDir+"/") {
+									pathname = "." + strings.TrimPrefix(filename, pkgDir)
+								}
+							}
+							skippedCSS.Add(pathname)
+							return esbuild.OnResolveResult{
+								Path:      args.Path,
+								Namespace: "browser-exclude",
+							}, nil
+						}
+					}
+
 					// if `?external-require` present, ignore specifier that is a require call
 					if ctx.args.externalRequire && args.Kind == esbuild.ResolveJSRequireCall && entry.module {
 						return esbuild.OnResolveResult{
@@ -453,6 +580,14 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 					if len(ctx.args.alias) > 0 && !isRelPathSpecifier(specifier) {
 						pkgName, _, subpath, _ := splitEsmPath(specifier)
 						if name, ok := ctx.args.alias[pkgName]; ok {
+							appliedAlias.Add(pkgName)
+							// replace the dependency with an empty module, e.g. `?alias=some-analytics:false`
+							if name == "false" {
+								return esbuild.OnResolveResult{
+									Path:      args.Path,
+									Namespace: "browser-exclude",
+								}, nil
+							}
 							specifier = name
 							if subpath != "" {
 								specifier += "/" + subpath
@@ -497,6 +632,14 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 						}
 					}
 
+					// replace the excluded dependency with an empty module, e.g. `?deps=-some-polyfill`
+					if ctx.args.exclude.Len() > 0 && !isRelPathSpecifier(specifier) && ctx.args.exclude.Has(toPackageName(specifier)) {
+						return esbuild.OnResolveResult{
+							Path:      args.Path,
+							Namespace: "browser-exclude",
+						}, nil
+					}
+
 					// nodejs builtin module
 					if isNodeBuiltInModule(specifier) {
 						externalPath, err := ctx.resolveExternalModule(specifier, args.Kind, withTypeJSON, analyzeMode)
@@ -509,6 +652,14 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 						}, nil
 					}
 
+					// fail the build if the dependency is not allowed in the `strict` mode of the allow list, both the bundled
+					// and the externalized dependencies are checked
+					if config.AllowList.Strict && !isRelPathSpecifier(specifier) && !strings.HasPrefix(specifier, "/") && !strings.HasPrefix(specifier, "#") && !ctx.externalAll && !ctx.isExternal(specifier) {
+						if pkgName := toPackageName(specifier); pkgName != ctx.esm.PkgName && pkgName != pkgJson.PkgName && !config.AllowList.IsDependencyAllowed(pkgName) {
+							return esbuild.OnResolveResult{}, fmt.Errorf("dependency \"%s\" is not allowed (imported by %s)", pkgName, importerName(args.Importer))
+						}
+					}
+
 					var filename string
 					if strings.HasPrefix(specifier, "/") {
 						filename = specifier
@@ -528,7 +679,7 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 
 					// externalize top-level module
 					// e.g. "react/jsx-runtime" imports "react"
-					if ctx.esm.SubModuleName != "" && specifier == ctx.esm.PkgName && ctx.bundleMode != BundleDeps {
+					if specifier == ctx.esm.PkgName && ((ctx.esm.SubModuleName != "" && ctx.bundleMode != BundleDeps) || selfExternal) {
 						externalPath, err := ctx.resolveExternalModule(ctx.esm.PkgName, args.Kind, withTypeJSON, analyzeMode)
 						if err != nil {
 							return esbuild.OnResolveResult{}, err
@@ -541,10 +692,11 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 					}
 
 					// bundles all dependencies in `bundle` mode, apart from peerDependencies and `?external` flag
-					if ctx.bundleMode == BundleDeps && !ctx.args.external.Has(toPackageName(specifier)) && !implicitExternal.Has(specifier) {
+					if ctx.bundleMode == BundleDeps && !ctx.isExternal(specifier) && !implicitExternal.Has(specifier) {
 						pkgName := toPackageName(specifier)
 						_, ok := pkgJson.PeerDependencies[pkgName]
-						if !ok {
+						// keep the missing optional peer dependencies external instead of failing the build
+						if !ok && !pkgJson.OptionalPeerDeps.Has(pkgName) && (isRelPathSpecifier(specifier) || strings.HasPrefix(specifier, "/") || !ctx.isMissingOptionalPeerDep(pkgName, args.Importer)) {
 							return esbuild.OnResolveResult{}, nil
 						}
 					}
@@ -789,23 +941,28 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 					// replace some npm modules with browser native APIs
 					var replacement npm_replacements.NpmReplacement
 					var ok bool
-					query := "browser"
-					if ctx.isDenoTarget() {
-						query = "deno"
-					} else if ctx.target == "node" {
-						query = "node"
-					}
-					if ctx.dev {
-						replacement, ok = npm_replacements.Get(specifier + "_" + query + "_dev")
+					if polyfill, isLegacy := getWebAPIPolyfill(specifier, ctx.target); isLegacy {
+						// the target predates the Web API that the replacement relies on, use the polyfill package instead
+						specifier = polyfill
+					} else {
+						query := "browser"
+						if ctx.isDenoTarget() {
+							query = "deno"
+						} else if ctx.target == "node" {
+							query = "node"
+						}
+						if ctx.dev {
+							replacement, ok = npm_replacements.Get(specifier + "_" + query + "_dev")
+							if !ok {
+								replacement, ok = npm_replacements.Get(specifier + "_dev")
+							}
+						}
 						if !ok {
-							replacement, ok = npm_replacements.Get(specifier + "_dev")
+							replacement, ok = npm_replacements.Get(specifier + "_" + query)
+						}
+						if !ok {
+							replacement, ok = npm_replacements.Get(specifier)
 						}
-					}
-					if !ok {
-						replacement, ok = npm_replacements.Get(specifier + "_" + query)
-					}
-					if !ok {
-						replacement, ok = npm_replacements.Get(specifier)
 					}
 					if ok {
 						if args.Kind == esbuild.ResolveJSRequireCall || args.Kind == esbuild.ResolveJSRequireResolve {
@@ -843,6 +1000,36 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 				},
 			)
 
+			// input size limit loader, it limits the total size of the source files loaded by esbuild to prevent the
+			// pathological packages from exhausting the memory, see `maxBuildInputSize` config
+			if config.MaxBuildInputSize > 0 {
+				var lock sync.Mutex
+				var inputSize int64
+				inputFiles := set.New[string]()
+				build.OnLoad(
+					esbuild.OnLoadOptions{Filter: ".*", Namespace: "file"},
+					func(args esbuild.OnLoadArgs) (ret esbuild.OnLoadResult, err error) {
+						fi, err := os.Stat(args.Path)
+						if err != nil {
+							// let esbuild report the error
+							return ret, nil
+						}
+						lock.Lock()
+						defer lock.Unlock()
+						// the files are loaded again when rebuilding
+						if !inputFiles.Has(args.Path) {
+							inputFiles.Add(args.Path)
+							inputSize += fi.Size()
+						}
+						if inputSize > int64(config.MaxBuildInputSize) {
+							return ret, fmt.Errorf("%s %d bytes", errBuildInputTooLarge, config.MaxBuildInputSize)
+						}
+						// continue with the default loader
+						return ret, nil
+					},
+				)
+			}
+
 			// npm replacement loader
 			build.OnLoad(
 				esbuild.OnLoadOptions{Filter: ".*", Namespace: "npm-replacement"},
@@ -880,6 +1067,23 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 				},
 			)
 
+			// JSON5/JSONC loader
+			build.OnLoad(
+				esbuild.OnLoadOptions{Filter: `\.json[5c]$`, Namespace: "file"},
+				func(args esbuild.OnLoadArgs) (ret esbuild.OnLoadResult, err error) {
+					data, err := os.ReadFile(args.Path)
+					if err != nil {
+						return
+					}
+					data, err = json5ToJSON(data)
+					if err != nil {
+						return
+					}
+					contents := string(data)
+					return esbuild.OnLoadResult{Contents: &contents, Loader: esbuild.LoaderJSON}, nil
+				},
+			)
+
 			// svelte SFC loader
 			build.OnLoad(
 				esbuild.OnLoadOptions{Filter: ".*", Namespace: "svelte"},
@@ -906,7 +1110,7 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 					if semverLessThan(svelteVersion, "4.0.0") {
 						return esbuild.OnLoadResult{}, errors.New("svelte version must be greater than 4.0.0")
 					}
-					out, err := transformSvelte(ctx.npmrc, svelteVersion, ctx.esm.Specifier(), string(code))
+					out, err := transformSvelte(ctx.npmrc, svelteVersion, ctx.esm.Specifier(), string(code), ctx.dev)
 					if err != nil {
 						return esbuild.OnLoadResult{}, err
 					}
@@ -940,7 +1144,7 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 					if semverLessThan(vueVersion, "3.0.0") {
 						return esbuild.OnLoadResult{}, errors.New("vue version must be greater than 3.0.0")
 					}
-					out, err := transformVue(ctx.npmrc, vueVersion, ctx.esm.Specifier(), string(code))
+					out, err := transformVue(ctx.npmrc, vueVersion, ctx.esm.Specifier(), string(code), ctx.dev)
 					if err != nil {
 						return esbuild.OnLoadResult{}, err
 					}
@@ -993,6 +1197,17 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 			define["globalThis."+k] = v
 		}
 		define["global"] = "globalThis"
+		// the `import.meta` is not available in the legacy targets, the `import.meta.url` is replaced with the
+		// module url, the `{ESM_CDN_ORIGIN}` placeholder is replaced with the origin of the request by the router
+		if !supportsImportMeta(ctx.target) {
+			define["import.meta.url"] = fmt.Sprintf(`"{ESM_CDN_ORIGIN}%s"`, ctx.Path())
+		}
+	}
+	// the user defines can not override the built-in defines
+	for k, v := range ctx.args.define {
+		if _, ok := define[k]; !ok {
+			define[k] = v
+		}
 	}
 	conditions := ctx.args.conditions
 	if ctx.dev {
@@ -1003,22 +1218,28 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 	} else if ctx.target == "node" {
 		conditions = append(conditions, "node")
 	}
+	// the package author never intended to support the browsers that are excluded by the `browserslist` of the package,
+	// upgrade the legacy es target to the lowest target that is implied by it
+	buildTarget := ctx.target
+	if t := getBrowserslistTarget(ctx.pkgJson.Browserslist); t != "" && targets[ctx.target] >= esbuild.ES5 && targets[t] > targets[ctx.target] {
+		buildTarget = t
+	}
 	options := esbuild.BuildOptions{
 		AbsWorkingDir:     ctx.wd,
 		PreserveSymlinks:  true,
 		Format:            esbuild.FormatESModule,
-		Target:            targets[ctx.target],
+		Target:            targets[buildTarget],
 		Platform:          esbuild.PlatformBrowser,
 		Define:            define,
 		Supported:         supported,
 		JSX:               esbuild.JSXAutomatic,
 		JSXImportSource:   "react",
 		Bundle:            true,
-		MinifyWhitespace:  config.Minify,
-		MinifyIdentifiers: config.Minify,
-		MinifySyntax:      config.Minify,
-		KeepNames:         ctx.args.keepNames,         // prevent class/function names erasing
-		IgnoreAnnotations: ctx.args.ignoreAnnotations, // some libs maybe use wrong side-effect annotations
+		MinifyWhitespace:  config.Minify && !ctx.dev,
+		MinifyIdentifiers: config.Minify && !ctx.dev,
+		MinifySyntax:      config.Minify && !ctx.dev,
+		KeepNames:         ctx.args.keepNames || ctx.dev, // prevent class/function names erasing, keep readable component stacks in dev mode
+		IgnoreAnnotations: ctx.args.ignoreAnnotations,    // some libs maybe use wrong side-effect annotations
 		Conditions:        conditions,
 		Loader:            loaders,
 		Plugins:           []esbuild.Plugin{esmifyPlugin},
@@ -1036,6 +1257,17 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 	if config.SourceMap {
 		options.Sourcemap = esbuild.SourceMapExternal
 	}
+	if mode, ok := legalCommentsModes[ctx.args.legalComments]; ok {
+		options.LegalComments = mode
+	}
+	if ctx.args.tsconfig != "" {
+		// overrides the `tsconfig.json` files of the package
+		options.TsconfigRaw = `{"compilerOptions":` + ctx.args.tsconfig + `}`
+	}
+	if !supportsImportMeta(buildTarget) {
+		// esbuild doesn't warn about the empty `import.meta` in the node_modules, which is used to upgrade the target
+		options.LogOverride = map[string]esbuild.LogLevel{"empty-import-meta": esbuild.LogLevelWarning}
+	}
 	for _, pkgName := range []string{"preact", "react", "solid-js", "mono-jsx", "vue", "hono"} {
 		_, ok1 := ctx.pkgJson.Dependencies[pkgName]
 		_, ok2 := ctx.pkgJson.PeerDependencies[pkgName]
@@ -1053,7 +1285,10 @@ func (ctx *BuildContext) buildModule(analyzeMode bool) (meta *BuildMeta, include
 		err = errors.New("esbuild: " + ctxErr.Error())
 		return
 	}
-	defer esbCtx.Dispose()
+	defer func() {
+		// the context may be recreated for the upgraded target
+		esbCtx.Dispose()
+	}()
 
 REBUILD:
 	res := esbCtx.Rebuild()
@@ -1091,6 +1326,18 @@ REBUILD:
 				}
 			}
 		}
+		if strings.HasPrefix(msg, errBuildInputTooLarge) {
+			err = errors.New(msg)
+			return
+		}
+		// keep the full diagnostics for the `?build-log` query, the error message only contains the first error
+		saveBuildLog(ctx.npmrc.zoneId, ctx.Path(), res.Errors, res.Warnings)
+		if ctx.target == "es5" {
+			if syntax := getUnsupportedES5Syntax(msg); syntax != "" {
+				err = fmt.Errorf("%s: %s can not be downleveled to es5, please use a higher target like `?target=es2015`", errUnsupportedES5Syntax, syntax)
+				return
+			}
+		}
 		err = errors.New("esbuild: " + msg)
 		return
 	}
@@ -1099,8 +1346,32 @@ REBUILD:
 		return
 	}
 
+	// the `import.meta` is empty in the legacy targets, instead of emitting the broken output, upgrade the target to
+	// es2020 that supports it, the `import.meta.url` is replaced with the module url so it doesn't require the upgrade
+	if !supportsImportMeta(buildTarget) && hasEmptyImportMetaWarning(res.Warnings) {
+		ctx.logger.Warnf("build(%s): upgrade the target to es2020 for `import.meta`", ctx.Path())
+		buildTarget = "es2020"
+		options.Target = targets[buildTarget]
+		esbCtx.Dispose()
+		esbCtx, ctxErr = esbuild.Context(options)
+		if ctxErr != nil {
+			err = errors.New("esbuild: " + ctxErr.Error())
+			return
+		}
+		goto REBUILD
+	}
+	if buildTarget != ctx.target {
+		meta.TargetUpgraded = buildTarget
+	}
+
+	// keep the esbuild warnings in the build meta, they are reported by the `X-ESM-Warning-Count` header and the `?meta` query
 	for _, w := range res.Warnings {
 		ctx.logger.Warnf("esbuild(%s): %s", ctx.Path(), w.Text)
+		if len(meta.Warnings) < maxBuildWarnings {
+			if warning := formatBuildWarning(w); !stringInSlice(meta.Warnings, warning) {
+				meta.Warnings = append(meta.Warnings, warning)
+			}
+		}
 	}
 
 	imports := set.New[string]()
@@ -1115,6 +1386,8 @@ REBUILD:
 				header.WriteString("github:")
 			} else if ctx.esm.PrPrefix {
 				header.WriteString("pkg.pr.new/")
+			} else if ctx.esm.TgzPrefix {
+				header.WriteString("tgz/")
 			}
 			header.WriteString(ctx.esm.PkgName)
 			if ctx.esm.GhPrefix {
@@ -1127,6 +1400,16 @@ REBUILD:
 				header.WriteByte('/')
 				header.WriteString(ctx.esm.SubModuleName)
 			}
+			// note the heavy syntax lowering that bloats the build of the low target, the dev build is never minified
+			if !config.Minify || ctx.dev {
+				if features := getDownleveledFeatures(jsContent); len(features) > 0 {
+					target := ctx.target
+					if meta.TargetUpgraded != "" {
+						target = meta.TargetUpgraded
+					}
+					fmt.Fprintf(header, " (downleveled %s to %s)", strings.Join(features, ", "), target)
+				}
+			}
 			header.WriteString(" */\n")
 
 			// remove shebang
@@ -1142,7 +1425,7 @@ REBUILD:
 					ids.Add(string(r))
 				}
 				if ids.Has("__Process$") {
-					if ctx.args.external.Has("node:process") {
+					if isExternalNodeBuiltin(ctx.args.external, "node:process") {
 						header.WriteString(`import __Process$ from "node:process";`)
 						header.WriteByte('\n')
 					} else if ctx.isBrowserTarget() {
@@ -1175,7 +1458,7 @@ REBUILD:
 					}
 				}
 				if ids.Has("__Buffer$") {
-					if ctx.args.external.Has("node:buffer") {
+					if isExternalNodeBuiltin(ctx.args.external, "node:buffer") {
 						header.WriteString(`import { Buffer as __Buffer$ } from "node:buffer";`)
 						header.WriteByte('\n')
 					} else if ctx.isBrowserTarget() {
@@ -1327,7 +1610,7 @@ REBUILD:
 			finalJS.Write(jsContent)
 
 			// check if the package is deprecated
-			if !ctx.esm.GhPrefix && !ctx.esm.PrPrefix {
+			if !ctx.esm.GhPrefix && !ctx.esm.PrPrefix && !ctx.esm.TgzPrefix {
 				deprecated, _ := ctx.npmrc.isDeprecated(ctx.pkgJson.Name, ctx.pkgJson.Version)
 				if deprecated != "" {
 					fmt.Fprintf(finalJS, `console.warn("%%c[esm.sh]%%c %%cdeprecated%%c %s@%s: " + %s, "color:grey", "", "color:red", "");%s`, ctx.esm.PkgName, ctx.esm.PkgVersion, utils.MustEncodeJSON(deprecated), "\n")
@@ -1352,15 +1635,29 @@ REBUILD:
 
 	for _, file := range res.OutputFiles {
 		if strings.HasSuffix(file.Path, ".css") {
+			var css []byte
+			css, err = ctx.minifyCSS(file.Contents)
+			if err != nil {
+				return
+			}
 			savePath := ctx.getSavepath()
 			savePath = strings.TrimSuffix(savePath, path.Ext(savePath)) + ".css"
-			err = ctx.storage.Put(savePath, bytes.NewReader(file.Contents))
+			err = ctx.storage.Put(savePath, bytes.NewReader(css))
 			if err != nil {
 				ctx.logger.Errorf("storage.put(%s): %v", savePath, err)
 				err = errors.New("storage: " + err.Error())
 				return
 			}
 			meta.CSSInJS = true
+		} else if strings.HasSuffix(file.Path, ".js.LEGAL.txt") {
+			// the legal comments extracted by the `?legal-comments=external` query
+			savePath := ctx.getSavepath() + ".LEGAL.txt"
+			err = ctx.storage.Put(savePath, bytes.NewReader(file.Contents))
+			if err != nil {
+				ctx.logger.Errorf("storage.put(%s): %v", savePath, err)
+				err = errors.New("storage: " + err.Error())
+				return
+			}
 		} else if config.SourceMap && strings.HasSuffix(file.Path, ".js.map") {
 			var sourceMap map[string]interface{}
 			if json.Unmarshal(file.Contents, &sourceMap) == nil {
@@ -1386,29 +1683,52 @@ REBUILD:
 		}
 	}
 
-	// sort imports
+	// sort imports, and resolve the versions of the external bare imports for the `?importmap` query
 	for _, path := range imports.Values() {
 		if strings.HasPrefix(path, "/") {
 			meta.Imports = append(meta.Imports, path)
+		} else if isBareImportSpecifier(path) {
+			dep, _, err := ctx.lookupDep(path, false)
+			if err != nil {
+				ctx.logger.Warnf("could not resolve the external import %s: %v", path, err)
+				continue
+			}
+			if meta.ExternalDeps == nil {
+				meta.ExternalDeps = map[string]string{}
+			}
+			meta.ExternalDeps[path] = dep.Specifier()
 		}
 	}
 	sort.Strings(meta.Imports)
 
+	// record the skipped CSS imports
+	if skippedCSS.Len() > 0 {
+		meta.SkippedCSS = skippedCSS.Values()
+		sort.Strings(meta.SkippedCSS)
+	}
+
+	// record the aliases that matched the imports of the build
+	if appliedAlias.Len() > 0 {
+		meta.AppliedAlias = appliedAlias.Values()
+		sort.Strings(meta.AppliedAlias)
+	}
+
 	// resolve types(dts)
+	ctx.setStatus("transform-dts")
 	meta.Dts, err = ctx.resloveDTS(entry)
 	return
 }
 
 func (ctx *BuildContext) buildTypes() (ret *BuildMeta, err error) {
 	// install the package
-	ctx.status = "install"
+	ctx.setStatus("install")
 	err = ctx.install()
 	if err != nil {
 		return
 	}
 
 	var dts string
-	if endsWith(ctx.esm.SubPath, ".d.ts", "d.mts") {
+	if endsWith(ctx.esm.SubPath, ".d.ts", ".d.mts", ".d.cts") {
 		dts = "./" + ctx.esm.SubPath
 	} else {
 		entry := ctx.resolveEntry(ctx.esm)
@@ -1419,7 +1739,7 @@ func (ctx *BuildContext) buildTypes() (ret *BuildMeta, err error) {
 		dts = entry.types
 	}
 
-	ctx.status = "build"
+	ctx.setStatus("build")
 	err = ctx.transformDTS(dts)
 	if err != nil {
 		return
@@ -1436,7 +1756,7 @@ func (ctx *BuildContext) install() (err error) {
 			return err
 		}
 
-		if ctx.esm.GhPrefix || ctx.esm.PrPrefix {
+		if ctx.esm.GhPrefix || ctx.esm.PrPrefix || ctx.esm.TgzPrefix {
 			// if the name in package.json is not the same as the repository name
 			if p.Name != ctx.esm.PkgName {
 				p.PkgName = p.Name
@@ -1501,3 +1821,20 @@ func (ctx *BuildContext) install() (err error) {
 	}
 	return
 }
+
+// formatBuildWarning formats the esbuild warning as a single line with the file location in the package,
+// e.g. `foo/style.css:2: "colr" is not a known CSS property`
+func formatBuildWarning(msg esbuild.Message) string {
+	text := strings.Join(strings.Fields(msg.Text), " ")
+	if loc := msg.Location; loc != nil && loc.File != "" {
+		file := loc.File
+		if i := strings.LastIndex(file, "node_modules/"); i >= 0 {
+			file = file[i+len("node_modules/"):]
+		}
+		text = fmt.Sprintf("%s:%d: %s", file, loc.Line, text)
+	}
+	if len(text) > 512 {
+		text = strings.ToValidUTF8(text[:509], "") + "..."
+	}
+	return text
+}
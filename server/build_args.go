@@ -1,23 +1,113 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"path"
 	"sort"
 	"strings"
+	"time"
 
+	esbuild "github.com/evanw/esbuild/pkg/api"
 	"github.com/ije/gox/set"
 	"github.com/ije/gox/utils"
 )
 
+var errTooManyLockedDeps = errors.New("too many dependencies to lock")
+
 type BuildArgs struct {
 	alias             map[string]string
 	deps              map[string]string
 	external          set.ReadOnlySet[string]
+	exclude           set.ReadOnlySet[string]
 	conditions        []string
+	define            map[string]string
 	keepNames         bool
 	ignoreAnnotations bool
 	externalRequire   bool
+	preferRequire     bool
+	ignoreExports     bool
+	noCSS             bool
+	legalComments     string
+	tsconfig          string
+	entries           []string
+}
+
+// legalCommentsModes maps the `?legal-comments` query to the esbuild options
+var legalCommentsModes = map[string]esbuild.LegalComments{
+	"none":     esbuild.LegalCommentsNone,
+	"inline":   esbuild.LegalCommentsInline,
+	"eof":      esbuild.LegalCommentsEndOfFile,
+	"external": esbuild.LegalCommentsExternal,
+}
+
+// tsconfigCompilerOptions is the allowlist of the `compilerOptions` that can be set by the `?tsconfig` query,
+// the options that access the file system (like `baseUrl` and `paths`) are not allowed.
+var tsconfigCompilerOptions = map[string]func(value any) bool{
+	"alwaysStrict":            isBool,
+	"experimentalDecorators":  isBool,
+	"preserveValueImports":    isBool,
+	"strict":                  isBool,
+	"useDefineForClassFields": isBool,
+	"verbatimModuleSyntax":    isBool,
+	"importsNotUsedAsValues": func(value any) bool {
+		s, ok := value.(string)
+		return ok && (s == "remove" || s == "preserve" || s == "error")
+	},
+	"jsx": func(value any) bool {
+		s, ok := value.(string)
+		return ok && (s == "react" || s == "react-jsx" || s == "react-jsxdev")
+	},
+	"jsxFactory": func(value any) bool {
+		s, ok := value.(string)
+		return ok && isDefineKey(s)
+	},
+	"jsxFragmentFactory": func(value any) bool {
+		s, ok := value.(string)
+		return ok && isDefineKey(s)
+	},
+	"jsxImportSource": func(value any) bool {
+		s, ok := value.(string)
+		return ok && validatePackageName(s)
+	},
+}
+
+func isBool(value any) bool {
+	_, ok := value.(bool)
+	return ok
+}
+
+// normalizeTsconfig validates the `compilerOptions` against the allowlist and returns the JSON with sorted keys.
+func normalizeTsconfig(data []byte) (string, error) {
+	var compilerOptions map[string]any
+	if err := json.Unmarshal(data, &compilerOptions); err != nil {
+		return "", errors.New("invalid JSON")
+	}
+	// the `{"compilerOptions": {...}}` form of tsconfig.json is accepted too
+	if v, ok := compilerOptions["compilerOptions"]; ok && len(compilerOptions) == 1 {
+		if compilerOptions, ok = v.(map[string]any); !ok {
+			return "", errors.New("invalid compilerOptions")
+		}
+	}
+	for key, value := range compilerOptions {
+		validate, ok := tsconfigCompilerOptions[key]
+		if !ok {
+			return "", fmt.Errorf("unsupported compiler option %q", key)
+		}
+		if !validate(value) {
+			return "", fmt.Errorf("invalid value of compiler option %q", key)
+		}
+	}
+	if len(compilerOptions) == 0 {
+		return "", nil
+	}
+	// the keys of the map are sorted by the json encoder
+	ret, err := json.Marshal(compilerOptions)
+	if err != nil {
+		return "", err
+	}
+	return string(ret), nil
 }
 
 func decodeBuildArgs(argsString string) (args BuildArgs, err error) {
@@ -46,6 +136,24 @@ func decodeBuildArgs(argsString string) (args BuildArgs, err error) {
 				args.external = *set.NewReadOnly[string](strings.Split(p[1:], ",")...)
 			} else if strings.HasPrefix(p, "c") {
 				args.conditions = append(args.conditions, strings.Split(p[1:], ",")...)
+			} else if strings.HasPrefix(p, "x") {
+				args.exclude = *set.NewReadOnly[string](strings.Split(p[1:], ",")...)
+			} else if strings.HasPrefix(p, "L") {
+				if _, ok := legalCommentsModes[p[1:]]; ok {
+					args.legalComments = p[1:]
+				}
+			} else if strings.HasPrefix(p, "T") {
+				args.tsconfig, err = normalizeTsconfig([]byte(p[1:]))
+				if err != nil {
+					return
+				}
+			} else if strings.HasPrefix(p, "E") {
+				args.entries = strings.Split(p[1:], ",")
+			} else if strings.HasPrefix(p, "D") {
+				err = json.Unmarshal([]byte(p[1:]), &args.define)
+				if err != nil {
+					return
+				}
 			} else {
 				switch p {
 				case "r":
@@ -54,7 +162,12 @@ func decodeBuildArgs(argsString string) (args BuildArgs, err error) {
 					args.keepNames = true
 				case "i":
 					args.ignoreAnnotations = true
-
+				case "p":
+					args.preferRequire = true
+				case "s":
+					args.noCSS = true
+				case "n":
+					args.ignoreExports = true
 				}
 			}
 		}
@@ -104,7 +217,26 @@ func encodeBuildArgs(args BuildArgs, isDts bool) string {
 			lines = append(lines, fmt.Sprintf("c%s", strings.Join(ss, ",")))
 		}
 	}
+	// the types are resolved without the `exports` field too
+	if args.ignoreExports {
+		lines = append(lines, "n")
+	}
 	if !isDts {
+		if args.exclude.Len() > 0 {
+			var ss sort.StringSlice
+			for _, name := range args.exclude.Values() {
+				ss = append(ss, name)
+			}
+			ss.Sort()
+			lines = append(lines, fmt.Sprintf("x%s", strings.Join(ss, ",")))
+		}
+		if len(args.define) > 0 {
+			// the keys of the map are sorted by the json encoder
+			data, err := json.Marshal(args.define)
+			if err == nil {
+				lines = append(lines, "D"+string(data))
+			}
+		}
 		if args.externalRequire {
 			lines = append(lines, "r")
 		}
@@ -114,6 +246,22 @@ func encodeBuildArgs(args BuildArgs, isDts bool) string {
 		if args.ignoreAnnotations {
 			lines = append(lines, "i")
 		}
+		if args.preferRequire {
+			lines = append(lines, "p")
+		}
+		if args.noCSS {
+			lines = append(lines, "s")
+		}
+		if args.legalComments != "" {
+			lines = append(lines, "L"+args.legalComments)
+		}
+		if args.tsconfig != "" {
+			lines = append(lines, "T"+args.tsconfig)
+		}
+		// the entries are sorted by the `parseEntriesQuery` function
+		if len(args.entries) > 0 {
+			lines = append(lines, "E"+strings.Join(args.entries, ","))
+		}
 	}
 	if len(lines) > 0 {
 		return btoaUrl(strings.Join(lines, "\n"))
@@ -121,10 +269,10 @@ func encodeBuildArgs(args BuildArgs, isDts bool) string {
 	return ""
 }
 
-// resolveBuildArgs resolves `alias`, `deps`, `external` of the build args
+// resolveBuildArgs resolves `alias`, `deps`, `external`, `exclude` of the build args
 func resolveBuildArgs(npmrc *NpmRC, installDir string, args *BuildArgs, esm EsmPath) error {
-	if len(args.alias) > 0 || len(args.deps) > 0 || args.external.Len() > 0 {
-		// quick check if the alias, deps, external are all in dependencies of the package
+	if len(args.alias) > 0 || len(args.deps) > 0 || args.external.Len() > 0 || args.exclude.Len() > 0 {
+		// quick check if the alias, deps, external, exclude are all in dependencies of the package
 		deps, ok, err := func() (deps *set.Set[string], ok bool, err error) {
 			var p *PackageJSON
 			pkgJsonPath := path.Join(installDir, "node_modules", esm.PkgName, "package.json")
@@ -134,7 +282,7 @@ func resolveBuildArgs(npmrc *NpmRC, installDir string, args *BuildArgs, esm EsmP
 				if err == nil {
 					p = raw.ToNpmPackage()
 				}
-			} else if esm.GhPrefix || esm.PrPrefix {
+			} else if esm.GhPrefix || esm.PrPrefix || esm.TgzPrefix {
 				p, err = npmrc.installPackage(esm.Package())
 			} else {
 				p, err = npmrc.getPackageInfo(esm.PkgName, esm.PkgVersion)
@@ -165,6 +313,13 @@ func resolveBuildArgs(npmrc *NpmRC, installDir string, args *BuildArgs, esm EsmP
 			}
 			if args.external.Len() > 0 {
 				for _, name := range args.external.Values() {
+					if name != esm.PkgName && !isExternalPattern(name) && !deps.Has(name) {
+						return nil, false, nil
+					}
+				}
+			}
+			if args.exclude.Len() > 0 {
+				for _, name := range args.exclude.Values() {
 					if !deps.Has(name) {
 						return nil, false, nil
 					}
@@ -190,6 +345,9 @@ func resolveBuildArgs(npmrc *NpmRC, installDir string, args *BuildArgs, esm EsmP
 				}
 			}
 			for from, to := range alias {
+				if to == "false" {
+					continue
+				}
 				pkgName, _, _, _ := splitEsmPath(to)
 				if pkgName == esm.PkgName {
 					delete(alias, from)
@@ -224,21 +382,77 @@ func resolveBuildArgs(npmrc *NpmRC, installDir string, args *BuildArgs, esm EsmP
 					}
 					continue
 				}
-				// if the subModule externalizes the package entry
-				if name == esm.PkgName && esm.SubPath != "" {
+				// the builtin modules are imported with or without the `node:` prefix, e.g. `?external=buffer`
+				if nodeBuiltinModules[name] {
+					external = append(external, "node:"+name)
+					continue
+				}
+				// externalize the package entry, e.g. `?external=self`
+				if name == esm.PkgName {
 					external = append(external, name)
 					continue
 				}
-				if name != esm.PkgName && deps.Has(name) {
+				// keep the pattern if it matches any of the dependencies, e.g. `?external=@org/**`
+				if isExternalPattern(name) {
+					for _, dep := range deps.Values() {
+						if matchExternalPattern(name, dep) {
+							external = append(external, name)
+							break
+						}
+					}
+					continue
+				}
+				if deps.Has(name) {
 					external = append(external, name)
 				}
 			}
 			args.external = *set.NewReadOnly[string](external...)
 		}
+		if args.exclude.Len() > 0 {
+			exclude := make([]string, 0, args.exclude.Len())
+			for _, name := range args.exclude.Values() {
+				if name != esm.PkgName && deps.Has(name) {
+					exclude = append(exclude, name)
+				}
+			}
+			args.exclude = *set.NewReadOnly[string](exclude...)
+		}
 	}
 	return nil
 }
 
+// isExternalPattern checks if the `?external` item is a pattern, e.g. `@org/**`
+func isExternalPattern(name string) bool {
+	return strings.HasSuffix(name, "/**")
+}
+
+// matchExternalPattern checks if the specifier matches the `**` pattern that matches the prefix
+// with all the subpaths at any depth, e.g. `@org/**` matches `@org/pkg` and `@org/pkg/sub/path`.
+func matchExternalPattern(pattern string, specifier string) bool {
+	prefix, ok := strings.CutSuffix(pattern, "/**")
+	return ok && (specifier == prefix || strings.HasPrefix(specifier, prefix+"/"))
+}
+
+// isExternalSpecifier checks if the specifier is marked as external by the `?external` query.
+func isExternalSpecifier(external set.ReadOnlySet[string], specifier string) bool {
+	if external.Has(toPackageName(specifier)) {
+		return true
+	}
+	for _, name := range external.Values() {
+		if matchExternalPattern(name, specifier) {
+			return true
+		}
+	}
+	return false
+}
+
+// isExternalNodeBuiltin checks if the node builtin module is marked as external by the `?external` query,
+// the `node:` prefix is ignored, e.g. `?external=buffer` matches `node:buffer` and vice versa.
+func isExternalNodeBuiltin(external set.ReadOnlySet[string], specifier string) bool {
+	name := strings.TrimPrefix(specifier, "node:")
+	return nodeBuiltinModules[name] && (external.Has(name) || external.Has("node:"+name))
+}
+
 func walkDeps(npmrc *NpmRC, installDir string, pkg Package, mark *set.Set[string]) (err error) {
 	if mark.Has(pkg.Name) {
 		return
@@ -252,7 +466,7 @@ func walkDeps(npmrc *NpmRC, installDir string, pkg Package, mark *set.Set[string
 		if err == nil {
 			p = raw.ToNpmPackage()
 		}
-	} else if pkg.Github || pkg.PkgPrNew {
+	} else if pkg.Github || pkg.PkgPrNew || pkg.Tarball {
 		p, err = npmrc.installPackage(pkg)
 	} else {
 		p, err = npmrc.getPackageInfo(pkg.Name, pkg.Version)
@@ -280,3 +494,90 @@ func walkDeps(npmrc *NpmRC, installDir string, pkg Package, mark *set.Set[string
 	}
 	return
 }
+
+// lockDeps resolves the dependency closure of the package to exact versions for the `?deps=locked` query,
+// the versions that are specified explicitly in the `deps` take precedence. The dependency tree is walked
+// breadth-first in the name order, so the shallower dependency wins on version conflicts like how npm
+// hoists the dependencies. The aliased and non-registry dependencies (e.g. "npm:foo@1.0.0", "github:foo/bar")
+// and the optional peer dependencies are not locked.
+// The result is cached per package version in the `npmQueryCacheTTL`, the walk is aborted with the
+// `errTooManyLockedDeps` error once the closure exceeds the `maxQueryListLength` config.
+func lockDeps(npmrc *NpmRC, pkgJson *PackageJSON, deps map[string]string, exclude *set.Set[string]) (locked map[string]string, err error) {
+	depNames := make([]string, 0, len(deps))
+	for name, version := range deps {
+		depNames = append(depNames, name+"@"+version)
+	}
+	sort.Strings(depNames)
+	excludeNames := exclude.Values()
+	sort.Strings(excludeNames)
+	cacheKey := fmt.Sprintf("%s%s@%s?lock-deps=%s&exclude=%s", npmrc.Registry, pkgJson.Name, pkgJson.Version, strings.Join(depNames, ","), strings.Join(excludeNames, ","))
+	cached, err := withCache(cacheKey, time.Duration(config.NpmQueryCacheTTL)*time.Second, func() (map[string]string, string, error) {
+		locked, err := walkLockDeps(npmrc, pkgJson, deps, exclude)
+		return locked, "", err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// copy the cached map, the build args may be modified by the caller
+	locked = make(map[string]string, len(cached))
+	for name, version := range cached {
+		locked[name] = version
+	}
+	return
+}
+
+func walkLockDeps(npmrc *NpmRC, pkgJson *PackageJSON, deps map[string]string, exclude *set.Set[string]) (locked map[string]string, err error) {
+	maxDeps := int(config.MaxQueryListLength)
+	locked = map[string]string{}
+	queue := []*PackageJSON{pkgJson}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		ranges := make(map[string]string, len(p.Dependencies)+len(p.PeerDependencies))
+		for name, version := range p.PeerDependencies {
+			if !p.OptionalPeerDeps.Has(name) {
+				ranges[name] = version
+			}
+		}
+		for name, version := range p.Dependencies {
+			ranges[name] = version
+		}
+		names := make([]string, 0, len(ranges))
+		for name := range ranges {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if _, ok := locked[name]; ok || name == pkgJson.Name || exclude.Has(name) {
+				continue
+			}
+			version, ok := deps[name]
+			if !ok {
+				version = strings.TrimSpace(ranges[name])
+				if dep, e := resolveDependencyVersion(version); e != nil || dep.Name != "" {
+					continue
+				}
+			}
+			var dep *PackageJSON
+			dep, err = npmrc.getPackageInfo(name, version)
+			if err != nil {
+				return nil, err
+			}
+			locked[name] = dep.Version
+			if len(locked) > maxDeps {
+				return nil, errTooManyLockedDeps
+			}
+			queue = append(queue, dep)
+		}
+	}
+	// keep the explicit versions that are not in the dependency tree, see `resolveBuildArgs`
+	for name, version := range deps {
+		if _, ok := locked[name]; !ok {
+			locked[name] = version
+		}
+	}
+	if len(locked) > maxDeps {
+		return nil, errTooManyLockedDeps
+	}
+	return
+}
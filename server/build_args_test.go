@@ -1,6 +1,9 @@
 package server
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/ije/gox/set"
@@ -10,17 +13,24 @@ func TestEncodeBuildArgs(t *testing.T) {
 	conditions := []string{"react-server"}
 	buildArgsString := encodeBuildArgs(
 		BuildArgs{
-			alias: map[string]string{"a": "b"},
+			alias: map[string]string{"a": "b", "analytics": "false"},
 			deps: map[string]string{
 				"c": "1.0.0",
 				"d": "1.0.0",
 				"e": "1.0.0",
 			},
 			external:          *set.NewReadOnly("baz", "bar"),
+			exclude:           *set.NewReadOnly("polyfill"),
 			conditions:        conditions,
+			define:            map[string]string{"__FEATURE_X__": "true", "VERSION": `"1,2\n3"`},
 			externalRequire:   true,
 			keepNames:         true,
 			ignoreAnnotations: true,
+			preferRequire:     true,
+			ignoreExports:     true,
+			noCSS:             true,
+			legalComments:     "none",
+			tsconfig:          `{"experimentalDecorators":true}`,
 		},
 		false,
 	)
@@ -28,7 +38,7 @@ func TestEncodeBuildArgs(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(args.alias) != 1 || args.alias["a"] != "b" {
+	if len(args.alias) != 2 || args.alias["a"] != "b" || args.alias["analytics"] != "false" {
 		t.Fatal("invalid alias")
 	}
 	if len(args.deps) != 3 {
@@ -37,9 +47,15 @@ func TestEncodeBuildArgs(t *testing.T) {
 	if args.external.Len() != 2 {
 		t.Fatal("invalid external")
 	}
+	if args.exclude.Len() != 1 || !args.exclude.Has("polyfill") {
+		t.Fatal("invalid exclude")
+	}
 	if len(args.conditions) != 1 || args.conditions[0] != "react-server" {
 		t.Fatal("invalid conditions")
 	}
+	if len(args.define) != 2 || args.define["__FEATURE_X__"] != "true" || args.define["VERSION"] != `"1,2\n3"` {
+		t.Fatal("invalid define")
+	}
 	if !args.externalRequire {
 		t.Fatal("ignoreRequire should be true")
 	}
@@ -49,4 +65,108 @@ func TestEncodeBuildArgs(t *testing.T) {
 	if !args.ignoreAnnotations {
 		t.Fatal("ignoreAnnotations should be true")
 	}
+	if !args.preferRequire {
+		t.Fatal("preferRequire should be true")
+	}
+	if !args.noCSS {
+		t.Fatal("noCSS should be true")
+	}
+	if !args.ignoreExports {
+		t.Fatal("ignoreExports should be true")
+	}
+	if args.legalComments != "none" {
+		t.Fatal("legalComments should be none")
+	}
+	if args.tsconfig != `{"experimentalDecorators":true}` {
+		t.Fatal("invalid tsconfig")
+	}
+}
+
+func TestLockDeps(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metadata, ok := map[string]string{
+			"/a": `{"name":"a","dist-tags":{"latest":"1.2.0"},"versions":{
+				"1.1.0":{"name":"a","version":"1.1.0"},
+				"1.2.0":{"name":"a","version":"1.2.0","dependencies":{"b":"^3.0.0","d":"^1.0.0"}}
+			}}`,
+			"/b": `{"name":"b","dist-tags":{"latest":"3.0.0"},"versions":{
+				"2.0.0":{"name":"b","version":"2.0.0"},
+				"2.0.1":{"name":"b","version":"2.0.1"},
+				"3.0.0":{"name":"b","version":"3.0.0"}
+			}}`,
+			"/d": `{"name":"d","dist-tags":{"latest":"1.1.0"},"versions":{
+				"1.0.0":{"name":"d","version":"1.0.0"},
+				"1.1.0":{"name":"d","version":"1.1.0","dependencies":{"e":"^1.0.0"}}
+			}}`,
+			"/e": `{"name":"e","dist-tags":{"latest":"1.0.0"},"versions":{"1.0.0":{"name":"e","version":"1.0.0"}}}`,
+		}[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(metadata))
+	}))
+	defer registry.Close()
+	// drop the cached metadata of the test registry, which would be counted by `TestCache`
+	defer cacheStore.Range(func(key, value any) bool {
+		if strings.HasPrefix(key.(string), registry.URL) {
+			cacheStore.Delete(key)
+		}
+		return true
+	})
+
+	npmrc := &NpmRC{NpmRegistry: NpmRegistry{Registry: registry.URL + "/"}}
+	pkgJson := &PackageJSON{
+		Name:    "app",
+		Version: "1.0.0",
+		Dependencies: map[string]string{
+			"a":     "^1.0.0",
+			"b":     "~2.0.0",
+			"c":     "npm:b@^3.0.0",
+			"tslib": "github:microsoft/tslib",
+		},
+		PeerDependencies: map[string]string{"react": "^19.0.0"},
+		OptionalPeerDeps: *set.NewReadOnly("react"),
+	}
+
+	// the shallower `b@~2.0.0` wins, `d@1.0.0` is pinned explicitly so `e` is not in the closure
+	locked, err := lockDeps(npmrc, pkgJson, map[string]string{"d": "1.0.0", "preact": "10.0.0"}, set.New[string]())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locked) != 4 || locked["a"] != "1.2.0" || locked["b"] != "2.0.1" || locked["d"] != "1.0.0" || locked["preact"] != "10.0.0" {
+		t.Fatalf("invalid locked deps %v", locked)
+	}
+
+	locked, err = lockDeps(npmrc, pkgJson, nil, set.New("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(locked) != 3 || locked["a"] != "1.2.0" || locked["d"] != "1.1.0" || locked["e"] != "1.0.0" {
+		t.Fatalf("invalid locked deps %v", locked)
+	}
+
+	// the result is cached per package version
+	delete(pkgJson.Dependencies, "a")
+	locked, err = lockDeps(npmrc, pkgJson, nil, set.New("b"))
+	pkgJson.Dependencies["a"] = "^1.0.0"
+	if err != nil || locked["a"] != "1.2.0" {
+		t.Fatalf("the locked deps should be cached, got %v (%v)", locked, err)
+	}
+
+	// the walk is aborted once the closure exceeds the `maxQueryListLength`
+	saved := config
+	config = &Config{MaxQueryListLength: 2, NpmQueryCacheTTL: saved.NpmQueryCacheTTL}
+	_, err = lockDeps(npmrc, pkgJson, nil, set.New[string]())
+	config = saved
+	if err != errTooManyLockedDeps {
+		t.Fatalf("expected the too many deps error, got %v", err)
+	}
+
+	pkgJson.Dependencies["missing"] = "^1.0.0"
+	_, err = lockDeps(npmrc, pkgJson, nil, set.New[string]())
+	if err == nil {
+		t.Fatal("should fail to lock a missing dependency")
+	}
 }
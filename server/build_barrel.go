@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ije/gox/set"
+)
+
+// the error message of the `?entries` that are not JavaScript modules
+const errBarrelEntryNotJS = "is not a JavaScript module"
+
+// buildBarrel builds the module that re-exports the sub-modules of the `entries` build arg under namespaces,
+// e.g. `?entries=a,b/c` -> `export * as a from "/pkg@1.0.0/es2022/a.mjs"; export * as b_c from "/pkg@1.0.0/es2022/b/c.mjs";`
+// The entries are built and cached as separate modules, the barrel imports their dependencies upfront so the
+// browser can fetch them in parallel.
+func (ctx *BuildContext) buildBarrel() (meta *BuildMeta, err error) {
+	args := ctx.args
+	args.entries = nil
+	imports := set.New[string]()
+	buf, recycle := NewBuffer()
+	defer recycle()
+	fmt.Fprintf(buf, "/* esm.sh - %s?entries=%s */\n", ctx.esm.Name(), strings.Join(ctx.args.entries, ","))
+	for _, entry := range ctx.args.entries {
+		esm := ctx.esm
+		esm.SubModuleName = entry
+		esm.SubPath = entry
+		b := &BuildContext{
+			npmrc:       ctx.npmrc,
+			logger:      ctx.logger,
+			db:          ctx.db,
+			storage:     ctx.storage,
+			esm:         esm,
+			args:        args,
+			bundleMode:  ctx.bundleMode,
+			externalAll: ctx.externalAll,
+			target:      ctx.target,
+			dev:         ctx.dev,
+		}
+		var ret *BuildMeta
+		ret, err = b.Build()
+		if err != nil {
+			msg := err.Error()
+			if strings.Contains(msg, "no such file or directory") || strings.Contains(msg, "is not exported from package") || strings.Contains(msg, "could not resolve build entry") || strings.HasSuffix(msg, " not found") {
+				err = fmt.Errorf("entry \"%s\" not found", entry)
+			}
+			return
+		}
+		if ret.TypesOnly || ret.CSSEntry != "" {
+			err = fmt.Errorf("entry \"%s\" %s", entry, errBarrelEntryNotJS)
+			return
+		}
+		imports.Add(b.Path())
+		for _, dep := range ret.Imports {
+			imports.Add(dep)
+		}
+		fmt.Fprintf(buf, "export * as %s from \"%s\";\n", toNamespaceIdentifier(entry), b.Path())
+	}
+	err = ctx.storage.Put(ctx.getSavepath(), buf)
+	if err != nil {
+		ctx.logger.Errorf("storage.put(%s): %v", ctx.getSavepath(), err)
+		err = errors.New("storage: " + err.Error())
+		return
+	}
+	meta = &BuildMeta{Imports: imports.Values()}
+	sort.Strings(meta.Imports)
+	return
+}
+
+// toNamespaceIdentifier converts the sub-module name to a valid JavaScript identifier, e.g. "b/c" -> "b_c"
+func toNamespaceIdentifier(name string) string {
+	buf := make([]byte, 0, len(name)+1)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '$' {
+			buf = append(buf, c)
+		} else {
+			buf = append(buf, '_')
+		}
+	}
+	if len(buf) > 0 && buf[0] >= '0' && buf[0] <= '9' {
+		buf = append([]byte{'_'}, buf...)
+	}
+	return string(buf)
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBuildBarrel(t *testing.T) {
+	workDir := config.WorkDir
+	config.WorkDir = t.TempDir()
+	defer func() { config.WorkDir = workDir }()
+
+	db, err := OpenDB(path.Join(config.WorkDir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the package is installed to the npm store, so the entries are built without fetching the registry
+	npmrc := DefaultNpmRC()
+	wd := path.Join(npmrc.StoreDir(), "barrel-pkg@1.0.0")
+	writeFixturePackage(t, wd, "barrel-pkg", map[string]string{
+		"package.json": `{
+			"name": "barrel-pkg",
+			"version": "1.0.0",
+			"type": "module",
+			"exports": {
+				".": "./index.js",
+				"./a": "./a.js",
+				"./b/c": "./b/c.js",
+				"./style.css": "./style.css"
+			}
+		}`,
+		"index.js":  `export const name = "index";`,
+		"a.js":      `export const name = "a";`,
+		"b/c.js":    `export const name = "c";`,
+		"style.css": `.foo { color: red; }`,
+	})
+	buildStorage, logger := newTestBuildStorage(t, wd)
+	newBuildContext := func(entries ...string) *BuildContext {
+		return &BuildContext{
+			npmrc:   npmrc,
+			logger:  logger,
+			db:      db,
+			storage: buildStorage,
+			esm:     EsmPath{PkgName: "barrel-pkg", PkgVersion: "1.0.0"},
+			args:    BuildArgs{entries: entries},
+			target:  "es2022",
+		}
+	}
+
+	// the entries are encoded into the build id
+	ctx := newBuildContext("a", "b/c")
+	if ctx.Path() == newBuildContext("a").Path() || ctx.Path() == newBuildContext().Path() {
+		t.Fatalf("the build path should vary by the entries: %s", ctx.Path())
+	}
+	args, err := decodeBuildArgs(strings.TrimPrefix(strings.Split(ctx.Path(), "/")[2], "X-"))
+	if err != nil || !reflect.DeepEqual(args.entries, []string{"a", "b/c"}) {
+		t.Fatalf("unexpected entries of the build args: %v (%v)", args.entries, err)
+	}
+
+	meta, err := ctx.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := string(readStoredFile(t, buildStorage, ctx.getSavepath()))
+	for _, line := range []string{
+		`export * as a from "/barrel-pkg@1.0.0/es2022/a.mjs";`,
+		`export * as b_c from "/barrel-pkg@1.0.0/es2022/b/c.mjs";`,
+	} {
+		if !strings.Contains(code, line) {
+			t.Fatalf("the barrel should include %s:\n%s", line, code)
+		}
+	}
+	if !reflect.DeepEqual(meta.Imports, []string{"/barrel-pkg@1.0.0/es2022/a.mjs", "/barrel-pkg@1.0.0/es2022/b/c.mjs"}) {
+		t.Fatalf("unexpected imports of the barrel: %v", meta.Imports)
+	}
+	// the entries are built and cached as separate modules
+	if _, ok, _ := newBuildContext().Exists(); ok {
+		t.Fatal("the main module should not be built")
+	}
+	entry := newBuildContext()
+	entry.args.entries = nil
+	entry.esm.SubModuleName = "a"
+	entry.esm.SubPath = "a"
+	if _, ok, err := entry.Exists(); !ok || err != nil {
+		t.Fatalf("the entry should be built: %v", err)
+	}
+	// the barrel is cached as a unit
+	if cached, ok, err := ctx.Exists(); !ok || err != nil || !reflect.DeepEqual(cached.Imports, meta.Imports) {
+		t.Fatalf("the barrel should be cached: %v", err)
+	}
+
+	_, err = newBuildContext("a", "not-exists").Build()
+	if err == nil || err.Error() != `entry "not-exists" not found` {
+		t.Fatalf("expected the not found error, got %v", err)
+	}
+	_, err = newBuildContext("style.css").Build()
+	if err == nil || !strings.HasSuffix(err.Error(), errBarrelEntryNotJS) {
+		t.Fatalf("expected the error of the CSS entry, got %v", err)
+	}
+}
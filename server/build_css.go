@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	esbuild "github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/esbuild-internal/xxhash"
+	"github.com/ije/gox/set"
+)
+
+// the metafile of esbuild, see https://esbuild.github.io/api/#metafile
+type esbuildMetafile struct {
+	Inputs map[string]struct {
+		Imports []struct {
+			Path     string `json:"path"`
+			External bool   `json:"external"`
+		} `json:"imports"`
+	} `json:"inputs"`
+	Outputs map[string]struct {
+		Inputs map[string]struct{} `json:"inputs"`
+	} `json:"outputs"`
+}
+
+// buildTreeShakenCSSFile builds the tree-shaken package CSS of the `cssExports` and saves it to the storage,
+// the build meta is not saved since the CSS file is looked up in the storage directly.
+func (ctx *BuildContext) buildTreeShakenCSSFile() (meta *BuildMeta, err error) {
+	ctx.setStatus("build")
+	css, err := ctx.buildTreeShakenCSS(ctx.cssExports)
+	if err != nil {
+		return
+	}
+	err = ctx.storage.Put(ctx.getSavepath(), bytes.NewReader(css))
+	if err != nil {
+		ctx.logger.Errorf("storage.put(%s): %v", ctx.getSavepath(), err)
+		err = errors.New("storage: " + err.Error())
+		return
+	}
+	return &BuildMeta{CSSInJS: true}, nil
+}
+
+// buildTreeShakenCSS builds the package CSS that is reachable from the given exports of the entry module,
+// the CSS files imported by the modules that are tree-shaken away are excluded.
+func (ctx *BuildContext) buildTreeShakenCSS(exports []string) (css []byte, err error) {
+	err = ctx.install()
+	if err != nil {
+		return
+	}
+
+	entry := ctx.resolveEntry(ctx.esm)
+	if entry.main == "" || !entry.module {
+		err = errors.New("tree-shaking CSS requires an ES module entry")
+		return
+	}
+
+	pkgDir := path.Join(ctx.wd, "node_modules", ctx.esm.PkgName)
+	var names []string
+	var contents strings.Builder
+	for _, name := range exports {
+		if ns, ok := strings.CutPrefix(name, "*:"); ok {
+			fmt.Fprintf(&contents, "export * as %s from %q;", ns, entry.main)
+		} else {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		fmt.Fprintf(&contents, "export { %s } from %q;", strings.Join(names, ", "), entry.main)
+	}
+
+	// 1. tree-shake the module graph of the exports, the CSS files are loaded as empty modules
+	conditions := ctx.args.conditions
+	if ctx.dev {
+		conditions = append(conditions, "development")
+	}
+	depCSS := map[string]string{}
+	moduleLoaders := make(map[string]esbuild.Loader, len(loaders))
+	for ext, loader := range loaders {
+		if loader == esbuild.LoaderCSS || loader == esbuild.LoaderDataURL {
+			loader = esbuild.LoaderEmpty
+		}
+		moduleLoaders[ext] = loader
+	}
+	ret := esbuild.Build(esbuild.BuildOptions{
+		AbsWorkingDir:    pkgDir,
+		PreserveSymlinks: true,
+		Stdin: &esbuild.StdinOptions{
+			Contents:   contents.String(),
+			ResolveDir: pkgDir,
+			Loader:     esbuild.LoaderJS,
+		},
+		Format:            esbuild.FormatESModule,
+		Target:            esbuild.ESNext,
+		Platform:          esbuild.PlatformBrowser,
+		JSX:               esbuild.JSXAutomatic,
+		Bundle:            true,
+		IgnoreAnnotations: ctx.args.ignoreAnnotations,
+		Conditions:        conditions,
+		Loader:            moduleLoaders,
+		Metafile:          true,
+		Outdir:            "/esbuild",
+		Write:             false,
+		Plugins: []esbuild.Plugin{{
+			Name: "external-deps",
+			Setup: func(build esbuild.PluginBuild) {
+				build.OnResolve(esbuild.OnResolveOptions{Filter: ".*"}, func(args esbuild.OnResolveArgs) (esbuild.OnResolveResult, error) {
+					if isRelPathSpecifier(args.Path) || isAbsPathSpecifier(args.Path) {
+						return esbuild.OnResolveResult{}, nil
+					}
+					// the CSS imports of the dependencies (e.g. `import "other-pkg/style.css"`) are imported by the
+					// URL that respects the `alias`, `deps` and `external` of the build args
+					if strings.HasSuffix(args.Path, ".css") {
+						url, err := ctx.resolveDepCSS(args.Path)
+						if err != nil {
+							return esbuild.OnResolveResult{}, err
+						}
+						if url != "" {
+							depCSS[args.Path] = url
+						}
+					}
+					return esbuild.OnResolveResult{Path: args.Path, External: true}, nil
+				})
+			},
+		}},
+	})
+	if len(ret.Errors) > 0 {
+		err = errors.New("esbuild: " + ret.Errors[0].Text)
+		return
+	}
+
+	var metafile esbuildMetafile
+	err = json.Unmarshal([]byte(ret.Metafile), &metafile)
+	if err != nil {
+		return
+	}
+	liveModules := set.New[string]()
+	for _, output := range metafile.Outputs {
+		for input := range output.Inputs {
+			liveModules.Add(input)
+		}
+	}
+	// the entry module is always live even if it only re-exports the other modules
+	for _, imp := range metafile.Inputs["<stdin>"].Imports {
+		liveModules.Add(imp.Path)
+	}
+
+	// 2. collect the CSS files imported by the live modules in the import order, the modules that are
+	//    tree-shaken away (e.g. re-exporting barrels) are walked through but their CSS imports are dropped
+	var cssImports strings.Builder
+	visited := set.New[string]()
+	var walk func(input string)
+	walk = func(input string) {
+		if visited.Has(input) {
+			return
+		}
+		visited.Add(input)
+		live := liveModules.Has(input)
+		for _, imp := range metafile.Inputs[input].Imports {
+			if imp.External {
+				if url, ok := depCSS[imp.Path]; ok && live && !visited.Has(url) {
+					visited.Add(url)
+					fmt.Fprintf(&cssImports, "@import %q;\n", url)
+				}
+				continue
+			}
+			if strings.HasSuffix(imp.Path, ".css") {
+				if live && !visited.Has(imp.Path) {
+					visited.Add(imp.Path)
+					fmt.Fprintf(&cssImports, "@import %q;\n", path.Join(pkgDir, imp.Path))
+				}
+			} else {
+				walk(imp.Path)
+			}
+		}
+	}
+	walk("<stdin>")
+	if cssImports.Len() == 0 {
+		return []byte{}, nil
+	}
+
+	// 3. bundle the CSS files, the CSS of the dependencies is kept as the `@import` rules
+	ret = esbuild.Build(esbuild.BuildOptions{
+		AbsWorkingDir:    pkgDir,
+		PreserveSymlinks: true,
+		Stdin: &esbuild.StdinOptions{
+			Contents:   cssImports.String(),
+			ResolveDir: pkgDir,
+			Loader:     esbuild.LoaderCSS,
+		},
+		Target:           targets[ctx.target],
+		Engines:          cssEngines[ctx.target],
+		Bundle:           true,
+		MinifyWhitespace: config.Minify && !ctx.dev,
+		MinifySyntax:     config.Minify && !ctx.dev,
+		Loader:           loaders,
+		Outdir:           "/esbuild",
+		Write:            false,
+		Plugins: []esbuild.Plugin{{
+			Name: "external-dep-css",
+			Setup: func(build esbuild.PluginBuild) {
+				build.OnResolve(esbuild.OnResolveOptions{Filter: ".*"}, func(args esbuild.OnResolveArgs) (esbuild.OnResolveResult, error) {
+					if args.Importer == "<stdin>" && !strings.HasPrefix(args.Path, pkgDir+"/") {
+						return esbuild.OnResolveResult{Path: args.Path, External: true}, nil
+					}
+					return esbuild.OnResolveResult{}, nil
+				})
+			},
+		}},
+	})
+	if len(ret.Errors) > 0 {
+		err = errors.New("esbuild: " + ret.Errors[0].Text)
+		return
+	}
+	for _, file := range ret.OutputFiles {
+		if strings.HasSuffix(file.Path, ".css") {
+			return file.Contents, nil
+		}
+	}
+	return []byte{}, nil
+}
+
+// resolveDepCSS resolves the CSS file of a dependency to the import URL, an empty URL is returned if the
+// dependency is excluded or externalized (the host app provides the styles).
+func (ctx *BuildContext) resolveDepCSS(specifier string) (url string, err error) {
+	pkgName, _, subPath, _ := splitEsmPath(specifier)
+	if name, ok := ctx.args.alias[pkgName]; ok {
+		if name == "false" {
+			return "", nil
+		}
+		specifier = name
+		if subPath != "" {
+			specifier += "/" + subPath
+		}
+	}
+	if ctx.args.exclude.Has(toPackageName(specifier)) || ctx.externalAll || ctx.isExternal(specifier) {
+		return "", nil
+	}
+	pkgName, version, subPath, _ := splitEsmPath(specifier)
+	if version == "" {
+		if pkgName == ctx.esm.PkgName {
+			version = ctx.esm.PkgVersion
+		} else if v, ok := ctx.args.deps[pkgName]; ok {
+			version = v
+		} else if v, ok := ctx.pkgJson.Dependencies[pkgName]; ok {
+			version = strings.TrimSpace(v)
+		} else if v, ok := ctx.pkgJson.PeerDependencies[pkgName]; ok {
+			version = strings.TrimSpace(v)
+		} else {
+			version = "latest"
+		}
+	}
+	dep := EsmPath{PkgName: pkgName, PkgVersion: version}
+	// resolve alias in dependencies, e.g. "@mark/html": "npm:@jsr/mark__html@^1.0.0"
+	p, err := resolveDependencyVersion(version)
+	if err != nil {
+		return "", err
+	}
+	if p.Name != "" {
+		dep.GhPrefix = p.Github
+		dep.PrPrefix = p.PkgPrNew
+		dep.PkgName = p.Name
+		dep.PkgVersion = p.Version
+	}
+	// the CSS file is served as is by the raw file url
+	return "/" + dep.Name() + "/" + subPath, nil
+}
+
+// getTreeShakenCSSPath returns the build path of the package CSS that is tree-shaken by the `?exports` query
+func getTreeShakenCSSPath(buildPath string, exports []string) string {
+	xxh := xxhash.New()
+	xxh.Write([]byte(strings.Join(exports, ",")))
+	return strings.TrimSuffix(buildPath, ".mjs") + "_" + base64.RawURLEncoding.EncodeToString(xxh.Sum(nil)) + ".css"
+}
+
+// minifyCSS minifies the CSS output of the build and lowers the CSS features (e.g. nesting) for the browsers of
+// the build target, the CSS of the dev builds is kept readable.
+func (ctx *BuildContext) minifyCSS(css []byte) ([]byte, error) {
+	ret := esbuild.Transform(string(css), esbuild.TransformOptions{
+		Loader:           esbuild.LoaderCSS,
+		Engines:          cssEngines[ctx.target],
+		MinifyWhitespace: config.Minify && !ctx.dev,
+		MinifySyntax:     config.Minify && !ctx.dev,
+	})
+	if len(ret.Errors) > 0 {
+		return nil, errors.New("esbuild: " + ret.Errors[0].Text)
+	}
+	return ret.Code, nil
+}
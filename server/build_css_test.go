@@ -0,0 +1,98 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ije/gox/set"
+)
+
+func TestBuildTreeShakenCSS(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "ui-kit", map[string]string{
+		"package.json": `{
+			"name": "ui-kit",
+			"version": "1.0.0",
+			"module": "./src/index.js",
+			"sideEffects": ["*.css"],
+			"dependencies": {"icons": "1.0.0"}
+		}`,
+		"src/index.js":   `import "./global.css"; export * from "./button.js"; export * from "./card.js";`,
+		"src/global.css": `body { margin: 0 }`,
+		"src/button.js":  `import "./button.css"; import { cx } from "./utils.js"; export function Button() { return cx("button") }`,
+		"src/button.css": `@import "./icon.css"; .button { color: red }`,
+		"src/icon.css":   `.icon { width: 1em }`,
+		"src/card.js":    `import "icons/style.css"; import "./card.css"; export function Card() { return "card" }`,
+		"src/card.css":   `.card { color: blue }`,
+		"src/utils.js":   `import "./utils.css"; export const cx = (s) => "ui-" + s;`,
+		"src/utils.css":  `.ui-reset { all: unset }`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	meta, _, err := ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.CSSInJS {
+		t.Fatal("the package CSS should be built")
+	}
+
+	css, err := ctx.buildTreeShakenCSS([]string{"Button"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, selector := range []string{"body", ".icon", ".ui-reset", ".button"} {
+		if !strings.Contains(string(css), selector) {
+			t.Fatalf("the CSS should include %q:\n%s", selector, css)
+		}
+	}
+	if strings.Contains(string(css), ".card") {
+		t.Fatalf("the CSS of the unused component should be excluded:\n%s", css)
+	}
+	if strings.Index(string(css), "body") > strings.Index(string(css), ".button") {
+		t.Fatalf("the CSS should be in the import order:\n%s", css)
+	}
+
+	css, err = ctx.buildTreeShakenCSS([]string{"Card"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(css), ".card") || strings.Contains(string(css), ".button") || strings.Contains(string(css), ".ui-reset") {
+		t.Fatalf("the CSS should only include the card styles:\n%s", css)
+	}
+	if !strings.Contains(string(css), `@import"/icons@1.0.0/style.css"`) {
+		t.Fatalf("the CSS of the dependency should be imported by the url:\n%s", css)
+	}
+
+	// the CSS imports of the dependencies respect the `alias`, `deps` and `external` of the build args
+	for _, tc := range []struct {
+		args     BuildArgs
+		expected string
+	}{
+		{BuildArgs{deps: map[string]string{"icons": "2.0.0"}}, `@import"/icons@2.0.0/style.css"`},
+		{BuildArgs{alias: map[string]string{"icons": "other-icons@3.0.0"}}, `@import"/other-icons@3.0.0/style.css"`},
+		{BuildArgs{alias: map[string]string{"icons": "false"}}, ""},
+		{BuildArgs{external: *set.NewReadOnly("icons")}, ""},
+	} {
+		cssCtx := newFixtureBuildContext(t, wd, pkgJson)
+		cssCtx.args = tc.args
+		cssCtx.cssExports = []string{"Card"}
+		if !strings.HasSuffix(cssCtx.Path(), ".css") {
+			t.Fatalf("unexpected path of the tree-shaken CSS: %s", cssCtx.Path())
+		}
+		_, err = cssCtx.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		css := readStoredFile(t, cssCtx.storage, cssCtx.getSavepath())
+		if !strings.Contains(string(css), ".card") {
+			t.Fatalf("unexpected tree-shaken CSS:\n%s", css)
+		}
+		if tc.expected == "" && strings.Contains(string(css), "@import") {
+			t.Fatalf("the CSS of the excluded or external dependency should be dropped:\n%s", css)
+		}
+		if tc.expected != "" && !strings.Contains(string(css), tc.expected) {
+			t.Fatalf("the CSS should import %s:\n%s", tc.expected, css)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	esbuild "github.com/evanw/esbuild/pkg/api"
+)
+
+// BuildLog is the full esbuild diagnostics of a failed build, it's kept in memory for a short time
+// and can be fetched with the `?build-log` query or from the JSON error response.
+type BuildLog struct {
+	Path     string            `json:"path"`
+	Errors   []BuildLogMessage `json:"errors"`
+	Warnings []BuildLogMessage `json:"warnings,omitempty"`
+}
+
+// BuildLogMessage is an esbuild message with the location in the package.
+type BuildLogMessage struct {
+	Text     string            `json:"text"`
+	File     string            `json:"file,omitempty"`
+	Line     int               `json:"line,omitempty"`
+	Column   int               `json:"column,omitempty"`
+	LineText string            `json:"lineText,omitempty"`
+	Notes    []BuildLogMessage `json:"notes,omitempty"`
+}
+
+func getBuildLogKey(zoneId string, buildPath string) string {
+	return "build-log:" + zoneId + ":" + buildPath
+}
+
+// saveBuildLog keeps the esbuild messages of the failed build in the cache store, the expired logs
+// are removed by the cache gc.
+func saveBuildLog(zoneId string, buildPath string, errors []esbuild.Message, warnings []esbuild.Message) {
+	log := &BuildLog{
+		Path:     buildPath,
+		Errors:   toBuildLogMessages(errors),
+		Warnings: toBuildLogMessages(warnings),
+	}
+	exp := time.Now().Add(buildLogTTL * time.Second)
+	cacheStore.Store(getBuildLogKey(zoneId, buildPath), &cacheItem{exp.UnixMilli(), log})
+}
+
+// getBuildLog returns the log of the failed build if it's not expired.
+func getBuildLog(zoneId string, buildPath string) (*BuildLog, bool) {
+	v, ok := cacheStore.Load(getBuildLogKey(zoneId, buildPath))
+	if !ok {
+		return nil, false
+	}
+	item := v.(*cacheItem)
+	if item.exp < time.Now().UnixMilli() {
+		return nil, false
+	}
+	return item.data.(*BuildLog), true
+}
+
+func toBuildLogMessages(messages []esbuild.Message) []BuildLogMessage {
+	if len(messages) > maxBuildLogMessages {
+		messages = messages[:maxBuildLogMessages]
+	}
+	ret := make([]BuildLogMessage, len(messages))
+	for i, msg := range messages {
+		ret[i] = toBuildLogMessage(msg.Text, msg.Location)
+		for _, note := range msg.Notes {
+			ret[i].Notes = append(ret[i].Notes, toBuildLogMessage(note.Text, note.Location))
+		}
+	}
+	return ret
+}
+
+func toBuildLogMessage(text string, loc *esbuild.Location) BuildLogMessage {
+	msg := BuildLogMessage{Text: text}
+	if loc != nil && loc.File != "" {
+		// strip the working directory of the build, e.g. `node_modules/foo/index.js` -> `foo/index.js`
+		file := loc.File
+		if i := strings.LastIndex(file, "node_modules/"); i >= 0 {
+			file = file[i+len("node_modules/"):]
+		}
+		msg.File = file
+		msg.Line = loc.Line
+		msg.Column = loc.Column
+		msg.LineText = loc.LineText
+		if len(msg.LineText) > 512 {
+			msg.LineText = strings.ToValidUTF8(msg.LineText[:509], "") + "..."
+		}
+	}
+	return msg
+}
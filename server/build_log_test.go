@@ -0,0 +1,43 @@
+package server
+
+import "testing"
+
+func TestBuildLogOfFailedBuild(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "broken-pkg", map[string]string{
+		"package.json": `{"name": "broken-pkg", "version": "1.0.0", "module": "index.js"}`,
+		"index.js":     "export { a } from \"./a.js\";\nexport { b } from \"./b.js\";\n",
+		"a.js":         "export const a = 1;\nexport const a = 2;\n",
+		"b.js":         "export const b = ;\n",
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	_, _, err := ctx.buildModule(false)
+	if err == nil {
+		t.Fatal("the build should fail")
+	}
+	buildLog, ok := getBuildLog(ctx.npmrc.zoneId, ctx.Path())
+	if !ok {
+		t.Fatal("the log of the failed build should be kept")
+	}
+	// the error message only contains the first error, the log keeps all of them
+	if buildLog.Path != ctx.Path() || len(buildLog.Errors) < 2 {
+		t.Fatalf("unexpected build log %+v", buildLog)
+	}
+	files := map[string]int{}
+	for _, msg := range buildLog.Errors {
+		files[msg.File] = msg.Line
+	}
+	if files["broken-pkg/a.js"] != 2 || files["broken-pkg/b.js"] != 1 {
+		t.Fatalf("the errors should have the locations in the package, got %+v", buildLog.Errors)
+	}
+	// the redeclared symbol error has a note that points to the original declaration
+	for _, msg := range buildLog.Errors {
+		if msg.File == "broken-pkg/a.js" && (len(msg.Notes) == 0 || msg.Notes[0].Line != 1) {
+			t.Fatalf("the notes of the error should be kept, got %+v", msg)
+		}
+	}
+	if _, ok := getBuildLog("other-zone", ctx.Path()); ok {
+		t.Fatal("the build log should be isolated by the zone")
+	}
+}
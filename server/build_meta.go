@@ -3,6 +3,7 @@ package server
 import (
 	"bytes"
 	"errors"
+	"sort"
 	"strings"
 
 	"github.com/ije/gox/utils"
@@ -14,13 +15,25 @@ type BuildMeta struct {
 	TypesOnly     bool
 	ExportDefault bool
 	CSSEntry      string
-	Dts           string
-	Imports       []string
+	// the entry of the package that is chosen for the build, e.g. the ESM entry of a dual package
+	Entry        string
+	Dts          string
+	Imports      []string
+	SkippedCSS   []string
+	AppliedAlias []string
+	Warnings     []string
+	ExternalDeps map[string]string
+	// the build target is upgraded to support the `import.meta` of the package, e.g. "es2020"
+	TargetUpgraded string
+	// the meta is built by an older version that doesn't record the `ExternalDeps`
+	noExternalDeps bool
 }
 
 func encodeBuildMeta(meta *BuildMeta) []byte {
 	buf := bytes.NewBuffer(nil)
 	buf.Write([]byte{'E', 'S', 'M', '\r', '\n'})
+	// the marker of the metas that record the `ExternalDeps`
+	buf.Write([]byte{'X', '\n'})
 	if meta.CJS {
 		buf.Write([]byte{'j', '\n'})
 	}
@@ -38,6 +51,16 @@ func encodeBuildMeta(meta *BuildMeta) []byte {
 		buf.WriteString(meta.CSSEntry)
 		buf.WriteByte('\n')
 	}
+	if meta.Entry != "" {
+		buf.Write([]byte{'m', ':'})
+		buf.WriteString(meta.Entry)
+		buf.WriteByte('\n')
+	}
+	if meta.TargetUpgraded != "" {
+		buf.Write([]byte{'u', ':'})
+		buf.WriteString(meta.TargetUpgraded)
+		buf.WriteByte('\n')
+	}
 	if meta.Dts != "" {
 		buf.Write([]byte{'d', ':'})
 		buf.WriteString(meta.Dts)
@@ -50,6 +73,35 @@ func encodeBuildMeta(meta *BuildMeta) []byte {
 			buf.WriteByte('\n')
 		}
 	}
+	for _, path := range meta.SkippedCSS {
+		buf.Write([]byte{'s', ':'})
+		buf.WriteString(path)
+		buf.WriteByte('\n')
+	}
+	for _, name := range meta.AppliedAlias {
+		buf.Write([]byte{'a', ':'})
+		buf.WriteString(name)
+		buf.WriteByte('\n')
+	}
+	for _, warning := range meta.Warnings {
+		buf.Write([]byte{'w', ':'})
+		buf.WriteString(warning)
+		buf.WriteByte('\n')
+	}
+	if len(meta.ExternalDeps) > 0 {
+		specifiers := make([]string, 0, len(meta.ExternalDeps))
+		for specifier := range meta.ExternalDeps {
+			specifiers = append(specifiers, specifier)
+		}
+		sort.Strings(specifiers)
+		for _, specifier := range specifiers {
+			buf.Write([]byte{'x', ':'})
+			buf.WriteString(specifier)
+			buf.WriteByte(' ')
+			buf.WriteString(meta.ExternalDeps[specifier])
+			buf.WriteByte('\n')
+		}
+	}
 	return buf.Bytes()
 }
 
@@ -66,12 +118,15 @@ func decodeBuildMeta(data []byte) (*BuildMeta, error) {
 		}
 	}
 	meta.Imports = make([]string, 0, n)
+	meta.noExternalDeps = true
 	for _, line := range lines {
 		ll := len(line)
 		if ll == 0 {
 			continue
 		}
 		switch {
+		case ll == 1 && line[0] == 'X':
+			meta.noExternalDeps = false
 		case ll == 1 && line[0] == 'j':
 			meta.CJS = true
 		case ll == 1 && line[0] == 'c':
@@ -82,6 +137,13 @@ func decodeBuildMeta(data []byte) (*BuildMeta, error) {
 			meta.ExportDefault = true
 		case ll > 2 && line[0] == '.' && line[1] == ':':
 			meta.CSSEntry = string(line[2:])
+		case ll > 2 && line[0] == 'm' && line[1] == ':':
+			meta.Entry = string(line[2:])
+		case ll > 2 && line[0] == 'u' && line[1] == ':':
+			meta.TargetUpgraded = string(line[2:])
+			if _, ok := targets[meta.TargetUpgraded]; !ok {
+				return nil, errors.New("invalid target")
+			}
 		case ll > 2 && line[0] == 'd' && line[1] == ':':
 			meta.Dts = string(line[2:])
 			if !endsWith(meta.Dts, ".ts", ".mts", ".cts") {
@@ -96,6 +158,21 @@ func decodeBuildMeta(data []byte) (*BuildMeta, error) {
 				}
 			}
 			meta.Imports = append(meta.Imports, importSepcifier)
+		case ll > 2 && line[0] == 's' && line[1] == ':':
+			meta.SkippedCSS = append(meta.SkippedCSS, string(line[2:]))
+		case ll > 2 && line[0] == 'a' && line[1] == ':':
+			meta.AppliedAlias = append(meta.AppliedAlias, string(line[2:]))
+		case ll > 2 && line[0] == 'w' && line[1] == ':':
+			meta.Warnings = append(meta.Warnings, string(line[2:]))
+		case ll > 2 && line[0] == 'x' && line[1] == ':':
+			specifier, dep := utils.SplitByFirstByte(string(line[2:]), ' ')
+			if specifier == "" || dep == "" {
+				return nil, errors.New("invalid external dependency")
+			}
+			if meta.ExternalDeps == nil {
+				meta.ExternalDeps = map[string]string{}
+			}
+			meta.ExternalDeps[specifier] = dep
 		default:
 			return nil, errors.New("invalid build meta")
 		}
@@ -60,7 +60,7 @@ func (q *BuildQueue) Add(ctx *BuildContext) chan BuildOutput {
 	task.createdAt = time.Now()
 	task.waitChans = []chan BuildOutput{ch}
 	task.pending = true
-	ctx.status = "pending"
+	ctx.setStatus("pending")
 
 	task.el = q.queue.PushBack(task)
 	q.tasks[ctx.Path()] = task
@@ -70,6 +70,22 @@ func (q *BuildQueue) Add(ctx *BuildContext) chan BuildOutput {
 	return ch
 }
 
+// Diagnose returns the diagnostic info of the build task, or an empty string if
+// the task is not in the queue.
+func (q *BuildQueue) Diagnose(path string) string {
+	q.lock.Lock()
+	task, ok := q.tasks[path]
+	var ctx *BuildContext
+	if ok {
+		ctx = task.ctx
+	}
+	q.lock.Unlock()
+	if ctx == nil {
+		return ""
+	}
+	return ctx.diagnose()
+}
+
 func (q *BuildQueue) schedule() {
 	q.lock.Lock()
 	defer q.lock.Unlock()
@@ -94,16 +110,17 @@ func (q *BuildQueue) schedule() {
 }
 
 func (q *BuildQueue) run(task *BuildTask) {
+	task.ctx.logger.Debugf("build '%s' started, waited %v in the queue", task.ctx.Path(), task.startedAt.Sub(task.createdAt))
 	meta, err := task.ctx.Build()
 	if err == nil {
-		task.ctx.status = "done"
+		task.ctx.setStatus("done")
 		if task.ctx.target == "types" {
 			task.ctx.logger.Infof("build '%s'(types) done in %v", task.ctx.Path(), time.Since(task.startedAt))
 		} else {
 			task.ctx.logger.Infof("build '%s' done in %v", task.ctx.Path(), time.Since(task.startedAt))
 		}
 	} else {
-		task.ctx.status = "error"
+		task.ctx.setStatus("error")
 		task.ctx.logger.Errorf("build '%s': %v", task.ctx.Path(), err)
 	}
 
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildQueueDiagnose(t *testing.T) {
+	q := NewBuildQueue(0)
+	ctx := &BuildContext{
+		esm:    EsmPath{PkgName: "react", PkgVersion: "18.2.0"},
+		target: "es2022",
+	}
+	if q.Diagnose(ctx.Path()) != "" {
+		t.Fatal("expected empty diagnostic info for unknown task")
+	}
+	q.Add(ctx)
+	ctx.setStatus("install")
+	info := q.Diagnose(ctx.Path())
+	for _, s := range []string{"build: /react@18.2.0/es2022/react.mjs\n", "stage: install\n", "  - pending: ", "  - install: "} {
+		if !strings.Contains(info, s) {
+			t.Fatalf("expected %q in diagnostic info:\n%s", s, info)
+		}
+	}
+}
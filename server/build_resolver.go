@@ -7,18 +7,21 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
 	"github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/gox/set"
 	"github.com/ije/gox/utils"
 	"github.com/ije/gox/valid"
 )
 
 // BuildEntry represents the build entrypoints of a module
 type BuildEntry struct {
-	main   string
-	module bool
-	types  string
+	main    string
+	module  bool
+	types   string
+	browser bool // resolved by the `browser` condition of the `exports` field
 }
 
 func (entry *BuildEntry) isEmpty() bool {
@@ -65,16 +68,16 @@ func (ctx *BuildContext) resolveEntry(esm EsmPath) (entry BuildEntry) {
 			return
 		}
 
-		if endsWith(subPath, ".json", ".jsx", ".svelte", ".vue") {
+		if endsWith(subPath, ".json", ".json5", ".jsonc", ".jsx", ".svelte", ".vue") {
 			entry.update(subPath, true)
 			return
 		}
 	}
 
 	if subModuleName := esm.SubModuleName; subModuleName != "" {
-		// reslove sub-module using `exports` conditions if exists
+		// reslove sub-module using `exports` conditions if exists, unless `?ignore-exports` is set
 		// see https://nodejs.org/api/packages.html#package-entry-points
-		if pkgJson.Exports.Len() > 0 {
+		if pkgJson.Exports.Len() > 0 && !ctx.args.ignoreExports {
 			var exportEntry BuildEntry
 			conditions, ok := pkgJson.Exports.Get("./" + subModuleName)
 			if ok {
@@ -173,6 +176,7 @@ func (ctx *BuildContext) resolveEntry(esm EsmPath) (entry BuildEntry) {
 			}
 			if exportEntry.main != "" && ctx.existsPkgFile(exportEntry.main) {
 				entry.update(exportEntry.main, exportEntry.module)
+				entry.browser = exportEntry.browser
 			}
 			if exportEntry.types != "" && ctx.existsPkgFile(exportEntry.types) {
 				entry.types = exportEntry.types
@@ -249,9 +253,12 @@ func (ctx *BuildContext) resolveEntry(esm EsmPath) (entry BuildEntry) {
 			}
 		}
 	} else {
-		if pkgJson.Module != "" && ctx.existsPkgFile(pkgJson.Module) {
+		if ctx.args.preferRequire && pkgJson.Main != "" && ctx.existsPkgFile(pkgJson.Main) {
+			entry.update(pkgJson.Main, pkgJson.Type == "module")
+		} else if pkgJson.Module != "" && ctx.existsPkgFile(pkgJson.Module) {
 			entry.update(pkgJson.Module, true)
-		} else if pkgJson.Main != "" {
+		} else if pkgJson.Main != "" && ctx.existsPkgModule(pkgJson.Main) {
+			// the misconfigured `main` that points to a missing file falls back to the `index.js` convention below
 			entry.update(pkgJson.Main, pkgJson.Type == "module")
 		}
 		if pkgJson.Types != "" {
@@ -265,7 +272,7 @@ func (ctx *BuildContext) resolveEntry(esm EsmPath) (entry BuildEntry) {
 			}
 		}
 
-		if exports := pkgJson.Exports; exports.Len() > 0 {
+		if exports := pkgJson.Exports; exports.Len() > 0 && !ctx.args.ignoreExports {
 			exportEntry := BuildEntry{}
 			v, ok := exports.Get(".")
 			if ok {
@@ -298,6 +305,7 @@ func (ctx *BuildContext) resolveEntry(esm EsmPath) (entry BuildEntry) {
 			}
 			if exportEntry.main != "" && ctx.existsPkgFile(exportEntry.main) {
 				entry.update(exportEntry.main, exportEntry.module)
+				entry.browser = exportEntry.browser
 			}
 			if exportEntry.types != "" && ctx.existsPkgFile(exportEntry.types) {
 				entry.types = exportEntry.types
@@ -356,8 +364,9 @@ func (ctx *BuildContext) resolveEntry(esm EsmPath) (entry BuildEntry) {
 		}
 	}
 
-	// resolve entry main from `browser` field if it's defined
-	if len(pkgJson.Browser) > 0 && ctx.isBrowserTarget() {
+	// resolve entry main from `browser` field if it's defined,
+	// the `browser` condition of the `exports` field takes precedence over the `browser` field
+	if len(pkgJson.Browser) > 0 && ctx.isBrowserTarget() && !entry.browser {
 		if entry.main != "" {
 			if path, ok := pkgJson.Browser[entry.main]; ok && ctx.existsPkgFile(path) {
 				entry.update(path, pkgJson.Type == "module")
@@ -549,6 +558,7 @@ func (ctx *BuildContext) resolveConditionExportEntry(conditions JSONObject, pref
 
 	if ctx.isBrowserTarget() {
 		conditionFound = applyCondition("browser")
+		entry.browser = conditionFound
 	} else if ctx.isDenoTarget() {
 		conditionName := "deno"
 		// [workaround] to support ssr in Deno, use `node` condition for solid-js < 1.6.0
@@ -564,6 +574,7 @@ func (ctx *BuildContext) resolveConditionExportEntry(conditions JSONObject, pref
 		for _, conditionName := range ctx.args.conditions {
 			conditionFound = applyCondition(conditionName)
 			if conditionFound {
+				entry.browser = conditionName == "browser"
 				break
 			}
 		}
@@ -611,13 +622,22 @@ LOOP:
 			// skip unknown condition
 			continue LOOP
 		}
-		if entry.main == "" || (!entry.module && module && !conditionFound) {
+		// prefer the ESM entry for dual packages, unless the `?prefer-require` query is present
+		var preferred bool
+		if ctx.args.preferRequire {
+			preferred = entry.module && conditionName == "require" && !conditionFound
+		} else {
+			preferred = !entry.module && module && !conditionFound
+		}
+		if entry.main == "" || preferred {
 			if s, ok := condition.(string); ok {
 				entry.update(s, module)
+				entry.browser = false
 			} else if obj, ok := condition.(JSONObject); ok {
 				e := ctx.resolveConditionExportEntry(obj, prefered)
 				if e.main != "" {
 					entry.update(e.main, e.module)
+					entry.browser = e.browser
 				}
 				if e.types != "" {
 					entry.types = e.types
@@ -658,7 +678,7 @@ func (ctx *BuildContext) resolveExternalModule(specifier string, kind api.Resolv
 	}()
 
 	// check `?external`
-	if ctx.externalAll || ctx.args.external.Has(toPackageName(specifier)) {
+	if ctx.externalAll || ctx.isExternal(specifier) {
 		resolvedPath = specifier
 		return
 	}
@@ -670,13 +690,14 @@ func (ctx *BuildContext) resolveExternalModule(specifier string, kind api.Resolv
 			PkgVersion: pkgJson.Version,
 			GhPrefix:   ctx.esm.GhPrefix,
 			PrPrefix:   ctx.esm.PrPrefix,
+			TgzPrefix:  ctx.esm.TgzPrefix,
 		}, ctx.getBuildArgsPrefix(false), ctx.externalAll)
 		return
 	}
 
 	// if it's a node builtin module
 	if isNodeBuiltInModule(specifier) {
-		if ctx.externalAll || ctx.target == "node" || ctx.target == "denonext" || ctx.args.external.Has(specifier) {
+		if ctx.externalAll || ctx.target == "node" || ctx.target == "denonext" || isExternalNodeBuiltin(ctx.args.external, specifier) {
 			resolvedPath = specifier
 		} else if ctx.target == "deno" {
 			resolvedPath = fmt.Sprintf("https://deno.land/std@0.177.1/node/%s.ts", specifier[5:])
@@ -692,6 +713,7 @@ func (ctx *BuildContext) resolveExternalModule(specifier string, kind api.Resolv
 		subModule := EsmPath{
 			GhPrefix:      ctx.esm.GhPrefix,
 			PrPrefix:      ctx.esm.PrPrefix,
+			TgzPrefix:     ctx.esm.TgzPrefix,
 			PkgName:       ctx.esm.PkgName,
 			PkgVersion:    ctx.esm.PkgVersion,
 			SubPath:       subPath,
@@ -769,9 +791,12 @@ func (ctx *BuildContext) resolveExternalModule(specifier string, kind api.Resolv
 		}
 	}
 
-	// [workaround] force the dependency version of `react` equals to react-dom
+	// [workaround] force the dependency version of `react` equals to react-dom,
+	// unless the version of `react` is pinned by the `?deps` query, e.g. `?deps=react@18.2.0&external=react`
 	if ctx.esm.PkgName == "react-dom" && dep.PkgName == "react" {
-		dep.PkgVersion = ctx.esm.PkgVersion
+		if _, pinned := ctx.args.deps["react"]; !pinned {
+			dep.PkgVersion = ctx.esm.PkgVersion
+		}
 	}
 
 	if withTypeJSON {
@@ -795,10 +820,13 @@ func (ctx *BuildContext) resolveExternalModule(specifier string, kind api.Resolv
 	}
 
 	args := BuildArgs{
-		alias:      ctx.args.alias,
-		deps:       ctx.args.deps,
-		external:   ctx.args.external,
-		conditions: ctx.args.conditions,
+		alias:         ctx.args.alias,
+		deps:          ctx.args.deps,
+		external:      ctx.args.external,
+		exclude:       ctx.args.exclude,
+		conditions:    ctx.args.conditions,
+		noCSS:         ctx.args.noCSS,
+		legalComments: ctx.args.legalComments,
 	}
 	err = resolveBuildArgs(ctx.npmrc, ctx.wd, &args, dep)
 	if err != nil {
@@ -845,11 +873,14 @@ func (ctx *BuildContext) resolveExternalModule(specifier string, kind api.Resolv
 		}
 		params = append(params, "alias="+strings.Join(alias, ","))
 	}
-	if len(args.deps) > 0 {
+	if len(args.deps) > 0 || args.exclude.Len() > 0 {
 		var deps sort.StringSlice
 		for n, v := range args.deps {
 			deps = append(deps, n+"@"+v)
 		}
+		for _, n := range args.exclude.Values() {
+			deps = append(deps, "-"+n)
+		}
 		deps.Sort()
 		params = append(params, "deps="+strings.Join(deps, ","))
 	}
@@ -867,6 +898,12 @@ func (ctx *BuildContext) resolveExternalModule(specifier string, kind api.Resolv
 		conditions.Sort()
 		params = append(params, "conditions="+strings.Join(conditions, ","))
 	}
+	if args.noCSS {
+		params = append(params, "no-css")
+	}
+	if args.legalComments != "" {
+		params = append(params, "legal-comments="+args.legalComments)
+	}
 	if dep.SubModuleName != "" && strings.HasSuffix(dep.SubModuleName, ".json") {
 		params = append(params, "module")
 	} else {
@@ -948,6 +985,25 @@ func (ctx *BuildContext) resloveDTS(entry BuildEntry) (string, error) {
 	return "", nil
 }
 
+// resolveTargetTypes resolves the types of the module that is used by the build of the target,
+// e.g. `index.d.ts` resolves to `./browser.d.ts` for browser targets if the package declares
+// the types in the `browser` condition. It returns an empty string if no types are found.
+func (ctx *BuildContext) resolveTargetTypes(dtsPath string) string {
+	subModuleName := dtsPath
+	for _, ext := range []string{".d.ts", ".d.mts", ".d.cts"} {
+		subModuleName = strings.TrimSuffix(subModuleName, ext)
+	}
+	if subModuleName == "index" {
+		subModuleName = ""
+	} else {
+		subModuleName = strings.TrimSuffix(subModuleName, "/index")
+	}
+	esm := ctx.esm
+	esm.SubPath = subModuleName
+	esm.SubModuleName = subModuleName
+	return ctx.resolveEntry(esm).types
+}
+
 func (ctx *BuildContext) getImportPath(esm EsmPath, buildArgsPrefix string, externalAll bool) string {
 	if strings.HasSuffix(esm.SubPath, ".json") && ctx.existsPkgFile(esm.SubPath) {
 		return esm.Name() + "/" + esm.SubPath + "?module"
@@ -1017,6 +1073,50 @@ func (ctx *BuildContext) existsPkgFile(fp ...string) bool {
 	return existsFile(path.Join(args...))
 }
 
+// isExternal checks if the specifier is marked as external by the `?external` query,
+// the patterns like `@org/**` don't match the package itself.
+func (ctx *BuildContext) isExternal(specifier string) bool {
+	pkgName := toPackageName(specifier)
+	if ctx.args.external.Has(pkgName) {
+		return true
+	}
+	return pkgName != ctx.esm.PkgName && isExternalSpecifier(ctx.args.external, specifier)
+}
+
+// existsPkgModule checks if the module exists in the package directory with the node resolution,
+// the extension and the `index` file of the directory can be omitted.
+func (ctx *BuildContext) existsPkgModule(name string) bool {
+	for _, suffix := range []string{"", ".js", ".mjs", ".cjs", ".json", "/index.js", "/index.mjs", "/index.cjs", "/index.json"} {
+		if ctx.existsPkgFile(name + suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isMissingOptionalPeerDep checks if the package is an optional peer dependency
+// (`peerDependenciesMeta[name].optional`) of the importer's package that is not installed.
+func (ctx *BuildContext) isMissingOptionalPeerDep(pkgName string, importer string) bool {
+	i := strings.LastIndex(importer, "/node_modules/")
+	if i < 0 {
+		return false
+	}
+	importerPkgName := toPackageName(importer[i+14:])
+	importerPkgDir := importer[:i+14] + importerPkgName
+	pkgJson := ctx.pkgJson
+	if importerPkgName != ctx.esm.PkgName {
+		var raw PackageJSONRaw
+		if utils.ParseJSONFile(path.Join(importerPkgDir, "package.json"), &raw) != nil {
+			return false
+		}
+		pkgJson = raw.ToNpmPackage()
+	}
+	if !pkgJson.OptionalPeerDeps.Has(pkgName) {
+		return false
+	}
+	return !existsDir(path.Join(importerPkgDir, "node_modules", pkgName)) && !existsDir(path.Join(ctx.wd, "node_modules", pkgName))
+}
+
 func (ctx *BuildContext) lookupDep(specifier string, isDts bool) (esm EsmPath, packageJson *PackageJSON, err error) {
 	pkgName, version, subpath, _ := splitEsmPath(specifier)
 lookup:
@@ -1183,6 +1283,77 @@ func getExportConditionPaths(condition JSONObject) []string {
 	return values
 }
 
+// resolveFlowTypes returns the flow type stubs(`*.js.flow`) of the module, or an empty string if not found.
+func (ctx *BuildContext) resolveFlowTypes() string {
+	candidates := []string{ctx.resolveEntry(ctx.esm).main}
+	if ctx.esm.SubModuleName == "" {
+		// the flow stubs are usually placed next to the commonjs `main` entry
+		candidates = append(candidates, ctx.pkgJson.Main, ctx.pkgJson.Module)
+	}
+	for _, filename := range candidates {
+		if filename != "" && ctx.existsPkgFile(filename+".flow") {
+			return normalizeEntryPath(filename) + ".flow"
+		}
+	}
+	return ""
+}
+
+// getExportConditionEntry returns the path of the first matched condition, the nested
+// conditions fall back to the `default` condition.
+func getExportConditionEntry(conditions JSONObject, names ...string) string {
+	for _, name := range names {
+		v, ok := conditions.Get(name)
+		if !ok {
+			continue
+		}
+		if s, ok := v.(string); ok {
+			return s
+		}
+		if obj, ok := v.(JSONObject); ok {
+			if s := getExportConditionEntry(obj, append(names, "default")...); s != "" {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+// matchExportConditions checks if any of the conditions is used by the `.` export of the package, including the
+// nested conditions. It returns true if the package doesn't define the `.` export since there is nothing to match.
+func matchExportConditions(pkgJson *PackageJSON, conditions []string) bool {
+	exports := pkgJson.Exports
+	if exports.Len() == 0 {
+		return true
+	}
+	v, ok := exports.Get(".")
+	if !ok {
+		if strings.HasPrefix(exports.keys[0], ".") {
+			return true
+		}
+		// exports: { "import": "./esm/index.js", "require": "./cjs/index.js" }
+		v = exports
+	}
+	var match func(v any) bool
+	match = func(v any) bool {
+		switch v := v.(type) {
+		case JSONObject:
+			for _, name := range v.keys {
+				if stringInSlice(conditions, name) || match(v.values[name]) {
+					return true
+				}
+			}
+		case []any:
+			for _, item := range v {
+				if match(item) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return match(v)
+}
+
 func normalizeEntryPath(path string) string {
 	return "." + utils.NormalizePathname(path)
 }
@@ -1262,3 +1433,65 @@ func isCommitish(s string) bool {
 func semverLessThan(a string, b string) bool {
 	return semver.MustParse(a).LessThan(semver.MustParse(b))
 }
+
+// suggestSubModules returns the sub-modules of the package that are similar to the given sub-module name, e.g. "utils" for
+// "util". The candidates are the subpaths of the `exports` field, or the module files of the package if it has no subpath exports.
+// The candidates are cached per package version, the suggestions are ranked for every request.
+func (ctx *BuildContext) suggestSubModules(subModuleName string) []string {
+	cacheKey := "sub-module-candidates:" + ctx.npmrc.zoneId + ":" + ctx.esm.Name()
+	candidates, err := withCache(cacheKey, time.Duration(config.NpmQueryCacheTTL)*time.Second, func() ([]string, string, error) {
+		if ctx.wd == "" || ctx.pkgJson == nil {
+			if err := ctx.install(); err != nil {
+				return nil, "", err
+			}
+		}
+		candidates := set.New[string]()
+		for _, key := range ctx.pkgJson.Exports.keys {
+			if strings.HasPrefix(key, "./") && !strings.ContainsRune(key, '*') && key != "./package.json" {
+				candidates.Add(stripEntryModuleExt(key[2:]))
+			}
+		}
+		if candidates.Len() == 0 {
+			files, err := findFiles(path.Join(ctx.wd, "node_modules", ctx.esm.PkgName), "", func(filename string) bool {
+				return endsWith(filename, ".js", ".mjs", ".cjs") && !strings.HasSuffix(filename, ".min.js")
+			})
+			if err != nil {
+				return nil, "", err
+			}
+			for _, filename := range files {
+				candidates.Add(strings.TrimSuffix(stripEntryModuleExt(filename), "/index"))
+			}
+		}
+		return candidates.Values(), "", nil
+	})
+	if err != nil {
+		return nil
+	}
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	var matched []suggestion
+	name := strings.ToLower(subModuleName)
+	for _, candidate := range candidates {
+		distance := levenshteinDistance(name, strings.ToLower(candidate))
+		// e.g. "button" -> "components/button"
+		if d := levenshteinDistance(path.Base(name), strings.ToLower(path.Base(candidate))) + 1; d < distance {
+			distance = d
+		}
+		if distance <= max(1, len(name)/3) {
+			matched = append(matched, suggestion{candidate, distance})
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if matched[i].distance != matched[j].distance {
+			return matched[i].distance < matched[j].distance
+		}
+		return matched[i].name < matched[j].name
+	})
+	suggestions := make([]string, 0, 3)
+	for i := 0; i < len(matched) && i < 3; i++ {
+		suggestions = append(suggestions, ctx.esm.Name()+"/"+matched[i].name)
+	}
+	return suggestions
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	esbuild "github.com/evanw/esbuild/pkg/api"
+	"github.com/ije/gox/set"
+)
+
+// a fixture dual package that provides both `require` and `import` entries
+func createDualPackageFixture(t *testing.T) (wd string, pkgJson *PackageJSON) {
+	wd = t.TempDir()
+	pkgJson = writeFixturePackage(t, wd, "dual-pkg", map[string]string{
+		"package.json": `{
+			"name": "dual-pkg",
+			"version": "1.0.0",
+			"main": "./cjs/index.js",
+			"module": "./esm/index.js",
+			"exports": {
+				".": {
+					"require": "./cjs/index.js",
+					"import": "./esm/index.js"
+				}
+			}
+		}`,
+		"cjs/index.js": `Object.defineProperty(exports, "__esModule", { value: true }); exports.foo = "bar";`,
+		"esm/index.js": `export const foo = "bar";`,
+	})
+	return
+}
+
+func TestResolveDualPackageEntry(t *testing.T) {
+	wd, pkgJson := createDualPackageFixture(t)
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	entry := ctx.resolveEntry(ctx.esm)
+	if entry.main != "./esm/index.js" || !entry.module {
+		t.Fatalf("expected the ESM entry, got %s (module: %v)", entry.main, entry.module)
+	}
+
+	ctx.args.preferRequire = true
+	entry = ctx.resolveEntry(ctx.esm)
+	if entry.main != "./cjs/index.js" || entry.module {
+		t.Fatalf("expected the CJS entry with `preferRequire`, got %s (module: %v)", entry.main, entry.module)
+	}
+}
+
+func TestResolveBrowserEntry(t *testing.T) {
+	wd := t.TempDir()
+	files := map[string]string{
+		"index.js":           `export const env = "node";`,
+		"browser-exports.js": `export const env = "browser-exports";`,
+		"browser-field.js":   `export const env = "browser-field";`,
+	}
+	files["package.json"] = `{
+		"name": "browser-pkg",
+		"version": "1.0.0",
+		"type": "module",
+		"main": "./index.js",
+		"browser": {
+			"./index.js": "./browser-field.js",
+			"./browser-exports.js": "./browser-field.js"
+		},
+		"exports": {
+			".": {
+				"browser": "./browser-exports.js",
+				"default": "./index.js"
+			}
+		}
+	}`
+	pkgJson := writeFixturePackage(t, wd, "browser-pkg", files)
+	files["package.json"] = `{
+		"name": "browser-field-pkg",
+		"version": "1.0.0",
+		"type": "module",
+		"main": "./index.js",
+		"browser": {
+			"./index.js": "./browser-field.js"
+		},
+		"exports": {
+			".": "./index.js"
+		}
+	}`
+	fieldPkgJson := writeFixturePackage(t, wd, "browser-field-pkg", files)
+
+	for _, tc := range []struct {
+		pkgJson *PackageJSON
+		target  string
+		main    string
+	}{
+		{pkgJson, "es2022", "./browser-exports.js"},
+		{pkgJson, "node", "./index.js"},
+		{fieldPkgJson, "es2022", "./browser-field.js"},
+		{fieldPkgJson, "denonext", "./index.js"},
+	} {
+		ctx := newFixtureBuildContext(t, wd, tc.pkgJson)
+		ctx.target = tc.target
+		entry := ctx.resolveEntry(ctx.esm)
+		if entry.main != tc.main {
+			t.Fatalf("%s(target=%s): expected entry %s, got %s", tc.pkgJson.Name, tc.target, tc.main, entry.main)
+		}
+	}
+}
+
+func TestResolveDMTSTypes(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "mts-pkg", map[string]string{
+		"package.json": `{
+			"name": "mts-pkg",
+			"version": "1.0.0",
+			"type": "module",
+			"module": "./index.mjs",
+			"types": "./index.d.mts"
+		}`,
+		"index.mjs":   `export const foo = "bar";`,
+		"index.d.mts": `export declare const foo: string;`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	entry := ctx.resolveEntry(ctx.esm)
+	if entry.types != "./index.d.mts" {
+		t.Fatalf("expected the types entry ./index.d.mts, got %s", entry.types)
+	}
+	dts, err := ctx.resloveDTS(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dts != "/mts-pkg@1.0.0/index.d.mts" {
+		t.Fatalf("expected the X-TypeScript-Types path /mts-pkg@1.0.0/index.d.mts, got %s", dts)
+	}
+
+	// the types path should resolve to the `.d.mts` file
+	typesCtx := newFixtureBuildContext(t, wd, pkgJson)
+	typesCtx.esm.SubPath = "index.d.mts"
+	typesCtx.target = "types"
+	if typesCtx.Path() != dts {
+		t.Fatalf("expected the types build path %s, got %s", dts, typesCtx.Path())
+	}
+	err = typesCtx.transformDTS("./index.d.mts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = typesCtx.storage.Stat(normalizeSavePath(ctx.npmrc.zoneId, path.Join("types", dts)))
+	if err != nil {
+		t.Fatalf("the `.d.mts` file should be saved: %v", err)
+	}
+}
+
+func TestResolveTargetTypes(t *testing.T) {
+	wd := t.TempDir()
+	files := map[string]string{
+		"index.js":     `export const env = "default";`,
+		"index.d.ts":   `export declare const env: "default";`,
+		"browser.js":   `export const env = "browser";`,
+		"browser.d.ts": `export declare const env: "browser";`,
+	}
+	files["package.json"] = `{
+		"name": "target-types-pkg",
+		"version": "1.0.0",
+		"type": "module",
+		"exports": {
+			".": {
+				"browser": {
+					"types": "./browser.d.ts",
+					"default": "./browser.js"
+				},
+				"default": {
+					"types": "./index.d.ts",
+					"default": "./index.js"
+				}
+			}
+		}
+	}`
+	pkgJson := writeFixturePackage(t, wd, "target-types-pkg", files)
+	files["package.json"] = `{
+		"name": "single-types-pkg",
+		"version": "1.0.0",
+		"type": "module",
+		"module": "./index.js",
+		"types": "./index.d.ts"
+	}`
+	singlePkgJson := writeFixturePackage(t, wd, "single-types-pkg", files)
+
+	for _, tc := range []struct {
+		pkgJson *PackageJSON
+		target  string
+		types   string
+	}{
+		{pkgJson, "es2022", "./browser.d.ts"},
+		{pkgJson, "denonext", "./index.d.ts"},
+		{pkgJson, "node", "./index.d.ts"},
+		{singlePkgJson, "es2022", "./index.d.ts"},
+		{singlePkgJson, "denonext", "./index.d.ts"},
+	} {
+		ctx := newFixtureBuildContext(t, wd, tc.pkgJson)
+		ctx.target = tc.target
+		types := ctx.resolveTargetTypes("index.d.ts")
+		if types != tc.types {
+			t.Fatalf("%s(target=%s): expected types %s, got %s", tc.pkgJson.Name, tc.target, tc.types, types)
+		}
+	}
+}
+
+func TestResolveExternalReactWithPinnedVersion(t *testing.T) {
+	wd := t.TempDir()
+	writeFixturePackage(t, wd, "react", map[string]string{
+		"package.json": `{"name": "react", "version": "18.2.0", "main": "./index.js"}`,
+		"index.js":     `exports.version = "18.2.0";`,
+	})
+	reactDomPkgJson := writeFixturePackage(t, wd, "react-dom", map[string]string{
+		"package.json": `{"name": "react-dom", "version": "18.3.1", "main": "./index.js", "peerDependencies": {"react": "^18.3.1"}}`,
+		"index.js":     `exports.render = require("react").version;`,
+	})
+	uiPkgJson := writeFixturePackage(t, wd, "ui-lib", map[string]string{
+		"package.json": `{"name": "ui-lib", "version": "1.0.0", "module": "./index.js", "peerDependencies": {"react": "^18.0.0", "react-dom": "18.3.1"}}`,
+		"index.js":     `export * from "react"; export * from "react-dom";`,
+	})
+
+	newCtx := func(pkgJson *PackageJSON, args BuildArgs) *BuildContext {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.args = args
+		return ctx
+	}
+	resolve := func(ctx *BuildContext, specifier string) string {
+		resolvedPath, err := ctx.resolveExternalModule(specifier, esbuild.ResolveJSImportStatement, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resolvedPath
+	}
+	pinned := map[string]string{"react": "18.2.0"}
+
+	// react-dom uses the react of the same version by default
+	if p := resolve(newCtx(reactDomPkgJson, BuildArgs{}), "react"); p != "/react@18.3.1/es2022/react.mjs" {
+		t.Fatalf("unexpected react path: %s", p)
+	}
+	// react-dom honors the react version that is pinned by `?deps`
+	if p := resolve(newCtx(reactDomPkgJson, BuildArgs{deps: pinned}), "react"); p != "/react@18.2.0/es2022/react.mjs" {
+		t.Fatalf("unexpected react path: %s", p)
+	}
+
+	// the consumer keeps the externalized react as a bare import, and propagates
+	// the pinned version and the `external` to the nested react-dom build
+	args := BuildArgs{deps: pinned, external: *set.NewReadOnly("react")}
+	ctx := newCtx(uiPkgJson, args)
+	if p := resolve(ctx, "react"); p != "react" {
+		t.Fatalf("react should be external, got %s", p)
+	}
+	reactDomPath := resolve(ctx, "react-dom")
+	a := strings.Split(reactDomPath, "/")
+	if len(a) != 5 || a[1] != "react-dom@18.3.1" || !strings.HasPrefix(a[2], "X-") {
+		t.Fatalf("unexpected react-dom path: %s", reactDomPath)
+	}
+	nestedArgs, err := decodeBuildArgs(strings.TrimPrefix(a[2], "X-"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nestedArgs.deps["react"] != "18.2.0" || !nestedArgs.external.Has("react") {
+		t.Fatalf("the pinned react should be propagated to react-dom: %v", reactDomPath)
+	}
+	if p := resolve(newCtx(reactDomPkgJson, nestedArgs), "react"); p != "react" {
+		t.Fatalf("react should be external in the nested react-dom build, got %s", p)
+	}
+	// without `external`, the nested react-dom build imports the pinned react
+	nestedArgs.external = set.ReadOnlySet[string]{}
+	if p := resolve(newCtx(reactDomPkgJson, nestedArgs), "react"); p != "/react@18.2.0/es2022/react.mjs" {
+		t.Fatalf("unexpected react path: %s", p)
+	}
+}
+
+func TestResolveFlowTypes(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "flow-pkg", map[string]string{
+		"package.json": `{
+			"name": "flow-pkg",
+			"version": "1.0.0",
+			"main": "./lib/index.js",
+			"module": "./es/index.js"
+		}`,
+		"lib/index.js":      `exports.foo = "bar";`,
+		"lib/index.js.flow": `// @flow\ndeclare export var foo: string;`,
+		"es/index.js":       `export const foo = "bar";`,
+		"lib/util.js":       `exports.util = "util";`,
+	})
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	if flow := ctx.resolveFlowTypes(); flow != "./lib/index.js.flow" {
+		t.Fatalf("expected the flow types next to the `main` entry, got %q", flow)
+	}
+	ctx.esm.SubModuleName = "lib/util"
+	ctx.esm.SubPath = "lib/util"
+	if flow := ctx.resolveFlowTypes(); flow != "" {
+		t.Fatalf("expected no flow types for the sub-module, got %q", flow)
+	}
+}
+
+func TestResolveEntryIgnoreExports(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "exports-pkg", map[string]string{
+		"package.json": `{
+			"name": "exports-pkg",
+			"version": "1.0.0",
+			"exports": {
+				".": "./dist/index.mjs",
+				"./*": "./dist/*.mjs"
+			},
+			"module": "./src/index.mjs"
+		}`,
+		"dist/index.mjs":  `export default "DIST_INDEX";`,
+		"dist/utils.mjs":  `export default "DIST_UTILS";`,
+		"src/index.mjs":   `export default "SRC_INDEX";`,
+		"utils.mjs":       `export default "INTERNAL_UTILS";`,
+		"bundle/full.mjs": `export default "INTERNAL_BUNDLE";`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	for _, tc := range []struct {
+		subModule     string
+		ignoreExports bool
+		want          string
+	}{
+		{"", false, "./dist/index.mjs"},
+		{"", true, "./src/index.mjs"},
+		{"utils", false, "./dist/utils.mjs"},
+		{"utils", true, "./utils.mjs"},
+		{"bundle/full", true, "./bundle/full.mjs"},
+	} {
+		ctx.args = BuildArgs{ignoreExports: tc.ignoreExports}
+		entry := ctx.resolveEntry(EsmPath{PkgName: "exports-pkg", PkgVersion: "1.0.0", SubPath: tc.subModule, SubModuleName: tc.subModule})
+		if entry.main != tc.want {
+			t.Fatalf("resolveEntry(%q, ignoreExports=%v): expected %q, got %q", tc.subModule, tc.ignoreExports, tc.want, entry.main)
+		}
+	}
+	// the types are resolved without the `exports` field too
+	if encodeBuildArgs(BuildArgs{ignoreExports: true}, true) == "" {
+		t.Fatal("the `ignoreExports` arg should be encoded into the types path")
+	}
+}
+
+func TestSuggestSubModules(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "suggest-pkg", map[string]string{
+		"package.json": `{
+			"name": "suggest-pkg",
+			"version": "1.0.0",
+			"exports": {
+				".": "./index.js",
+				"./utils": "./utils.js",
+				"./utils/*": "./utils/*.js",
+				"./components/button": "./button.js",
+				"./package.json": "./package.json"
+			}
+		}`,
+		"index.js":  `export default 1;`,
+		"utils.js":  `export default 1;`,
+		"button.js": `export default 1;`,
+	})
+	// drop the cached candidates of the fixtures, which would be counted by `TestCache`
+	defer cacheStore.Range(func(key, value any) bool {
+		if strings.HasPrefix(key.(string), "sub-module-candidates:") {
+			cacheStore.Delete(key)
+		}
+		return true
+	})
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	for _, tc := range []struct {
+		subModule string
+		want      string
+	}{
+		{"util", "suggest-pkg@1.0.0/utils"},
+		{"Utils", "suggest-pkg@1.0.0/utils"},
+		{"button", "suggest-pkg@1.0.0/components/button"},
+		{"something-else", ""},
+	} {
+		if s := strings.Join(ctx.suggestSubModules(tc.subModule), ","); s != tc.want {
+			t.Fatalf("suggestSubModules(%q): expected %q, got %q", tc.subModule, tc.want, s)
+		}
+	}
+
+	// the module files are the candidates if the package has no subpath exports
+	wd = t.TempDir()
+	pkgJson = writeFixturePackage(t, wd, "suggest-files-pkg", map[string]string{
+		"package.json":        `{"name": "suggest-files-pkg", "version": "1.0.0", "main": "./index.js"}`,
+		"index.js":            `export default 1;`,
+		"lib/parser.js":       `export default 1;`,
+		"lib/parsers.js":      `export default 1;`,
+		"lib/format/index.js": `export default 1;`,
+	})
+	ctx = newFixtureBuildContext(t, wd, pkgJson)
+	if s := strings.Join(ctx.suggestSubModules("lib/parse"), ","); s != "suggest-files-pkg@1.0.0/lib/parser,suggest-files-pkg@1.0.0/lib/parsers" {
+		t.Fatalf("unexpected suggestions: %s", s)
+	}
+	// the candidates are cached per package version, the package files are not walked again for other names
+	err := os.RemoveAll(path.Join(wd, "node_modules", "suggest-files-pkg", "lib"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Join(ctx.suggestSubModules("lib/formats"), ","); s != "suggest-files-pkg@1.0.0/lib/format" {
+		t.Fatalf("unexpected suggestions: %s", s)
+	}
+}
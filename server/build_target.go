@@ -1,6 +1,9 @@
 package server
 
 import (
+	"bytes"
+	"net/http"
+	"regexp"
 	"strings"
 
 	"github.com/Masterminds/semver/v3"
@@ -9,7 +12,17 @@ import (
 
 var v1_33_2 = semver.MustParse("1.33.2")
 
+// the request header of the runtimes that provide the `Deno` global but don't present the `Deno/` user agent,
+// e.g. `X-Runtime: deno`
+const runtimeHintHeader = "X-Runtime"
+
+// the user agent substrings of the Deno-based edge runtimes, extended by the `denoUserAgents` config
+var denoLikeUserAgents = []string{"Deno Deploy", "Supabase-Edge-Runtime/", "Netlify-Edge-Functions/"}
+
+var regexpUnsupportedES5Syntax = regexp.MustCompile(`^(?:Transforming (.+) to the configured target environment|(.+) (?:is|are) not available in the configured target environment) \("es5"[^)]*\)`)
+
 var targets = map[string]esbuild.Target{
+	"es5":      esbuild.ES5, // best-effort, esbuild can not lower all es2015+ syntax to es5
 	"es2015":   esbuild.ES2015,
 	"es2016":   esbuild.ES2016,
 	"es2017":   esbuild.ES2017,
@@ -40,8 +53,187 @@ func getBuildTargetByUA(ua string) string {
 		}
 		return "denonext"
 	}
+	// the Deno-based runtimes may present their own user agents, e.g. `Supabase-Edge-Runtime/1.58.0 (compatible; Deno/1.45.2)`
+	if strings.Contains(ua, "Deno/") || isDenoLikeUserAgent(ua) {
+		return "denonext"
+	}
 	if ua == "undici" || strings.HasPrefix(ua, "Node.js/") || strings.HasPrefix(ua, "Node/") || strings.HasPrefix(ua, "Bun/") {
 		return "node"
 	}
 	return "es2022"
 }
+
+// getBuildTargetByRequest returns the build target by the runtime hint header or the `User-Agent` header of the request
+func getBuildTargetByRequest(header http.Header) string {
+	if strings.EqualFold(header.Get(runtimeHintHeader), "deno") {
+		return "denonext"
+	}
+	return getBuildTargetByUA(header.Get("User-Agent"))
+}
+
+func isDenoLikeUserAgent(ua string) bool {
+	for _, s := range denoLikeUserAgents {
+		if strings.Contains(ua, s) {
+			return true
+		}
+	}
+	for _, s := range config.DenoUserAgents {
+		if strings.Contains(ua, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendVaryTargetHeaders appends the request headers that determine the build target to the `Vary` header
+func appendVaryTargetHeaders(header http.Header) {
+	appendVaryHeader(header, "User-Agent")
+	appendVaryHeader(header, runtimeHintHeader)
+}
+
+// the runtime helpers that are injected by esbuild when lowering the syntax for the build target
+var downlevelHelpers = []struct {
+	helper  string
+	feature string
+}{
+	{"__async", "async/await"},
+	{"__asyncGenerator", "async generators"},
+	{"__forAwait", "for-await"},
+	{"__spreadValues", "object spread"},
+	{"__objRest", "object rest"},
+	{"__publicField", "class fields"},
+	{"__privateAdd", "private class members"},
+}
+
+// getDownleveledFeatures returns the syntax features that are lowered in the build output,
+// it only works with non-minified code since the helper names are mangled by the minifier.
+func getDownleveledFeatures(code []byte) (features []string) {
+	for _, h := range downlevelHelpers {
+		if bytes.Contains(code, []byte("var "+h.helper+" = ")) {
+			features = append(features, h.feature)
+		}
+	}
+	return
+}
+
+// getUnsupportedES5Syntax returns the syntax feature of the esbuild error that can not be lowered to es5,
+// e.g. `Transforming generator functions to the configured target environment ("es5" + 2 overrides) is not supported yet`.
+func getUnsupportedES5Syntax(msg string) string {
+	m := regexpUnsupportedES5Syntax.FindStringSubmatch(msg)
+	if m == nil {
+		return ""
+	}
+	if m[1] != "" {
+		return m[1]
+	}
+	return strings.ToLower(m[2][:1]) + m[2][1:]
+}
+
+// getWebAPIPolyfill returns the polyfill package of the npm replacement if the build target predates the Web API
+// the replacement relies on, the non-es targets (esnext, deno, node) are considered to support the Web APIs natively.
+func getWebAPIPolyfill(specifier string, target string) (string, bool) {
+	p, ok := webAPIPolyfills[specifier]
+	if !ok {
+		return "", false
+	}
+	t := targets[target]
+	if t < esbuild.ES5 || t >= targets[p.target] {
+		return "", false
+	}
+	return p.polyfill, true
+}
+
+// supportsImportMeta checks if the target supports the `import.meta` syntax that is introduced in es2020,
+// note: the `esnext` target is less than `es5` in the esbuild target enum.
+func supportsImportMeta(target string) bool {
+	t := targets[target]
+	return t < esbuild.ES5 || t >= esbuild.ES2020
+}
+
+// hasEmptyImportMetaWarning checks if esbuild reports that the `import.meta` is empty in the build target.
+func hasEmptyImportMetaWarning(warnings []esbuild.Message) bool {
+	for _, w := range warnings {
+		if w.ID == "empty-import-meta" {
+			return true
+		}
+	}
+	return false
+}
+
+var regexpBrowserslistQuery = regexp.MustCompile(`^([a-z_]+)\s*(?:>=|>)?\s*(\d+(?:\.\d+)*)(?:\s*-\s*\d+(?:\.\d+)*)?$`)
+
+// the browsers of the `browserslist` queries that are mapped to the engines of the es targets
+var browserslistEngines = map[string]esbuild.EngineName{
+	"chrome":  esbuild.EngineChrome,
+	"and_chr": esbuild.EngineChrome,
+	"edge":    esbuild.EngineEdge,
+	"firefox": esbuild.EngineFirefox,
+	"ff":      esbuild.EngineFirefox,
+	"and_ff":  esbuild.EngineFirefox,
+	"safari":  esbuild.EngineSafari,
+	"ios":     esbuild.EngineSafari,
+	"ios_saf": esbuild.EngineSafari,
+}
+
+// getBrowserslistTarget returns the lowest es target that is implied by the `browserslist` of a package, e.g. "es2020"
+// for `["chrome >= 80", "firefox >= 80"]`. Only the version queries of the major browsers are supported, an empty string
+// is returned for the other queries (like `defaults` or `> 0.5%`) since they may include the legacy browsers.
+func getBrowserslistTarget(browserslist []string) string {
+	minVersions := map[esbuild.EngineName]*semver.Version{}
+	for _, queries := range browserslist {
+		for _, query := range strings.Split(strings.ReplaceAll(strings.ToLower(queries), " or ", ","), ",") {
+			query = strings.TrimSpace(query)
+			// the `not` queries only exclude browsers
+			if query == "" || strings.HasPrefix(query, "not ") {
+				continue
+			}
+			m := regexpBrowserslistQuery.FindStringSubmatch(query)
+			if m == nil {
+				return ""
+			}
+			engine, ok := browserslistEngines[m[1]]
+			if !ok {
+				return ""
+			}
+			version, err := semver.NewVersion(m[2])
+			if err != nil {
+				return ""
+			}
+			if v, ok := minVersions[engine]; !ok || version.LessThan(v) {
+				minVersions[engine] = version
+			}
+		}
+	}
+	if len(minVersions) == 0 {
+		return ""
+	}
+	for _, target := range []string{"es2024", "es2023", "es2022", "es2021", "es2020", "es2019", "es2018", "es2017", "es2016", "es2015"} {
+		supported := true
+		for _, engine := range cssEngines[target] {
+			if v, ok := minVersions[engine.Name]; ok && v.LessThan(semver.MustParse(engine.Version)) {
+				supported = false
+				break
+			}
+		}
+		if supported {
+			return target
+		}
+	}
+	return ""
+}
+
+// the browser engines of the es targets, esbuild lowers the CSS features (e.g. nesting) by the engines instead of the es target,
+// the versions are the first releases that support the es version.
+var cssEngines = map[string][]esbuild.Engine{
+	"es5":    {{Name: esbuild.EngineIE, Version: "11"}},
+	"es2015": {{Name: esbuild.EngineChrome, Version: "51"}, {Name: esbuild.EngineEdge, Version: "15"}, {Name: esbuild.EngineFirefox, Version: "54"}, {Name: esbuild.EngineSafari, Version: "10"}},
+	"es2016": {{Name: esbuild.EngineChrome, Version: "52"}, {Name: esbuild.EngineEdge, Version: "15"}, {Name: esbuild.EngineFirefox, Version: "52"}, {Name: esbuild.EngineSafari, Version: "10.1"}},
+	"es2017": {{Name: esbuild.EngineChrome, Version: "58"}, {Name: esbuild.EngineEdge, Version: "16"}, {Name: esbuild.EngineFirefox, Version: "53"}, {Name: esbuild.EngineSafari, Version: "11"}},
+	"es2018": {{Name: esbuild.EngineChrome, Version: "64"}, {Name: esbuild.EngineEdge, Version: "79"}, {Name: esbuild.EngineFirefox, Version: "78"}, {Name: esbuild.EngineSafari, Version: "12"}},
+	"es2019": {{Name: esbuild.EngineChrome, Version: "73"}, {Name: esbuild.EngineEdge, Version: "79"}, {Name: esbuild.EngineFirefox, Version: "64"}, {Name: esbuild.EngineSafari, Version: "12.1"}},
+	"es2020": {{Name: esbuild.EngineChrome, Version: "80"}, {Name: esbuild.EngineEdge, Version: "80"}, {Name: esbuild.EngineFirefox, Version: "80"}, {Name: esbuild.EngineSafari, Version: "14.1"}},
+	"es2021": {{Name: esbuild.EngineChrome, Version: "85"}, {Name: esbuild.EngineEdge, Version: "85"}, {Name: esbuild.EngineFirefox, Version: "79"}, {Name: esbuild.EngineSafari, Version: "14.1"}},
+	"es2022": {{Name: esbuild.EngineChrome, Version: "94"}, {Name: esbuild.EngineEdge, Version: "94"}, {Name: esbuild.EngineFirefox, Version: "93"}, {Name: esbuild.EngineSafari, Version: "16.4"}},
+	"es2023": {{Name: esbuild.EngineChrome, Version: "110"}, {Name: esbuild.EngineEdge, Version: "110"}, {Name: esbuild.EngineFirefox, Version: "115"}, {Name: esbuild.EngineSafari, Version: "16.4"}},
+	"es2024": {{Name: esbuild.EngineChrome, Version: "117"}, {Name: esbuild.EngineEdge, Version: "117"}, {Name: esbuild.EngineFirefox, Version: "119"}, {Name: esbuild.EngineSafari, Version: "17.4"}},
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetBuildTargetByUA(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{DenoUserAgents: []string{"MyEdge/"}}
+
+	for _, tc := range []struct {
+		ua     string
+		target string
+	}{
+		{"Deno/1.33.1", "deno"},
+		{"Deno/2.1.4", "denonext"},
+		{"Deno Deploy", "denonext"},
+		{"Supabase-Edge-Runtime/1.58.0 (compatible; Deno/1.45.2)", "denonext"},
+		{"Netlify-Edge-Functions/1.0", "denonext"},
+		{"MyEdge/1.0", "denonext"},
+		{"Node.js/22", "node"},
+		{"ES/2019", "es2019"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7)", "es2022"},
+	} {
+		if target := getBuildTargetByUA(tc.ua); target != tc.target {
+			t.Fatalf("getBuildTargetByUA(%q): expected %q, got %q", tc.ua, tc.target, target)
+		}
+	}
+
+	header := http.Header{}
+	header.Set("User-Agent", "Mozilla/5.0")
+	if target := getBuildTargetByRequest(header); target != "es2022" {
+		t.Fatalf("expected es2022, got %q", target)
+	}
+	header.Set("X-Runtime", "deno")
+	if target := getBuildTargetByRequest(header); target != "denonext" {
+		t.Fatalf("the runtime hint header should be respected, got %q", target)
+	}
+}
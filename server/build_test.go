@@ -0,0 +1,1384 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/esm-dev/esm.sh/server/npm_replacements"
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/log"
+	"github.com/ije/gox/set"
+)
+
+// newTestBuildStorage creates the fs storage and the logger for the fixture builds of the working directory
+func newTestBuildStorage(t *testing.T, wd string) (storage.Storage, *log.Logger) {
+	buildStorage, err := storage.NewFSStorage(&storage.StorageOptions{Type: "fs", Endpoint: path.Join(wd, "storage")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, err := log.New("file:" + path.Join(wd, "build.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buildStorage, logger
+}
+
+// readStoredFile reads the content of the file in the build storage
+func readStoredFile(t *testing.T, buildStorage storage.Storage, savePath string) []byte {
+	f, _, err := buildStorage.Get(savePath)
+	if err != nil {
+		t.Fatalf("%s: %v", savePath, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// newFixtureBuildContext creates the build context of the fixture package in the working directory, the tests
+// set the other options of the build on the returned context
+func newFixtureBuildContext(t *testing.T, wd string, pkgJson *PackageJSON) *BuildContext {
+	buildStorage, logger := newTestBuildStorage(t, wd)
+	// drop the logs of the failed fixture builds, which would be counted by `TestCache`
+	t.Cleanup(func() {
+		prefix := getBuildLogKey(DefaultNpmRC().zoneId, "/"+pkgJson.Name+"@")
+		cacheStore.Range(func(key, value any) bool {
+			if strings.HasPrefix(key.(string), prefix) {
+				cacheStore.Delete(key)
+			}
+			return true
+		})
+	})
+	return &BuildContext{
+		npmrc:   DefaultNpmRC(),
+		logger:  logger,
+		storage: buildStorage,
+		esm:     EsmPath{PkgName: pkgJson.Name, PkgVersion: pkgJson.Version},
+		pkgJson: pkgJson,
+		wd:      wd,
+		target:  "es2022",
+	}
+}
+
+// buildFixture builds the module of the build context and returns the meta and the code of the build
+func buildFixture(t *testing.T, ctx *BuildContext) (*BuildMeta, []byte) {
+	meta, _, err := ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return meta, readStoredFile(t, ctx.storage, ctx.getSavepath())
+}
+
+// writeFixturePackage writes the files of a fixture package to the `node_modules` directory
+func writeFixturePackage(t *testing.T, wd string, pkgName string, files map[string]string) (pkgJson *PackageJSON) {
+	pkgDir := path.Join(wd, "node_modules", pkgName)
+	for name, content := range files {
+		filename := path.Join(pkgDir, name)
+		err := os.MkdirAll(path.Dir(filename), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(filename, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pkgJson = &PackageJSON{}
+	err := pkgJson.UnmarshalJSON([]byte(files["package.json"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestBuildWithMissingOptionalPeerDep(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "app-pkg", map[string]string{
+		"package.json": `{
+			"name": "app-pkg",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"dependencies": {
+				"plugin-pkg": "1.0.0"
+			}
+		}`,
+		"index.js": `export { plugin } from "plugin-pkg";`,
+	})
+	// the `plugin-pkg` imports the optional peer dependency `optional-dep` that is not installed
+	writeFixturePackage(t, wd, "plugin-pkg", map[string]string{
+		"package.json": `{
+			"name": "plugin-pkg",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"peerDependencies": {
+				"optional-dep": "^1.0.0"
+			},
+			"peerDependenciesMeta": {
+				"optional-dep": {
+					"optional": true
+				}
+			}
+		}`,
+		"index.js": `import dep from "optional-dep"; export const plugin = () => dep;`,
+	})
+	if pkgJson.OptionalPeerDeps.Len() != 0 {
+		t.Fatal("unexpected optional peer dependencies of `app-pkg`")
+	}
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	ctx.bundleMode = BundleDeps
+	if !ctx.isMissingOptionalPeerDep("optional-dep", path.Join(wd, "node_modules/plugin-pkg/index.js")) {
+		t.Fatal("`optional-dep` should be a missing optional peer dependency of `plugin-pkg`")
+	}
+	_, code := buildFixture(t, ctx)
+	if !strings.Contains(string(code), `"/optional-dep?target=es2022"`) {
+		t.Fatalf("the optional peer dependency should be external:\n%s", code)
+	}
+}
+
+func TestBuildDualPackageEntry(t *testing.T) {
+	wd, pkgJson := createDualPackageFixture(t)
+	newBuildContext := func(args BuildArgs) *BuildContext {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.args = args
+		return ctx
+	}
+	// the cjs-module-lexer caches the result of every entry it parses
+	lexerInvoked := func() bool {
+		entries, _ := os.ReadDir(path.Join(wd, ".cache"))
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), "cml-") {
+				return true
+			}
+		}
+		return false
+	}
+
+	meta, code := buildFixture(t, newBuildContext(BuildArgs{}))
+	if meta.CJS || meta.Entry != "./esm/index.js" {
+		t.Fatalf("expected the ESM entry, got %s (cjs: %v)", meta.Entry, meta.CJS)
+	}
+	if lexerInvoked() {
+		t.Fatal("the cjs-module-lexer should not be invoked for the ESM entry")
+	}
+	if !strings.Contains(string(code), "bar") {
+		t.Fatalf("unexpected build:\n%s", code)
+	}
+	decoded, err := decodeBuildMeta(encodeBuildMeta(meta))
+	if err != nil || decoded.Entry != meta.Entry {
+		t.Fatalf("the entry should be recorded in the build meta, got %v (%v)", decoded, err)
+	}
+
+	meta, _ = buildFixture(t, newBuildContext(BuildArgs{preferRequire: true}))
+	if !meta.CJS || meta.Entry != "./cjs/index.js" {
+		t.Fatalf("expected the CJS entry with `preferRequire`, got %s (cjs: %v)", meta.Entry, meta.CJS)
+	}
+	if !lexerInvoked() {
+		t.Fatal("the cjs-module-lexer should be invoked for the CJS entry")
+	}
+}
+
+func TestBuildWithSelfExternal(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "host-pkg", map[string]string{
+		"package.json": `{
+			"name": "host-pkg",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js":  `export { plugin } from "./plugin.js"; export const host = "host";`,
+		"plugin.js": `import { host } from "host-pkg"; export const plugin = () => host;`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	ctx.args.external = *set.NewReadOnly("host-pkg")
+	_, code := buildFixture(t, ctx)
+	if !strings.Contains(string(code), `"host-pkg"`) {
+		t.Fatalf("the package's own entry should be external:\n%s", code)
+	}
+	if !strings.Contains(string(code), `"host"`) {
+		t.Fatalf("the entry module should be bundled:\n%s", code)
+	}
+}
+
+func TestBuildWithExternalNodeBuiltin(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "buffer-pkg", map[string]string{
+		"package.json": `{"name": "buffer-pkg", "version": "1.0.0", "module": "index.js"}`,
+		"index.js": `
+			import { Buffer as B } from "buffer";
+			export const a = B.from("a");
+			export const b = Buffer.from("b");
+		`,
+	})
+
+	for _, name := range []string{"node:buffer", "buffer"} {
+		esm := EsmPath{PkgName: "buffer-pkg", PkgVersion: "1.0.0"}
+		args := BuildArgs{external: *set.NewReadOnly(name)}
+		err := resolveBuildArgs(DefaultNpmRC(), wd, &args, esm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args.external.Len() != 1 || !args.external.Has("node:buffer") {
+			t.Fatalf("external=%s: the builtin module should be normalized to node:buffer, got %v", name, args.external.Values())
+		}
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.args = args
+		_, code := buildFixture(t, ctx)
+		if strings.Contains(string(code), "/node/buffer.mjs") || !strings.Contains(string(code), `"node:buffer"`) {
+			t.Fatalf("external=%s: the buffer polyfill should not be imported:\n%s", name, code)
+		}
+	}
+
+	// the bare name matches the `node:` prefixed specifier and vice versa
+	for _, tc := range []struct {
+		external  string
+		specifier string
+		expected  bool
+	}{
+		{"buffer", "node:buffer", true},
+		{"node:buffer", "buffer", true},
+		{"node:buffer", "node:buffer", true},
+		{"buffer", "node:process", false},
+		{"react", "react", false},
+	} {
+		if isExternalNodeBuiltin(*set.NewReadOnly(tc.external), tc.specifier) != tc.expected {
+			t.Fatalf("isExternalNodeBuiltin(%q, %q) should be %v", tc.external, tc.specifier, tc.expected)
+		}
+	}
+}
+
+func TestBuildWithExternalAllImportMap(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "split-app", map[string]string{
+		"package.json": `{
+			"name": "split-app",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"dependencies": { "split-dep": "^2.0.0" }
+		}`,
+		"index.js": `import { dep } from "split-dep"; import { sub } from "split-dep/sub"; import "./local.js"; export const app = () => dep + sub;`,
+		"local.js": `export const local = 1;`,
+	})
+	writeFixturePackage(t, wd, "split-dep", map[string]string{
+		"package.json": `{"name": "split-dep", "version": "2.1.0", "module": "./index.js"}`,
+		"index.js":     `export const dep = "dep";`,
+		"sub.js":       `export const sub = "sub";`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	ctx.externalAll = true
+	meta, _, err := ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"split-dep":     "split-dep@2.1.0",
+		"split-dep/sub": "split-dep@2.1.0/sub",
+	}
+	if !reflect.DeepEqual(meta.ExternalDeps, want) {
+		t.Fatalf("unexpected external deps: %v", meta.ExternalDeps)
+	}
+
+	decoded, err := decodeBuildMeta(encodeBuildMeta(meta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.ExternalDeps, want) {
+		t.Fatalf("the external deps should be kept in the build meta, got %v", decoded.ExternalDeps)
+	}
+	if decoded.noExternalDeps {
+		t.Fatal("the meta should record the external deps")
+	}
+
+	// the meta of an older version doesn't record the external deps, the module is rebuilt for `?importmap`
+	legacy, err := decodeBuildMeta([]byte("ESM\r\ne\ni:/react@18.3.1/es2022/react.mjs\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !legacy.noExternalDeps {
+		t.Fatal("the meta of an older version should be marked")
+	}
+}
+
+func TestBuildWithLegalComments(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "licensed-pkg", map[string]string{
+		"package.json": `{"name": "licensed-pkg", "version": "1.0.0", "module": "./index.js"}`,
+		"index.js":     "/*! licensed-pkg v1.0.0 | MIT */\nexport const licensed = true;",
+	})
+
+	for _, mode := range []string{"", "none", "eof", "external"} {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.args.legalComments = mode
+		readFile := func(savePath string) string {
+			return string(readStoredFile(t, ctx.storage, savePath))
+		}
+		if mode != "" && !strings.Contains(ctx.Path(), "/X-") {
+			t.Fatalf("the legal-comments mode %q should be encoded into the build path", mode)
+		}
+		_, _, err := ctx.buildModule(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		js := readFile(ctx.getSavepath())
+		hasLegalComment := strings.Contains(js, "licensed-pkg v1.0.0 | MIT")
+		if hasLegalComment != (mode == "" || mode == "eof") {
+			t.Fatalf("legal-comments=%s: unexpected legal comment in the build:\n%s", mode, js)
+		}
+		if mode == "external" {
+			if legal := readFile(ctx.getSavepath() + ".LEGAL.txt"); !strings.Contains(legal, "licensed-pkg v1.0.0 | MIT") {
+				t.Fatalf("the legal comment should be extracted to the LEGAL.txt file, got %q", legal)
+			}
+		}
+	}
+}
+
+func TestBuildWithExcludedDep(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "app-pkg", map[string]string{
+		"package.json": `{
+			"name": "app-pkg",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"dependencies": {
+				"some-polyfill": "1.0.0"
+			}
+		}`,
+		"index.js": `import { polyfill } from "some-polyfill"; export const app = polyfill;`,
+	})
+	writeFixturePackage(t, wd, "some-polyfill", map[string]string{
+		"package.json": `{
+			"name": "some-polyfill",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js": `export const polyfill = "SOME_POLYFILL";`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	ctx.bundleMode = BundleDeps
+	ctx.args.exclude = *set.NewReadOnly("some-polyfill")
+	_, code := buildFixture(t, ctx)
+	if strings.Contains(string(code), "some-polyfill") || strings.Contains(string(code), "SOME_POLYFILL") {
+		t.Fatalf("the excluded dependency should be replaced with an empty module:\n%s", code)
+	}
+}
+
+func TestBuildWithNoCSS(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "ui-pkg", map[string]string{
+		"package.json": `{
+			"name": "ui-pkg",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js":          `import "./styles/button.css"; export const button = "button";`,
+		"styles/button.css": `.button { color: UI_PKG_RED; }`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	ctx.args.noCSS = true
+	meta, _, err := ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.CSSInJS {
+		t.Fatal("the CSS should not be bundled")
+	}
+	if len(meta.SkippedCSS) != 1 || meta.SkippedCSS[0] != "./styles/button.css" {
+		t.Fatalf("expected the skipped CSS [./styles/button.css], got %v", meta.SkippedCSS)
+	}
+	if !strings.Contains(ctx.Path(), "/X-") {
+		t.Fatalf("the `noCSS` arg should be encoded in the build path, got %s", ctx.Path())
+	}
+	code := readStoredFile(t, ctx.storage, ctx.getSavepath())
+	if strings.Contains(string(code), "UI_PKG_RED") || strings.Contains(string(code), "button.css") {
+		t.Fatalf("the CSS import should be skipped:\n%s", code)
+	}
+	if !strings.Contains(string(code), `"button"`) {
+		t.Fatalf("the module should be built:\n%s", code)
+	}
+
+	decoded, err := decodeBuildMeta(encodeBuildMeta(meta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.SkippedCSS) != 1 || decoded.SkippedCSS[0] != "./styles/button.css" {
+		t.Fatalf("the skipped CSS should be kept in the build meta, got %v", decoded.SkippedCSS)
+	}
+}
+
+func TestBuildWithDeniedImport(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "app-pkg", map[string]string{
+		"package.json": `{
+			"name": "app-pkg",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"dependencies": {
+				"telemetry-sdk": "1.0.0"
+			}
+		}`,
+		"index.js": `export { track } from "./track.js";`,
+		"track.js": `import { send } from "telemetry-sdk/browser"; export const track = send;`,
+	})
+	writeFixturePackage(t, wd, "telemetry-sdk", map[string]string{
+		"package.json": `{
+			"name": "telemetry-sdk",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js":   `export const send = () => {};`,
+		"browser.js": `export const send = () => {};`,
+	})
+
+	denyImports := config.DenyImports
+	config.DenyImports = []string{"telemetry-sdk"}
+	defer func() { config.DenyImports = denyImports }()
+
+	for _, bundleMode := range []BundleMode{BundleDefault, BundleDeps} {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.bundleMode = bundleMode
+		_, _, err := ctx.buildModule(false)
+		if err == nil {
+			t.Fatal("the build should fail with the denied import")
+		}
+		if !strings.Contains(err.Error(), `import "telemetry-sdk/browser" is denied (imported by app-pkg/track.js)`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestBuildWithStrictAllowList(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "app-pkg", map[string]string{
+		"package.json": `{
+			"name": "app-pkg",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"dependencies": {
+				"helper-pkg": "1.0.0"
+			}
+		}`,
+		"index.js":  `export { format } from "./format.js";`,
+		"format.js": `import { pad } from "helper-pkg/pad"; export const format = pad;`,
+	})
+	writeFixturePackage(t, wd, "helper-pkg", map[string]string{
+		"package.json": `{
+			"name": "helper-pkg",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js": `export const pad = (s) => s;`,
+		"pad.js":   `export const pad = (s) => s;`,
+	})
+
+	allowList := config.AllowList
+	config.AllowList = AllowList{Packages: []string{"app-pkg"}, Strict: true}
+	defer func() { config.AllowList = allowList }()
+
+	newBuildContext := func(bundleMode BundleMode) *BuildContext {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.bundleMode = bundleMode
+		return ctx
+	}
+	for _, bundleMode := range []BundleMode{BundleDefault, BundleDeps} {
+		_, _, err := newBuildContext(bundleMode).buildModule(false)
+		if err == nil {
+			t.Fatal("the build should fail with the dependency that is not allowed")
+		}
+		if !strings.Contains(err.Error(), `dependency "helper-pkg" is not allowed (imported by app-pkg/format.js)`) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	config.AllowList.Packages = append(config.AllowList.Packages, "helper-pkg")
+	_, _, err := newBuildContext(BundleDeps).buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildWithConditionsOnlyMainExport(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "cond-pkg", map[string]string{
+		"package.json": `{
+			"name": "cond-pkg",
+			"version": "1.0.0",
+			"exports": {
+				".": {
+					"types": "./dist/index.d.ts",
+					"import": {
+						"types": "./dist/index.d.mts",
+						"default": "./dist/index.mjs"
+					},
+					"require": "./dist/index.cjs"
+				}
+			}
+		}`,
+		"dist/index.mjs":   `export const kind = "COND_PKG_ESM";`,
+		"dist/index.cjs":   `exports.kind = "COND_PKG_CJS";`,
+		"dist/index.d.ts":  `export declare const kind: string;`,
+		"dist/index.d.mts": `export declare const kind: string;`,
+	})
+	if pkgJson.Module != "./dist/index.mjs" || pkgJson.Main != "./dist/index.cjs" {
+		t.Fatalf("expected the main entries extracted from the `.` export, got module=%q main=%q", pkgJson.Module, pkgJson.Main)
+	}
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	entry := ctx.resolveEntry(ctx.esm)
+	if entry.main != "./dist/index.mjs" || !entry.module {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	meta, _, err := ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Dts != "/cond-pkg@1.0.0/dist/index.d.mts" {
+		t.Fatalf("unexpected types: %s", meta.Dts)
+	}
+	code := readStoredFile(t, ctx.storage, ctx.getSavepath())
+	if !strings.Contains(string(code), "COND_PKG_ESM") {
+		t.Fatalf("the module should be built from the `import` condition:\n%s", code)
+	}
+}
+
+func TestBuildWithDownleveledNote(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "async-pkg", map[string]string{
+		"package.json": `{
+			"name": "async-pkg",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js": `export class Store { items = []; async load() { return await fetch("/items"); } }`,
+	})
+
+	minify := config.Minify
+	defer func() { config.Minify = minify }()
+
+	readHeader := func(target string, dev bool) string {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.target = target
+		ctx.dev = dev
+		_, code := buildFixture(t, ctx)
+		header, _, _ := strings.Cut(string(code), "\n")
+		return header
+	}
+
+	config.Minify = false
+	if header := readHeader("es2015", false); header != "/* esm.sh - async-pkg@1.0.0 (downleveled async/await, class fields to es2015) */" {
+		t.Fatalf("unexpected header: %s", header)
+	}
+	if header := readHeader("es2022", false); header != "/* esm.sh - async-pkg@1.0.0 */" {
+		t.Fatalf("unexpected header: %s", header)
+	}
+
+	// the dev build is not minified even if the minification is enabled
+	config.Minify = true
+	if header := readHeader("es2015", true); header != "/* esm.sh - async-pkg@1.0.0 (downleveled async/await, class fields to es2015) */" {
+		t.Fatalf("unexpected header of the dev build: %s", header)
+	}
+	if header := readHeader("es2015", false); header != "/* esm.sh - async-pkg@1.0.0 */" {
+		t.Fatalf("unexpected header of the minified build: %s", header)
+	}
+}
+
+func TestBuildWithFalseAlias(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "app-pkg", map[string]string{
+		"package.json": `{
+			"name": "app-pkg",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"dependencies": {
+				"analytics-lib": "^1.0.0"
+			}
+		}`,
+		"index.js": `import analytics, { track } from "analytics-lib"; export function run() { track("run"); return analytics; }`,
+	})
+	// the aliased dependency is not even installed
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	ctx.args.alias = map[string]string{"analytics-lib": "false"}
+	meta, _, err := ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Imports) != 0 {
+		t.Fatalf("the aliased dependency should not be imported, got %v", meta.Imports)
+	}
+	if !reflect.DeepEqual(meta.AppliedAlias, []string{"analytics-lib"}) {
+		t.Fatalf("the alias should be recorded as applied, got %v", meta.AppliedAlias)
+	}
+	if decoded, err := decodeBuildMeta(encodeBuildMeta(meta)); err != nil || !reflect.DeepEqual(decoded.AppliedAlias, meta.AppliedAlias) {
+		t.Fatalf("the applied aliases should be kept in the build meta, got %v (%v)", decoded, err)
+	}
+	if !strings.Contains(ctx.Path(), "/X-") {
+		t.Fatalf("the alias should be encoded in the build path, got %s", ctx.Path())
+	}
+	code := readStoredFile(t, ctx.storage, ctx.getSavepath())
+	if strings.Contains(string(code), "analytics-lib") {
+		t.Fatalf("the aliased dependency should be replaced with an empty module:\n%s", code)
+	}
+}
+
+func TestBuildWithWorkerCondition(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "worker-pkg", map[string]string{
+		"package.json": `{
+			"name": "worker-pkg",
+			"version": "1.0.0",
+			"exports": {
+				".": {
+					"worker": "./worker.mjs",
+					"browser": "./browser.mjs",
+					"default": "./index.mjs"
+				}
+			}
+		}`,
+		"worker.mjs":  `export const env = "WORKER_ENTRY";`,
+		"browser.mjs": `export const env = "BROWSER_ENTRY";`,
+		"index.mjs":   `export const env = "DEFAULT_ENTRY";`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	ctx.args.conditions = parseConditionsQuery("", true)
+	_, _, err := ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ctx.Path(), "/X-") {
+		t.Fatalf("the worker build should have its own build path, got %s", ctx.Path())
+	}
+	code := readStoredFile(t, ctx.storage, ctx.getSavepath())
+	if !strings.Contains(string(code), "WORKER_ENTRY") {
+		t.Fatalf("the module should be built from the `worker` condition:\n%s", code)
+	}
+}
+
+func TestBuildWithDefine(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "define-pkg", map[string]string{
+		"package.json": `{"name": "define-pkg", "version": "1.0.0", "module": "index.mjs"}`,
+		"index.mjs": `
+			export const version = VERSION;
+			export const env = process.env.NODE_ENV;
+			export function feature() {
+				if (__FEATURE_X__) {
+					return "FEATURE_X_ENABLED";
+				}
+				return "FEATURE_X_DISABLED";
+			}
+		`,
+	})
+
+	define, err := parseDefineQuery(`__FEATURE_X__:false,VERSION:"1.2.3",process.env.NODE_ENV:"test"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	ctx.args.define = define
+	_, _, err = ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(ctx.Path(), "/X-") {
+		t.Fatalf("the build with defines should have its own build path, got %s", ctx.Path())
+	}
+	code := readStoredFile(t, ctx.storage, ctx.getSavepath())
+	if strings.Contains(string(code), "FEATURE_X_ENABLED") || !strings.Contains(string(code), "FEATURE_X_DISABLED") {
+		t.Fatalf("the disabled feature should be compiled out:\n%s", code)
+	}
+	if !strings.Contains(string(code), `"1.2.3"`) {
+		t.Fatalf("the VERSION should be defined:\n%s", code)
+	}
+	// the built-in defines can not be overridden
+	if strings.Contains(string(code), `"test"`) || !strings.Contains(string(code), `"production"`) {
+		t.Fatalf("the process.env.NODE_ENV should not be overridden:\n%s", code)
+	}
+}
+
+func TestBuildWithTsconfig(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "decorators-pkg", map[string]string{
+		"package.json": `{"name": "decorators-pkg", "version": "1.0.0", "module": "index.ts"}`,
+		"index.ts": `
+			function sealed(constructor: Function) {
+				Object.seal(constructor);
+			}
+			@sealed
+			export class Greeter {
+				greeting = "hello";
+			}
+		`,
+	})
+
+	for _, tc := range []struct {
+		query  string
+		legacy bool
+	}{
+		{"", false},
+		{btoaUrl(`{"compilerOptions":{"experimentalDecorators":true}}`), true},
+	} {
+		tsconfig, err := parseTsconfigQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.args.tsconfig = tsconfig
+		_, _, err = ctx.buildModule(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(ctx.Path(), "/X-") != tc.legacy {
+			t.Fatalf("unexpected build path %s", ctx.Path())
+		}
+		code := readStoredFile(t, ctx.storage, ctx.getSavepath())
+		// the standard decorators are lowered with the helpers that implement the `addInitializer` API
+		if strings.Contains(string(code), "addInitializer") == tc.legacy {
+			t.Fatalf("experimentalDecorators=%v: unexpected output:\n%s", tc.legacy, code)
+		}
+	}
+
+	for _, value := range []string{
+		btoaUrl(`{"paths":{"*":["/etc/*"]}}`),
+		btoaUrl(`{"compilerOptions":{"baseUrl":"/"}}`),
+		btoaUrl(`{"experimentalDecorators":"yes"}`),
+		btoaUrl(`{"jsxFactory":"alert(1)"}`),
+		"not-json",
+	} {
+		if _, err := parseTsconfigQuery(value); err == nil {
+			t.Fatalf("the tsconfig query %q should be rejected", value)
+		}
+	}
+}
+
+func TestBuildWithES5Target(t *testing.T) {
+	wd := t.TempDir()
+	cjsPkgJson := writeFixturePackage(t, wd, "es5-pkg", map[string]string{
+		"package.json": `{"name": "es5-pkg", "version": "1.0.0", "main": "index.js"}`,
+		"index.js": `"use strict";
+Object.defineProperty(exports, "__esModule", { value: true });
+exports.greet = function (name) { return "Hello, " + name; };
+`,
+	})
+	genPkgJson := writeFixturePackage(t, wd, "generator-pkg", map[string]string{
+		"package.json": `{"name": "generator-pkg", "version": "1.0.0", "module": "index.mjs"}`,
+		"index.mjs":    `export function* range(n) { for (var i = 0; i < n; i++) yield i; }`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, cjsPkgJson)
+	ctx.target = "es5"
+	_, code := buildFixture(t, ctx)
+	if !strings.Contains(string(code), "greet") || strings.Contains(string(code), "const ") {
+		t.Fatalf("the module should be built to es5:\n%s", code)
+	}
+
+	ctx = newFixtureBuildContext(t, wd, genPkgJson)
+	ctx.target = "es5"
+	_, _, err := ctx.buildModule(false)
+	if err == nil || err.Error() != errUnsupportedES5Syntax+": generator functions can not be downleveled to es5, please use a higher target like `?target=es2015`" {
+		t.Fatalf("should fail with the unsupported es5 syntax error, got %v", err)
+	}
+}
+
+func TestBuildWithESModuleInteropCJS(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "tsc-pkg", map[string]string{
+		"package.json": `{
+			"name": "tsc-pkg",
+			"version": "1.0.0",
+			"main": "./dist/index.js"
+		}`,
+		// compiled by `tsc --module commonjs`
+		"dist/index.js": `"use strict";
+Object.defineProperty(exports, "__esModule", { value: true });
+exports.greet = exports.VERSION = void 0;
+const util_1 = require("./util");
+exports.VERSION = "TSC_PKG_VERSION";
+function greet(name) {
+    return (0, util_1.format)(name);
+}
+exports.greet = greet;
+Object.defineProperty(exports, "format", { enumerable: true, get: function () { return util_1.format; } });
+exports.default = greet;
+`,
+		"dist/util.js": `"use strict";
+Object.defineProperty(exports, "__esModule", { value: true });
+exports.format = void 0;
+const format = (name) => "Hello, " + name;
+exports.format = format;
+`,
+		// re-exports all the exports of another module dynamically
+		"dist/star.js": `"use strict";
+var __exportStar = (this && this.__exportStar) || function(m, exports) {
+    for (var p in m) if (p !== "default" && !Object.prototype.hasOwnProperty.call(exports, p)) exports[p] = m[p];
+};
+Object.defineProperty(exports, "__esModule", { value: true });
+__exportStar(require("./util"), exports);
+`,
+	})
+
+	exports, ok := parseESModuleInteropExports(path.Join(wd, "node_modules", "tsc-pkg", "dist/index.js"))
+	if !ok || strings.Join(exports, ",") != "__esModule,greet,VERSION,format" {
+		t.Fatalf("unexpected exports: %v (ok=%v)", exports, ok)
+	}
+	if _, ok := parseESModuleInteropExports(path.Join(wd, "node_modules", "tsc-pkg", "dist/star.js")); ok {
+		t.Fatal("the dynamic re-exports should fall back to the lexer")
+	}
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	meta, _, err := ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.CJS || !meta.ExportDefault {
+		t.Fatalf("unexpected build meta: %+v", meta)
+	}
+	code := readStoredFile(t, ctx.storage, ctx.getSavepath())
+	for _, name := range []string{"greet", "VERSION", "format"} {
+		if !regexp.MustCompile(`export\s*\{[^}]*\b` + name + `\b`).Match(code) {
+			t.Fatalf("the named export %q is missing:\n%s", name, code)
+		}
+	}
+}
+
+func TestBuildWithMaxInputSize(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = DefaultConfig()
+	config.MaxBuildInputSize = 1024
+
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "huge-pkg", map[string]string{
+		"package.json": `{
+			"name": "huge-pkg",
+			"version": "1.0.0",
+			"module": "./index.mjs"
+		}`,
+		"index.mjs": `export { data } from "./data.mjs";`,
+		"data.mjs":  `export const data = "` + strings.Repeat("x", 2048) + `";`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	_, _, err := ctx.buildModule(false)
+	if err == nil || err.Error() != errBuildInputTooLarge+" 1024 bytes" {
+		t.Fatalf("the build should be rejected, got %v", err)
+	}
+
+	config.MaxBuildInputSize = 4096
+	_, _, err = ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildWithMissingMainFile(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "missing-main-pkg", map[string]string{
+		"package.json": `{
+			"name": "missing-main-pkg",
+			"version": "1.0.0",
+			"main": "./dist/index.js"
+		}`,
+		"index.js": `export const msg = "INDEX_JS_CONVENTION";`,
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	entry := ctx.resolveEntry(ctx.esm)
+	if entry.main != "./index.js" {
+		t.Fatalf("the entry should fall back to the `index.js` convention, got %+v", entry)
+	}
+	_, code := buildFixture(t, ctx)
+	if !strings.Contains(string(code), "INDEX_JS_CONVENTION") {
+		t.Fatalf("the module should be built from the `index.js`:\n%s", code)
+	}
+}
+
+func TestBuildWithNoEntryPoint(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "no-entry-pkg", map[string]string{
+		"package.json": `{
+			"name": "no-entry-pkg",
+			"version": "1.0.0"
+		}`,
+		"README.md": "# no-entry-pkg",
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	_, _, err := ctx.buildModule(false)
+	if err == nil || err.Error() != "package has no entry point" {
+		t.Fatalf("expected the 'package has no entry point' error, got %v", err)
+	}
+}
+
+func TestBuildWithExternalPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern   string
+		specifier string
+		match     bool
+	}{
+		{"@org/**", "@org/ui", true},
+		{"@org/**", "@org/ui/forms/input", true},
+		{"@org/**", "@orgx/ui", false},
+		{"@org/ui/**", "@org/ui", true},
+		{"@org/ui/**", "@org/ui/button", true},
+		{"@org/ui/**", "@org/uikit", false},
+		{"@org/ui", "@org/ui", false},
+	} {
+		if matchExternalPattern(tc.pattern, tc.specifier) != tc.match {
+			t.Fatalf("matchExternalPattern(%q, %q) should be %v", tc.pattern, tc.specifier, tc.match)
+		}
+	}
+
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "app-pkg", map[string]string{
+		"package.json": `{
+			"name": "app-pkg",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"dependencies": {
+				"@org/ui": "^1.0.0"
+			}
+		}`,
+		"index.js": `export { ui } from "@org/ui"; export { button } from "@org/ui/button"; export { input } from "@org/ui/forms/input";`,
+	})
+	writeFixturePackage(t, wd, "@org/ui", map[string]string{
+		"package.json": `{
+			"name": "@org/ui",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js":             `export const ui = "ORG_UI";`,
+		"button/index.js":      `export const button = "ORG_UI_BUTTON";`,
+		"forms/input/index.js": `export const input = "ORG_UI_INPUT";`,
+	})
+
+	args := BuildArgs{external: *set.NewReadOnly("@org/**")}
+	err := resolveBuildArgs(DefaultNpmRC(), wd, &args, EsmPath{PkgName: "app-pkg", PkgVersion: "1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !args.external.Has("@org/**") {
+		t.Fatal("the pattern that matches the dependencies should be kept")
+	}
+	decoded, err := decodeBuildArgs(encodeBuildArgs(args, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.external.Has("@org/**") {
+		t.Fatal("the pattern should be encoded in the build id")
+	}
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	ctx.bundleMode = BundleDeps
+	ctx.args = args
+	_, code := buildFixture(t, ctx)
+	for _, specifier := range []string{`"@org/ui"`, `"@org/ui/button"`, `"@org/ui/forms/input"`} {
+		if !strings.Contains(string(code), specifier) {
+			t.Fatalf("the import %s should be external:\n%s", specifier, code)
+		}
+	}
+	if strings.Contains(string(code), "ORG_UI") {
+		t.Fatalf("the external modules should not be bundled:\n%s", code)
+	}
+}
+
+func TestBuildWithWebAPIPolyfill(t *testing.T) {
+	_, err := npm_replacements.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "fetch-pkg", map[string]string{
+		"package.json": `{
+			"name": "fetch-pkg",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"dependencies": {"node-fetch": "^2.7.0", "abort-controller": "^3.0.0"}
+		}`,
+		"index.js": `import fetch from "node-fetch"; import AbortController from "abort-controller"; export const get = (url) => fetch(url, { signal: new AbortController().signal });`,
+	})
+
+	build := func(target string) string {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.target = target
+		_, code := buildFixture(t, ctx)
+		return string(code)
+	}
+
+	// the native `fetch` and `AbortController` are used for the modern targets
+	code := build("es2022")
+	if strings.Contains(code, "node-fetch") || strings.Contains(code, "cross-fetch") || strings.Contains(code, "/abort-controller@") {
+		t.Fatalf("the npm replacements should be used for es2022: %s", code)
+	}
+
+	// the polyfill packages are imported for the targets that predate the Web APIs
+	code = build("es2015")
+	if !strings.Contains(code, `"/cross-fetch@4?target=es2015"`) || !strings.Contains(code, `"/abortcontroller-polyfill@1/dist/cjs-ponyfill?target=es2015"`) {
+		t.Fatalf("the polyfill packages should be imported for es2015: %s", code)
+	}
+	if strings.Contains(code, "node-fetch") {
+		t.Fatalf("node-fetch should be replaced with cross-fetch for es2015: %s", code)
+	}
+}
+
+func TestBuildWithConditionNotMatched(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "no-server-pkg", map[string]string{
+		"package.json": `{
+			"name": "no-server-pkg",
+			"version": "1.0.0",
+			"exports": {
+				".": {
+					"import": {
+						"browser": "./dist/browser.mjs",
+						"default": "./dist/index.mjs"
+					},
+					"require": "./dist/index.cjs"
+				},
+				"./server": {
+					"react-server": "./dist/server.mjs"
+				}
+			}
+		}`,
+		"dist/browser.mjs": `export const kind = "BROWSER";`,
+		"dist/index.mjs":   `export const kind = "DEFAULT";`,
+		"dist/index.cjs":   `exports.kind = "CJS";`,
+		"dist/server.mjs":  `export const kind = "SERVER";`,
+	})
+
+	// only the conditions of the `.` export are matched
+	if matchExportConditions(pkgJson, []string{"react-server"}) {
+		t.Fatal("the `react-server` condition should not match the `.` export")
+	}
+	if !matchExportConditions(pkgJson, []string{"react-server", "browser"}) {
+		t.Fatal("the nested `browser` condition should match the `.` export")
+	}
+	if !matchExportConditions(&PackageJSON{Name: "no-exports-pkg"}, []string{"react-server"}) {
+		t.Fatal("the package without exports should always match")
+	}
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	ctx.target = "node"
+	ctx.args.conditions = []string{"react-server"}
+	// falls back to the default conditions
+	entry := ctx.resolveEntry(ctx.esm)
+	if entry.main != "./dist/index.mjs" || !entry.module {
+		t.Fatalf("unexpected entry: %+v", entry)
+	}
+	_, code := buildFixture(t, ctx)
+	if !strings.Contains(string(code), "DEFAULT") {
+		t.Fatalf("the module should be built from the default condition:\n%s", code)
+	}
+}
+
+func TestBuildWithJSON5(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "json5-pkg", map[string]string{
+		"package.json": `{
+			"name": "json5-pkg",
+			"version": "1.0.0",
+			"main": "./index.mjs"
+		}`,
+		"index.mjs": `import data from "./data.json5"; export const name = data.name;`,
+		"data.json5": `{
+			// the package name
+			name: 'json5-pkg',
+			tags: ['a', 'b',],
+		}`,
+		"config.jsonc": `{
+			/* the config */
+			"port": 8080, // the port
+			"debug": true,
+		}`,
+	})
+
+	build := func(subPath string) string {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.esm.SubPath = subPath
+		ctx.esm.SubModuleName = subPath
+		_, code := buildFixture(t, ctx)
+		return string(code)
+	}
+
+	// the JSONC file is exported as a module with the default and named exports
+	code := build("config.jsonc")
+	if !strings.Contains(code, "8080") || !strings.Contains(code, " as default") || !strings.Contains(code, "port") || !strings.Contains(code, "debug") {
+		t.Fatalf("unexpected config.jsonc module:\n%s", code)
+	}
+	if strings.Contains(code, "the port") {
+		t.Fatalf("the comments should be removed:\n%s", code)
+	}
+
+	// the JSON5 file imported by a module is bundled
+	code = build("")
+	if !strings.Contains(code, "json5-pkg") || strings.Contains(code, "the package name") {
+		t.Fatalf("the data.json5 should be bundled:\n%s", code)
+	}
+}
+
+func TestBuildWithWarnings(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "warn-pkg", map[string]string{
+		"package.json": `{
+			"name": "warn-pkg",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js":  `import "./style.css"; export const button = "button";`,
+		"style.css": ".button {\n  colr: red;\n}",
+	})
+
+	ctx := newFixtureBuildContext(t, wd, pkgJson)
+	meta, _, err := ctx.buildModule(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Warnings) != 1 || meta.Warnings[0] != `warn-pkg/style.css:2: "colr" is not a known CSS property` {
+		t.Fatalf("unexpected warnings %q", meta.Warnings)
+	}
+
+	decoded, err := decodeBuildMeta(encodeBuildMeta(meta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Warnings) != 1 || decoded.Warnings[0] != meta.Warnings[0] {
+		t.Fatalf("the warnings should be kept in the build meta, got %q", decoded.Warnings)
+	}
+}
+
+func TestBuildWithNestedCSS(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "nested-css-pkg", map[string]string{
+		"package.json": `{
+			"name": "nested-css-pkg",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js":  `import "./style.css"; export const card = "card";`,
+		"style.css": ".card {\n  color: red;\n\n  & .title {\n    color: blue;\n  }\n}\n",
+	})
+
+	for target, want := range map[string]string{
+		"es2020": ".card{color:red}.card .title{color:#00f}",
+		"esnext": ".card{color:red;.title{color:#00f}}",
+	} {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.target = target
+		meta, _, err := ctx.buildModule(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !meta.CSSInJS {
+			t.Fatal("the build should have CSS")
+		}
+		savePath := ctx.getSavepath()
+		if !strings.Contains(savePath, "/"+target+"/") {
+			t.Fatalf("the target should be encoded in the save path: %s", savePath)
+		}
+		css := readStoredFile(t, ctx.storage, strings.TrimSuffix(savePath, ".mjs")+".css")
+		if got := strings.TrimSpace(string(css)); !strings.Contains(got, want) {
+			t.Fatalf("unexpected CSS of the %s target: %s", target, got)
+		}
+	}
+}
+
+func TestBuildWithImportMetaURL(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "asset-pkg", map[string]string{
+		"package.json": `{
+			"name": "asset-pkg",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js": `export const logoUrl = new URL("./logo.svg", import.meta.url).href;`,
+		"logo.svg": `<svg xmlns="http://www.w3.org/2000/svg"></svg>`,
+	})
+
+	build := func(target string) (*BuildContext, string) {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.target = target
+		_, code := buildFixture(t, ctx)
+		return ctx, string(code)
+	}
+
+	// the `import.meta.url` is kept for the targets that support `import.meta`
+	for _, target := range []string{"es2020", "es2022", "esnext", "node", "denonext"} {
+		_, code := build(target)
+		if !strings.Contains(code, "import.meta.url") || strings.Contains(code, "{ESM_CDN_ORIGIN}") {
+			t.Fatalf("the `import.meta.url` should be kept for the %s target:\n%s", target, code)
+		}
+	}
+
+	// the `import.meta.url` is replaced with the module url for the legacy targets
+	for _, target := range []string{"es2015", "es2019"} {
+		ctx, code := build(target)
+		if strings.Contains(code, "import.meta") || !strings.Contains(code, `"{ESM_CDN_ORIGIN}`+ctx.Path()+`"`) {
+			t.Fatalf("the `import.meta.url` should be replaced with the module url for the %s target:\n%s", target, code)
+		}
+	}
+}
+
+func TestBuildTargetUpgradeForImportMeta(t *testing.T) {
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "meta-pkg", map[string]string{
+		"package.json": `{
+			"name": "meta-pkg",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js": `export const mode = import.meta.env?.MODE; export const resolve = (s) => import.meta.resolve(s);`,
+	})
+
+	for _, target := range []string{"es2015", "es2022"} {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.target = target
+		meta, code := buildFixture(t, ctx)
+		if !strings.Contains(string(code), "import.meta.resolve(") {
+			t.Fatalf("the `import.meta` should be kept for the %s target:\n%s", target, code)
+		}
+		if target == "es2015" {
+			if meta.TargetUpgraded != "es2020" {
+				t.Fatalf("the es2015 target should be upgraded to es2020, got %q", meta.TargetUpgraded)
+			}
+			if !strings.HasPrefix(ctx.Path(), "/meta-pkg@1.0.0/es2015/") {
+				t.Fatalf("the build path should keep the requested target, got %s", ctx.Path())
+			}
+			decoded, err := decodeBuildMeta(encodeBuildMeta(meta))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decoded.TargetUpgraded != "es2020" {
+				t.Fatal("the upgraded target should be kept in the build meta")
+			}
+		} else if meta.TargetUpgraded != "" {
+			t.Fatalf("the %s target should not be upgraded", target)
+		}
+	}
+}
+
+func TestBuildTargetUpgradeForBrowserslist(t *testing.T) {
+	for _, tc := range []struct {
+		browserslist []string
+		target       string
+	}{
+		{[]string{"chrome >= 80", "firefox >= 80", "safari >= 14.1", "edge >= 80"}, "es2020"},
+		{[]string{"chrome >= 94, firefox >= 93", "not dead"}, "es2022"},
+		{[]string{"chrome 64 or safari > 12"}, "es2018"},
+		{[]string{"ios_saf >= 10.3"}, "es2016"},
+		{[]string{"defaults"}, ""},
+		{[]string{"> 0.5%", "chrome >= 80"}, ""},
+		{[]string{"ie 11"}, ""},
+		{nil, ""},
+	} {
+		if target := getBrowserslistTarget(tc.browserslist); target != tc.target {
+			t.Fatalf("getBrowserslistTarget(%v): expected %q, got %q", tc.browserslist, tc.target, target)
+		}
+	}
+
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "modern-pkg", map[string]string{
+		"package.json": `{
+			"name": "modern-pkg",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"browserslist": {
+				"production": ["chrome >= 91", "firefox >= 90", "safari >= 15"],
+				"development": ["last 1 chrome version"]
+			}
+		}`,
+		"index.js": `export const get = (o) => o?.a ?? 1;`,
+	})
+	if !reflect.DeepEqual(pkgJson.Browserslist, []string{"chrome >= 91", "firefox >= 90", "safari >= 15"}) {
+		t.Fatalf("unexpected browserslist %v", pkgJson.Browserslist)
+	}
+
+	for _, tc := range []struct {
+		target   string
+		upgraded string
+	}{
+		{"es2015", "es2021"},
+		{"es2022", ""},
+		{"esnext", ""},
+	} {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.target = tc.target
+		meta, _, err := ctx.buildModule(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.TargetUpgraded != tc.upgraded {
+			t.Fatalf("%s: expected the upgraded target %q, got %q", tc.target, tc.upgraded, meta.TargetUpgraded)
+		}
+		code := readStoredFile(t, ctx.storage, ctx.getSavepath())
+		// the optional chaining and nullish coalescing of es2020 are not lowered
+		if !strings.Contains(string(code), "?.") || !strings.Contains(string(code), "??") {
+			t.Fatalf("%s: the es2020 syntax should be kept:\n%s", tc.target, code)
+		}
+	}
+}
+
+func TestBuildWithDevMode(t *testing.T) {
+	minify := config.Minify
+	config.Minify = true
+	defer func() { config.Minify = minify }()
+
+	wd := t.TempDir()
+	pkgJson := writeFixturePackage(t, wd, "dev-app", map[string]string{
+		"package.json": `{
+			"name": "dev-app",
+			"version": "1.0.0",
+			"module": "./index.js",
+			"dependencies": {
+				"dev-dep": "1.0.0"
+			}
+		}`,
+		"index.js": `import { formatMessage } from "dev-dep";
+export function renderGreeting(userName) {
+  const greetingMessage = formatMessage("hello", userName);
+  return greetingMessage;
+}`,
+	})
+	depPkgJson := writeFixturePackage(t, wd, "dev-dep", map[string]string{
+		"package.json": `{
+			"name": "dev-dep",
+			"version": "1.0.0",
+			"module": "./index.js"
+		}`,
+		"index.js": `export function formatMessage(messageText, userName) {
+  const formattedMessage = messageText + ", " + userName;
+  return formattedMessage;
+}`,
+	})
+
+	build := func(pkgJson *PackageJSON) string {
+		ctx := newFixtureBuildContext(t, wd, pkgJson)
+		ctx.dev = true
+		_, code := buildFixture(t, ctx)
+		return string(code)
+	}
+
+	code := build(pkgJson)
+	if !strings.Contains(code, "const greetingMessage = formatMessage(\"hello\", userName);") {
+		t.Fatalf("the build should not be minified in dev mode:\n%s", code)
+	}
+	// the dependency is imported in dev mode too
+	if !strings.Contains(code, "/dev-dep@1.0.0/es2022/dev-dep.development.mjs") {
+		t.Fatalf("the dependency should be imported in dev mode:\n%s", code)
+	}
+
+	code = build(depPkgJson)
+	if !strings.Contains(code, "const formattedMessage = messageText + \", \" + userName;") {
+		t.Fatalf("the build of the dependency should not be minified in dev mode:\n%s", code)
+	}
+}
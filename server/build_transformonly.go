@@ -3,9 +3,14 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
 	"strings"
 
 	"github.com/esm-dev/esm.sh/server/common"
+	"github.com/esm-dev/esm.sh/server/storage"
 	esbuild "github.com/evanw/esbuild/pkg/api"
 	"github.com/ije/gox/utils"
 )
@@ -19,17 +24,66 @@ type TransformOptions struct {
 	Target          string          `json:"target"`
 	SourceMap       string          `json:"sourceMap"`
 	Minify          bool            `json:"minify"`
+	Conditions      []string        `json:"conditions"`
 }
 
 type ResolvedTransformOptions struct {
 	TransformOptions
 	importMap     common.ImportMap
 	globalVersion string
+	// safe mode rejects the unsafe import map targets and strips the `node:` imports
+	safe bool
 }
 
 type TransformOutput struct {
-	Code string `json:"code"`
-	Map  string `json:"map"`
+	Code     string            `json:"code"`
+	Map      string            `json:"map"`
+	Rejected []string          `json:"rejected,omitempty"`
+	Imports  map[string]string `json:"imports,omitempty"`
+	// bare import specifiers that are not resolved by the import map
+	bareImports []string
+}
+
+// getTransformOutput reads the cached output of the `/transform` API from the storage, the source map,
+// the rejected imports of the `?safe` mode and the resolved imports are stored beside the code.
+func getTransformOutput(buildStorage storage.Storage, savePath string) (output *TransformOutput, err error) {
+	file, _, err := buildStorage.Get(savePath)
+	if err != nil {
+		return
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, errors.New("failed to read code")
+	}
+	output = &TransformOutput{
+		Code: string(data),
+	}
+	file, _, err = buildStorage.Get(savePath + ".map")
+	if err == nil {
+		data, err = io.ReadAll(file)
+		file.Close()
+		if err == nil {
+			output.Map = string(data)
+		}
+	}
+	file, _, err = buildStorage.Get(savePath + ".rejected")
+	if err == nil {
+		data, err = io.ReadAll(file)
+		file.Close()
+		if err == nil {
+			output.Rejected = strings.Split(string(data), "\n")
+		}
+	}
+	file, _, err = buildStorage.Get(savePath + ".imports")
+	if err == nil {
+		err = json.NewDecoder(file).Decode(&output.Imports)
+		file.Close()
+		if err != nil {
+			return nil, errors.New("failed to read imports")
+		}
+	}
+	return output, nil
 }
 
 func transform(options *ResolvedTransformOptions) (out *TransformOutput, err error) {
@@ -81,6 +135,12 @@ func transform(options *ResolvedTransformOptions) (out *TransformOutput, err err
 		}
 	}
 
+	var rejected []string
+	var bareImports []string
+	if options.safe {
+		rejected = sanitizeImportMap(&options.importMap)
+	}
+
 	sourceMap := esbuild.SourceMapNone
 	if options.SourceMap == "external" {
 		sourceMap = esbuild.SourceMapExternal
@@ -116,9 +176,21 @@ func transform(options *ResolvedTransformOptions) (out *TransformOutput, err err
 				Name: "resolver",
 				Setup: func(build esbuild.PluginBuild) {
 					build.OnResolve(esbuild.OnResolveOptions{Filter: ".*"}, func(args esbuild.OnResolveArgs) (esbuild.OnResolveResult, error) {
-						path, _ := options.importMap.Resolve(args.Path)
+						path, resolved := options.importMap.Resolve(args.Path)
+						if !resolved && isBareImportSpecifier(path) && !stringInSlice(bareImports, path) {
+							bareImports = append(bareImports, path)
+						}
+						if options.safe && (strings.HasPrefix(path, "node:") || strings.HasPrefix(path, "file:")) {
+							rejected = append(rejected, args.Path)
+							return esbuild.OnResolveResult{Path: args.Path, Namespace: "rejected"}, nil
+						}
 						return esbuild.OnResolveResult{Path: path, External: true}, nil
 					})
+					// replace the rejected imports with empty modules
+					build.OnLoad(esbuild.OnLoadOptions{Filter: ".*", Namespace: "rejected"}, func(args esbuild.OnLoadArgs) (esbuild.OnLoadResult, error) {
+						contents := ""
+						return esbuild.OnLoadResult{Contents: &contents, Loader: esbuild.LoaderEmpty}, nil
+					})
 				},
 			},
 		},
@@ -132,7 +204,11 @@ func transform(options *ResolvedTransformOptions) (out *TransformOutput, err err
 		err = errors.New("failed to validate code: no output files")
 		return
 	}
-	out = &TransformOutput{}
+	out = &TransformOutput{bareImports: bareImports}
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		out.Rejected = rejected
+	}
 	for _, file := range ret.OutputFiles {
 		if strings.HasSuffix(file.Path, ".js") || strings.HasSuffix(file.Path, ".css") {
 			out.Code = string(file.Contents)
@@ -142,3 +218,66 @@ func transform(options *ResolvedTransformOptions) (out *TransformOutput, err err
 	}
 	return
 }
+
+// sanitizeImportMap removes the import map targets that are not http(s) URLs or absolute paths,
+// and returns the specifiers of the removed targets.
+func sanitizeImportMap(importMap *common.ImportMap) (rejected []string) {
+	if importMap.Src != "" && !isSafeImportMapTarget(importMap.Src, false) {
+		rejected = append(rejected, "$src")
+		importMap.Src = ""
+	}
+	// the relative targets are resolved by the `$src` url
+	allowRelative := importMap.Src != ""
+	for specifier, target := range importMap.Imports {
+		if !isSafeImportMapTarget(target, allowRelative) {
+			rejected = append(rejected, specifier)
+			delete(importMap.Imports, specifier)
+		}
+	}
+	for scope, imports := range importMap.Scopes {
+		for specifier, target := range imports {
+			if !isSafeImportMapTarget(target, allowRelative) {
+				rejected = append(rejected, scope+":"+specifier)
+				delete(imports, specifier)
+			}
+		}
+	}
+	return
+}
+
+func isSafeImportMapTarget(target string, allowRelative bool) bool {
+	if strings.HasPrefix(target, "https://") || strings.HasPrefix(target, "http://") {
+		u, err := url.Parse(target)
+		return err == nil && u.Host != ""
+	}
+	if strings.HasPrefix(target, "/") && !strings.HasPrefix(target, "//") {
+		pathname, _ := utils.SplitByFirstByte(target, '?')
+		return !stringInSlice(strings.Split(pathname, "/"), "..")
+	}
+	if allowRelative && strings.HasPrefix(target, "./") {
+		pathname, _ := utils.SplitByFirstByte(target, '?')
+		return !stringInSlice(strings.Split(pathname, "/"), "..")
+	}
+	return false
+}
+
+func isBareImportSpecifier(specifier string) bool {
+	return specifier != "" && !isRelPathSpecifier(specifier) && !strings.HasPrefix(specifier, "/") && !strings.ContainsRune(specifier, ':')
+}
+
+// resolveTransformImports resolves the bare import specifiers to the esm.sh urls with exact versions.
+func resolveTransformImports(npmrc *NpmRC, origin string, specifiers []string, target string, conditions []string) (imports map[string]string, err error) {
+	query := "?target=" + target
+	if len(conditions) > 0 {
+		query += "&conditions=" + strings.Join(conditions, ",")
+	}
+	imports = make(map[string]string, len(specifiers))
+	for _, specifier := range specifiers {
+		esm, _, _, _, err := praseEsmPath(npmrc, "/"+specifier)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve %q: %v", specifier, err)
+		}
+		imports[specifier] = origin + "/" + esm.Specifier() + query
+	}
+	return
+}
@@ -10,12 +10,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ije/gox/set"
@@ -42,6 +43,10 @@ var cjsModuleLexerIgnoredPackages = set.New[string](
 	"web-streams-ponyfill",
 )
 
+// limits the number of concurrent cjs-module-lexer processes, see `cjsLexerConcurrency` config
+var cjsModuleLexerQueue chan struct{}
+var cjsModuleLexerQueueOnce sync.Once
+
 type cjsModuleLexerResult struct {
 	Exports  []string `json:"exports,omitempty"`
 	Reexport string   `json:"reexport,omitempty"`
@@ -72,6 +77,12 @@ func cjsModuleLexer(ctx *BuildContext, cjsEntry string) (ret cjsModuleLexerResul
 		}
 	}()
 
+	// fast path for the transpiled-ESM modules, no need to spawn the lexer process
+	if exports, ok := parseESModuleInteropExports(path.Join(ctx.wd, "node_modules", ctx.esm.PkgName, cjsEntry)); ok {
+		ret.Exports = exports
+		return
+	}
+
 	if cjsModuleLexerIgnoredPackages.Has(ctx.esm.PkgName) {
 		js := path.Join(ctx.wd, "reveal_"+strings.ReplaceAll(cjsEntry[2:], "/", "_"))
 		err = os.WriteFile(js, []byte(fmt.Sprintf(`console.log(JSON.stringify(Object.keys((await import("npm:%s")).default)))`, path.Join(ctx.esm.Name(), cjsEntry))), 0644)
@@ -99,6 +110,12 @@ func cjsModuleLexer(ctx *BuildContext, cjsEntry string) (ret cjsModuleLexerResul
 	worthToRetry := true
 RETRY:
 
+	// acquire a slot of the queue before starting the timeout, the time waiting in the queue is not counted
+	cjsModuleLexerQueueOnce.Do(func() {
+		cjsModuleLexerQueue = make(chan struct{}, config.CjsLexerConcurrency)
+	})
+	cjsModuleLexerQueue <- struct{}{}
+
 	c, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -113,6 +130,7 @@ RETRY:
 	cmd.Env = append(os.Environ(), "NODE_ENV="+ctx.getNodeEnv())
 
 	err = cmd.Run()
+	<-cjsModuleLexerQueue
 	if err != nil {
 		if stderr.Len() > 0 {
 			msg := stderr.String()
@@ -168,16 +186,23 @@ func installCommonJSModuleLexer() (err error) {
 		return
 	}
 
-	url, err := getCommonJSModuleLexerDownloadURL()
+	downloadUrl, err := getCommonJSModuleLexerDownloadURL()
 	if err != nil {
 		return
 	}
 
 	if DEBUG {
-		fmt.Println(term.Dim(fmt.Sprintf("Downloading %s...", path.Base(url))))
+		fmt.Println(term.Dim(fmt.Sprintf("Downloading %s...", path.Base(downloadUrl))))
 	}
 
-	res, err := http.Get(url)
+	u, err := url.Parse(downloadUrl)
+	if err != nil {
+		return
+	}
+	fetchClient, recycle := NewFetchClient(300, config.UserAgent, false)
+	defer recycle()
+
+	res, err := fetchClient.Fetch(u, nil)
 	if err != nil {
 		return
 	}
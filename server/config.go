@@ -23,33 +23,60 @@ var (
 
 // Config represents the configuration of esm.sh server.
 type Config struct {
-	Port                uint16                 `json:"port"`
-	TlsPort             uint16                 `json:"tlsPort"`
-	LegacyServer        string                 `json:"legacyServer"` // normally you don't need to set this
-	CustomLandingPage   LandingPageOptions     `json:"customLandingPage"`
-	WorkDir             string                 `json:"workDir"`
-	CorsAllowOrigins    []string               `json:"corsAllowOrigins"`
-	AllowList           AllowList              `json:"allowList"`
-	BanList             BanList                `json:"banList"`
-	BuildConcurrency    uint16                 `json:"buildConcurrency"`
-	BuildWaitTime       uint16                 `json:"buildWaitTime"`
-	Storage             storage.StorageOptions `json:"storage"`
-	CacheRawFile        bool                   `json:"cacheRawFile"`
-	LogDir              string                 `json:"logDir"`
-	LogLevel            string                 `json:"logLevel"`
-	AccessLog           bool                   `json:"accessLog"`
-	NpmRegistry         string                 `json:"npmRegistry"`
-	NpmToken            string                 `json:"npmToken"`
-	NpmUser             string                 `json:"npmUser"`
-	NpmPassword         string                 `json:"npmPassword"`
-	NpmScopedRegistries map[string]NpmRegistry `json:"npmScopedRegistries"`
-	NpmQueryCacheTTL    uint32                 `json:"npmQueryCacheTTL"`
-	MinifyRaw           json.RawMessage        `json:"minify"`
-	SourceMapRaw        json.RawMessage        `json:"sourceMap"`
-	CompressRaw         json.RawMessage        `json:"compress"`
-	Minify              bool                   `json:"-"`
-	SourceMap           bool                   `json:"-"`
-	Compress            bool                   `json:"-"`
+	Port                      uint16                 `json:"port"`
+	TlsPort                   uint16                 `json:"tlsPort"`
+	LegacyServer              string                 `json:"legacyServer"` // normally you don't need to set this
+	CustomLandingPage         LandingPageOptions     `json:"customLandingPage"`
+	WorkDir                   string                 `json:"workDir"`
+	CorsAllowOrigins          []string               `json:"corsAllowOrigins"`
+	TimingAllowOrigin         string                 `json:"timingAllowOrigin"`
+	CrossOriginResourcePolicy string                 `json:"crossOriginResourcePolicy"`
+	TrustForwarded            bool                   `json:"trustForwardedHeaders"`
+	AllowList                 AllowList              `json:"allowList"`
+	BanList                   BanList                `json:"banList"`
+	DenyImports               []string               `json:"denyImports"`
+	DenoUserAgents            []string               `json:"denoUserAgents"`
+	PackageAliases            map[string]string      `json:"packageAliases"`
+	TarballHosts              []string               `json:"tarballHosts"`
+	DisableIgnoreExports      bool                   `json:"disableIgnoreExports"`
+	BuildConcurrency          uint16                 `json:"buildConcurrency"`
+	BuildWaitTime             uint16                 `json:"buildWaitTime"`
+	CjsLexerConcurrency       uint16                 `json:"cjsLexerConcurrency"`
+	BundlePackages            []string               `json:"bundlePackages"`
+	Storage                   storage.StorageOptions `json:"storage"`
+	CacheRawFile              bool                   `json:"cacheRawFile"`
+	GC                        GCOptions              `json:"gc"`
+	LogDir                    string                 `json:"logDir"`
+	LogLevel                  string                 `json:"logLevel"`
+	AccessLog                 bool                   `json:"accessLog"`
+	NpmRegistry               string                 `json:"npmRegistry"`
+	NpmToken                  string                 `json:"npmToken"`
+	NpmUser                   string                 `json:"npmUser"`
+	NpmPassword               string                 `json:"npmPassword"`
+	NpmScopedRegistries       map[string]NpmRegistry `json:"npmScopedRegistries"`
+	NpmQueryCacheTTL          uint32                 `json:"npmQueryCacheTTL"`
+	InstallRetries            uint16                 `json:"installRetries"`
+	FloatCacheTTL             uint32                 `json:"floatCacheTTL"`
+	UserAgent                 string                 `json:"userAgent"`
+	MaxQueryListLength        uint16                 `json:"maxQueryListLength"`
+	MaxEntryImports           uint16                 `json:"maxEntryImports"`
+	MaxBuildInputSize         uint32                 `json:"maxBuildInputSize"`
+	MinifyRaw                 json.RawMessage        `json:"minify"`
+	SourceMapRaw              json.RawMessage        `json:"sourceMap"`
+	CompressRaw               json.RawMessage        `json:"compress"`
+	Minify                    bool                   `json:"-"`
+	SourceMap                 bool                   `json:"-"`
+	Compress                  bool                   `json:"-"`
+}
+
+// GCOptions is the options of the garbage collector that removes the stale build artifacts of the storage
+type GCOptions struct {
+	// the interval of the GC runs in seconds, the GC is disabled if it's zero
+	Interval uint32 `json:"interval"`
+	// the build artifacts that have not been accessed within the retention period (in seconds) are removed
+	Retention uint32 `json:"retention"`
+	// the packages whose build artifacts are never removed
+	Pinned []string `json:"pinned"`
 }
 
 type LandingPageOptions struct {
@@ -70,6 +97,9 @@ type BanScope struct {
 type AllowList struct {
 	Packages []string     `json:"packages"`
 	Scopes   []AllowScope `json:"scopes"`
+	// the packages that are not allowed are treated as non-existent, and the builds
+	// fail if they import the dependencies that are not allowed
+	Strict bool `json:"strict"`
 }
 
 type AllowScope struct {
@@ -136,6 +166,32 @@ func normalizeConfig(config *Config) {
 			}
 		}
 	}
+	if config.TimingAllowOrigin == "" {
+		config.TimingAllowOrigin = os.Getenv("TIMING_ALLOW_ORIGIN")
+		if config.TimingAllowOrigin == "" {
+			config.TimingAllowOrigin = "*"
+		}
+	}
+	if config.TimingAllowOrigin == "none" {
+		config.TimingAllowOrigin = ""
+	}
+	if config.CrossOriginResourcePolicy == "" {
+		config.CrossOriginResourcePolicy = os.Getenv("CROSS_ORIGIN_RESOURCE_POLICY")
+		if config.CrossOriginResourcePolicy == "" {
+			config.CrossOriginResourcePolicy = "cross-origin"
+		}
+	}
+	switch config.CrossOriginResourcePolicy {
+	case "cross-origin", "same-site", "same-origin":
+	case "none":
+		config.CrossOriginResourcePolicy = ""
+	default:
+		fmt.Println(term.Red("[error] invalid crossOriginResourcePolicy: " + config.CrossOriginResourcePolicy))
+		config.CrossOriginResourcePolicy = "cross-origin"
+	}
+	if !config.TrustForwarded {
+		config.TrustForwarded = os.Getenv("TRUST_FORWARDED_HEADERS") == "true"
+	}
 	if config.CustomLandingPage.Origin == "" {
 		v := os.Getenv("CUSTOM_LANDING_PAGE_ORIGIN")
 		if v != "" {
@@ -163,9 +219,77 @@ func normalizeConfig(config *Config) {
 	if config.BuildConcurrency == 0 {
 		config.BuildConcurrency = uint16(runtime.NumCPU())
 	}
+	if config.CjsLexerConcurrency == 0 {
+		config.CjsLexerConcurrency = uint16(runtime.NumCPU())
+	}
 	if config.BuildWaitTime == 0 {
 		config.BuildWaitTime = 30 // seconds
 	}
+	if len(config.BundlePackages) == 0 {
+		if v := os.Getenv("BUNDLE_PACKAGES"); v != "" {
+			for _, p := range strings.Split(v, ",") {
+				name := strings.TrimSpace(p)
+				if name != "" {
+					config.BundlePackages = append(config.BundlePackages, name)
+				}
+			}
+		}
+	}
+	if len(config.DenyImports) == 0 {
+		if v := os.Getenv("DENY_IMPORTS"); v != "" {
+			for _, p := range strings.Split(v, ",") {
+				specifier := strings.TrimSpace(p)
+				if specifier != "" {
+					config.DenyImports = append(config.DenyImports, specifier)
+				}
+			}
+		}
+	}
+	if len(config.DenoUserAgents) == 0 {
+		if v := os.Getenv("DENO_USER_AGENTS"); v != "" {
+			for _, p := range strings.Split(v, ",") {
+				ua := strings.TrimSpace(p)
+				if ua != "" {
+					config.DenoUserAgents = append(config.DenoUserAgents, ua)
+				}
+			}
+		}
+	}
+	if len(config.PackageAliases) == 0 {
+		if v := os.Getenv("PACKAGE_ALIASES"); v != "" {
+			config.PackageAliases = map[string]string{}
+			for _, p := range strings.Split(v, ",") {
+				name, to, _ := strings.Cut(strings.TrimSpace(p), ":")
+				if name != "" && to != "" {
+					config.PackageAliases[strings.TrimSpace(name)] = strings.TrimSpace(to)
+				}
+			}
+		}
+	}
+	if len(config.PackageAliases) > 0 {
+		aliases := make(map[string]string)
+		for name, to := range config.PackageAliases {
+			if validatePackageAlias(name, to) {
+				aliases[name] = to
+			} else {
+				fmt.Printf("[error] invalid package alias %s: %s\n", name, to)
+			}
+		}
+		config.PackageAliases = aliases
+	}
+	if len(config.TarballHosts) == 0 {
+		if v := os.Getenv("TARBALL_HOSTS"); v != "" {
+			for _, p := range strings.Split(v, ",") {
+				host := strings.TrimSpace(p)
+				if host != "" {
+					config.TarballHosts = append(config.TarballHosts, host)
+				}
+			}
+		}
+	}
+	if !config.DisableIgnoreExports {
+		config.DisableIgnoreExports = os.Getenv("DISABLE_IGNORE_EXPORTS") == "true"
+	}
 	if config.Storage.Type == "" {
 		storageType := os.Getenv("STORAGE_TYPE")
 		if storageType == "" {
@@ -189,6 +313,46 @@ func normalizeConfig(config *Config) {
 	if config.Storage.SecretAccessKey == "" {
 		config.Storage.SecretAccessKey = os.Getenv("STORAGE_SECRET_ACCESS_KEY")
 	}
+	if !config.Storage.Dedupe {
+		config.Storage.Dedupe = os.Getenv("STORAGE_DEDUPE") == "true"
+	}
+	if config.GC.Interval == 0 {
+		if v := os.Getenv("GC_INTERVAL"); v != "" {
+			i, e := strconv.ParseUint(v, 10, 32)
+			if e == nil {
+				config.GC.Interval = uint32(i)
+			} else {
+				fmt.Println(term.Red("[error] invalid GC_INTERVAL: " + v))
+			}
+		}
+	}
+	if config.GC.Retention == 0 {
+		if v := os.Getenv("GC_RETENTION"); v != "" {
+			i, e := strconv.ParseUint(v, 10, 32)
+			if e == nil && i > 0 {
+				config.GC.Retention = uint32(i)
+			} else {
+				fmt.Println(term.Red("[error] invalid GC_RETENTION: " + v))
+			}
+		}
+	}
+	if config.GC.Retention > 0 && config.GC.Retention < minGCRetention {
+		fmt.Println(term.Red(fmt.Sprintf("[error] invalid gc.retention: %d, the minimum is %d (one day)", config.GC.Retention, minGCRetention)))
+		config.GC.Retention = 0
+	}
+	if config.GC.Retention == 0 {
+		config.GC.Retention = defaultGCRetention
+	}
+	if len(config.GC.Pinned) == 0 {
+		if v := os.Getenv("GC_PINNED"); v != "" {
+			for _, p := range strings.Split(v, ",") {
+				name := strings.TrimSpace(p)
+				if name != "" {
+					config.GC.Pinned = append(config.GC.Pinned, name)
+				}
+			}
+		}
+	}
 	if config.LogDir == "" {
 		config.LogDir = path.Join(config.WorkDir, "log")
 	}
@@ -246,6 +410,78 @@ func normalizeConfig(config *Config) {
 		}
 		config.NpmQueryCacheTTL = 600
 	}
+	if config.UserAgent == "" {
+		config.UserAgent = os.Getenv("USER_AGENT")
+		if config.UserAgent == "" {
+			config.UserAgent = "esm.sh/" + VERSION
+		}
+	}
+	if config.FloatCacheTTL == 0 {
+		if v := os.Getenv("FLOAT_CACHE_TTL"); v != "" {
+			i, e := strconv.Atoi(v)
+			if e == nil && i > 0 && i <= maxFloatCacheTTL {
+				config.FloatCacheTTL = uint32(i)
+			} else {
+				fmt.Println(term.Red("[error] invalid FLOAT_CACHE_TTL: " + v))
+			}
+		}
+	} else if config.FloatCacheTTL > maxFloatCacheTTL {
+		fmt.Println(term.Red(fmt.Sprintf("[error] invalid floatCacheTTL: %d, the maximum is %d (one year)", config.FloatCacheTTL, maxFloatCacheTTL)))
+		config.FloatCacheTTL = 0
+	}
+	if config.FloatCacheTTL == 0 {
+		config.FloatCacheTTL = config.NpmQueryCacheTTL
+	}
+	if config.InstallRetries == 0 {
+		if v := os.Getenv("INSTALL_RETRIES"); v != "" {
+			i, e := strconv.Atoi(v)
+			if e == nil && i > 0 && i <= maxInstallRetries {
+				config.InstallRetries = uint16(i)
+			} else {
+				fmt.Println(term.Red("[error] invalid INSTALL_RETRIES: " + v))
+			}
+		}
+	} else if config.InstallRetries > maxInstallRetries {
+		fmt.Println(term.Red(fmt.Sprintf("[error] invalid installRetries: %d, the maximum is %d", config.InstallRetries, maxInstallRetries)))
+		config.InstallRetries = 0
+	}
+	if config.InstallRetries == 0 {
+		config.InstallRetries = 3
+	}
+	if config.MaxQueryListLength == 0 {
+		v := os.Getenv("MAX_QUERY_LIST_LENGTH")
+		if v != "" {
+			i, e := strconv.Atoi(v)
+			if e == nil && i > 0 && i <= 0xFFFF {
+				config.MaxQueryListLength = uint16(i)
+			}
+		}
+		if config.MaxQueryListLength == 0 {
+			config.MaxQueryListLength = 64
+		}
+	}
+	if config.MaxEntryImports == 0 {
+		v := os.Getenv("MAX_ENTRY_IMPORTS")
+		if v != "" {
+			i, e := strconv.Atoi(v)
+			if e == nil && i > 0 && i <= 0xFFFF {
+				config.MaxEntryImports = uint16(i)
+			}
+		}
+		if config.MaxEntryImports == 0 {
+			config.MaxEntryImports = 64
+		}
+	}
+	if config.MaxBuildInputSize == 0 {
+		if v := os.Getenv("MAX_BUILD_INPUT_SIZE"); v != "" {
+			i, e := strconv.ParseUint(v, 10, 32)
+			if e == nil && i > 0 {
+				config.MaxBuildInputSize = uint32(i)
+			} else {
+				fmt.Println(term.Red("[error] invalid MAX_BUILD_INPUT_SIZE: " + v))
+			}
+		}
+	}
 	config.Compress = !(bytes.Equal(config.CompressRaw, []byte("false")) || os.Getenv("COMPRESS") == "false")
 	config.SourceMap = !(bytes.Equal(config.SourceMapRaw, []byte("false")) || (os.Getenv("SOURCEMAP") == "false" || os.Getenv("SOURCE_MAP") == "false"))
 	config.Minify = !(bytes.Equal(config.MinifyRaw, []byte("false")) || os.Getenv("MINIFY") == "false")
@@ -292,6 +528,17 @@ func (banList *BanList) IsPackageBanned(fullName string) bool {
 	return false
 }
 
+// isImportDenied checks if the import specifier is listed in the `denyImports` config.
+// A package name denies the package itself and all of its sub-modules.
+func isImportDenied(specifier string) bool {
+	for _, p := range config.DenyImports {
+		if specifier == p || strings.HasPrefix(specifier, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
 // IsPackageAllowed Checking if the package is allowed.
 // The `packages` list is the highest priority allow rule to match,
 // so the `includes` list in the `scopes` list won't take effect if the package is allowed in `packages` list
@@ -317,6 +564,12 @@ func (allowList *AllowList) IsPackageAllowed(fullName string) bool {
 	return false
 }
 
+// IsDependencyAllowed Checking if the dependency can be imported by the builds.
+// Only the packages in the allow list can be imported in the `strict` mode.
+func (allowList *AllowList) IsDependencyAllowed(pkgName string) bool {
+	return !allowList.Strict || allowList.IsPackageAllowed(pkgName)
+}
+
 func isPackageExcluded(name string, excludes []string) bool {
 	for _, exclude := range excludes {
 		if name == exclude {
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -282,3 +284,125 @@ func TestBanList_IsPackageBanned(t *testing.T) {
 		})
 	}
 }
+
+func TestMaxQueryListLength(t *testing.T) {
+	if DefaultConfig().MaxQueryListLength != 64 {
+		t.Fatal("the default max query list length should be 64")
+	}
+	t.Setenv("MAX_QUERY_LIST_LENGTH", "3")
+	if DefaultConfig().MaxQueryListLength != 3 {
+		t.Fatal("the max query list length should be read from the `MAX_QUERY_LIST_LENGTH` env")
+	}
+
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{MaxQueryListLength: 3}
+	for _, tt := range []struct {
+		query string
+		ok    bool
+	}{
+		{"deps=a@1,b@1,c@1", true},
+		{"deps=a@1,b@1,c@1,d@1", false},
+		{"external=a,b,c,d", false},
+		{"alias=a:b,c:d,e:f,g:h", false},
+		{"exports=a,b,c,d", false},
+		{"conditions=a,b,c,d", false},
+		{"target=es2022&dev", true},
+	} {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkQueryListLength(query, "alias", "deps", "external", "exports", "conditions")
+		if (err == nil) != tt.ok {
+			t.Fatalf("checkQueryListLength(%s): unexpected result: %v", tt.query, err)
+		}
+	}
+}
+
+func TestMaxEntryImports(t *testing.T) {
+	if DefaultConfig().MaxEntryImports != 64 {
+		t.Fatal("the default max entry imports should be 64")
+	}
+	t.Setenv("MAX_ENTRY_IMPORTS", "16")
+	if DefaultConfig().MaxEntryImports != 16 {
+		t.Fatal("the max entry imports should be read from the `MAX_ENTRY_IMPORTS` env")
+	}
+}
+
+func TestMaxBuildInputSize(t *testing.T) {
+	if DefaultConfig().MaxBuildInputSize != 0 {
+		t.Fatal("the build input size should be unlimited by default")
+	}
+	t.Setenv("MAX_BUILD_INPUT_SIZE", "104857600")
+	if DefaultConfig().MaxBuildInputSize != 104857600 {
+		t.Fatal("the max build input size should be read from the `MAX_BUILD_INPUT_SIZE` env")
+	}
+	t.Setenv("MAX_BUILD_INPUT_SIZE", "100MB")
+	if DefaultConfig().MaxBuildInputSize != 0 {
+		t.Fatal("the invalid `MAX_BUILD_INPUT_SIZE` env should be ignored")
+	}
+}
+
+func TestFloatCacheTTL(t *testing.T) {
+	if c := DefaultConfig(); c.FloatCacheTTL != c.NpmQueryCacheTTL {
+		t.Fatal("the default float cache TTL should be the same as the npm query cache TTL")
+	}
+	t.Setenv("FLOAT_CACHE_TTL", "86400")
+	if DefaultConfig().FloatCacheTTL != 86400 {
+		t.Fatal("the float cache TTL should be read from the `FLOAT_CACHE_TTL` env")
+	}
+	t.Setenv("FLOAT_CACHE_TTL", "-1")
+	if c := DefaultConfig(); c.FloatCacheTTL != c.NpmQueryCacheTTL {
+		t.Fatal("the invalid `FLOAT_CACHE_TTL` env should be ignored")
+	}
+	c := &Config{FloatCacheTTL: maxFloatCacheTTL + 1}
+	normalizeConfig(c)
+	if c.FloatCacheTTL != c.NpmQueryCacheTTL {
+		t.Fatal("the float cache TTL greater than one year should be ignored")
+	}
+
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{FloatCacheTTL: 3600}
+	if ccFloat() != "public, max-age=3600" {
+		t.Fatalf("unexpected Cache-Control: %s", ccFloat())
+	}
+}
+
+func TestCrossOriginResourcePolicy(t *testing.T) {
+	if DefaultConfig().CrossOriginResourcePolicy != "cross-origin" {
+		t.Fatal("the default `Cross-Origin-Resource-Policy` should be 'cross-origin'")
+	}
+	t.Setenv("CROSS_ORIGIN_RESOURCE_POLICY", "same-site")
+	if DefaultConfig().CrossOriginResourcePolicy != "same-site" {
+		t.Fatal("the policy should be read from the `CROSS_ORIGIN_RESOURCE_POLICY` env")
+	}
+	t.Setenv("CROSS_ORIGIN_RESOURCE_POLICY", "none")
+	if DefaultConfig().CrossOriginResourcePolicy != "" {
+		t.Fatal("the policy should be disabled by 'none'")
+	}
+	c := &Config{CrossOriginResourcePolicy: "any-origin"}
+	normalizeConfig(c)
+	if c.CrossOriginResourcePolicy != "cross-origin" {
+		t.Fatal("the invalid policy should fall back to 'cross-origin'")
+	}
+}
+
+func TestGCOptions(t *testing.T) {
+	if c := DefaultConfig(); c.GC.Interval != 0 || c.GC.Retention != defaultGCRetention {
+		t.Fatalf("unexpected default gc options %+v", c.GC)
+	}
+	t.Setenv("GC_INTERVAL", "3600")
+	t.Setenv("GC_RETENTION", "604800")
+	t.Setenv("GC_PINNED", "react, @scope/pkg")
+	c := DefaultConfig()
+	if c.GC.Interval != 3600 || c.GC.Retention != 604800 || strings.Join(c.GC.Pinned, ",") != "react,@scope/pkg" {
+		t.Fatalf("the gc options should be read from the env: %+v", c.GC)
+	}
+	c = &Config{GC: GCOptions{Interval: 60, Retention: 60}}
+	normalizeConfig(c)
+	if c.GC.Retention != defaultGCRetention {
+		t.Fatal("the retention less than one day should be ignored")
+	}
+}
@@ -1,10 +1,22 @@
 package server
 
 const (
-	MB                    = 1 << 20
-	maxAssetFileSize      = 50 * MB
-	maxPackageTarballSize = 256 * MB
-	lruCacheCapacity      = 10000
+	MB                     = 1 << 20
+	maxAssetFileSize       = 50 * MB
+	maxPackageTarballSize  = 256 * MB
+	lruCacheCapacity       = 10000
+	maxBarrelEntries       = 16
+	maxFloatCacheTTL       = 365 * 24 * 60 * 60 // same as the `max-age` of the immutable responses
+	maxInstallRetries      = 10                 // the backoff delay of the last retry is ~100 seconds
+	maxModuleGraphDepth    = 32
+	maxModuleGraphSize     = 1000
+	maxModuleGraphWalkTime = 60        // seconds, the overall deadline of walking the dependency closure
+	maxDenoImportsSize     = 16 * 1024 // the max size of the `X-Deno-Imports` header
+	maxBuildWarnings       = 32        // the max number of the esbuild warnings kept in the build meta
+	maxBuildLogMessages    = 64        // the max number of the esbuild messages kept in the log of a failed build
+	buildLogTTL            = 10 * 60   // the logs of the failed builds are kept for 10 minutes
+	minGCRetention         = 24 * 60 * 60
+	defaultGCRetention     = 30 * 24 * 60 * 60
 )
 
 // asset file extensions
@@ -17,6 +29,7 @@ var assetExts = map[string]bool{
 	"stylus":     true,
 	"styl":       true,
 	"json":       true,
+	"json5":      true,
 	"jsonc":      true,
 	"csv":        true,
 	"xml":        true,
@@ -33,6 +46,7 @@ var assetExts = map[string]bool{
 	"md":         true,
 	"mdx":        true,
 	"markdown":   true,
+	"flow":       true, // flow type stubs, e.g. `index.js.flow`
 	"html":       true,
 	"htm":        true,
 	"svg":        true,
@@ -126,6 +140,19 @@ var cssPackages = map[string]string{
 	"reset-css":        "reset.css",
 }
 
+// the runtime packages that are typically shared as singletons by an app, like UI frameworks and CSS-in-JS engines,
+// multiple instances of them cause bugs, see the `X-ESM-Shareable-Deps` header
+var shareableDeps = map[string]bool{
+	"@emotion/react":    true,
+	"@emotion/styled":   true,
+	"preact":            true,
+	"react":             true,
+	"react-dom":         true,
+	"solid-js":          true,
+	"styled-components": true,
+	"vue":               true,
+}
+
 // force to use `npm:` specifier for `denonext` target to support node native module or fix `createRequire` issue
 var forceNpmSpecifiers = map[string]bool{
 	"@achingbrain/ssdp": true,
@@ -137,3 +164,20 @@ var forceNpmSpecifiers = map[string]bool{
 	"zlib-sync":         true,
 	"css-tree":          true,
 }
+
+// the npm replacements that rely on the native Web APIs, the imports are resolved to the polyfill packages instead
+// for the targets that predate the APIs, e.g. `fetch` is not available in the browsers that only support es2015.
+// note: the ES version doesn't imply the Web APIs, the target is a heuristic of the browser versions that ship the
+// API, e.g. `AbortController` is shipped by Chrome 66 and Safari 12.1 that support es2018.
+// note: the browser entry of the `abort-controller` package re-exports the global `AbortController`, so the
+// imports are resolved to the `abortcontroller-polyfill` package that implements the API.
+var webAPIPolyfills = map[string]struct {
+	target   string
+	polyfill string
+}{
+	"abort-controller":          {"es2018", "abortcontroller-polyfill@1/dist/cjs-ponyfill"},
+	"abort-controller/polyfill": {"es2018", "abortcontroller-polyfill@1/dist/abortcontroller-polyfill-only"},
+	"cross-fetch":               {"es2017", "cross-fetch"},
+	"cross-fetch/polyfill":      {"es2017", "cross-fetch/polyfill"},
+	"node-fetch":                {"es2017", "cross-fetch@4"},
+}
@@ -169,7 +169,8 @@ func transformDTS(ctx *BuildContext, dts string, buildArgsPrefix string, marker
 
 		// respect `?alias` query
 		alias, ok := ctx.args.alias[depPkgName]
-		if ok {
+		// keep the types of the dependency that is replaced with an empty module by `?alias=PKG:false`
+		if ok && alias != "false" {
 			aliasPkgName, _, aliasSubPath, _ := splitEsmPath(alias)
 			depPkgName = aliasPkgName
 			if aliasSubPath != "" {
@@ -186,7 +187,7 @@ func transformDTS(ctx *BuildContext, dts string, buildArgsPrefix string, marker
 		}
 
 		// respect `?external` query
-		if ctx.externalAll || ctx.args.external.Has(depPkgName) {
+		if ctx.externalAll || ctx.isExternal(depPkgName) {
 			return specifier, nil
 		}
 
@@ -211,7 +212,17 @@ func transformDTS(ctx *BuildContext, dts string, buildArgsPrefix string, marker
 			SubPath:       subPath,
 			SubModuleName: subPath,
 		}
-		args := BuildArgs{}
+		// inherit the `alias`, `deps`, `external` and `conditions` args to keep the types of nested dependencies consistent
+		args := BuildArgs{
+			alias:      ctx.args.alias,
+			deps:       ctx.args.deps,
+			external:   ctx.args.external,
+			conditions: ctx.args.conditions,
+		}
+		err = resolveBuildArgs(ctx.npmrc, ctx.wd, &args, dtsModule)
+		if err != nil {
+			return "", err
+		}
 		b := &BuildContext{
 			npmrc:  ctx.npmrc,
 			logger: ctx.logger,
@@ -1,27 +1,55 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// the delay before the first retry of a failed fetch, it doubles for each retry
+var fetchRetryDelay = 200 * time.Millisecond
+
+// fetchTransport is shared by the fetch clients to reuse the connections to the registries, it prefers HTTP/2
+// that multiplexes the requests to the same host over a single connection.
+var fetchTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   10 * time.Second, // the connect timeout
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          256,
+	MaxIdleConnsPerHost:   32,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
 var fetchClientPool = sync.Pool{
 	New: func() any {
-		return &FetchClient{Client: &http.Client{}}
+		return &FetchClient{Client: &http.Client{Transport: fetchTransport}}
 	},
 }
 
 type FetchClient struct {
 	*http.Client
 	userAgent string
+	timeout   time.Duration
 }
 
+// NewFetchClient returns a fetch client from the pool. The timeout (in seconds) limits the time to wait for the
+// response headers and the idle time between the reads of the response body, instead of the whole download, so the
+// big tarballs are not aborted as long as the data keeps coming.
 func NewFetchClient(timeout int, userAgent string, noRedirect bool) (client *FetchClient, recycle func()) {
 	client = fetchClientPool.Get().(*FetchClient)
-	client.Timeout = time.Duration(timeout) * time.Second
+	client.timeout = time.Duration(timeout) * time.Second
 	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
 		if noRedirect && len(via) > 0 {
 			return http.ErrUseLastResponse
@@ -36,13 +64,17 @@ func NewFetchClient(timeout int, userAgent string, noRedirect bool) (client *Fet
 }
 
 func (c *FetchClient) Fetch(url *url.URL, header http.Header) (resp *http.Response, err error) {
+	if header == nil {
+		header = make(http.Header)
+	}
 	if c.userAgent != "" {
-		if header == nil {
-			header = make(http.Header)
-		}
 		header.Set("User-Agent", c.userAgent)
+	} else if header.Get("User-Agent") == "" {
+		// use the configured `User-Agent` by default
+		header.Set("User-Agent", config.UserAgent)
 	}
-	req := &http.Request{
+	timer := newFetchTimer(c.timeout)
+	req := (&http.Request{
 		Method:     "GET",
 		URL:        url,
 		Host:       url.Host,
@@ -50,6 +82,128 @@ func (c *FetchClient) Fetch(url *url.URL, header http.Header) (resp *http.Respon
 		ProtoMajor: 1,
 		ProtoMinor: 1,
 		Header:     header,
+	}).WithContext(timer.ctx)
+	resp, err = c.Do(req)
+	if err != nil {
+		timer.stop()
+		if timer.timedOut.Load() {
+			// report the timeout instead of the `context canceled` error, so it can be retried
+			err = &fetchTimeoutError{url: url.String()}
+		}
+		return
+	}
+	timer.reset()
+	resp.Body = &fetchBody{ReadCloser: resp.Body, url: url.String(), timer: timer}
+	return
+}
+
+// fetchTimer cancels the fetch if there is no progress within the timeout
+type fetchTimer struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	timeout  time.Duration
+	timedOut atomic.Bool
+}
+
+func newFetchTimer(timeout time.Duration) *fetchTimer {
+	t := &fetchTimer{timeout: timeout}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() {
+			t.timedOut.Store(true)
+			t.cancel()
+		})
+	}
+	return t
+}
+
+func (t *fetchTimer) reset() {
+	if t.timer != nil && !t.timedOut.Load() {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *fetchTimer) stop() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.cancel()
+}
+
+// fetchBody resets the timer of the fetch on every read of the response body
+type fetchBody struct {
+	io.ReadCloser
+	url   string
+	timer *fetchTimer
+}
+
+func (b *fetchBody) Read(p []byte) (n int, err error) {
+	b.timer.reset()
+	n, err = b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.timer.timedOut.Load() {
+		err = &fetchTimeoutError{url: b.url}
+	}
+	return
+}
+
+func (b *fetchBody) Close() error {
+	b.timer.stop()
+	return b.ReadCloser.Close()
+}
+
+// fetchTimeoutError implements the `net.Error` interface
+type fetchTimeoutError struct {
+	url string
+}
+
+func (e *fetchTimeoutError) Error() string {
+	return "fetch " + e.url + ": timeout"
+}
+
+func (e *fetchTimeoutError) Timeout() bool   { return true }
+func (e *fetchTimeoutError) Temporary() bool { return true }
+
+// FetchWithRetry fetches the url and retries with exponential backoff if the request fails with a retryable
+// error (timeout, connection reset, 5xx status, etc.), the permanent errors like 404 or 403 are returned immediately.
+// The `onRetry` callback is called before each retry.
+func (c *FetchClient) FetchWithRetry(url *url.URL, header http.Header, retries int, onRetry func(attempt int, delay time.Duration, reason string)) (resp *http.Response, err error) {
+	for attempt := 0; ; attempt++ {
+		var reason string
+		resp, err = c.Fetch(url, header)
+		if err != nil {
+			if !isRetryableError(err) {
+				return
+			}
+			reason = err.Error()
+		} else if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			reason = resp.Status
+		} else {
+			return
+		}
+		if attempt >= retries {
+			return
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		delay := fetchRetryDelay << attempt
+		if onRetry != nil {
+			onRetry(attempt+1, delay, reason)
+		}
+		time.Sleep(delay)
+	}
+}
+
+// isRetryableError checks if the fetch error is transient
+func isRetryableError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsTemporary {
+		return true
 	}
-	return c.Do(req)
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
 }
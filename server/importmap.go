@@ -0,0 +1,303 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/common"
+	"github.com/ije/gox/set"
+	"github.com/ije/gox/utils"
+)
+
+var (
+	errBuildTimeout        = errors.New("timeout")
+	errModuleGraphTooLarge = fmt.Errorf("the dependency closure is too large, the max depth is %d and the max size is %d", maxModuleGraphDepth, maxModuleGraphSize)
+)
+
+// ImportMapWalker walks the dependency closure of a module and collects the
+// build paths into an import map.
+type ImportMapWalker struct {
+	buildQueue *BuildQueue
+	origin     string
+	timeout    time.Duration
+	importMap  common.ImportMap
+	graph      map[string][]string
+	visited    *set.Set[string]
+	modules    []walkedModule
+}
+
+// walkedModule is a module of the dependency closure that is walked by the `ImportMapWalker`
+type walkedModule struct {
+	ctx  *BuildContext
+	meta *BuildMeta
+}
+
+// ModuleGraph is the import graph of a module, the nodes are the build paths and
+// the edges are the import relationships.
+type ModuleGraph struct {
+	Entry     string              `json:"entry"`
+	Modules   map[string][]string `json:"modules"`
+	Truncated bool                `json:"truncated,omitempty"`
+}
+
+func NewImportMapWalker(buildQueue *BuildQueue, origin string, timeout time.Duration) *ImportMapWalker {
+	return &ImportMapWalker{
+		buildQueue: buildQueue,
+		origin:     origin,
+		timeout:    timeout,
+		importMap:  common.ImportMap{Imports: map[string]string{}},
+		graph:      map[string][]string{},
+		visited:    set.New[string](),
+	}
+}
+
+// Walk builds the entry module and its dependencies recursively, the modules
+// that are closer to the entry win if a package is imported with different versions.
+// An incomplete import map is useless, so the `errModuleGraphTooLarge` error is returned
+// if the closure exceeds the `maxModuleGraphDepth` or `maxModuleGraphSize` limit.
+func (w *ImportMapWalker) Walk(entry *BuildContext) (importMap common.ImportMap, err error) {
+	truncated, err := w.walk(entry, maxModuleGraphDepth, maxModuleGraphSize)
+	if err == nil && truncated {
+		err = errModuleGraphTooLarge
+	}
+	if err != nil {
+		return common.ImportMap{}, err
+	}
+	return w.importMap, nil
+}
+
+// WalkGraph builds the entry module and its dependencies recursively like `Walk`, and returns
+// the import graph. The modules deeper than `maxDepth` are not walked, and the walking stops
+// once the graph has `maxModules` modules, the graph is marked as truncated in both cases.
+func (w *ImportMapWalker) WalkGraph(entry *BuildContext, maxDepth int, maxModules int) (graph ModuleGraph, err error) {
+	truncated, err := w.walk(entry, maxDepth, maxModules)
+	if err != nil {
+		return ModuleGraph{}, err
+	}
+	return ModuleGraph{Entry: entry.Path(), Modules: w.graph, Truncated: truncated}, nil
+}
+
+// WalkTypes builds the entry module and its dependencies recursively like `Walk`, and returns an ambient
+// declaration file that declares the modules of the closure with their types. Each module is declared by the
+// bare specifier of the import map, the url of the package module and the url of the build.
+func (w *ImportMapWalker) WalkTypes(entry *BuildContext) ([]byte, error) {
+	truncated, err := w.walk(entry, maxModuleGraphDepth, maxModuleGraphSize)
+	if err == nil && truncated {
+		err = errModuleGraphTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	return w.closureTypes(entry), nil
+}
+
+func (w *ImportMapWalker) closureTypes(entry *BuildContext) []byte {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "/* esm.sh - the types of the dependency closure of %s */\n", entry.esm.Specifier())
+	declared := set.New[string]()
+	for _, m := range w.modules {
+		if m.meta.Dts == "" {
+			continue
+		}
+		buildUrl := w.origin + m.ctx.Path()
+		specifier := m.ctx.esm.PkgName
+		if m.ctx.esm.SubModuleName != "" {
+			specifier += "/" + m.ctx.esm.SubModuleName
+		}
+		names := []string{w.origin + "/" + m.ctx.esm.Specifier(), buildUrl}
+		if w.importMap.Imports[specifier] == buildUrl {
+			names = append([]string{specifier}, names...)
+		}
+		dtsUrl := w.origin + m.meta.Dts
+		for _, name := range names {
+			if declared.Has(name) {
+				continue
+			}
+			declared.Add(name)
+			fmt.Fprintf(buf, "declare module \"%s\" {\n", name)
+			fmt.Fprintf(buf, "  export * from \"%s\";\n", dtsUrl)
+			if m.meta.ExportDefault || m.meta.CJS {
+				fmt.Fprintf(buf, "  export { default } from \"%s\";\n", dtsUrl)
+			}
+			buf.WriteString("}\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+func (w *ImportMapWalker) walk(entry *BuildContext, maxDepth int, maxModules int) (truncated bool, err error) {
+	type node struct {
+		ctx   *BuildContext
+		depth int
+	}
+	queue := []node{{entry, 0}}
+	w.visited.Add(entry.Path())
+	// the overall deadline of the walk, the builds of the closure keep running in the build queue
+	deadline := time.Now().Add(maxModuleGraphWalkTime * time.Second)
+	for len(queue) > 0 {
+		ctx, depth := queue[0].ctx, queue[0].depth
+		queue = queue[1:]
+		meta, err := w.build(ctx, deadline)
+		if err != nil {
+			return false, err
+		}
+		deps := []string{}
+		w.graph[ctx.Path()] = deps
+		if meta.TypesOnly || meta.CSSEntry != "" {
+			continue
+		}
+		specifier := ctx.esm.PkgName
+		if ctx.esm.SubModuleName != "" {
+			specifier += "/" + ctx.esm.SubModuleName
+		}
+		if _, ok := w.importMap.Imports[specifier]; !ok {
+			w.importMap.Imports[specifier] = w.origin + ctx.Path()
+		}
+		w.modules = append(w.modules, walkedModule{ctx, meta})
+		if maxDepth > 0 && depth >= maxDepth {
+			truncated = truncated || len(meta.Imports) > 0
+			continue
+		}
+		for _, importPath := range meta.Imports {
+			dep, err := w.resolveImport(ctx, importPath)
+			if err != nil {
+				return false, err
+			}
+			if dep == nil {
+				// e.g. the node polyfills
+				deps = append(deps, importPath)
+				continue
+			}
+			deps = append(deps, dep.Path())
+			// pin the dependency that is imported with a semver range
+			if strings.ContainsRune(importPath, '?') {
+				w.importMap.Imports[w.origin+importPath] = w.origin + dep.Path()
+			}
+			if !w.visited.Has(dep.Path()) {
+				if maxModules > 0 && w.visited.Len() >= maxModules {
+					truncated = true
+					continue
+				}
+				w.visited.Add(dep.Path())
+				queue = append(queue, node{dep, depth + 1})
+			}
+		}
+		w.graph[ctx.Path()] = deps
+	}
+	return truncated, nil
+}
+
+func (w *ImportMapWalker) build(ctx *BuildContext, deadline time.Time) (meta *BuildMeta, err error) {
+	meta, ok, err := ctx.Exists()
+	if err != nil || ok {
+		return
+	}
+	timeout := min(w.timeout, time.Until(deadline))
+	if timeout <= 0 {
+		return nil, errBuildTimeout
+	}
+	select {
+	case output := <-w.buildQueue.Add(ctx):
+		return output.meta, output.err
+	case <-time.After(timeout):
+		return nil, errBuildTimeout
+	}
+}
+
+// resolveImport returns the build context of the import path that is
+// recorded in the build meta, or nil if it's not a package module.
+func (w *ImportMapWalker) resolveImport(importer *BuildContext, importPath string) (*BuildContext, error) {
+	pathname, rawQuery := utils.SplitByFirstByte(importPath, '?')
+	if strings.HasPrefix(pathname, "/node/") || pathname == "/error.js" {
+		return nil, nil
+	}
+	externalAll := strings.HasPrefix(pathname, "/*")
+	if externalAll {
+		pathname = "/" + pathname[2:]
+	}
+	esm, _, _, _, err := praseEsmPath(importer.npmrc, pathname)
+	if err != nil {
+		return nil, err
+	}
+	ctx := &BuildContext{
+		npmrc:       importer.npmrc,
+		logger:      importer.logger,
+		db:          importer.db,
+		storage:     importer.storage,
+		esm:         esm,
+		externalAll: externalAll,
+		target:      importer.target,
+	}
+
+	// match path `PKG@VERSION?target=TARGET`
+	if rawQuery != "" {
+		query, err := url.ParseQuery(rawQuery)
+		if err != nil {
+			return nil, err
+		}
+		if query.Has("module") {
+			// json module
+			return nil, nil
+		}
+		if t := query.Get("target"); targets[t] > 0 {
+			ctx.target = t
+		}
+		ctx.dev = query.Has("dev")
+		ctx.args = BuildArgs{
+			alias:         importer.args.alias,
+			deps:          importer.args.deps,
+			external:      importer.args.external,
+			exclude:       importer.args.exclude,
+			conditions:    importer.args.conditions,
+			noCSS:         importer.args.noCSS,
+			legalComments: importer.args.legalComments,
+		}
+		err = resolveBuildArgs(ctx.npmrc, path.Join(ctx.npmrc.StoreDir(), esm.Name()), &ctx.args, esm)
+		if err != nil {
+			return nil, err
+		}
+		return ctx, nil
+	}
+
+	// match path `PKG@VERSION/X-${args}/TARGET/SUBMODULE.mjs`
+	a := strings.Split(esm.SubPath, "/")
+	if len(a) > 1 && strings.HasPrefix(a[0], "X-") {
+		args, err := decodeBuildArgs(strings.TrimPrefix(a[0], "X-"))
+		if err != nil {
+			return nil, err
+		}
+		ctx.args = args
+		a = a[1:]
+		ctx.esm.SubPath = strings.Join(a, "/")
+	}
+	if len(a) < 2 || targets[a[0]] == 0 || !strings.HasSuffix(ctx.esm.SubPath, ".mjs") {
+		return nil, nil
+	}
+	ctx.target = a[0]
+	submodule := strings.TrimSuffix(strings.Join(a[1:], "/"), ".mjs")
+	if strings.HasSuffix(submodule, ".bundle") {
+		submodule = strings.TrimSuffix(submodule, ".bundle")
+		ctx.bundleMode = BundleDeps
+	} else if strings.HasSuffix(submodule, ".nobundle") {
+		submodule = strings.TrimSuffix(submodule, ".nobundle")
+		ctx.bundleMode = BundleFalse
+	}
+	if strings.HasSuffix(submodule, ".development") {
+		submodule = strings.TrimSuffix(submodule, ".development")
+		ctx.dev = true
+	}
+	basename := strings.TrimSuffix(path.Base(esm.PkgName), ".js")
+	if submodule == basename {
+		submodule = ""
+	} else if submodule == "__"+basename {
+		// the sub-module name is same as the package name
+		submodule = basename
+	}
+	ctx.esm.SubModuleName = submodule
+	return ctx, nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestImportMapWalkerLimits(t *testing.T) {
+	wd := t.TempDir()
+	db, err := OpenDB(path.Join(wd, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	buildStorage, logger := newTestBuildStorage(t, wd)
+
+	// a chain of modules that is deeper than the `maxModuleGraphDepth`
+	npmrc := DefaultNpmRC()
+	newBuildContext := func(i int) *BuildContext {
+		name := fmt.Sprintf("chain-%d", i)
+		return &BuildContext{
+			npmrc:   npmrc,
+			logger:  logger,
+			db:      db,
+			storage: buildStorage,
+			esm:     EsmPath{PkgName: name, PkgVersion: "1.0.0"},
+			target:  "es2022",
+		}
+	}
+	for i := 0; i <= maxModuleGraphDepth+1; i++ {
+		meta := &BuildMeta{}
+		if i <= maxModuleGraphDepth {
+			meta.Imports = []string{newBuildContext(i + 1).Path()}
+		}
+		err = db.Put(npmrc.zoneId+":"+newBuildContext(i).Path(), encodeBuildMeta(meta))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err = NewImportMapWalker(nil, "https://esm.sh", time.Second).Walk(newBuildContext(0))
+	if err != errModuleGraphTooLarge {
+		t.Fatalf("expected the too large error, got %v", err)
+	}
+	_, err = NewImportMapWalker(nil, "https://esm.sh", time.Second).WalkTypes(newBuildContext(0))
+	if err != errModuleGraphTooLarge {
+		t.Fatalf("expected the too large error, got %v", err)
+	}
+
+	// the closure within the limits is walked completely
+	importMap, err := NewImportMapWalker(nil, "https://esm.sh", time.Second).Walk(newBuildContext(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(importMap.Imports) != maxModuleGraphDepth {
+		t.Fatalf("expected %d imports, got %d", maxModuleGraphDepth, len(importMap.Imports))
+	}
+}
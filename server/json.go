@@ -24,6 +24,30 @@ func (obj *JSONObject) Get(key string) (any, bool) {
 	return v, ok
 }
 
+// MarshalJSON implements type json.Marshaler interface, the keys order is preserved
+func (obj JSONObject) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte('{')
+	for i, key := range obj.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(obj.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
 // UnmarshalJSON implements type json.Unmarshaler interface
 func (obj *JSONObject) UnmarshalJSON(data []byte) error {
 	dec := json.NewDecoder(bytes.NewReader(data))
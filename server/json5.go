@@ -0,0 +1,377 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var regexpJSONNumber = regexp.MustCompile(`^-?(0|[1-9]\d*)(\.\d+)?([eE][+-]?\d+)?$`)
+
+// maxJSON5Depth limits the nesting of the objects and arrays, the deeply nested input
+// would overflow the stack of the recursive parser.
+const maxJSON5Depth = 1000
+
+// json5ToJSON converts the JSON5/JSONC data to the standard JSON, the comments and trailing commas
+// are removed, the unquoted keys and single-quoted strings are quoted with double quotes, and the
+// JSON5 numbers (hex, leading/trailing decimal point, explicit plus sign) are normalized.
+// `Infinity` and `NaN` are not supported since they can't be represented in JSON.
+// see https://spec.json5.org
+func json5ToJSON(data []byte) ([]byte, error) {
+	p := &json5Parser{data: bytes.TrimPrefix(data, []byte("\xEF\xBB\xBF"))}
+	err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	err = p.skipSpaces()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.data) {
+		return nil, p.errorf("unexpected character %q", p.data[p.pos])
+	}
+	return p.out.Bytes(), nil
+}
+
+type json5Parser struct {
+	data  []byte
+	pos   int
+	depth int
+	out   bytes.Buffer
+}
+
+func (p *json5Parser) errorf(format string, args ...any) error {
+	line := bytes.Count(p.data[:min(p.pos, len(p.data))], []byte{'\n'}) + 1
+	return fmt.Errorf("invalid json5 at line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// skipSpaces skips the whitespaces and comments
+func (p *json5Parser) skipSpaces() error {
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if c == '/' && p.pos+1 < len(p.data) {
+			switch p.data[p.pos+1] {
+			case '/':
+				end := bytes.IndexByte(p.data[p.pos:], '\n')
+				if end == -1 {
+					p.pos = len(p.data)
+				} else {
+					p.pos += end + 1
+				}
+				continue
+			case '*':
+				end := bytes.Index(p.data[p.pos+2:], []byte("*/"))
+				if end == -1 {
+					return p.errorf("unterminated comment")
+				}
+				p.pos += end + 4
+				continue
+			}
+		}
+		if c < utf8.RuneSelf {
+			if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != '\v' && c != '\f' {
+				return nil
+			}
+			p.pos++
+			continue
+		}
+		r, size := utf8.DecodeRune(p.data[p.pos:])
+		if !unicode.IsSpace(r) && r != '\uFEFF' {
+			return nil
+		}
+		p.pos += size
+	}
+	return nil
+}
+
+func (p *json5Parser) parseValue() error {
+	err := p.skipSpaces()
+	if err != nil {
+		return err
+	}
+	if p.pos >= len(p.data) {
+		return p.errorf("unexpected end of input")
+	}
+	switch c := p.data[p.pos]; {
+	case c == '{' || c == '[':
+		if p.depth >= maxJSON5Depth {
+			return p.errorf("exceeded max depth %d", maxJSON5Depth)
+		}
+		p.depth++
+		defer func() { p.depth-- }()
+		if c == '{' {
+			return p.parseObject()
+		}
+		return p.parseArray()
+	case c == '"' || c == '\'':
+		s, err := p.parseString()
+		if err != nil {
+			return err
+		}
+		return p.writeString(s)
+	case c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9'):
+		return p.parseNumber()
+	default:
+		name := p.parseIdentifier()
+		switch name {
+		case "true", "false", "null":
+			p.out.WriteString(name)
+			return nil
+		case "Infinity", "NaN":
+			return p.errorf("%s is not supported", name)
+		case "":
+			return p.errorf("unexpected character %q", c)
+		default:
+			return p.errorf("unexpected identifier %q", name)
+		}
+	}
+}
+
+func (p *json5Parser) parseObject() error {
+	p.pos++ // skip '{'
+	p.out.WriteByte('{')
+	first := true
+	for {
+		err := p.skipSpaces()
+		if err != nil {
+			return err
+		}
+		if p.pos >= len(p.data) {
+			return p.errorf("unterminated object")
+		}
+		if p.data[p.pos] == '}' {
+			p.pos++
+			p.out.WriteByte('}')
+			return nil
+		}
+		if !first {
+			p.out.WriteByte(',')
+		}
+		first = false
+		var key string
+		if c := p.data[p.pos]; c == '"' || c == '\'' {
+			key, err = p.parseString()
+			if err != nil {
+				return err
+			}
+		} else {
+			key = p.parseIdentifier()
+			if key == "" {
+				return p.errorf("unexpected character %q in object key", c)
+			}
+		}
+		err = p.writeString(key)
+		if err != nil {
+			return err
+		}
+		err = p.skipSpaces()
+		if err != nil {
+			return err
+		}
+		if p.pos >= len(p.data) || p.data[p.pos] != ':' {
+			return p.errorf("missing ':' after object key %q", key)
+		}
+		p.pos++
+		p.out.WriteByte(':')
+		err = p.parseValue()
+		if err != nil {
+			return err
+		}
+		err = p.skipSpaces()
+		if err != nil {
+			return err
+		}
+		if p.pos < len(p.data) && p.data[p.pos] == ',' {
+			p.pos++
+		} else if p.pos < len(p.data) && p.data[p.pos] != '}' {
+			return p.errorf("missing ',' in object")
+		}
+	}
+}
+
+func (p *json5Parser) parseArray() error {
+	p.pos++ // skip '['
+	p.out.WriteByte('[')
+	first := true
+	for {
+		err := p.skipSpaces()
+		if err != nil {
+			return err
+		}
+		if p.pos >= len(p.data) {
+			return p.errorf("unterminated array")
+		}
+		if p.data[p.pos] == ']' {
+			p.pos++
+			p.out.WriteByte(']')
+			return nil
+		}
+		if !first {
+			p.out.WriteByte(',')
+		}
+		first = false
+		err = p.parseValue()
+		if err != nil {
+			return err
+		}
+		err = p.skipSpaces()
+		if err != nil {
+			return err
+		}
+		if p.pos < len(p.data) && p.data[p.pos] == ',' {
+			p.pos++
+		} else if p.pos < len(p.data) && p.data[p.pos] != ']' {
+			return p.errorf("missing ',' in array")
+		}
+	}
+}
+
+// parseIdentifier parses the unquoted object key or the literal name, e.g. `true`, `Infinity`
+func (p *json5Parser) parseIdentifier() string {
+	start := p.pos
+	for p.pos < len(p.data) {
+		r, size := utf8.DecodeRune(p.data[p.pos:])
+		if !(r == '_' || r == '$' || unicode.IsLetter(r) || (p.pos > start && (unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r) || unicode.Is(unicode.Pc, r)))) {
+			break
+		}
+		p.pos += size
+	}
+	return string(p.data[start:p.pos])
+}
+
+func (p *json5Parser) parseString() (string, error) {
+	quote := p.data[p.pos]
+	p.pos++
+	var sb strings.Builder
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		switch c {
+		case quote:
+			p.pos++
+			return sb.String(), nil
+		case '\n', '\r':
+			return "", p.errorf("unterminated string")
+		case '\\':
+			p.pos++
+			if p.pos >= len(p.data) {
+				return "", p.errorf("unterminated string")
+			}
+			e := p.data[p.pos]
+			p.pos++
+			switch e {
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case 'v':
+				sb.WriteByte('\v')
+			case '0':
+				sb.WriteByte(0)
+			case 'x', 'u':
+				n := 2
+				if e == 'u' {
+					n = 4
+				}
+				if p.pos+n > len(p.data) {
+					return "", p.errorf("invalid escape sequence")
+				}
+				v, err := strconv.ParseUint(string(p.data[p.pos:p.pos+n]), 16, 32)
+				if err != nil {
+					return "", p.errorf("invalid escape sequence")
+				}
+				p.pos += n
+				r := rune(v)
+				// decode the surrogate pair, e.g. `\uD83D\uDE00`
+				if utf16.IsSurrogate(r) && p.pos+6 <= len(p.data) && p.data[p.pos] == '\\' && p.data[p.pos+1] == 'u' {
+					if lo, err := strconv.ParseUint(string(p.data[p.pos+2:p.pos+6]), 16, 32); err == nil {
+						if dr := utf16.DecodeRune(r, rune(lo)); dr != unicode.ReplacementChar {
+							r = dr
+							p.pos += 6
+						}
+					}
+				}
+				sb.WriteRune(r)
+			case '\r':
+				// line continuation
+				if p.pos < len(p.data) && p.data[p.pos] == '\n' {
+					p.pos++
+				}
+			case '\n':
+				// line continuation
+			default:
+				sb.WriteByte(e)
+			}
+		default:
+			sb.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *json5Parser) parseNumber() error {
+	start := p.pos
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		if (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '.' || c == '+' || c == '-' {
+			// the sign is only allowed at the start or after the exponent
+			if (c == '+' || c == '-') && p.pos > start && p.data[p.pos-1] != 'e' && p.data[p.pos-1] != 'E' {
+				break
+			}
+			p.pos++
+			continue
+		}
+		break
+	}
+	raw := string(p.data[start:p.pos])
+	if regexpJSONNumber.MatchString(raw) {
+		p.out.WriteString(raw)
+		return nil
+	}
+	num := strings.TrimPrefix(raw, "+")
+	sign := ""
+	if strings.HasPrefix(num, "-") {
+		sign = "-"
+		num = num[1:]
+	}
+	if num == "Infinity" || num == "NaN" {
+		return p.errorf("%s is not supported", num)
+	}
+	if strings.HasPrefix(num, "0x") || strings.HasPrefix(num, "0X") {
+		v, err := strconv.ParseUint(num[2:], 16, 64)
+		if err != nil {
+			return p.errorf("invalid number %q", raw)
+		}
+		p.out.WriteString(sign + strconv.FormatUint(v, 10))
+		return nil
+	}
+	// `strconv.ParseFloat` also accepts "inf", hex floats and underscores that are not allowed in JSON5
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || num == "" || !(num[0] == '.' || (num[0] >= '0' && num[0] <= '9')) || strings.ContainsAny(num, "xXpP_") {
+		return p.errorf("invalid number %q", raw)
+	}
+	p.out.WriteString(sign + strconv.FormatFloat(f, 'g', -1, 64))
+	return nil
+}
+
+func (p *json5Parser) writeString(s string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return errors.New("invalid string")
+	}
+	p.out.Write(data)
+	return nil
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSON5ToJSON(t *testing.T) {
+	tests := []struct {
+		input  string
+		output string
+	}{
+		{`{"a": 1}`, `{"a":1}`},
+		{"\uFEFF{\"a\": 1}", `{"a":1}`},
+		{"{\n  // comment\n  \"a\": 1, /* block\ncomment */\n}", `{"a":1}`},
+		{`[1, 2, 3,]`, `[1,2,3]`},
+		{`{a: 1, $b_2: 'two', "c": [true, false, null,],}`, `{"a":1,"$b_2":"two","c":[true,false,null]}`},
+		{`{'it\'s': 'say "hi"'}`, `{"it's":"say \"hi\""}`},
+		{`'\x41\u0042\uD83D\uDE00'`, "\"AB\U0001F600\""},
+		{"'line \\\ncontinuation'", `"line continuation"`},
+		{`[0x1F, -0xff, +1, .5, 5., 1e3, -1.5E-2]`, `[31,-255,1,0.5,5,1e3,-1.5E-2]`},
+	}
+	for _, test := range tests {
+		output, err := json5ToJSON([]byte(test.input))
+		if err != nil {
+			t.Fatalf("json5ToJSON(%q): %v", test.input, err)
+		}
+		if string(output) != test.output {
+			t.Fatalf("json5ToJSON(%q): expected %s, got %s", test.input, test.output, output)
+		}
+	}
+
+	invalids := []string{
+		``,
+		`{a: 1`,
+		`{a 1}`,
+		`[1 2]`,
+		`{"a": Infinity}`,
+		`[NaN]`,
+		`[inf]`,
+		`[0x1p3]`,
+		`[1_000]`,
+		`{"a": 1} /* unterminated`,
+		`'unterminated`,
+		`{"a": 1}}`,
+	}
+	for _, input := range invalids {
+		if _, err := json5ToJSON([]byte(input)); err == nil {
+			t.Fatalf("json5ToJSON(%q): expected an error", input)
+		}
+	}
+
+	// the deeply nested input is rejected instead of overflowing the stack
+	if _, err := json5ToJSON([]byte(strings.Repeat("[", 20_000_000))); err == nil || !strings.Contains(err.Error(), "max depth") {
+		t.Fatalf("json5ToJSON: expected the max depth error, got %v", err)
+	}
+	nested := strings.Repeat("[", maxJSON5Depth) + strings.Repeat("]", maxJSON5Depth)
+	if output, err := json5ToJSON([]byte(nested)); err != nil || string(output) != nested {
+		t.Fatalf("json5ToJSON: the nesting within the max depth should be allowed, got %v", err)
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -30,21 +30,24 @@ type LoaderOutput struct {
 	Error string `json:"error"`
 }
 
-func runLoader(loaderJsPath string, filename string, code string) (output *LoaderOutput, err error) {
+func runLoader(loaderJsPath string, filename string, code string, args ...string) (output *LoaderOutput, err error) {
 	stdout, recycle := NewBuffer()
 	defer recycle()
 	stderr, recycle := NewBuffer()
 	defer recycle()
 	cmd := exec.Command(
-		path.Join(config.WorkDir, "bin", loaderRuntime), "run",
-		"--no-config",
-		"--no-lock",
-		"--cached-only",
-		"--no-prompt",
-		"--allow-read=.",
-		"--quiet",
-		loaderJsPath,
-		filename, // args[0]
+		path.Join(config.WorkDir, "bin", loaderRuntime),
+		append([]string{
+			"run",
+			"--no-config",
+			"--no-lock",
+			"--cached-only",
+			"--no-prompt",
+			"--allow-read=.",
+			"--quiet",
+			loaderJsPath,
+			filename, // args[0]
+		}, args...)...,
 	)
 	cmd.Dir = os.TempDir()
 	cmd.Stdin = strings.NewReader(code)
@@ -140,16 +143,23 @@ func installLoaderRuntime() (err error) {
 		}
 	}
 
-	url, err := getLoaderRuntimeInstallURL()
+	downloadUrl, err := getLoaderRuntimeInstallURL()
 	if err != nil {
 		return
 	}
 
 	if DEBUG {
-		fmt.Println(term.Dim(fmt.Sprintf("Downloading %s...", path.Base(url))))
+		fmt.Println(term.Dim(fmt.Sprintf("Downloading %s...", path.Base(downloadUrl))))
 	}
 
-	res, err := http.Get(url)
+	u, err := url.Parse(downloadUrl)
+	if err != nil {
+		return
+	}
+	fetchClient, recycle := NewFetchClient(300, config.UserAgent, false)
+	defer recycle()
+
+	res, err := fetchClient.Fetch(u, nil)
 	if err != nil {
 		return
 	}
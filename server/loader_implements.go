@@ -21,8 +21,8 @@ var (
 	regexpVuePath    = regexp.MustCompile(`/\*?vue@([~\^]?[\w\+\-\.]+)(/|\?|&|$)`)
 )
 
-func transformSvelte(npmrc *NpmRC, svelteVersion string, filename string, code string) (output *LoaderOutput, err error) {
-	loaderExecPath := path.Join(npmrc.StoreDir(), "svelte@"+svelteVersion, "loader.js")
+func transformSvelte(npmrc *NpmRC, svelteVersion string, filename string, code string, isDev bool) (output *LoaderOutput, err error) {
+	loaderExecPath := path.Join(npmrc.StoreDir(), "svelte@"+svelteVersion, "loader-2.js")
 
 	once, _ := compileSyncMap.LoadOrStore(loaderExecPath, &sync.Once{})
 	err = once.(*sync.Once).Do(func() (err error) {
@@ -39,7 +39,7 @@ func transformSvelte(npmrc *NpmRC, svelteVersion string, filename string, code s
 		return
 	}
 
-	return runLoader(loaderExecPath, filename, code)
+	return runLoader(loaderExecPath, filename, code, loaderModeArg(isDev))
 }
 
 func compileSvelteLoader(npmrc *NpmRC, svelteVersion string, loaderExecPath string) (err error) {
@@ -61,7 +61,8 @@ func compileSvelteLoader(npmrc *NpmRC, svelteVersion string, loaderExecPath stri
 	    for await (const text of stdin.readable.pipeThrough(new TextDecoderStream())) {
 	      sourceCode += text;
 	    }
-	    const { js } = compile(sourceCode, { filename: Deno.args[0], css: "injected" });
+	    const dev = Deno.args[1] === "development";
+	    const { js } = compile(sourceCode, { filename: Deno.args[0], css: "injected", dev });
 	    await write("1\n" + js.code);
 	  } catch (err) {
 	    await write("0\n" + err.message);
@@ -225,9 +226,9 @@ func compileUnocssLoader(npmrc *NpmRC, loaderVersion string, loaderExecPath stri
 	return
 }
 
-func transformVue(npmrc *NpmRC, vueVersion string, filename string, code string) (output *LoaderOutput, err error) {
+func transformVue(npmrc *NpmRC, vueVersion string, filename string, code string, isDev bool) (output *LoaderOutput, err error) {
 	loaderVersion := "1.0.1" // @esm.sh/vue-compiler
-	loaderExecPath := path.Join(npmrc.StoreDir(), "@vue/compiler-sfc@"+vueVersion, "loader-"+loaderVersion+".js")
+	loaderExecPath := path.Join(npmrc.StoreDir(), "@vue/compiler-sfc@"+vueVersion, "loader-"+loaderVersion+"-2.js")
 
 	once, _ := compileSyncMap.LoadOrStore(loaderExecPath, &sync.Once{})
 	err = once.(*sync.Once).Do(func() (err error) {
@@ -244,7 +245,7 @@ func transformVue(npmrc *NpmRC, vueVersion string, filename string, code string)
 		return
 	}
 
-	return runLoader(loaderExecPath, filename, code)
+	return runLoader(loaderExecPath, filename, code, loaderModeArg(isDev))
 }
 
 func compileVueLoader(npmrc *NpmRC, vueVersion string, loaderVersion, loaderExecPath string) (err error) {
@@ -268,7 +269,8 @@ func compileVueLoader(npmrc *NpmRC, vueVersion string, loaderVersion, loaderExec
 	    for await (const text of stdin.readable.pipeThrough(new TextDecoderStream())) {
 	      sourceCode += text;
 	    }
-	    const { lang, code } = await transform(Deno.args[0], sourceCode, { imports: { "@vue/compiler-sfc": vueCompilerSFC } });
+	    const isDev = Deno.args[1] === "development";
+	    const { lang, code } = await transform(Deno.args[0], sourceCode, { imports: { "@vue/compiler-sfc": vueCompilerSFC }, isDev });
 	    await write((lang === "ts" ? '2' : '1') + '\n' + code);
 	  } catch (err) {
 	    await write("0\n" + err.message);
@@ -278,6 +280,15 @@ func compileVueLoader(npmrc *NpmRC, vueVersion string, loaderVersion, loaderExec
 	return
 }
 
+// loaderModeArg returns the mode argument of the framework loaders, the dev mode enables
+// the dev-only features of the compilers, e.g. the runtime warnings and the component filenames.
+func loaderModeArg(isDev bool) string {
+	if isDev {
+		return "development"
+	}
+	return "production"
+}
+
 func resolveVueVersion(npmrc *NpmRC, importMap common.ImportMap) (vueVersion string, err error) {
 	vueVersion = "3"
 	if len(importMap.Imports) > 0 {
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/ije/gox/crypto/rand"
+	"github.com/ije/gox/log"
+)
+
+// Logger is the logger interface of the build context.
+type Logger interface {
+	Debugf(format string, v ...any)
+	Infof(format string, v ...any)
+	Warnf(format string, v ...any)
+	Errorf(format string, v ...any)
+}
+
+// RequestLogger is a request-scoped logger that prefixes all the log lines with
+// the request id, the lines share the level and the file sink of the server logger.
+type RequestLogger struct {
+	logger *log.Logger
+	id     string
+}
+
+func NewRequestLogger(logger *log.Logger, id string) *RequestLogger {
+	return &RequestLogger{logger: logger, id: id}
+}
+
+func (l *RequestLogger) Debugf(format string, v ...any) {
+	l.logger.Debugf("[%s] %s", l.id, fmt.Sprintf(format, v...))
+}
+
+func (l *RequestLogger) Infof(format string, v ...any) {
+	l.logger.Infof("[%s] %s", l.id, fmt.Sprintf(format, v...))
+}
+
+func (l *RequestLogger) Warnf(format string, v ...any) {
+	l.logger.Warnf("[%s] %s", l.id, fmt.Sprintf(format, v...))
+}
+
+func (l *RequestLogger) Errorf(format string, v ...any) {
+	l.logger.Errorf("[%s] %s", l.id, fmt.Sprintf(format, v...))
+}
+
+// newRequestId generates a random request id.
+func newRequestId() string {
+	return rand.Hex.String(16)
+}
+
+// isValidRequestId checks if the `X-Request-Id` header that is set by the upstream proxy is valid.
+func isValidRequestId(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
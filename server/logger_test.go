@@ -0,0 +1,51 @@
+package server
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ije/gox/log"
+)
+
+func TestRequestLogger(t *testing.T) {
+	logFile := path.Join(t.TempDir(), "server.log")
+	logger, err := log.New("file:" + logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.SetQuite(true)
+	logger.SetLevelByName("info")
+
+	var l Logger = NewRequestLogger(logger, "abc123")
+	l.Debugf("build '%s' started", "/react@18.2.0/es2022/react.mjs")
+	l.Errorf("build '%s': %v", "/react@18.2.0/es2022/react.mjs", "100%")
+
+	data, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 log line with the `info` level, got %d:\n%s", len(lines), data)
+	}
+	if !strings.HasSuffix(lines[0], "[error] [abc123] build '/react@18.2.0/es2022/react.mjs': 100%") {
+		t.Fatalf("unexpected log line: %s", lines[0])
+	}
+}
+
+func TestIsValidRequestId(t *testing.T) {
+	for id, valid := range map[string]bool{
+		newRequestId():                         true,
+		"9f86d081-884c-7d65-9a2f-eaa0c55ad015": true,
+		"":                                     false,
+		"foo bar":                              false,
+		"foo\nbar":                             false,
+		strings.Repeat("a", 65):                false,
+	} {
+		if isValidRequestId(id) != valid {
+			t.Fatalf("isValidRequestId(%q) should be %v", id, valid)
+		}
+	}
+}
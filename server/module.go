@@ -11,7 +11,9 @@ import (
 
 	"github.com/esm-dev/esm.sh/server/common"
 	esbuild "github.com/evanw/esbuild/pkg/api"
+	esbuild_ast "github.com/ije/esbuild-internal/ast"
 	esbuild_config "github.com/ije/esbuild-internal/config"
+	"github.com/ije/esbuild-internal/helpers"
 	"github.com/ije/esbuild-internal/js_ast"
 	"github.com/ije/esbuild-internal/js_parser"
 	"github.com/ije/esbuild-internal/logger"
@@ -47,6 +49,11 @@ func validateModuleFile(filename string) (isESM bool, namedExports []string, err
 	if err != nil {
 		return
 	}
+	return parseModuleExports(filename, data)
+}
+
+// parseModuleExports parses the javascript/typescript module code and returns the named exports.
+func parseModuleExports(filename string, data []byte) (isESM bool, namedExports []string, err error) {
 	log := logger.NewDeferLog(logger.DeferLogNoVerboseOrDebug, nil)
 	parserOpts := js_parser.OptionsFromConfig(&esbuild_config.Options{
 		JSX: esbuild_config.JSXOptions{
@@ -77,8 +84,125 @@ func validateModuleFile(filename string) (isESM bool, namedExports []string, err
 	return
 }
 
+// parseESModuleInteropExports returns the named exports of a transpiled-ESM CommonJS module (compiled
+// by Babel/TypeScript) that sets `exports.__esModule`. The exports are derived statically from the top-level
+// `exports.NAME = ...` and `Object.defineProperty(exports, "NAME", ...)` statements; `ok` is false if the
+// module doesn't set the interop marker, or if `exports`/`module` is used in any other way.
+func parseESModuleInteropExports(filename string) (exports []string, ok bool) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, false
+	}
+	// fast check before parsing
+	if !strings.Contains(string(data), "__esModule") {
+		return nil, false
+	}
+	log := logger.NewDeferLog(logger.DeferLogNoVerboseOrDebug, nil)
+	ast, pass := js_parser.Parse(log, logger.Source{
+		Index:          0,
+		KeyPath:        logger.Path{Text: "<stdin>"},
+		PrettyPath:     "<stdin>",
+		IdentifierName: "stdin",
+		Contents:       string(data),
+	}, js_parser.OptionsFromConfig(&esbuild_config.Options{}))
+	if !pass || ast.ExportsKind == js_ast.ExportsESM || ast.ExportsKind == js_ast.ExportsESMWithDynamicFallback {
+		return nil, false
+	}
+
+	// the `exports` and `module` are unbound globals in the pass-through mode
+	getGlobal := func(name string) *esbuild_ast.Symbol {
+		if member, ok := ast.ModuleScope.Members[name]; ok {
+			if symbol := &ast.Symbols[member.Ref.InnerIndex]; symbol.Kind == esbuild_ast.SymbolUnbound {
+				return symbol
+			}
+		}
+		return nil
+	}
+	exportsSymbol := getGlobal("exports")
+	if exportsSymbol == nil {
+		return nil, false
+	}
+	if moduleSymbol := getGlobal("module"); moduleSymbol != nil && moduleSymbol.UseCountEstimate > 0 {
+		return nil, false
+	}
+	isGlobal := func(expr js_ast.Expr, name string) bool {
+		id, ok := expr.Data.(*js_ast.EIdentifier)
+		if !ok {
+			return false
+		}
+		symbol := ast.Symbols[id.Ref.InnerIndex]
+		return symbol.Kind == esbuild_ast.SymbolUnbound && symbol.OriginalName == name
+	}
+	isExports := func(expr js_ast.Expr) bool {
+		return isGlobal(expr, "exports")
+	}
+	// returns the property name of `exports.NAME` or `exports["NAME"]`
+	exportName := func(expr js_ast.Expr) (string, bool) {
+		switch e := expr.Data.(type) {
+		case *js_ast.EDot:
+			if isExports(e.Target) {
+				return e.Name, true
+			}
+		case *js_ast.EIndex:
+			if str, ok := e.Index.Data.(*js_ast.EString); ok && isExports(e.Target) {
+				return helpers.UTF16ToString(str.Value), true
+			}
+		}
+		return "", false
+	}
+
+	names := []string{}
+	for _, part := range ast.Parts {
+		for _, stmt := range part.Stmts {
+			sexpr, ok := stmt.Data.(*js_ast.SExpr)
+			if !ok {
+				continue
+			}
+			switch e := sexpr.Value.Data.(type) {
+			case *js_ast.EBinary:
+				// exports.a = exports.b = void 0;
+				for expr := e; expr != nil && expr.Op == js_ast.BinOpAssign; {
+					name, ok := exportName(expr.Left)
+					if !ok {
+						break
+					}
+					names = append(names, name)
+					expr, _ = expr.Right.Data.(*js_ast.EBinary)
+				}
+			case *js_ast.ECall:
+				// Object.defineProperty(exports, "a", { enumerable: true, get: function () { return a_1.a; } });
+				if dot, ok := e.Target.Data.(*js_ast.EDot); ok && dot.Name == "defineProperty" && isGlobal(dot.Target, "Object") && len(e.Args) == 3 && isExports(e.Args[0]) {
+					if str, ok := e.Args[1].Data.(*js_ast.EString); ok {
+						names = append(names, helpers.UTF16ToString(str.Value))
+					}
+				}
+			}
+		}
+	}
+
+	// all the `exports` references must be the recognized statements above, otherwise
+	// the exports may be assigned dynamically, e.g. `__exportStar(require("./a"), exports)`
+	if exportsSymbol.UseCountEstimate != uint32(len(names)) || !stringInSlice(names, "__esModule") {
+		return nil, false
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !seen[name] && isJsIdentifier(name) && !isJsReservedWord(name) {
+			seen[name] = true
+			exports = append(exports, name)
+		}
+	}
+	return exports, true
+}
+
 // minify minifies the given javascript code.
-func minify(code string, loader esbuild.Loader, target esbuild.Target) ([]byte, error) {
+// The legal comments are moved to the top of the code by default, and the `external` ones too
+// since the transform API has no output file to keep them.
+func minify(code string, loader esbuild.Loader, target esbuild.Target, legalComments esbuild.LegalComments) ([]byte, error) {
+	if legalComments == esbuild.LegalCommentsDefault {
+		legalComments = esbuild.LegalCommentsExternal
+	}
 	ret := esbuild.Transform(code, esbuild.TransformOptions{
 		Target:            target,
 		Format:            esbuild.FormatESModule,
@@ -86,7 +210,7 @@ func minify(code string, loader esbuild.Loader, target esbuild.Target) ([]byte,
 		MinifyWhitespace:  true,
 		MinifyIdentifiers: true,
 		MinifySyntax:      true,
-		LegalComments:     esbuild.LegalCommentsExternal,
+		LegalComments:     legalComments,
 		Loader:            loader,
 	})
 	if len(ret.Errors) > 0 {
@@ -96,8 +220,20 @@ func minify(code string, loader esbuild.Loader, target esbuild.Target) ([]byte,
 }
 
 func treeShake(code []byte, exports []string, target esbuild.Target) ([]byte, error) {
+	var names []string
+	var contents strings.Builder
+	for _, name := range exports {
+		if ns, ok := strings.CutPrefix(name, "*:"); ok {
+			fmt.Fprintf(&contents, "export * as %s from '.';", ns)
+		} else {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		fmt.Fprintf(&contents, "export { %s } from '.';", strings.Join(names, ", "))
+	}
 	input := &esbuild.StdinOptions{
-		Contents: fmt.Sprintf(`export { %s } from '.';`, strings.Join(exports, ", ")),
+		Contents: contents.String(),
 		Loader:   esbuild.LoaderJS,
 	}
 	plugins := []esbuild.Plugin{
@@ -235,7 +371,7 @@ func bundleHttpModule(npmrc *NpmRC, entry string, importMap common.ImportMap, co
 							if err != nil {
 								return esbuild.OnLoadResult{}, err
 							}
-							ret, err := transformSvelte(npmrc, svelteVersion, args.Path, code)
+							ret, err := transformSvelte(npmrc, svelteVersion, args.Path, code, false)
 							if err != nil {
 								return esbuild.OnLoadResult{}, err
 							}
@@ -245,7 +381,7 @@ func bundleHttpModule(npmrc *NpmRC, entry string, importMap common.ImportMap, co
 							if err != nil {
 								return esbuild.OnLoadResult{}, err
 							}
-							ret, err := transformVue(npmrc, vueVersion, args.Path, code)
+							ret, err := transformVue(npmrc, vueVersion, args.Path, code, false)
 							if err != nil {
 								return esbuild.OnLoadResult{}, err
 							}
@@ -272,7 +408,7 @@ func bundleHttpModule(npmrc *NpmRC, entry string, importMap common.ImportMap, co
 								if err != nil {
 									return esbuild.OnLoadResult{}, err
 								}
-								ret, err := transformSvelte(npmrc, svelteVersion, args.Path, string(svelteCode))
+								ret, err := transformSvelte(npmrc, svelteVersion, args.Path, string(svelteCode), false)
 								if err != nil {
 									return esbuild.OnLoadResult{}, err
 								}
@@ -286,7 +422,7 @@ func bundleHttpModule(npmrc *NpmRC, entry string, importMap common.ImportMap, co
 								if err != nil {
 									return esbuild.OnLoadResult{}, err
 								}
-								ret, err := transformVue(npmrc, vueVersion, args.Path, string(vueCode))
+								ret, err := transformVue(npmrc, vueVersion, args.Path, string(vueCode), false)
 								if err != nil {
 									return esbuild.OnLoadResult{}, err
 								}
@@ -40,6 +40,7 @@ type Package struct {
 	Version  string
 	Github   bool
 	PkgPrNew bool
+	Tarball  bool
 }
 
 func (p *Package) String() string {
@@ -50,6 +51,9 @@ func (p *Package) String() string {
 	if p.PkgPrNew {
 		return "pr/" + s
 	}
+	if p.Tarball {
+		return "tgz/" + s
+	}
 	return s
 }
 
@@ -59,6 +63,14 @@ type NpmPackageMetadata struct {
 	Versions map[string]PackageJSONRaw `json:"versions"`
 }
 
+// NpmPackageVersions defines the versions, dist-tags and publish times of a NPM package
+type NpmPackageVersions struct {
+	Name     string            `json:"name"`
+	DistTags map[string]string `json:"dist-tags"`
+	Versions []string          `json:"versions"`
+	Time     map[string]string `json:"time,omitempty"`
+}
+
 // PackageJSONRaw defines the package.json of a NPM package
 type PackageJSONRaw struct {
 	Name             string          `json:"name"`
@@ -74,6 +86,7 @@ type PackageJSONRaw struct {
 	SideEffects      any             `json:"sideEffects"`
 	Dependencies     any             `json:"dependencies"`
 	PeerDependencies any             `json:"peerDependencies"`
+	PeerDepsMeta     any             `json:"peerDependenciesMeta"`
 	Imports          any             `json:"imports"`
 	TypesVersions    any             `json:"typesVersions"`
 	Exports          json.RawMessage `json:"exports"`
@@ -81,6 +94,8 @@ type PackageJSONRaw struct {
 	Esmsh            any             `json:"esm.sh"`
 	Dist             json.RawMessage `json:"dist"`
 	Deprecated       any             `json:"deprecated"`
+	License          any             `json:"license"`
+	Browserslist     any             `json:"browserslist"`
 }
 
 // NpmPackageDist defines the dist field of a NPM package
@@ -103,12 +118,15 @@ type PackageJSON struct {
 	Browser          map[string]string
 	Dependencies     map[string]string
 	PeerDependencies map[string]string
+	OptionalPeerDeps set.ReadOnlySet[string]
 	Imports          map[string]any
 	TypesVersions    map[string]any
 	Exports          JSONObject
 	Esmsh            map[string]any
 	Dist             NpmPackageDist
 	Deprecated       string
+	License          string
+	Browserslist     []string
 }
 
 // ToNpmPackage converts PackageJSONRaw to PackageJSON
@@ -155,6 +173,15 @@ func (a *PackageJSONRaw) ToNpmPackage() *PackageJSON {
 		}
 	}
 
+	optionalPeerDeps := set.New[string]()
+	if m, ok := a.PeerDepsMeta.(map[string]any); ok {
+		for k, v := range m {
+			if meta, ok := v.(map[string]any); ok && meta["optional"] == true {
+				optionalPeerDeps.Add(k)
+			}
+		}
+	}
+
 	sideEffects := set.New[string]()
 	sideEffectsFalse := false
 	if a.SideEffects != nil {
@@ -199,6 +226,35 @@ func (a *PackageJSONRaw) ToNpmPackage() *PackageJSON {
 		}
 	}
 
+	license := ""
+	if a.License != nil {
+		if s, ok := a.License.(string); ok {
+			license = s
+		} else if m, ok := a.License.(map[string]any); ok {
+			// legacy format: { "type": "MIT", "url": "..." }
+			if s, ok := m["type"].(string); ok {
+				license = s
+			}
+		}
+	}
+
+	// the `browserslist` field can be a string, an array, or an object of the environments, e.g.
+	// { "production": [">0.2%", "not dead"], "development": ["last 1 chrome version"] }
+	var browserslist []string
+	queries := a.Browserslist
+	if m, ok := queries.(map[string]any); ok {
+		queries = m["production"]
+	}
+	if s, ok := queries.(string); ok {
+		browserslist = []string{s}
+	} else if arr, ok := queries.([]any); ok {
+		for _, v := range arr {
+			if s, ok := v.(string); ok {
+				browserslist = append(browserslist, s)
+			}
+		}
+	}
+
 	var dist NpmPackageDist
 	if a.Dist != nil {
 		json.Unmarshal(a.Dist, &dist)
@@ -217,12 +273,28 @@ func (a *PackageJSONRaw) ToNpmPackage() *PackageJSON {
 		SideEffects:      *sideEffects.ReadOnly(),
 		Dependencies:     dependencies,
 		PeerDependencies: peerDependencies,
+		OptionalPeerDeps: *optionalPeerDeps.ReadOnly(),
 		Imports:          toMap(a.Imports),
 		TypesVersions:    toMap(a.TypesVersions),
 		Exports:          exports,
 		Esmsh:            toMap(a.Esmsh),
 		Deprecated:       depreacted,
 		Dist:             dist,
+		License:          license,
+		Browserslist:     browserslist,
+	}
+
+	// extract the main entries from the `.` export if the `main` and `module` fields are absent, e.g.
+	// exports: { ".": { "types": "./index.d.ts", "import": "./index.mjs", "require": "./index.cjs" } }
+	if p.Main == "" && p.Module == "" {
+		if v, ok := exports.Get("."); ok {
+			if s, ok := v.(string); ok {
+				p.Main = s
+			} else if conditions, ok := v.(JSONObject); ok {
+				p.Module = getExportConditionEntry(conditions, "import", "module")
+				p.Main = getExportConditionEntry(conditions, "require", "default")
+			}
+		}
 	}
 
 	// normalize package module field
@@ -250,6 +322,68 @@ func (a *PackageJSON) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// MarshalJSON implements the json.Marshaler interface
+func (a *PackageJSON) MarshalJSON() ([]byte, error) {
+	m := map[string]any{
+		"name":    a.Name,
+		"version": a.Version,
+	}
+	if a.Type != "" {
+		m["type"] = a.Type
+	}
+	if a.Main != "" {
+		m["main"] = a.Main
+	}
+	if a.Module != "" {
+		m["module"] = a.Module
+	}
+	if a.Types != "" {
+		m["types"] = a.Types
+	}
+	if a.Typings != "" {
+		m["typings"] = a.Typings
+	}
+	if a.SideEffectsFalse {
+		m["sideEffects"] = false
+	} else if a.SideEffects.Len() > 0 {
+		m["sideEffects"] = a.SideEffects.Values()
+	}
+	if len(a.Browser) > 0 {
+		m["browser"] = a.Browser
+	}
+	if len(a.Dependencies) > 0 {
+		m["dependencies"] = a.Dependencies
+	}
+	if len(a.PeerDependencies) > 0 {
+		m["peerDependencies"] = a.PeerDependencies
+	}
+	if len(a.Imports) > 0 {
+		m["imports"] = a.Imports
+	}
+	if len(a.TypesVersions) > 0 {
+		m["typesVersions"] = a.TypesVersions
+	}
+	if a.Exports.Len() > 0 {
+		m["exports"] = a.Exports
+	}
+	if len(a.Esmsh) > 0 {
+		m["esm.sh"] = a.Esmsh
+	}
+	if a.Dist.Tarball != "" {
+		m["dist"] = a.Dist
+	}
+	if a.Deprecated != "" {
+		m["deprecated"] = a.Deprecated
+	}
+	if a.License != "" {
+		m["license"] = a.License
+	}
+	if len(a.Browserslist) > 0 {
+		m["browserslist"] = a.Browserslist
+	}
+	return json.Marshal(m)
+}
+
 type NpmRegistry struct {
 	Registry string `json:"registry"`
 	Token    string `json:"token"`
@@ -261,6 +395,8 @@ type NpmRC struct {
 	NpmRegistry
 	ScopedRegistries map[string]NpmRegistry `json:"scopedRegistries"`
 	zoneId           string
+	logger           Logger
+	db               DB
 }
 
 var (
@@ -297,6 +433,22 @@ func DefaultNpmRC() *NpmRC {
 	return defaultNpmRC
 }
 
+// WithLogger returns a copy of the npmrc that logs the retries of the registry requests with the given logger.
+func (npmrc *NpmRC) WithLogger(logger Logger) *NpmRC {
+	rc := *npmrc
+	rc.logger = logger
+	return &rc
+}
+
+// onFetchRetry returns the callback that logs the retry of a failed registry request
+func (npmrc *NpmRC) onFetchRetry(what string) func(attempt int, delay time.Duration, reason string) {
+	return func(attempt int, delay time.Duration, reason string) {
+		if npmrc.logger != nil {
+			npmrc.logger.Warnf("fetch %s failed (%s), retry in %v (%d/%d)", what, reason, delay, attempt, config.InstallRetries)
+		}
+	}
+}
+
 func NewNpmRcFromJSON(jsonData []byte) (npmrc *NpmRC, err error) {
 	var rc NpmRC
 	err = json.Unmarshal(jsonData, &rc)
@@ -378,18 +530,11 @@ func (npmrc *NpmRC) getPackageInfo(pkgName string, version string) (packageJson
 			header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(reg.User+":"+reg.Password)))
 		}
 
-		fetchClient, recycle := NewFetchClient(15, "esmd/"+VERSION, false)
+		fetchClient, recycle := NewFetchClient(15, config.UserAgent, false)
 		defer recycle()
 
-		retryTimes := 0
-	RETRY:
-		res, err := fetchClient.Fetch(u, header)
+		res, err := fetchClient.FetchWithRetry(u, header, int(config.InstallRetries), npmrc.onFetchRetry("metadata of '"+pkgName+"'"))
 		if err != nil {
-			if retryTimes < 3 {
-				retryTimes++
-				time.Sleep(time.Duration(retryTimes) * 100 * time.Millisecond)
-				goto RETRY
-			}
 			return nil, "", err
 		}
 		defer res.Body.Close()
@@ -435,12 +580,13 @@ func (npmrc *NpmRC) getPackageInfo(pkgName string, version string) (packageJson
 				return raw.ToNpmPackage(), getCacheKey(pkgName, raw.Version), nil
 			}
 		} else {
-			if version == "lastest" {
-				return nil, "", fmt.Errorf("version %s of '%s' not found", version, pkgName)
-			}
 			var c *semver.Constraints
 			c, err = semver.NewConstraint(version)
 			if err != nil {
+				// the version is a dist-tag that is not published, e.g. `lastest`
+				if npmVersioning.Match(version) {
+					return nil, "", fmt.Errorf("version %s of '%s' not found", version, pkgName)
+				}
 				// fallback to latest if semverOrDistTag is not a valid semver
 				version = "latest"
 				goto CHECK
@@ -477,6 +623,72 @@ func (npmrc *NpmRC) getPackageInfo(pkgName string, version string) (packageJson
 	})
 }
 
+// getPackageVersions returns the versions, dist-tags and publish times of a package from the registry
+func (npmrc *NpmRC) getPackageVersions(pkgName string) (versions *NpmPackageVersions, err error) {
+	reg := npmrc.getRegistryByPackageName(pkgName)
+	return withCache(reg.Registry+pkgName+"?versions", time.Duration(config.NpmQueryCacheTTL)*time.Second, func() (*NpmPackageVersions, string, error) {
+		u, err := url.Parse(reg.Registry + pkgName)
+		if err != nil {
+			return nil, "", err
+		}
+
+		header := http.Header{}
+		if reg.Token != "" {
+			header.Set("Authorization", "Bearer "+reg.Token)
+		} else if reg.User != "" && reg.Password != "" {
+			header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(reg.User+":"+reg.Password)))
+		}
+
+		fetchClient, recycle := NewFetchClient(15, config.UserAgent, false)
+		defer recycle()
+
+		res, err := fetchClient.Fetch(u, header)
+		if err != nil {
+			return nil, "", err
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode == 404 || res.StatusCode == 401 {
+			return nil, "", fmt.Errorf("package '%s' not found", pkgName)
+		}
+
+		if res.StatusCode != 200 {
+			msg, _ := io.ReadAll(res.Body)
+			return nil, "", fmt.Errorf("could not get metadata of package '%s' (%s: %s)", pkgName, res.Status, string(msg))
+		}
+
+		var metadata struct {
+			Name     string              `json:"name"`
+			DistTags map[string]string   `json:"dist-tags"`
+			Versions map[string]struct{} `json:"versions"`
+			Time     map[string]string   `json:"time"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&metadata)
+		if err != nil {
+			return nil, "", err
+		}
+
+		vs := make([]*semver.Version, 0, len(metadata.Versions))
+		for v := range metadata.Versions {
+			ver, err := semver.NewVersion(v)
+			if err == nil {
+				vs = append(vs, ver)
+			}
+		}
+		sort.Sort(semver.Collection(vs))
+		versions := &NpmPackageVersions{
+			Name:     metadata.Name,
+			DistTags: metadata.DistTags,
+			Versions: make([]string, len(vs)),
+			Time:     metadata.Time,
+		}
+		for i, v := range vs {
+			versions.Versions[i] = v.Original()
+		}
+		return versions, "", nil
+	})
+}
+
 func (npmrc *NpmRC) installPackage(pkg Package) (packageJson *PackageJSON, err error) {
 	installDir := path.Join(npmrc.StoreDir(), pkg.String())
 	packageJsonPath := path.Join(installDir, "node_modules", pkg.Name, "package.json")
@@ -510,8 +722,11 @@ func (npmrc *NpmRC) installPackage(pkg Package) (packageJson *PackageJSON, err e
 			defer f.Close()
 			fmt.Fprintf(f, `{"name":"%s","version":"%s"}`, pkg.Name, pkg.Version)
 		}
+	} else if pkg.Tarball {
+		// the tarball packages are installed by the `installTarball` function, the version is the digest of the tarball
+		err = npmrc.reinstallTarball(installDir, pkg)
 	} else if pkg.PkgPrNew {
-		err = fetchPackageTarball(&NpmRegistry{}, installDir, pkg.Name, "https://pkg.pr.new/"+pkg.Name+"@"+pkg.Version)
+		err = fetchPackageTarball(&NpmRegistry{}, installDir, pkg.Name, "https://pkg.pr.new/"+pkg.Name+"@"+pkg.Version, npmrc.onFetchRetry("tarball of '"+pkg.String()+"'"))
 	} else {
 		info, fetchErr := npmrc.getPackageInfo(pkg.Name, pkg.Version)
 		if fetchErr != nil {
@@ -520,7 +735,7 @@ func (npmrc *NpmRC) installPackage(pkg Package) (packageJson *PackageJSON, err e
 		if info.Deprecated != "" {
 			os.WriteFile(path.Join(installDir, "deprecated.txt"), []byte(info.Deprecated), 0644)
 		}
-		err = fetchPackageTarball(npmrc.getRegistryByPackageName(pkg.Name), installDir, info.Name, info.Dist.Tarball)
+		err = fetchPackageTarball(npmrc.getRegistryByPackageName(pkg.Name), installDir, info.Name, info.Dist.Tarball, npmrc.onFetchRetry("tarball of '"+pkg.String()+"'"))
 	}
 	if err != nil {
 		return
@@ -615,7 +830,7 @@ func (npmrc *NpmRC) isDeprecated(pkgName string, pkgVersion string) (string, err
 	return string(data), nil
 }
 
-func fetchPackageTarball(reg *NpmRegistry, installDir string, pkgName string, tarballUrl string) (err error) {
+func fetchPackageTarball(reg *NpmRegistry, installDir string, pkgName string, tarballUrl string, onRetry func(attempt int, delay time.Duration, reason string)) (err error) {
 	u, err := url.Parse(tarballUrl)
 	if err != nil {
 		return
@@ -628,18 +843,11 @@ func fetchPackageTarball(reg *NpmRegistry, installDir string, pkgName string, ta
 		header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(reg.User+":"+reg.Password)))
 	}
 
-	fetchClient, recycle := NewFetchClient(30, "esmd/"+VERSION, false)
+	fetchClient, recycle := NewFetchClient(30, config.UserAgent, false)
 	defer recycle()
 
-	retryTimes := 0
-RETRY:
-	res, err := fetchClient.Fetch(u, header)
+	res, err := fetchClient.FetchWithRetry(u, header, int(config.InstallRetries), onRetry)
 	if err != nil {
-		if retryTimes < 3 {
-			retryTimes++
-			time.Sleep(time.Duration(retryTimes) * 100 * time.Millisecond)
-			goto RETRY
-		}
 		return
 	}
 	defer res.Body.Close()
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetPackageInfoWithDistTag(t *testing.T) {
+	var requests int
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/dist-tag-pkg" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"name": "dist-tag-pkg",
+			"dist-tags": {
+				"latest": "1.1.0",
+				"next": "2.0.0-rc.1",
+				"insiders": "2.0.0-insiders.3"
+			},
+			"versions": {
+				"1.0.0": {"name": "dist-tag-pkg", "version": "1.0.0"},
+				"1.1.0": {"name": "dist-tag-pkg", "version": "1.1.0"},
+				"2.0.0-rc.1": {"name": "dist-tag-pkg", "version": "2.0.0-rc.1"},
+				"2.0.0-insiders.3": {"name": "dist-tag-pkg", "version": "2.0.0-insiders.3"}
+			}
+		}`))
+	}))
+	defer registry.Close()
+
+	npmrc := &NpmRC{NpmRegistry: NpmRegistry{Registry: registry.URL + "/"}}
+	for _, tc := range []struct {
+		version string
+		want    string
+	}{
+		{"", "1.1.0"},
+		{"latest", "1.1.0"},
+		{"next", "2.0.0-rc.1"},
+		{"insiders", "2.0.0-insiders.3"},
+		{"~1.0.0", "1.0.0"},
+	} {
+		p, err := npmrc.getPackageInfo("dist-tag-pkg", tc.version)
+		if err != nil {
+			t.Fatalf("getPackageInfo(%q): %v", tc.version, err)
+		}
+		if p.Version != tc.want {
+			t.Fatalf("getPackageInfo(%q): expected version %s, got %s", tc.version, tc.want, p.Version)
+		}
+	}
+
+	// the unpublished dist-tag should not fallback to the latest version
+	for _, tag := range []string{"beta", "lastest"} {
+		_, err := npmrc.getPackageInfo("dist-tag-pkg", tag)
+		if err == nil || !strings.HasSuffix(err.Error(), " not found") {
+			t.Fatalf("getPackageInfo(%q): expected a not found error, got %v", tag, err)
+		}
+	}
+
+	esm, _, exactVersion, _, err := praseEsmPath(npmrc, "/dist-tag-pkg@insiders/es2022/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exactVersion || esm.PkgVersion != "2.0.0-insiders.3" {
+		t.Fatalf("the dist-tag should be resolved to the exact version, got %s (exact: %v)", esm.PkgVersion, exactVersion)
+	}
+	if requests == 0 {
+		t.Fatal("the dist-tags should be resolved by the registry")
+	}
+}
+
+func TestPackageJSONLicense(t *testing.T) {
+	for _, tc := range []struct {
+		raw  string
+		want string
+	}{
+		{`{"name":"a","version":"1.0.0","license":"MIT"}`, "MIT"},
+		{`{"name":"a","version":"1.0.0","license":{"type":"ISC","url":"https://opensource.org/licenses/ISC"}}`, "ISC"},
+		{`{"name":"a","version":"1.0.0"}`, ""},
+	} {
+		var pkgJson PackageJSON
+		if err := pkgJson.UnmarshalJSON([]byte(tc.raw)); err != nil {
+			t.Fatal(err)
+		}
+		if pkgJson.License != tc.want {
+			t.Fatalf("expected license %q, got %q", tc.want, pkgJson.License)
+		}
+	}
+}
+
+func TestFetchWithRetry(t *testing.T) {
+	saved := fetchRetryDelay
+	fetchRetryDelay = time.Millisecond
+	defer func() { fetchRetryDelay = saved }()
+
+	var requests int
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/flaky":
+			if requests < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		case "/down":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer registry.Close()
+
+	fetchClient, recycle := NewFetchClient(15, "", false)
+	defer recycle()
+
+	for _, tc := range []struct {
+		path     string
+		status   int
+		requests int
+		delays   []time.Duration
+	}{
+		{"/flaky", 200, 3, []time.Duration{time.Millisecond, 2 * time.Millisecond}},
+		{"/down", 502, 4, []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond}},
+		// permanent errors are not retried
+		{"/not-found", 404, 1, nil},
+	} {
+		requests = 0
+		var delays []time.Duration
+		u, _ := url.Parse(registry.URL + tc.path)
+		res, err := fetchClient.FetchWithRetry(u, nil, 3, func(attempt int, delay time.Duration, reason string) {
+			delays = append(delays, delay)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.status || requests != tc.requests {
+			t.Fatalf("%s: expected status %d with %d requests, got %d with %d requests", tc.path, tc.status, tc.requests, res.StatusCode, requests)
+		}
+		if len(delays) != len(tc.delays) {
+			t.Fatalf("%s: expected %d retries, got %d", tc.path, len(tc.delays), len(delays))
+		}
+		for i, delay := range delays {
+			if delay != tc.delays[i] {
+				t.Fatalf("%s: expected the backoff delays %v, got %v", tc.path, tc.delays, delays)
+			}
+		}
+	}
+
+	// connection errors are retried as well
+	registry.Close()
+	requests = 0
+	retries := 0
+	u, _ := url.Parse(registry.URL + "/flaky")
+	_, err := fetchClient.FetchWithRetry(u, nil, 2, func(attempt int, delay time.Duration, reason string) {
+		retries++
+	})
+	if err == nil || retries != 2 {
+		t.Fatalf("expected the connection error after 2 retries, got %v with %d retries", err, retries)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-download":
+			// the whole download takes longer than the timeout, but the data keeps coming
+			for i := 0; i < 6; i++ {
+				w.Write([]byte("chunk\n"))
+				w.(http.Flusher).Flush()
+				time.Sleep(300 * time.Millisecond)
+			}
+		case "/stalled-headers":
+			time.Sleep(1500 * time.Millisecond)
+			w.Write([]byte("ok"))
+		case "/stalled-body":
+			w.Write([]byte("chunk\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(1500 * time.Millisecond)
+			w.Write([]byte("chunk\n"))
+		}
+	}))
+	defer registry.Close()
+
+	fetchClient, recycle := NewFetchClient(1, "", false)
+	defer recycle()
+
+	u, _ := url.Parse(registry.URL + "/slow-download")
+	res, err := fetchClient.Fetch(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf("the slow download should not be aborted: %v", err)
+	}
+	if string(data) != strings.Repeat("chunk\n", 6) {
+		t.Fatalf("unexpected body %q", data)
+	}
+
+	u, _ = url.Parse(registry.URL + "/stalled-headers")
+	_, err = fetchClient.Fetch(u, nil)
+	if err == nil || !isRetryableError(err) {
+		t.Fatalf("expected a retryable timeout error, got %v", err)
+	}
+
+	u, _ = url.Parse(registry.URL + "/stalled-body")
+	res, err = fetchClient.Fetch(u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(res.Body)
+	res.Body.Close()
+	if err == nil || !isRetryableError(err) {
+		t.Fatalf("expected a retryable timeout error, got %v", err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 type EsmPath struct {
 	GhPrefix      bool
 	PrPrefix      bool
+	TgzPrefix     bool
 	PkgName       string
 	PkgVersion    string
 	SubPath       string
@@ -24,6 +25,7 @@ func (p EsmPath) Package() Package {
 	return Package{
 		Github:   p.GhPrefix,
 		PkgPrNew: p.PrPrefix,
+		Tarball:  p.TgzPrefix,
 		Name:     p.PkgName,
 		Version:  p.PkgVersion,
 	}
@@ -40,6 +42,9 @@ func (p EsmPath) Name() string {
 	if p.PrPrefix {
 		return "pr/" + name
 	}
+	if p.TgzPrefix {
+		return "tgz/" + name
+	}
 	return name
 }
 
@@ -80,6 +85,25 @@ func praseEsmPath(npmrc *NpmRC, pathname string) (esm EsmPath, extraQuery string
 		return
 	}
 
+	// the packages installed from the tarball urls, e.g. `/tgz/foo@<digest>/sub`
+	if strings.HasPrefix(pathname, "/tgz/") {
+		var pkgName, version, subPath string
+		pkgName, version, subPath, hasTargetSegment = splitEsmPath(pathname[4:])
+		if !validatePackageName(pkgName) || !isTarballDigest(version) {
+			err = errors.New("invalid path")
+			return
+		}
+		withExactVersion = true
+		esm = EsmPath{
+			PkgName:       pkgName,
+			PkgVersion:    version,
+			SubPath:       subPath,
+			SubModuleName: stripEntryModuleExt(subPath),
+			TgzPrefix:     true,
+		}
+		return
+	}
+
 	var ghPrefix bool
 	if strings.HasPrefix(pathname, "/gh/") {
 		if !strings.ContainsRune(pathname[4:], '/') {
@@ -253,3 +277,78 @@ func toPackageName(specifier string) string {
 	name, _, _, _ := splitEsmPath(specifier)
 	return name
 }
+
+// splitPackageAlias splits the target of the `packageAliases` config into the package name and version,
+// e.g. "@myorg/ui-kit@^2" -> ("@myorg/ui-kit", "^2")
+func splitPackageAlias(to string) (pkgName string, version string) {
+	if strings.HasPrefix(to, "@") {
+		pkgName, version = utils.SplitByLastByte(to[1:], '@')
+		return "@" + pkgName, version
+	}
+	return utils.SplitByLastByte(to, '@')
+}
+
+// validatePackageAlias checks if the vanity name and the target of the `packageAliases` config are valid
+func validatePackageAlias(name string, to string) bool {
+	pkgName, version := splitPackageAlias(to)
+	// the vanity name can not shadow the path prefixes of the non-npm modules and the npm metadata proxy
+	if !validatePackageName(name) || isNonNpmPathPrefix(name) || name == "npm" || !validatePackageName(pkgName) || pkgName == name {
+		return false
+	}
+	if version != "" && !npmVersioning.Match(version) {
+		if _, err := semver.NewConstraint(version); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// rewritePackageAlias rewrites the vanity package name of the pathname to the target of the `packageAliases` config,
+// the version of the pathname takes precedence over the version of the target, e.g. `/ui/button` -> `/@myorg/ui-kit@^2/button`
+func rewritePackageAlias(pathname string) (rewritten string, vanityName string, ok bool) {
+	if len(config.PackageAliases) == 0 || !strings.HasPrefix(pathname, "/") {
+		return
+	}
+	segs := strings.SplitN(pathname[1:], "/", 3)
+	n := 1
+	if strings.HasPrefix(segs[0], "@") {
+		n = 2
+	}
+	if len(segs) < n {
+		return
+	}
+	nameAndVersion := strings.Join(segs[:n], "/")
+	subPath := ""
+	if rest := strings.Join(segs[n:], "/"); rest != "" {
+		subPath = "/" + rest
+	}
+	// the extra query of the path, e.g. `/ui&dev`
+	nameAndVersion, extraQuery := utils.SplitByFirstByte(nameAndVersion, '&')
+	if extraQuery != "" {
+		extraQuery = "&" + extraQuery
+	}
+	name, version := splitPackageAlias(nameAndVersion)
+	to, ok := config.PackageAliases[name]
+	if !ok {
+		return
+	}
+	pkgName, aliasVersion := splitPackageAlias(to)
+	if version == "" {
+		version = aliasVersion
+	}
+	if version != "" {
+		pkgName += "@" + version
+	}
+	return "/" + pkgName + extraQuery + subPath, name, true
+}
+
+// restorePackageAlias replaces the package name of the url with the vanity name, e.g.
+// "https://mirror/@myorg/ui-kit@2.0.0/button" -> "https://mirror/ui@2.0.0/button"
+func restorePackageAlias(u string, origin string, vanityName string, pkgName string) string {
+	for _, prefix := range []string{origin + "/", origin + "/*"} {
+		if rest, ok := strings.CutPrefix(u, prefix+pkgName); ok && (rest == "" || rest[0] == '@' || rest[0] == '/' || rest[0] == '?' || rest[0] == '&') {
+			return prefix + vanityName + rest
+		}
+	}
+	return u
+}
@@ -2,7 +2,9 @@ package server
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/sha1"
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -14,10 +16,12 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/esm-dev/esm.sh/server/common"
 	"github.com/esm-dev/esm.sh/server/storage"
 	esbuild "github.com/evanw/esbuild/pkg/api"
@@ -39,6 +43,8 @@ const (
 	EsmBuild
 	// source map
 	EsmSourceMap
+	// legal comments extracted by the `?legal-comments=external` query
+	EsmLegalComments
 	// *.d.ts
 	EsmDts
 	// package raw file
@@ -54,15 +60,40 @@ const (
 	ctJSON           = "application/json; charset=utf-8"
 	ctJavaScript     = "application/javascript; charset=utf-8"
 	ctTypeScript     = "application/typescript; charset=utf-8"
+	ctText           = "text/plain; charset=utf-8"
 )
 
+// stable error codes of the JSON error responses
+const (
+	errCodeResolve     = "E_RESOLVE"
+	errCodeUnsupported = "E_UNSUPPORTED"
+	errCodeTimeout     = "E_TIMEOUT"
+	errCodeNotFound    = "E_NOT_FOUND"
+	errCodeBuild       = "E_BUILD"
+)
+
+var errorStatusCodes = map[string]int{
+	errCodeResolve:     http.StatusNotFound,
+	errCodeUnsupported: http.StatusUnprocessableEntity,
+	errCodeTimeout:     http.StatusRequestTimeout,
+	errCodeNotFound:    http.StatusNotFound,
+	errCodeBuild:       http.StatusInternalServerError,
+}
+
 func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Handle {
 	var (
 		startTime  = time.Now()
 		globalETag = fmt.Sprintf(`W/"%s"`, VERSION)
 		buildQueue = NewBuildQueue(int(config.BuildConcurrency))
+		artifactGC *ArtifactGC
 	)
 
+	// remove the stale build artifacts of the storage periodically
+	if config.GC.Interval > 0 {
+		artifactGC = NewArtifactGC(db, buildStorage, logger, config.GC)
+		artifactGC.Serve(time.Duration(config.GC.Interval) * time.Second)
+	}
+
 	return func(ctx *rex.Context) any {
 		pathname := ctx.R.URL.Path
 
@@ -71,13 +102,45 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			return rex.Status(404, "not found")
 		}
 
+		// attach a request id to the log lines of the request, use the `X-Request-Id` header of the upstream proxy if it's valid
+		requestId := ctx.R.Header.Get("X-Request-Id")
+		if !isValidRequestId(requestId) {
+			requestId = newRequestId()
+		}
+		ctx.SetHeader("X-Request-Id", requestId)
+		reqLogger := NewRequestLogger(logger, requestId)
+		reqLogger.Debugf("%s %s (ip: %s)", ctx.R.Method, ctx.R.URL.RequestURI(), ctx.RemoteIP())
+
 		// handle POST API requests
 		switch ctx.R.Method {
 		case "POST":
 			switch pathname {
 			case "/transform":
 				var options TransformOptions
-				err := json.NewDecoder(io.LimitReader(ctx.R.Body, 2*MB)).Decode(&options)
+				var body io.Reader = io.LimitReader(ctx.R.Body, 2*MB)
+				if ctx.R.Header.Get("Content-Encoding") == "gzip" {
+					// limit both the compressed and the decompressed size to prevent zip bombs
+					if ctx.R.ContentLength > 2*MB {
+						ctx.R.Body.Close()
+						return rex.Err(413, "Body is too large")
+					}
+					gr, err := gzip.NewReader(body)
+					if err != nil {
+						ctx.R.Body.Close()
+						return rex.Err(400, "require valid gzip body")
+					}
+					data, err := io.ReadAll(io.LimitReader(gr, 2*MB+1))
+					if err != nil {
+						ctx.R.Body.Close()
+						return rex.Err(400, "require valid gzip body")
+					}
+					if len(data) > 2*MB {
+						ctx.R.Body.Close()
+						return rex.Err(413, "Body is too large")
+					}
+					body = bytes.NewReader(data)
+				}
+				err := json.NewDecoder(body).Decode(&options)
 				ctx.R.Body.Close()
 				if err != nil {
 					return rex.Err(400, "require valid json body")
@@ -85,6 +148,9 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				if options.Code == "" {
 					return rex.Err(400, "Code is required")
 				}
+				if len(options.Conditions) > int(config.MaxQueryListLength) {
+					return rex.Err(400, fmt.Sprintf("Too many conditions, the maximum is %d", config.MaxQueryListLength))
+				}
 				if len(options.Code) > MB {
 					return rex.Err(429, "Code is too large")
 				}
@@ -103,29 +169,29 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				h.Write([]byte(options.JsxImportSource))
 				h.Write([]byte(options.SourceMap))
 				h.Write([]byte(fmt.Sprintf("%v", options.Minify)))
+				// the `?safe` mode rejects the unsafe import map targets and strips the `node:` imports
+				safe := ctx.Query().Has("safe")
+				if safe {
+					h.Write([]byte("safe"))
+				}
+				if options.Conditions != nil {
+					h.Write([]byte("conditions:" + strings.Join(options.Conditions, ",")))
+				}
 				hash := hex.EncodeToString(h.Sum(nil))
 
+				// the hash can be used to check the cached result by the `GET /transform/<hash>` API
+				ctx.SetHeader("X-ESM-Transform-Hash", hash)
+				ctx.SetHeader("Access-Control-Expose-Headers", "X-ESM-Transform-Hash")
+
 				// if previous build exists, return it directly
 				savePath := normalizeSavePath(ctx.R.Header.Get("X-Zone-Id"), fmt.Sprintf("modules/transform/%s.mjs", hash))
-				if file, _, err := buildStorage.Get(savePath); err == nil {
-					data, err := io.ReadAll(file)
-					file.Close()
-					if err != nil {
-						return rex.Err(500, "failed to read code")
-					}
-					output := TransformOutput{
-						Code: string(data),
-					}
-					file, _, err = buildStorage.Get(savePath + ".map")
-					if err == nil {
-						data, err = io.ReadAll(file)
-						file.Close()
-						if err == nil {
-							output.Map = string(data)
-						}
-					}
+				output, err := getTransformOutput(buildStorage, savePath)
+				if err == nil {
 					return output
 				}
+				if err != storage.ErrNotFound {
+					return rex.Err(500, err.Error())
+				}
 
 				importMap := common.ImportMap{Imports: map[string]string{}}
 				if len(options.ImportMap) > 0 {
@@ -135,9 +201,10 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 					}
 				}
 
-				output, err := transform(&ResolvedTransformOptions{
+				output, err = transform(&ResolvedTransformOptions{
 					TransformOptions: options,
 					importMap:        importMap,
+					safe:             safe,
 				})
 				if err != nil {
 					return rex.Err(400, err.Error())
@@ -146,12 +213,73 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 					output.Code = fmt.Sprintf("%s//# sourceMappingURL=+%s", output.Code, path.Base(savePath)+".map")
 					go buildStorage.Put(savePath+".map", strings.NewReader(output.Map))
 				}
+				if len(output.Rejected) > 0 {
+					go buildStorage.Put(savePath+".rejected", strings.NewReader(strings.Join(output.Rejected, "\n")))
+				}
+				// resolve the bare imports to esm.sh urls with the `conditions` when it's present
+				if options.Conditions != nil && len(output.bareImports) > 0 {
+					output.Imports, err = resolveTransformImports(DefaultNpmRC(), getOrigin(ctx), output.bareImports, options.Target, options.Conditions)
+					if err != nil {
+						return rex.Err(400, err.Error())
+					}
+					go buildStorage.Put(savePath+".imports", bytes.NewReader(utils.MustEncodeJSON(output.Imports)))
+				}
 				go buildStorage.Put(savePath, strings.NewReader(output.Code))
 				ctx.SetHeader("Cache-Control", ccMustRevalidate)
 				return output
 
 			case "/purge":
 				zoneId := ctx.FormValue("zoneId")
+				// evict a single build by the build id, e.g. `/react@18.3.1/es2022/react.mjs`
+				if buildId := ctx.FormValue("buildId"); buildId != "" {
+					if !strings.HasPrefix(buildId, "/") || !strings.HasSuffix(buildId, ".mjs") || strings.Contains(buildId, "/../") {
+						return rex.Err(400, "invalid build id")
+					}
+					savePath := normalizeSavePath(zoneId, path.Join("modules", buildId))
+					// only purge the build if it matches the expected etag to avoid racing a concurrent rebuild
+					if ifMatch := ctx.R.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" {
+						stat, err := buildStorage.Stat(savePath)
+						if err != nil && err != storage.ErrNotFound {
+							return rex.Err(500, err.Error())
+						}
+						matched := false
+						if err == nil {
+							etag := statETag(stat)
+							for _, v := range strings.Split(ifMatch, ",") {
+								if strings.TrimSpace(v) == etag {
+									matched = true
+									break
+								}
+							}
+						}
+						if !matched {
+							return rex.Err(412, "build has been changed")
+						}
+					}
+					deleteKeys := []string{}
+					cssSavePath := strings.TrimSuffix(savePath, ".mjs") + ".css"
+					for _, key := range []string{savePath, savePath + ".map", savePath + ".integrity", cssSavePath, cssSavePath + ".integrity"} {
+						if _, err := buildStorage.Stat(key); err == nil {
+							deleteKeys = append(deleteKeys, key)
+						} else if err != storage.ErrNotFound {
+							return rex.Err(500, err.Error())
+						}
+					}
+					if len(deleteKeys) > 0 {
+						err := buildStorage.Delete(deleteKeys...)
+						if err != nil {
+							return rex.Err(500, err.Error())
+						}
+					}
+					dbKey := zoneId + ":" + buildId
+					err := db.Delete(dbKey)
+					if err != nil {
+						return rex.Err(500, err.Error())
+					}
+					cacheLRU.Remove(dbKey)
+					reqLogger.Infof("Purged %d files for build %s (ip: %s)", len(deleteKeys), buildId, ctx.RemoteIP())
+					return map[string]any{"deleted": deleteKeys}
+				}
 				packageName := ctx.FormValue("package")
 				version := ctx.FormValue("version")
 				if packageName == "" {
@@ -175,7 +303,7 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				deleteKeys := make([]string, len(deletedBuildFiles)+len(deletedDTSFiles))
 				copy(deleteKeys, deletedBuildFiles)
 				copy(deleteKeys[len(deletedBuildFiles):], deletedDTSFiles)
-				logger.Infof("Purged %d files for %s@%s (ip: %s)", len(deleteKeys), packageName, version, ctx.RemoteIP())
+				reqLogger.Infof("Purged %d files for %s@%s (ip: %s)", len(deleteKeys), packageName, version, ctx.RemoteIP())
 				return map[string]any{"deleted": deleteKeys}
 
 			default:
@@ -315,67 +443,43 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				disk = "error"
 			}
 
-			ctx.SetHeader("Cache-Control", ccMustRevalidate)
-			return map[string]any{
-				"buildQueue": q[:i],
-				"version":    VERSION,
-				"uptime":     time.Since(startTime).String(),
-				"disk":       disk,
+			status := map[string]any{
+				"buildQueue":     q[:i],
+				"version":        VERSION,
+				"uptime":         time.Since(startTime).String(),
+				"disk":           disk,
+				"bundlePackages": config.BundlePackages,
 			}
+			if artifactGC != nil {
+				status["gc"] = artifactGC.Stats()
+			}
+			ctx.SetHeader("Cache-Control", ccMustRevalidate)
+			return status
 
 		case "/error.js":
-			switch query := ctx.Query(); query.Get("type") {
+			query := ctx.Query()
+			var code, message string
+			switch query.Get("type") {
 			case "resolve":
-				return errorJS(ctx, fmt.Sprintf(
-					`Could not resolve "%s" (Imported by "%s")`,
-					query.Get("name"),
-					query.Get("importer"),
-				))
+				code, message = errCodeResolve, "Could not resolve"
 			case "unsupported-node-builtin-module":
-				return errorJS(ctx, fmt.Sprintf(
-					`Unsupported Node builtin module "%s" (Imported by "%s")`,
-					query.Get("name"),
-					query.Get("importer"),
-				))
+				code, message = errCodeUnsupported, "Unsupported Node builtin module"
 			case "unsupported-node-native-module":
-				return errorJS(ctx, fmt.Sprintf(
-					`Unsupported node native module "%s" (Imported by "%s")`,
-					query.Get("name"),
-					query.Get("importer"),
-				))
+				code, message = errCodeUnsupported, "Unsupported node native module"
 			case "unsupported-npm-package":
-				return errorJS(ctx, fmt.Sprintf(
-					`Unsupported NPM package "%s" (Imported by "%s")`,
-					query.Get("name"),
-					query.Get("importer"),
-				))
+				code, message = errCodeUnsupported, "Unsupported NPM package"
 			case "unsupported-file-dependency":
-				return errorJS(ctx, fmt.Sprintf(
-					`Unsupported file dependency "%s" (Imported by "%s")`,
-					query.Get("name"),
-					query.Get("importer"),
-				))
+				code, message = errCodeUnsupported, "Unsupported file dependency"
 			case "unsupported-git-dependency":
-				return errorJS(ctx, fmt.Sprintf(
-					`Unsupported git dependency "%s" (Imported by "%s")`,
-					query.Get("name"),
-					query.Get("importer"),
-				))
+				code, message = errCodeUnsupported, "Unsupported git dependency"
 			case "invalid-jsr-dependency":
-				return errorJS(ctx, fmt.Sprintf(
-					`Invalid jsr dependency "%s" (Imported by "%s")`,
-					query.Get("name"),
-					query.Get("importer"),
-				))
+				code, message = errCodeResolve, "Invalid jsr dependency"
 			case "invalid-http-dependency":
-				return errorJS(ctx, fmt.Sprintf(
-					`Invalid http dependency "%s" (Imported by "%s")`,
-					query.Get("name"),
-					query.Get("importer"),
-				))
+				code, message = errCodeResolve, "Invalid http dependency"
 			default:
 				return rex.Status(500, "Unknown error")
 			}
+			return errorJS(ctx, code, fmt.Sprintf(`%s "%s" (Imported by "%s")`, message, query.Get("name"), query.Get("importer")))
 
 		// builtin scripts
 		case "/x", "/tsx", "/run":
@@ -388,7 +492,7 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			target := strings.ToLower(ctx.Query().Get("target"))
 			targetFromUA := targets[target] == 0
 			if targetFromUA {
-				target = getBuildTargetByUA(ctx.UserAgent())
+				target = getBuildTargetByRequest(ctx.R.Header)
 			}
 
 			cacheTtl := 31536000
@@ -399,14 +503,22 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			if pathname == "/run" {
 				filename = "embed/tsx.ts"
 			}
-			js, err := withCache(filename+"?"+target, time.Duration(cacheTtl)*time.Second, func() (js []byte, _ string, err error) {
+			legalComments := ctx.Query().Get("legal-comments")
+			if _, ok := legalCommentsModes[legalComments]; legalComments != "" && !ok {
+				return rex.Status(400, "Invalid legal-comments query: "+legalComments)
+			}
+			cacheKey := filename + "?" + target
+			if legalComments != "" {
+				cacheKey += "&legal-comments=" + legalComments
+			}
+			js, err := withCache(cacheKey, time.Duration(cacheTtl)*time.Second, func() (js []byte, _ string, err error) {
 				data, err := embedFS.ReadFile(filename)
 				if err != nil {
 					return
 				}
 				// replace `$TARGET` with the target
 				data = bytes.ReplaceAll(data, []byte("$TARGET"), []byte(target))
-				js, err = minify(string(data), esbuild.LoaderTS, targets[target])
+				js, err = minify(string(data), esbuild.LoaderTS, targets[target], legalCommentsModes[legalComments])
 				return
 			})
 			if err != nil {
@@ -419,12 +531,42 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			}
 			ctx.SetHeader("Etag", globalETag)
 			if targetFromUA {
-				appendVaryHeader(ctx.W.Header(), "User-Agent")
+				appendVaryTargetHeaders(ctx.W.Header())
 			}
 			ctx.SetHeader("Content-Type", ctJavaScript)
 			return js
 		}
 
+		// check or fetch the cached result of the `/transform` API by the hash, the `HEAD` method only checks the existence
+		if strings.HasPrefix(pathname, "/transform/") {
+			hash := pathname[11:]
+			if len(hash) != 40 || !valid.IsHexString(hash) {
+				return rex.Err(404, "Not Found")
+			}
+			savePath := normalizeSavePath(ctx.R.Header.Get("X-Zone-Id"), fmt.Sprintf("modules/transform/%s.mjs", hash))
+			if ctx.R.Method == http.MethodHead {
+				_, err := buildStorage.Stat(savePath)
+				if err != nil {
+					if err == storage.ErrNotFound {
+						return rex.Status(404, "Not Found")
+					}
+					return rex.Status(500, err.Error())
+				}
+				ctx.SetHeader("Cache-Control", ccMustRevalidate)
+				ctx.SetHeader("Content-Type", ctJSON)
+				return []byte{}
+			}
+			output, err := getTransformOutput(buildStorage, savePath)
+			if err != nil {
+				if err == storage.ErrNotFound {
+					return rex.Err(404, "Not Found")
+				}
+				return rex.Err(500, err.Error())
+			}
+			ctx.SetHeader("Cache-Control", ccMustRevalidate)
+			return output
+		}
+
 		// module generated by the `/transform` API
 		if strings.HasPrefix(pathname, "/+") {
 			hash, ext := utils.SplitByFirstByte(pathname[2:], '.')
@@ -434,6 +576,9 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			savePath := normalizeSavePath(ctx.R.Header.Get("X-Zone-Id"), fmt.Sprintf("modules/transform/%s.%s", hash, ext))
 			f, fi, err := buildStorage.Get(savePath)
 			if err != nil {
+				if err == storage.ErrNotFound {
+					return rex.Status(404, "Not Found")
+				}
 				return rex.Status(500, err.Error())
 			}
 			if strings.HasSuffix(pathname, ".map") {
@@ -526,10 +671,114 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				}
 			}
 		}
+		// log the retries of the registry requests with the request id
+		npmrc = npmrc.WithLogger(reqLogger)
+		npmrc.db = db
 		if zoneIdHeader != "" {
 			npmrc.zoneId = zoneIdHeader
 		}
 
+		// proxy the package metadata (versions, dist-tags and publish times) of the registry with CORS enabled
+		if pkgName := strings.TrimPrefix(pathname, "/npm/"); len(pkgName) < len(pathname) && validatePackageName(pkgName) {
+			if !config.AllowList.IsPackageAllowed(pkgName) || config.BanList.IsPackageBanned(pkgName) {
+				return forbiddenStatus(ctx, pkgName)
+			}
+			versions, err := npmrc.getPackageVersions(pkgName)
+			if err != nil {
+				if strings.HasSuffix(err.Error(), " not found") {
+					return rex.Status(404, err.Error())
+				}
+				return rex.Status(500, err.Error())
+			}
+			if ctx.R.Header.Get("X-Npmrc") != "" {
+				// do not share the metadata of private registries in public caches
+				ctx.SetHeader("Cache-Control", fmt.Sprintf("private, max-age=%d", config.FloatCacheTTL))
+			} else {
+				ctx.SetHeader("Cache-Control", ccFloat())
+			}
+			return versions
+		}
+
+		// generate an import map that pins the entry module and its dependency closure, or the `/closure.d.ts` that
+		// declares the types of the closure
+		// note: without the `entry` param, the path is treated as the `importmap` package
+		if (pathname == "/importmap" && ctx.Query().Has("entry")) || pathname == "/closure.d.ts" {
+			query := ctx.Query()
+			entry := strings.TrimSpace(query.Get("entry"))
+			if entry == "" {
+				return rex.Status(400, "Missing `entry` Param")
+			}
+			esm, _, _, _, err := praseEsmPath(npmrc, "/"+strings.TrimPrefix(entry, "/"))
+			if err != nil {
+				if strings.HasSuffix(err.Error(), " not found") {
+					return rex.Status(404, err.Error())
+				}
+				return rex.Status(400, "Invalid `entry` Param: "+err.Error())
+			}
+			if !config.AllowList.IsPackageAllowed(esm.PkgName) || config.BanList.IsPackageBanned(esm.PkgName) {
+				return forbiddenStatus(ctx, esm.PkgName)
+			}
+			target := strings.ToLower(query.Get("target"))
+			targetFromUA := targets[target] == 0
+			if targetFromUA {
+				target = getBuildTargetByRequest(ctx.R.Header)
+			}
+			bundleMode := BundleDefault
+			if stringInSlice(config.BundlePackages, esm.PkgName) {
+				bundleMode = BundleDeps
+			}
+			buildArgs := BuildArgs{}
+			err = resolveBuildArgs(npmrc, path.Join(npmrc.StoreDir(), esm.Name()), &buildArgs, esm)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			buildCtx := &BuildContext{
+				npmrc:      npmrc,
+				logger:     reqLogger,
+				db:         db,
+				storage:    buildStorage,
+				esm:        esm,
+				args:       buildArgs,
+				bundleMode: bundleMode,
+				target:     target,
+				dev:        query.Has("dev"),
+			}
+			walker := NewImportMapWalker(buildQueue, getOrigin(ctx), time.Duration(config.BuildWaitTime)*time.Second)
+			var importMap common.ImportMap
+			var closureDts []byte
+			if pathname == "/closure.d.ts" {
+				closureDts, err = withCache("closure.d.ts:"+npmrc.zoneId+":"+getOrigin(ctx)+buildCtx.Path(), time.Duration(config.NpmQueryCacheTTL)*time.Second, func() ([]byte, string, error) {
+					dts, err := walker.WalkTypes(buildCtx)
+					return dts, "", err
+				})
+			} else {
+				importMap, err = walker.Walk(buildCtx)
+			}
+			if err != nil {
+				if err == errBuildTimeout {
+					ctx.SetHeader("Cache-Control", ccMustRevalidate)
+					return errorStatus(ctx, http.StatusRequestTimeout, errCodeTimeout, "timeout, the modules are waiting to be built, please try refreshing the page.")
+				}
+				if err == errModuleGraphTooLarge {
+					return rex.Status(400, err.Error())
+				}
+				if strings.HasSuffix(err.Error(), " not found") {
+					return rex.Status(404, err.Error())
+				}
+				return rex.Status(500, err.Error())
+			}
+			if targetFromUA {
+				appendVaryTargetHeaders(ctx.W.Header())
+			}
+			// the closure may change when new versions of the dependencies are published
+			ctx.SetHeader("Cache-Control", ccFloat())
+			if closureDts != nil {
+				ctx.SetHeader("Content-Type", ctTypeScript)
+				return closureDts
+			}
+			return importMap
+		}
+
 		if strings.HasPrefix(pathname, "/http://") || strings.HasPrefix(pathname, "/https://") {
 			query := ctx.Query()
 			modUrl, err := url.Parse(pathname[1:])
@@ -832,6 +1081,43 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			}
 		}
 
+		// install the package from the tarball url and redirect to the immutable `/tgz/<name>@<digest>` path,
+		// e.g. `/tgz/https%3A%2F%2Fexample.com%2Ffoo-1.0.0.tgz/sub` -> `/tgz/foo@<digest>/sub`
+		if strings.HasPrefix(pathname, "/tgz/") && strings.Contains(pathname, "://") {
+			if len(config.TarballHosts) == 0 {
+				return errorStatus(ctx, 404, errCodeNotFound, "building from tarball urls is disabled")
+			}
+			rawUrl, subPath := utils.SplitByFirstByte(strings.TrimPrefix(ctx.R.URL.EscapedPath(), "/tgz/"), '/')
+			tarballUrl, err := url.PathUnescape(rawUrl)
+			if err != nil {
+				return rex.Status(400, "invalid tarball url")
+			}
+			if _, err = validateTarballUrl(tarballUrl); err != nil {
+				if strings.HasSuffix(err.Error(), " not allowed") {
+					return rex.Status(403, err.Error())
+				}
+				return rex.Status(400, err.Error())
+			}
+			pkg, err := npmrc.installTarball(tarballUrl)
+			if err != nil {
+				if strings.HasSuffix(err.Error(), " not found") {
+					return errorStatus(ctx, 404, errCodeNotFound, err.Error())
+				}
+				return rex.Status(500, err.Error())
+			}
+			if !config.AllowList.IsPackageAllowed(pkg.Name) || config.BanList.IsPackageBanned(pkg.Name) {
+				return forbiddenStatus(ctx, pkg.Name)
+			}
+			if subPath != "" {
+				subPath = "/" + subPath
+			}
+			if ctx.R.URL.RawQuery != "" {
+				subPath += "?" + ctx.R.URL.RawQuery
+			}
+			// the url may point to another tarball later, so the redirect is not permanent
+			return redirect(ctx, fmt.Sprintf("%s/%s%s", getOrigin(ctx), pkg.String(), subPath), false)
+		}
+
 		// check `/*pathname` pattern
 		asteriskPrefix := false
 		if strings.HasPrefix(pathname, "/*") {
@@ -851,6 +1137,18 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			pathname = "/pr/" + pathname[13:]
 		}
 
+		// rewrite the vanity package name of the `packageAliases` config, e.g. `/ui` -> `/@myorg/ui-kit@^2`,
+		// the redirects keep the vanity name
+		if rewritten, vanityName, ok := rewritePackageAlias(pathname); ok {
+			pathname = rewritten
+			pkgName, _ := splitPackageAlias(config.PackageAliases[vanityName])
+			defer func() {
+				if location := ctx.W.Header().Get("Location"); location != "" {
+					ctx.W.Header().Set("Location", restorePackageAlias(location, getOrigin(ctx), vanityName, pkgName))
+				}
+			}()
+		}
+
 		esm, extraQuery, isExactVersion, hasTargetSegment, err := praseEsmPath(npmrc, pathname)
 		if err != nil {
 			status := 500
@@ -858,7 +1156,7 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			if strings.HasPrefix(message, "invalid") {
 				status = 400
 			} else if strings.HasSuffix(message, " not found") {
-				status = 404
+				return errorStatus(ctx, 404, errCodeNotFound, message)
 			}
 			return rex.Status(status, message)
 		}
@@ -866,7 +1164,7 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 		pkgAllowed := config.AllowList.IsPackageAllowed(esm.PkgName)
 		pkgBanned := config.BanList.IsPackageBanned(esm.PkgName)
 		if !pkgAllowed || pkgBanned {
-			return rex.Status(403, "forbidden")
+			return forbiddenStatus(ctx, esm.PkgName)
 		}
 
 		origin := getOrigin(ctx)
@@ -876,6 +1174,8 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			registryPrefix = "/gh"
 		} else if esm.PrPrefix {
 			registryPrefix = "/pr"
+		} else if esm.TgzPrefix {
+			registryPrefix = "/tgz"
 		}
 
 		// redirect `/@types/PKG` to it's main dts file
@@ -936,12 +1236,52 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 		// parse the query
 		query := ctx.Query()
 
+		// limit the number of items in the list queries to protect the resolver and keep the build id bounded
+		if err := checkQueryListLength(query, "alias", "deps", "external", "exports", "conditions", "define"); err != nil {
+			return rex.Status(400, err.Error())
+		}
+
+		// reject the reserved words of the `?exports` query, they can't be the binding names of the entry module
+		if err := validateExportsQuery(query.Get("exports")); err != nil {
+			return rex.Status(400, err.Error())
+		}
+
+		// the `?v` query is a cache-buster for consumers who append a deployment hash to bust their own edge cache,
+		// it doesn't change the build id, but the responses of the floating versions are cached immutably.
+		cacheBusted := false
+		if v := query.Get("v"); v != "" {
+			if !npmVersioning.Match(v) || len(v) > 64 {
+				return rex.Status(400, "Invalid Version Param")
+			}
+			cacheBusted = true
+		}
+
 		// use `?path=$PATH` query to override the pathname
 		if v := query.Get("path"); v != "" {
 			esm.SubPath = utils.NormalizePathname(v)[1:]
 			esm.SubModuleName = stripEntryModuleExt(esm.SubPath)
 		}
 
+		// support `/PKG@VERSION/TARGET` pattern to pin the build target of the entry module,
+		// equivalent to `/PKG@VERSION?target=TARGET`
+		targetSegment := ""
+		if esm.SubPath != "" && targets[esm.SubPath] > 0 && !query.Has("path") {
+			exported := false
+			if !esm.GhPrefix && !esm.PrPrefix && !esm.TgzPrefix {
+				info, err := npmrc.getPackageInfo(esm.PkgName, esm.PkgVersion)
+				if err != nil {
+					return rex.Status(500, err.Error())
+				}
+				// the package may export a sub-module with the same name as the target
+				_, exported = info.Exports.Get("./" + esm.SubPath)
+			}
+			if !exported {
+				targetSegment = esm.SubPath
+				esm.SubPath = ""
+				esm.SubModuleName = ""
+			}
+		}
+
 		// check the path kind
 		pathKind := EsmEntry
 		if esm.SubPath != "" {
@@ -967,6 +1307,12 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				} else {
 					pathKind = RawFile
 				}
+			case ".txt":
+				if hasTargetSegment && strings.HasSuffix(esm.SubPath, ".mjs.LEGAL.txt") {
+					pathKind = EsmLegalComments
+				} else {
+					pathKind = RawFile
+				}
 			default:
 				if ext != "" && assetExts[ext[1:]] {
 					pathKind = RawFile
@@ -979,6 +1325,96 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			pathKind = RawFile
 		}
 
+		// allow browsers to expose the resource timing of the module responses
+		if config.TimingAllowOrigin != "" {
+			ctx.SetHeader("Timing-Allow-Origin", config.TimingAllowOrigin)
+		}
+
+		// return the normalized package metadata when `?package` query is present
+		if pathKind == EsmEntry && esm.SubPath == "" && query.Has("package") {
+			var pkgJson *PackageJSON
+			if esm.GhPrefix || esm.PrPrefix || esm.TgzPrefix {
+				pkgJson, err = npmrc.installPackage(esm.Package())
+			} else {
+				pkgJson, err = npmrc.getPackageInfo(esm.PkgName, esm.PkgVersion)
+			}
+			if err != nil {
+				if strings.HasSuffix(err.Error(), " not found") {
+					return rex.Status(404, err.Error())
+				}
+				return rex.Status(500, err.Error())
+			}
+			if isExactVersion || cacheBusted {
+				ctx.SetHeader("Cache-Control", ccImmutable)
+			} else {
+				ctx.SetHeader("Cache-Control", ccFloat())
+			}
+			return pkgJson
+		}
+
+		// return the license file of the package when `?license` query is present or the path is `/PKG@VERSION/LICENSE`
+		if pathKind == EsmEntry && ((esm.SubPath == "" && query.Has("license")) || strings.EqualFold(esm.SubPath, "LICENSE") || strings.EqualFold(esm.SubPath, "LICENCE")) {
+			pkgJson, err := npmrc.installPackage(esm.Package())
+			if err != nil {
+				if strings.HasSuffix(err.Error(), " not found") {
+					return rex.Status(404, err.Error())
+				}
+				return rex.Status(500, err.Error())
+			}
+			if pkgJson.License != "" {
+				ctx.SetHeader("X-ESM-License", pkgJson.License)
+			}
+			ctx.SetHeader("Access-Control-Expose-Headers", "X-ESM-License")
+			if isExactVersion || cacheBusted {
+				ctx.SetHeader("Cache-Control", ccImmutable)
+			} else {
+				ctx.SetHeader("Cache-Control", ccFloat())
+			}
+			pkgDir := path.Join(npmrc.StoreDir(), esm.Name(), "node_modules", esm.PkgName)
+			filename, err := findLicenseFile(pkgDir)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			if filename == "" {
+				return rex.Status(404, "License file not found")
+			}
+			f, err := os.Open(path.Join(pkgDir, filename))
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			if strings.HasSuffix(strings.ToLower(filename), ".md") {
+				ctx.SetHeader("Content-Type", "text/markdown; charset=utf-8")
+			} else {
+				ctx.SetHeader("Content-Type", ctText)
+			}
+			return f // auto closed
+		}
+
+		// redirect to the flow type stubs(`*.js.flow`) of the module when `?flow` query is present
+		if pathKind == EsmEntry && query.Has("flow") {
+			b := &BuildContext{
+				npmrc: npmrc,
+				esm:   esm,
+			}
+			err = b.install()
+			if err != nil {
+				if strings.HasSuffix(err.Error(), " not found") {
+					return rex.Status(404, err.Error())
+				}
+				return rex.Status(500, err.Error())
+			}
+			if flow := b.resolveFlowTypes(); flow != "" {
+				return redirect(ctx, fmt.Sprintf("%s/%s%s", origin, esm.Name(), utils.NormalizePathname(flow)), isExactVersion)
+			}
+			// the flow types of a floating version may be added in a newer version
+			if isExactVersion {
+				ctx.SetHeader("Cache-Control", ccImmutable)
+			} else {
+				ctx.SetHeader("Cache-Control", ccFloat())
+			}
+			return errorStatus(ctx, 404, errCodeNotFound, "flow types not found")
+		}
+
 		// redirect to the url with exact package version
 		if !isExactVersion {
 			if hasTargetSegment {
@@ -1001,7 +1437,7 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				if rawQuery != "" {
 					query = "?" + rawQuery
 				}
-				ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", config.NpmQueryCacheTTL))
+				ctx.SetHeader("Cache-Control", ccFloat())
 				return redirect(ctx, fmt.Sprintf("%s/%s%s%s", origin, pkgName, subPath, query), false)
 			}
 			if pathKind != EsmEntry {
@@ -1032,7 +1468,7 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				if rawQuery != "" {
 					query = "?" + rawQuery
 				}
-				ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", config.NpmQueryCacheTTL))
+				ctx.SetHeader("Cache-Control", ccFloat())
 				return redirect(ctx, fmt.Sprintf("%s%s/%s@%s%s%s", origin, registryPrefix, pkgName, pkgVersion, subPath, query), false)
 			}
 		} else {
@@ -1123,7 +1559,7 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 						return rex.Status(500, "storage error")
 					}
 					if err == nil {
-						etag = fmt.Sprintf(`W/"%x-%x"`, stat.ModTime().Unix(), stat.Size())
+						etag = statETag(stat)
 						if ifNoneMatch := ctx.R.Header.Get("If-None-Match"); ifNoneMatch == etag {
 							defer content.Close()
 							return rex.Status(http.StatusNotModified, nil)
@@ -1155,7 +1591,7 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 					if stat.Size() > maxAssetFileSize {
 						return rex.Status(403, "File Too Large")
 					}
-					etag = fmt.Sprintf(`W/"%x-%x"`, stat.ModTime().Unix(), stat.Size())
+					etag = statETag(stat)
 					if ifNoneMatch := ctx.R.Header.Get("If-None-Match"); ifNoneMatch == etag {
 						return rex.Status(http.StatusNotModified, nil)
 					}
@@ -1174,8 +1610,10 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 						}()
 					}
 				}
-				if endsWith(esm.SubPath, ".js", ".mjs", ".cjs") {
+				if endsWith(esm.SubPath, ".js", ".mjs", ".cjs", ".flow") {
 					ctx.SetHeader("Content-Type", ctJavaScript)
+				} else if strings.HasSuffix(esm.SubPath, ".json") {
+					ctx.SetHeader("Content-Type", ctJSON)
 				} else if endsWith(esm.SubPath, ".ts", ".mts", ".cts", ".tsx") {
 					ctx.SetHeader("Content-Type", ctTypeScript)
 				} else if strings.HasSuffix(esm.SubPath, ".jsx") {
@@ -1192,19 +1630,47 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				ctx.SetHeader("Etag", etag)
 				ctx.SetHeader("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
 				ctx.SetHeader("Cache-Control", ccImmutable)
-				if strings.HasSuffix(esm.SubPath, ".json") && query.Has("module") {
+				if endsWith(esm.SubPath, ".json", ".json5", ".jsonc") && query.Has("module") {
 					jsonData, err := io.ReadAll(content)
+					content.Close()
 					if err != nil {
 						return rex.Status(500, err.Error())
 					}
+					if !strings.HasSuffix(esm.SubPath, ".json") {
+						jsonData, err = json5ToJSON(jsonData)
+						if err != nil {
+							return rex.Status(400, err.Error())
+						}
+					}
 					ctx.SetHeader("Content-Type", ctJavaScript)
 					return concatBytes([]byte("export default "), jsonData)
 				}
 				return content // auto closed
 			}
 
-			// build/dts files
-			if pathKind == EsmBuild || pathKind == EsmSourceMap || pathKind == EsmDts {
+			// the types of the `?worker` module that reference the types of the module
+			if pathKind == EsmDts && query.Has("worker") {
+				dtsUrl := origin + ctx.R.URL.Path
+				if exports := parseExportsQuery(query.Get("exports")); len(exports) > 0 && !isExportsWildcard(query.Get("exports")) {
+					dtsUrl += "?exports=" + strings.Join(exports, ",")
+				}
+				ctx.SetHeader("Content-Type", ctTypeScript)
+				ctx.SetHeader("Cache-Control", ccImmutable)
+				return dtsWorkerFactory(dtsUrl)
+			}
+
+			// narrow the types to the names of the `?exports` query, to keep the types consistent with the tree-shaken module
+			if pathKind == EsmDts && query.Has("exports") {
+				exports := parseExportsQuery(query.Get("exports"))
+				if len(exports) > 0 && !isExportsWildcard(query.Get("exports")) {
+					ctx.SetHeader("Content-Type", ctTypeScript)
+					ctx.SetHeader("Cache-Control", ccImmutable)
+					return dtsWithExports(origin+ctx.R.URL.Path, exports)
+				}
+			}
+
+			// build/dts files, the `?imports`, `?meta` and `?importmap` queries of builds require the build meta
+			if (pathKind == EsmBuild && !query.Has("imports") && !query.Has("meta") && !query.Has("importmap")) || pathKind == EsmSourceMap || pathKind == EsmLegalComments || pathKind == EsmDts {
 				var savePath string
 				if asteriskPrefix {
 					pathname = "/*" + pathname[1:]
@@ -1219,39 +1685,73 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				if err != nil {
 					if err != storage.ErrNotFound {
 						return rex.Status(500, err.Error())
-					} else if pathKind == EsmSourceMap {
+					} else if pathKind == EsmSourceMap || pathKind == EsmLegalComments {
 						return rex.Status(404, "Not found")
 					}
 				}
 				if err == nil {
+					artifactGC.Touch(savePath)
 					ctx.SetHeader("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
 					ctx.SetHeader("Cache-Control", ccImmutable)
+					if pathKind == EsmBuild {
+						// the etag can be used by the `/purge` API to evict the build conditionally
+						ctx.SetHeader("Etag", statETag(stat))
+					}
 					if pathKind == EsmDts {
 						ctx.SetHeader("Content-Type", ctTypeScript)
 					} else if pathKind == EsmSourceMap {
 						ctx.SetHeader("Content-Type", ctJSON)
+					} else if pathKind == EsmLegalComments {
+						ctx.SetHeader("Content-Type", ctText)
 					} else if strings.HasSuffix(pathname, ".css") {
 						ctx.SetHeader("Content-Type", ctCSS)
 					} else {
 						ctx.SetHeader("Content-Type", ctJavaScript)
-						// check `?exports` query
-						jsIndentSet := set.New[string]()
-						if query.Has("exports") {
-							for _, p := range strings.Split(query.Get("exports"), ",") {
-								p = strings.TrimSpace(p)
-								if isJsIdentifier(p) {
-									jsIndentSet.Add(p)
+						// deno reads the types of the module from the `X-TypeScript-Types` header
+						var dtsUrl string
+						if t := getBuildPathTarget(pathname); (t == "deno" || t == "denonext") && !query.Has("no-dts") {
+							b := &BuildContext{npmrc: npmrc, logger: reqLogger, db: db, path: pathname}
+							if meta, ok, _ := b.Exists(); ok && meta.Dts != "" {
+								dtsUrl = origin + meta.Dts
+								ctx.SetHeader("X-TypeScript-Types", dtsUrl)
+								ctx.SetHeader("Access-Control-Expose-Headers", "X-TypeScript-Types")
+							}
+						}
+						// report the aliases of the build args that match nothing in the build
+						if _, xArgs, found := strings.Cut(pathname, "/X-"); found {
+							if args, err := decodeBuildArgs(strings.SplitN(xArgs, "/", 2)[0]); err == nil && len(args.alias) > 0 {
+								b := &BuildContext{npmrc: npmrc, logger: reqLogger, db: db, path: pathname}
+								if meta, ok, _ := b.Exists(); ok {
+									if unusedAlias := getUnusedAlias(mapKeys(args.alias), meta.AppliedAlias); len(unusedAlias) > 0 {
+										ctx.SetHeader("X-ESM-Unused-Alias", strings.Join(unusedAlias, ", "))
+										ctx.W.Header().Add("Access-Control-Expose-Headers", "X-ESM-Unused-Alias")
+									}
 								}
 							}
 						}
-						exports := jsIndentSet.Values()
-						sort.Strings(exports)
+						// check `?exports` query
+						exports := parseExportsQuery(query.Get("exports"))
+						var code []byte
+						if isExportsWildcard(query.Get("exports")) {
+							code, err = io.ReadAll(f)
+							f.Close()
+							if err != nil {
+								return rex.Status(500, err.Error())
+							}
+							exports, err = resolveExportsQuery(query.Get("exports"), code)
+							if err != nil {
+								return rex.Status(400, err.Error())
+							}
+						}
 						if query.Has("worker") {
 							defer f.Close()
 							moduleUrl := origin + pathname
 							if len(exports) > 0 {
 								moduleUrl += "?exports=" + strings.Join(exports, ",")
 							}
+							if dtsUrl != "" {
+								ctx.SetHeader("X-TypeScript-Types", workerDtsUrl(dtsUrl, exports))
+							}
 							return fmt.Sprintf(
 								`export default function workerFactory(injectOrOptions) { const options = typeof injectOrOptions === "string" ? { inject: injectOrOptions }: injectOrOptions ?? {}; const { inject, name = "%s" } = options; const blob = new Blob(['import * as $module from "%s";', inject].filter(Boolean), { type: "application/javascript" }); return new Worker(URL.createObjectURL(blob), { type: "module", name })}`,
 								moduleUrl,
@@ -1263,32 +1763,39 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 							xxh := xxhash.New()
 							xxh.Write([]byte(strings.Join(exports, ",")))
 							savePath = strings.TrimSuffix(savePath, ".mjs") + "_" + base64.RawURLEncoding.EncodeToString(xxh.Sum(nil)) + ".mjs"
-							f2, _, err := buildStorage.Get(savePath)
+							f2, fi2, err := buildStorage.Get(savePath)
 							if err == nil {
+								if !supportsImportMeta(getBuildPathTarget(pathname)) {
+									return resolveOriginPlaceholder(ctx, f2, fi2, savePath, origin)
+								}
 								return f2 // auto closed
 							}
 							if err != storage.ErrNotFound {
 								return rex.Status(500, err.Error())
 							}
-							code, err := io.ReadAll(f)
-							if err != nil {
-								return rex.Status(500, err.Error())
-							}
-							target := "es2022"
-							// check target in the pathname
-							for _, seg := range strings.Split(pathname, "/") {
-								if targets[seg] > 0 {
-									target = seg
-									break
+							if code == nil {
+								code, err = io.ReadAll(f)
+								if err != nil {
+									return rex.Status(500, err.Error())
 								}
 							}
+							target := getBuildPathTarget(pathname)
+							if target == "" {
+								target = "es2022"
+							}
 							ret, err := treeShake(code, exports, targets[target])
 							if err != nil {
 								return rex.Status(500, err.Error())
 							}
 							go buildStorage.Put(savePath, bytes.NewReader(ret))
 							// note: the source map is dropped
-							return ret
+							if !supportsImportMeta(target) {
+								return respondContent(ctx, bytes.ReplaceAll(ret, []byte("{ESM_CDN_ORIGIN}"), []byte(origin)), "")
+							}
+							return respondContent(ctx, ret, "")
+						}
+						if !supportsImportMeta(getBuildPathTarget(pathname)) {
+							return resolveOriginPlaceholder(ctx, f, stat, savePath, origin)
 						}
 					}
 					if pathKind == EsmDts {
@@ -1297,22 +1804,25 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 						if err != nil {
 							return rex.Status(500, err.Error())
 						}
-						return bytes.ReplaceAll(buffer, []byte("{ESM_CDN_ORIGIN}"), []byte(origin))
+						return respondContent(ctx, bytes.ReplaceAll(buffer, []byte("{ESM_CDN_ORIGIN}"), []byte(origin)), "resolved:"+origin+":"+savePath+":"+statETag(stat))
 					}
-					return f // auto closed
+					return respondStoredFile(ctx, f, stat, savePath)
 				}
 			}
 		}
 
 		// determine build target by `?target` query or `User-Agent` header
 		target := strings.ToLower(query.Get("target"))
+		if targetSegment != "" {
+			target = targetSegment
+		}
 		targetFromUA := targets[target] == 0
 		if targetFromUA {
-			target = getBuildTargetByUA(ctx.UserAgent())
+			target = getBuildTargetByRequest(ctx.R.Header)
 		}
 
-		// redirect to the url with exact package version for `deno` and `denonext` target
-		if !isExactVersion && (target == "denonext" || target == "deno") {
+		// redirect to the url with exact package version for `deno` and `denonext` target, or the target segment is present
+		if !isExactVersion && (target == "denonext" || target == "deno" || targetSegment != "") {
 			pkgName := esm.PkgName
 			pkgVersion := esm.PkgVersion
 			subPath := ""
@@ -1333,6 +1843,8 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				if esm.PkgName == "es5-ext" {
 					subPath = strings.ReplaceAll(subPath, "/#/", "/%23/")
 				}
+			} else if targetSegment != "" {
+				subPath = "/" + targetSegment
 			}
 			if extraQuery != "" {
 				pkgVersion += "&" + extraQuery
@@ -1341,13 +1853,39 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				qs = "?" + rawQuery
 			}
 			if targetFromUA {
-				appendVaryHeader(ctx.W.Header(), "User-Agent")
+				appendVaryTargetHeaders(ctx.W.Header())
 			}
 			return redirect(ctx, fmt.Sprintf("%s%s/%s@%s%s%s", origin, registryPrefix, pkgName, pkgVersion, subPath, qs), false)
 		}
 
+		// redirect to the TypeScript source of the package entry for deno if the request accepts `application/typescript`,
+		// this avoids double transpilation and preserves the type information
+		if pathKind == EsmEntry && (target == "denonext" || target == "deno") && strings.HasPrefix(ctx.UserAgent(), "Deno/") {
+			appendVaryHeader(ctx.W.Header(), "Accept")
+			if strings.Contains(ctx.R.Header.Get("Accept"), "application/typescript") {
+				b := &BuildContext{
+					npmrc:  npmrc,
+					esm:    esm,
+					target: target,
+				}
+				err = b.install()
+				if err != nil {
+					return rex.Status(500, err.Error())
+				}
+				entry := b.resolveEntry(esm)
+				if endsWith(entry.main, ".ts", ".mts", ".tsx") && !endsWith(entry.main, ".d.ts", ".d.mts", ".d.cts") {
+					if targetFromUA {
+						appendVaryTargetHeaders(ctx.W.Header())
+					}
+					// the types are included in the source, no `X-TypeScript-Types` header is needed
+					return redirect(ctx, fmt.Sprintf("%s/%s%s?raw", origin, esm.Name(), utils.NormalizePathname(entry.main)), false)
+				}
+			}
+		}
+
 		// check `?alias` query
 		alias := map[string]string{}
+		queryAlias := set.New[string]()
 		if query.Has("alias") {
 			for _, p := range strings.Split(query.Get("alias"), ",") {
 				p = strings.TrimSpace(p)
@@ -1357,16 +1895,50 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 					to = strings.TrimSpace(to)
 					if name != "" && to != "" && name != esm.PkgName {
 						alias[name] = to
+						queryAlias.Add(name)
 					}
 				}
 			}
 		}
 
+		// check `X-Deno-Imports` header, the aliases and externals of the `?alias` and `?external` queries take precedence
+		var denoExternal []string
+		if v := ctx.R.Header.Get("X-Deno-Imports"); v != "" {
+			denoAlias, external, err := parseDenoImports(v, origin)
+			if err != nil {
+				return rex.Status(400, "Invalid X-Deno-Imports Header: "+err.Error())
+			}
+			for name, to := range denoAlias {
+				if _, ok := alias[name]; !ok && name != esm.PkgName {
+					alias[name] = to
+				}
+			}
+			denoExternal = external
+			appendVaryHeader(ctx.W.Header(), "X-Deno-Imports")
+		}
+
 		// check `?deps` query
 		deps := map[string]string{}
+		exclude := set.New[string]()
+		lockedDeps := false
 		if query.Has("deps") {
 			for _, v := range strings.Split(query.Get("deps"), ",") {
 				v = strings.TrimSpace(v)
+				if v == "locked" {
+					// pin all the transitive dependencies to exact versions, e.g. `?deps=locked`
+					lockedDeps = true
+					continue
+				}
+				// the leading minus excludes the dependency, e.g. `?deps=-some-polyfill`
+				if name := strings.TrimPrefix(v, "-"); len(name) < len(v) {
+					if !validatePackageName(name) {
+						return rex.Status(400, fmt.Sprintf("Invalid deps query: %v", v))
+					}
+					if name != esm.PkgName {
+						exclude.Add(name)
+					}
+					continue
+				}
 				if v != "" {
 					m, _, _, _, err := praseEsmPath(npmrc, v)
 					if err != nil {
@@ -1380,43 +1952,120 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 		}
 
 		// check `?conditions` query
-		var conditions []string
-		conditionsSet := set.New[string]()
-		if query.Has("conditions") {
-			for _, p := range strings.Split(query.Get("conditions"), ",") {
-				p = strings.TrimSpace(p)
-				if p != "" && !strings.ContainsRune(p, ' ') && !conditionsSet.Has(p) {
-					conditionsSet.Add(p)
-					conditions = append(conditions, p)
-				}
-			}
+		conditions := parseConditionsQuery(query.Get("conditions"), query.Has("worker"))
+
+		// check `?ignore-exports` query
+		if query.Has("ignore-exports") && config.DisableIgnoreExports {
+			return rex.Status(403, "The `?ignore-exports` query is disabled")
 		}
 
-		// check `?external` query
-		external := set.New[string]()
-		externalAll := asteriskPrefix
+		// check `?define` query
+		define, err := parseDefineQuery(query.Get("define"))
+		if err != nil {
+			return rex.Status(400, "Invalid define query: "+err.Error())
+		}
+
+		// check `?legal-comments` query
+		legalComments := query.Get("legal-comments")
+		if _, ok := legalCommentsModes[legalComments]; legalComments != "" && !ok {
+			return rex.Status(400, "Invalid legal-comments query: "+legalComments)
+		}
+
+		// check `?tsconfig` query
+		tsconfig, err := parseTsconfigQuery(query.Get("tsconfig"))
+		if err != nil {
+			return rex.Status(400, "Invalid tsconfig query: "+err.Error())
+		}
+
+		// check `?external` query
+		external := set.New[string]()
+		externalAll := asteriskPrefix
+		noCSS := query.Has("no-css")
+		externalPeers := false
 		if !asteriskPrefix && query.Has("external") {
 			for _, p := range strings.Split(query.Get("external"), ",") {
 				p = strings.TrimSpace(p)
+				if p == "*.css" {
+					// skip the CSS imports, e.g. `?external=*.css`
+					noCSS = true
+					continue
+				}
+				if p == "peers" {
+					// externalize the peer dependencies of the package, e.g. `?external=peers`
+					externalPeers = true
+					continue
+				}
 				if p == "*" {
 					external.Reset()
 					externalAll = true
 					break
 				}
+				if p == "self" {
+					// externalize the package's own entry
+					p = esm.PkgName
+				}
 				if p != "" {
 					external.Add(p)
 				}
 			}
 		}
 
+		if !externalAll {
+			for _, name := range denoExternal {
+				if _, ok := alias[name]; !ok {
+					external.Add(name)
+				}
+			}
+		}
+
+		var pkgJson *PackageJSON
+		if (externalPeers && !externalAll) || lockedDeps {
+			if esm.GhPrefix || esm.PrPrefix || esm.TgzPrefix {
+				pkgJson, err = npmrc.installPackage(esm.Package())
+			} else {
+				pkgJson, err = npmrc.getPackageInfo(esm.PkgName, esm.PkgVersion)
+			}
+			if err != nil {
+				if strings.HasSuffix(err.Error(), " not found") {
+					return rex.Status(404, err.Error())
+				}
+				return rex.Status(500, err.Error())
+			}
+		}
+
+		if externalPeers && !externalAll {
+			for name := range pkgJson.PeerDependencies {
+				external.Add(name)
+			}
+		}
+
+		// resolve the dependency closure of the package for `?deps=locked`, the resolved versions are
+		// embedded in the build args so the build is reproducible
+		if lockedDeps {
+			deps, err = lockDeps(npmrc, pkgJson, deps, exclude)
+			if err != nil {
+				if err == errTooManyLockedDeps {
+					return rex.Status(400, fmt.Sprintf("Too many dependencies to lock, the maximum is %d", config.MaxQueryListLength))
+				}
+				if strings.HasSuffix(err.Error(), " not found") {
+					return rex.Status(404, err.Error())
+				}
+				return rex.Status(500, err.Error())
+			}
+		}
+
 		buildArgs := BuildArgs{
 			alias:      alias,
 			conditions: conditions,
+			define:     define,
 			deps:       deps,
 		}
 		if !externalAll && external.Len() > 0 {
 			buildArgs.external = *external.ReadOnly()
 		}
+		if exclude.Len() > 0 {
+			buildArgs.exclude = *exclude.ReadOnly()
+		}
 
 		// match path `PKG@VERSION/X-${args}/esnext/SUBPATH`
 		xArgs := false
@@ -1444,6 +2093,27 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 
 		// build and return the types(.d.ts) file
 		if pathKind == EsmDts {
+			// match path `PKG@VERSION/X-${args}/TARGET/SUBPATH.d.ts`, redirect to the types that are used by the build of the target,
+			// fallback to the target-agnostic types if the package doesn't declare the target-specific types
+			if a := strings.SplitN(esm.SubPath, "/", 2); len(a) == 2 && targets[a[0]] > 0 {
+				b := &BuildContext{
+					npmrc:  npmrc,
+					esm:    esm,
+					args:   buildArgs,
+					target: a[0],
+				}
+				err := b.install()
+				if err != nil {
+					return rex.Status(500, err.Error())
+				}
+				if !b.existsPkgFile(esm.SubPath) {
+					dts := a[1]
+					if types := b.resolveTargetTypes(dts); types != "" && b.existsPkgFile(types) {
+						dts = strings.TrimPrefix(types, "./")
+					}
+					return redirect(ctx, fmt.Sprintf("%s/%s/%s%s", origin, esm.Name(), b.getBuildArgsPrefix(true), dts), isExactVersion)
+				}
+			}
 			readDts := func() (content io.ReadCloser, stat storage.Stat, err error) {
 				args := ""
 				if a := encodeBuildArgs(buildArgs, true); a != "" {
@@ -1455,6 +2125,9 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 					args,
 				), esm.SubPath))
 				content, stat, err = buildStorage.Get(savePath)
+				if err == nil {
+					artifactGC.Touch(savePath)
+				}
 				return
 			}
 			content, _, err := readDts()
@@ -1464,7 +2137,7 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				}
 				buildCtx := &BuildContext{
 					npmrc:       npmrc,
-					logger:      logger,
+					logger:      reqLogger,
 					db:          db,
 					storage:     buildStorage,
 					esm:         esm,
@@ -1472,18 +2145,20 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 					externalAll: externalAll,
 					target:      "types",
 				}
+				ctx.SetHeader("X-ESM-Path", buildCtx.Path())
+				ctx.SetHeader("Access-Control-Expose-Headers", "X-ESM-Path")
 				ch := buildQueue.Add(buildCtx)
 				select {
 				case output := <-ch:
 					if output.err != nil {
 						if output.err.Error() == "types not found" {
-							return rex.Status(404, "Types Not Found")
+							return errorStatus(ctx, 404, errCodeNotFound, "Types Not Found")
 						}
 						return rex.Status(500, "Failed to build types: "+output.err.Error())
 					}
 				case <-time.After(time.Duration(config.BuildWaitTime) * time.Second):
 					ctx.SetHeader("Cache-Control", ccMustRevalidate)
-					return rex.Status(http.StatusRequestTimeout, "timeout, the types is waiting to be built, please try refreshing the page.")
+					return errorStatus(ctx, http.StatusRequestTimeout, errCodeTimeout, "timeout, the types is waiting to be built, please try refreshing the page.\n\n"+buildQueue.Diagnose(buildCtx.Path()))
 				}
 				content, _, err = readDts()
 			}
@@ -1500,7 +2175,7 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			}
 			ctx.SetHeader("Content-Type", ctTypeScript)
 			ctx.SetHeader("Cache-Control", ccImmutable)
-			return bytes.ReplaceAll(buffer, []byte("{ESM_CDN_ORIGIN}"), []byte(origin))
+			return respondContent(ctx, bytes.ReplaceAll(buffer, []byte("{ESM_CDN_ORIGIN}"), []byte(origin)), "")
 		}
 
 		if !xArgs {
@@ -1512,6 +2187,11 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			buildArgs.externalRequire = externalRequire
 			buildArgs.keepNames = query.Has("keep-names")
 			buildArgs.ignoreAnnotations = query.Has("ignore-annotations")
+			buildArgs.preferRequire = query.Has("prefer-require")
+			buildArgs.ignoreExports = query.Has("ignore-exports")
+			buildArgs.noCSS = noCSS
+			buildArgs.legalComments = legalComments
+			buildArgs.tsconfig = tsconfig
 		}
 
 		bundleMode := BundleDefault
@@ -1572,10 +2252,36 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			}
 		}
 
+		// bundle the packages that are listed in the `bundlePackages` config by default
+		if pathKind == EsmEntry && bundleMode == BundleDefault && stringInSlice(config.BundlePackages, esm.PkgName) {
+			bundleMode = BundleDeps
+		}
+
+		// build a barrel module that re-exports the sub-modules of the `?entries` query under namespaces,
+		// the entries are encoded into the build args, so the barrel is built and cached as a unit
+		if pathKind == EsmEntry && esm.SubModuleName == "" && query.Has("entries") {
+			entries := parseEntriesQuery(query.Get("entries"))
+			if len(entries) == 0 {
+				return rex.Status(400, "Invalid `entries` query")
+			}
+			if len(entries) > maxBarrelEntries {
+				return rex.Status(400, fmt.Sprintf("Too many entries, the maximum is %d", maxBarrelEntries))
+			}
+			namespaces := set.New[string]()
+			for _, entry := range entries {
+				ns := toNamespaceIdentifier(entry)
+				if namespaces.Has(ns) {
+					return rex.Status(400, fmt.Sprintf("Duplicate namespace \"%s\" of the entries", ns))
+				}
+				namespaces.Add(ns)
+			}
+			buildArgs.entries = entries
+		}
+
 	BUILD:
 		buildCtx := &BuildContext{
 			npmrc:       npmrc,
-			logger:      logger,
+			logger:      reqLogger,
 			db:          db,
 			storage:     buildStorage,
 			esm:         esm,
@@ -1585,6 +2291,47 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			target:      target,
 			dev:         isDev,
 		}
+		// expose the build path in all responses from here (including errors and redirects) for debugging
+		ctx.SetHeader("X-ESM-Path", buildCtx.Path())
+		ctx.SetHeader("Access-Control-Expose-Headers", "X-ESM-Path")
+
+		// return the diagnostics of the failed build when `?build-log` query is present
+		if query.Has("build-log") {
+			buildLog, ok := getBuildLog(npmrc.zoneId, buildCtx.Path())
+			if targetFromUA {
+				appendVaryTargetHeaders(ctx.W.Header())
+			}
+			ctx.SetHeader("Cache-Control", ccMustRevalidate)
+			if !ok {
+				return errorStatus(ctx, 404, errCodeNotFound, "build log not found, the logs of failed builds are kept for 10 minutes")
+			}
+			return buildLog
+		}
+
+		// return the import graph of the module when `?module-graph` query is present
+		if pathKind == EsmEntry && query.Has("module-graph") {
+			graph, err := withCache("module-graph:"+npmrc.zoneId+":"+buildCtx.Path(), time.Duration(config.NpmQueryCacheTTL)*time.Second, func() (ModuleGraph, string, error) {
+				graph, err := NewImportMapWalker(buildQueue, origin, time.Duration(config.BuildWaitTime)*time.Second).WalkGraph(buildCtx, maxModuleGraphDepth, maxModuleGraphSize)
+				return graph, "", err
+			})
+			if err != nil {
+				if err == errBuildTimeout {
+					ctx.SetHeader("Cache-Control", ccMustRevalidate)
+					return errorStatus(ctx, http.StatusRequestTimeout, errCodeTimeout, "timeout, the modules are waiting to be built, please try refreshing the page.")
+				}
+				if strings.HasSuffix(err.Error(), " not found") {
+					return rex.Status(404, err.Error())
+				}
+				return rex.Status(500, err.Error())
+			}
+			if targetFromUA {
+				appendVaryTargetHeaders(ctx.W.Header())
+			}
+			// the graph may change when new versions of the dependencies are published
+			ctx.SetHeader("Cache-Control", ccFloat())
+			return graph
+		}
+
 		ret, ok, err := buildCtx.Exists()
 		if err != nil {
 			return rex.Status(500, err.Error())
@@ -1597,20 +2344,72 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 					msg := output.err.Error()
 					if strings.Contains(msg, "no such file or directory") || strings.Contains(msg, "is not exported from package") || strings.Contains(msg, "could not resolve build entry") {
 						ctx.SetHeader("Cache-Control", ccImmutable)
-						return rex.Status(404, "module not found")
+						if esm.SubModuleName != "" {
+							if suggestions := buildCtx.suggestSubModules(esm.SubModuleName); len(suggestions) > 0 {
+								return errorStatus(ctx, 404, errCodeNotFound, fmt.Sprintf("module not found, did you mean \"%s\"?", strings.Join(suggestions, "\" or \"")))
+							}
+						}
+						return errorStatus(ctx, 404, errCodeNotFound, "module not found")
+					}
+					if strings.HasPrefix(msg, errUnsupportedES5Syntax) {
+						return errorStatus(ctx, http.StatusUnprocessableEntity, errCodeUnsupported, msg)
+					}
+					if strings.HasSuffix(msg, errBarrelEntryNotJS) {
+						return errorStatus(ctx, http.StatusUnprocessableEntity, errCodeUnsupported, msg)
+					}
+					if msg == "package has no entry point" {
+						ctx.SetHeader("Cache-Control", ccImmutable)
+						return errorStatus(ctx, 404, errCodeNotFound, fmt.Sprintf("package \"%s\" has no entry point", esm.PkgName))
 					}
 					if strings.HasSuffix(msg, " not found") {
-						return rex.Status(404, msg)
+						return errorStatus(ctx, 404, errCodeNotFound, msg)
+					}
+					// attach the full diagnostics of esbuild to the JSON error response
+					if buildLog, ok := getBuildLog(npmrc.zoneId, buildCtx.Path()); ok && acceptsJSON(ctx) {
+						appendVaryHeader(ctx.W.Header(), "Accept")
+						return rex.Status(500, map[string]any{
+							"error": msg,
+							"code":  errCodeBuild,
+							"log":   buildLog,
+						})
 					}
 					return rex.Status(500, msg)
 				}
 				ret = output.meta
 			case <-time.After(time.Duration(config.BuildWaitTime) * time.Second):
 				ctx.SetHeader("Cache-Control", ccMustRevalidate)
-				return rex.Status(http.StatusRequestTimeout, "timeout, the module is waiting to be built, please try refreshing the page.")
+				return errorStatus(ctx, http.StatusRequestTimeout, errCodeTimeout, "timeout, the module is waiting to be built, please try refreshing the page.\n\n"+buildQueue.Diagnose(buildCtx.Path()))
 			}
 		}
 
+		// the entry requests are counted as the access of the build, the build files are cached by the CDN as immutable
+		artifactGC.Touch(buildCtx.getSavepath())
+
+		// echo the resolved build target, e.g. to verify the target that is detected by the `User-Agent` header
+		ctx.SetHeader("X-ESM-Target", buildCtx.target)
+
+		// the build target is upgraded for the `import.meta` of the package that is not available in the legacy targets
+		if ret.TargetUpgraded != "" {
+			ctx.SetHeader("X-ESM-Target-Upgraded", ret.TargetUpgraded)
+		}
+
+		// report the aliases of the `?alias` query (or the build args of the `X-` path) that match nothing in the build,
+		// the configuration mistakes fail silently otherwise
+		aliasNames := queryAlias.Values()
+		if xArgs {
+			aliasNames = mapKeys(buildArgs.alias)
+		}
+		unusedAlias := getUnusedAlias(aliasNames, ret.AppliedAlias)
+		if len(unusedAlias) > 0 {
+			ctx.SetHeader("X-ESM-Unused-Alias", strings.Join(unusedAlias, ", "))
+		}
+
+		// report the CSS imports that are skipped by `?no-css`
+		if len(ret.SkippedCSS) > 0 {
+			ctx.SetHeader("X-ESM-Skipped-CSS", strings.Join(ret.SkippedCSS, ", "))
+			ctx.SetHeader("Access-Control-Expose-Headers", "X-ESM-Path, X-ESM-Target, X-ESM-Skipped-CSS")
+		}
+
 		if ret.CSSEntry != "" {
 			url := strings.Join([]string{origin, esm.Name(), ret.CSSEntry[2:]}, "/")
 			return redirect(ctx, url, isExactVersion)
@@ -1628,30 +2427,198 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 			return []byte("export default null;\n")
 		}
 
+		// check `?exports` query, the `*` item is resolved to the named exports of the build
+		exports := parseExportsQuery(query.Get("exports"))
+		if isExportsWildcard(query.Get("exports")) && !ret.CJS && (pathKind == EsmEntry || pathKind == EsmBuild) {
+			f, _, err := buildStorage.Get(buildCtx.getSavepath())
+			if err != nil {
+				if err == storage.ErrNotFound {
+					// seem the build file is non-exist in the storage, rebuild the module
+					key := npmrc.zoneId + ":" + buildCtx.Path()
+					db.Delete(key)
+					cacheLRU.Remove(key)
+					goto BUILD
+				}
+				return rex.Status(500, err.Error())
+			}
+			code, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			exports, err = resolveExportsQuery(query.Get("exports"), code)
+			if err != nil {
+				return rex.Status(400, err.Error())
+			}
+		}
+
 		// redirect to package css from `?css`
 		if isPkgCss && esm.SubModuleName == "" {
 			if !ret.CSSInJS {
 				return rex.Status(404, "Package CSS not found")
 			}
+			// only include the CSS that is reachable from the `?exports` of the module
+			if len(exports) > 0 && !ret.CJS {
+				cssCtx := &BuildContext{
+					npmrc:       npmrc,
+					logger:      reqLogger,
+					db:          db,
+					storage:     buildStorage,
+					esm:         buildCtx.esm,
+					args:        buildCtx.args,
+					bundleMode:  buildCtx.bundleMode,
+					externalAll: buildCtx.externalAll,
+					target:      buildCtx.target,
+					dev:         buildCtx.dev,
+					cssExports:  exports,
+				}
+				f, _, err := buildStorage.Get(cssCtx.getSavepath())
+				if err == storage.ErrNotFound {
+					select {
+					case output := <-buildQueue.Add(cssCtx):
+						if output.err != nil {
+							return rex.Status(500, output.err.Error())
+						}
+					case <-time.After(time.Duration(config.BuildWaitTime) * time.Second):
+						ctx.SetHeader("Cache-Control", ccMustRevalidate)
+						return errorStatus(ctx, http.StatusRequestTimeout, errCodeTimeout, "timeout, the CSS is waiting to be built, please try refreshing the page.\n\n"+buildQueue.Diagnose(cssCtx.Path()))
+					}
+					f, _, err = buildStorage.Get(cssCtx.getSavepath())
+				}
+				if err != nil {
+					return rex.Status(500, err.Error())
+				}
+				css, err := io.ReadAll(f)
+				f.Close()
+				if err != nil {
+					return rex.Status(500, err.Error())
+				}
+				if targetFromUA {
+					appendVaryTargetHeaders(ctx.W.Header())
+				}
+				if isExactVersion || cacheBusted {
+					ctx.SetHeader("Cache-Control", ccImmutable)
+				} else {
+					ctx.SetHeader("Cache-Control", ccFloat())
+				}
+				ctx.SetHeader("Content-Type", ctCSS)
+				return css
+			}
 			url := origin + strings.TrimSuffix(buildCtx.Path(), ".mjs") + ".css"
 			return redirect(ctx, url, isExactVersion)
 		}
 
-		// check `?exports` query
-		jsIdentSet := set.New[string]()
-		if query.Has("exports") {
-			for _, p := range strings.Split(query.Get("exports"), ",") {
-				p = strings.TrimSpace(p)
-				if isJsIdentifier(p) {
-					jsIdentSet.Add(p)
+		// return the SRI hash of the build file when `?integrity` query is present, e.g. for the `integrity` field of import maps
+		if query.Has("integrity") && (pathKind == EsmEntry || pathKind == EsmBuild) {
+			savePath := buildCtx.getSavepath()
+			buildUrl := origin + buildCtx.Path()
+			if pathKind == EsmBuild && strings.HasSuffix(esm.SubPath, ".css") && ret.CSSInJS {
+				savePath = strings.TrimSuffix(savePath, ".mjs") + ".css"
+				buildUrl = strings.TrimSuffix(buildUrl, ".mjs") + ".css"
+			}
+			placeholderOrigin := ""
+			if !supportsImportMeta(buildCtx.target) && strings.HasSuffix(savePath, ".mjs") {
+				placeholderOrigin = origin
+			}
+			integrity, err := getIntegrity(buildStorage, savePath, placeholderOrigin)
+			if err != nil {
+				if err == storage.ErrNotFound {
+					// seem the build file is non-exist in the storage, rebuild the module
+					key := npmrc.zoneId + ":" + buildCtx.Path()
+					db.Delete(key)
+					cacheLRU.Remove(key)
+					goto BUILD
 				}
+				return rex.Status(500, err.Error())
+			}
+			ctx.SetHeader("X-ESM-Integrity", integrity)
+			ctx.SetHeader("Access-Control-Expose-Headers", "X-ESM-Path, X-ESM-Integrity")
+			if isExactVersion || cacheBusted {
+				ctx.SetHeader("Cache-Control", ccImmutable)
+			} else {
+				ctx.SetHeader("Cache-Control", ccFloat())
+			}
+			return map[string]any{
+				"url":       buildUrl,
+				"integrity": integrity,
 			}
 		}
-		exports := jsIdentSet.Values()
-		sort.Strings(exports)
+
+		// return the build meta of the module, e.g. the esbuild warnings that are counted by the `X-ESM-Warning-Count` header
+		if query.Has("meta") && (pathKind == EsmEntry || pathKind == EsmBuild) {
+			imports, warnings := ret.Imports, ret.Warnings
+			if imports == nil {
+				imports = []string{}
+			}
+			if warnings == nil {
+				warnings = []string{}
+			}
+			dts := ""
+			if ret.Dts != "" {
+				dts = origin + ret.Dts
+			}
+			if isExactVersion || cacheBusted {
+				ctx.SetHeader("Cache-Control", ccImmutable)
+			} else {
+				ctx.SetHeader("Cache-Control", ccFloat())
+			}
+			appliedAlias := ret.AppliedAlias
+			if appliedAlias == nil {
+				appliedAlias = []string{}
+			}
+			if unusedAlias == nil {
+				unusedAlias = []string{}
+			}
+			return map[string]any{
+				"url":      origin + buildCtx.Path(),
+				"target":   buildCtx.target,
+				"cjs":      ret.CJS,
+				"entry":    ret.Entry,
+				"dts":      dts,
+				"imports":  imports,
+				"warnings": warnings,
+				"alias": map[string]any{
+					"applied": appliedAlias,
+					"unused":  unusedAlias,
+				},
+			}
+		}
+
+		// return the import map that maps the external bare imports of the module to the esm.sh urls with the resolved versions,
+		// e.g. `/*react-dom@18.3.1/client?importmap` -> `{"imports":{"react":"https://esm.sh/react@18.3.1"}}`
+		if query.Has("importmap") && (pathKind == EsmEntry || pathKind == EsmBuild) {
+			// the build meta of an older version doesn't record the external deps, rebuild the module
+			if ret.noExternalDeps {
+				key := npmrc.zoneId + ":" + buildCtx.Path()
+				db.Delete(key)
+				cacheLRU.Remove(key)
+				goto BUILD
+			}
+			importMap := common.ImportMap{Imports: map[string]string{}}
+			for specifier, dep := range ret.ExternalDeps {
+				importMap.Imports[specifier] = origin + "/" + dep
+			}
+			if isExactVersion || cacheBusted {
+				ctx.SetHeader("Cache-Control", ccImmutable)
+			} else {
+				ctx.SetHeader("Cache-Control", ccFloat())
+			}
+			return importMap
+		}
 
 		// if the path is `ESMBuild`, return the built js/css content
 		if pathKind == EsmBuild {
+			// the aggregated module of the dependency imports of an entry that exceeds the `maxEntryImports` config
+			if query.Has("imports") && !strings.HasSuffix(esm.SubPath, ".css") {
+				buf, recycle := NewBuffer()
+				defer recycle()
+				for _, dep := range ret.Imports {
+					fmt.Fprintf(buf, "import \"%s\";\n", dep)
+				}
+				ctx.SetHeader("Content-Type", ctJavaScript)
+				ctx.SetHeader("Cache-Control", ccImmutable)
+				return buf.Bytes()
+			}
 			if esm.SubPath != buildCtx.esm.SubPath {
 				buf, recycle := NewBuffer()
 				defer recycle()
@@ -1676,13 +2643,32 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 					// then re-build the module
 					key := npmrc.zoneId + ":" + buildCtx.Path()
 					db.Delete(key)
-					cacheStore.Delete("lru:" + key)
+					cacheLRU.Remove(key)
 					goto BUILD
 				}
 				return rex.Status(500, err.Error())
 			}
 			ctx.SetHeader("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
 			ctx.SetHeader("Cache-Control", ccImmutable)
+			exposeHeaders := []string{"X-ESM-Target"}
+			if ret.TargetUpgraded != "" {
+				exposeHeaders = append(exposeHeaders, "X-ESM-Target-Upgraded")
+			}
+			if len(ret.SkippedCSS) > 0 {
+				exposeHeaders = append(exposeHeaders, "X-ESM-Skipped-CSS")
+			}
+			if len(unusedAlias) > 0 {
+				exposeHeaders = append(exposeHeaders, "X-ESM-Unused-Alias")
+			}
+			if len(ret.Warnings) > 0 {
+				ctx.SetHeader("X-ESM-Warning-Count", strconv.Itoa(len(ret.Warnings)))
+				exposeHeaders = append(exposeHeaders, "X-ESM-Warning-Count")
+			}
+			if (buildCtx.target == "deno" || buildCtx.target == "denonext") && !noDts && ret.Dts != "" && !endsWith(savePath, ".css", ".map") {
+				ctx.SetHeader("X-TypeScript-Types", origin+ret.Dts)
+				exposeHeaders = append(exposeHeaders, "X-TypeScript-Types")
+			}
+			ctx.SetHeader("Access-Control-Expose-Headers", strings.Join(exposeHeaders, ", "))
 			if endsWith(savePath, ".css") {
 				ctx.SetHeader("Content-Type", ctCSS)
 			} else if endsWith(savePath, ".map") {
@@ -1692,8 +2678,13 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				if isWorker {
 					defer f.Close()
 					moduleUrl := origin + buildCtx.Path()
+					var workerExports []string
 					if !ret.CJS && len(exports) > 0 {
 						moduleUrl += "?exports=" + strings.Join(exports, ",")
+						workerExports = exports
+					}
+					if (buildCtx.target == "deno" || buildCtx.target == "denonext") && !noDts && ret.Dts != "" {
+						ctx.SetHeader("X-TypeScript-Types", workerDtsUrl(origin+ret.Dts, workerExports))
 					}
 					return fmt.Sprintf(
 						`export default function workerFactory(injectOrOptions) { const options = typeof injectOrOptions === "string" ? { inject: injectOrOptions }: injectOrOptions ?? {}; const { inject, name = "%s" } = options; const blob = new Blob(['import * as $module from "%s";', inject].filter(Boolean), { type: "application/javascript" }); return new Worker(URL.createObjectURL(blob), { type: "module", name })}`,
@@ -1706,8 +2697,11 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 					xxh := xxhash.New()
 					xxh.Write([]byte(strings.Join(exports, ",")))
 					savePath = strings.TrimSuffix(savePath, ".mjs") + "_" + base64.RawURLEncoding.EncodeToString(xxh.Sum(nil)) + ".mjs"
-					f2, _, err := buildStorage.Get(savePath)
+					f2, fi2, err := buildStorage.Get(savePath)
 					if err == nil {
+						if !supportsImportMeta(buildCtx.target) {
+							return resolveOriginPlaceholder(ctx, f2, fi2, savePath, origin)
+						}
 						return f2 // auto closed
 					}
 					if err != storage.ErrNotFound {
@@ -1723,10 +2717,24 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 					}
 					go buildStorage.Put(savePath, bytes.NewReader(ret))
 					// note: the source map is dropped
-					return ret
+					if !supportsImportMeta(buildCtx.target) {
+						return respondContent(ctx, bytes.ReplaceAll(ret, []byte("{ESM_CDN_ORIGIN}"), []byte(origin)), "")
+					}
+					return respondContent(ctx, ret, "")
+				}
+				if !supportsImportMeta(buildCtx.target) {
+					return resolveOriginPlaceholder(ctx, f, fi, savePath, origin)
 				}
 			}
-			return f // auto closed
+			return respondStoredFile(ctx, f, fi, savePath)
+		}
+
+		// redirect the deno module loader to the immutable build url, the entry module varies by the `User-Agent`
+		// header while the build url is stable, this reduces the cache fragmentation of deno consumers
+		if targetFromUA && isExactVersion && (target == "deno" || target == "denonext") && strings.HasPrefix(ctx.UserAgent(), "Deno/") && strings.Contains(ctx.R.Header.Get("Accept"), "application/typescript") && !isWorker && !noDts && len(exports) == 0 {
+			appendVaryTargetHeaders(ctx.W.Header())
+			appendVaryHeader(ctx.W.Header(), "Accept")
+			return redirect(ctx, origin+buildCtx.Path(), false)
 		}
 
 		buf, recycle := NewBuffer()
@@ -1735,8 +2743,14 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 
 		if isWorker {
 			moduleUrl := origin + buildCtx.Path()
+			var workerExports []string
 			if !ret.CJS && len(exports) > 0 {
 				moduleUrl += "?exports=" + strings.Join(exports, ",")
+				workerExports = exports
+			}
+			if !noDts && ret.Dts != "" {
+				ctx.SetHeader("X-TypeScript-Types", workerDtsUrl(origin+ret.Dts, workerExports))
+				ctx.SetHeader("Access-Control-Expose-Headers", "X-TypeScript-Types")
 			}
 			fmt.Fprintf(buf,
 				`export default function workerFactory(injectOrOptions) { const options = typeof injectOrOptions === "string" ? { inject: injectOrOptions }: injectOrOptions ?? {}; const { inject, name = "%s" } = options; const blob = new Blob(['import * as $module from "%s";', inject].filter(Boolean), { type: "application/javascript" }); return new Worker(URL.createObjectURL(blob), { type: "module", name })}`,
@@ -1744,39 +2758,111 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 				moduleUrl,
 			)
 		} else {
-			if len(ret.Imports) > 0 {
-				for _, dep := range ret.Imports {
-					fmt.Fprintf(buf, "import \"%s\";\n", dep)
-				}
+			exposeHeaders := []string{"X-ESM-Path", "X-ESM-Target"}
+			if ret.TargetUpgraded != "" {
+				exposeHeaders = append(exposeHeaders, "X-ESM-Target-Upgraded")
+			}
+			if len(unusedAlias) > 0 {
+				exposeHeaders = append(exposeHeaders, "X-ESM-Unused-Alias")
+			}
+			aggregated := writeEntryImports(buf, buildCtx.Path(), ret.Imports)
+			if aggregated {
+				ctx.SetHeader("X-ESM-Aggregated-Imports", strconv.Itoa(len(ret.Imports)))
+				exposeHeaders = append(exposeHeaders, "X-ESM-Aggregated-Imports")
 			}
 			esm := buildCtx.Path()
 			if !ret.CJS && len(exports) > 0 {
 				esm += "?exports=" + strings.Join(exports, ",")
 			}
 			ctx.SetHeader("X-ESM-Path", esm)
+			// schedule the entry first for the cold loads of deep module graphs, the HTTP/2 and HTTP/3 aware CDNs
+			// fetch the build module with the default priority and the dependencies with the low priority
+			ctx.SetHeader("Priority", "u=0")
+			ctx.SetHeader("Link", entryPreloadLinks(origin, esm, buildCtx.Path(), ret.Imports, aggregated))
 			fmt.Fprintf(buf, "export * from \"%s\";\n", esm)
 			if ret.ExportDefault && (len(exports) == 0 || stringInSlice(exports, "default")) {
 				fmt.Fprintf(buf, "export { default } from \"%s\";\n", esm)
 			}
 			if ret.CJS && len(exports) > 0 {
-				fmt.Fprintf(buf, "import _ from \"%s\";\n", esm)
-				fmt.Fprintf(buf, "export const { %s } = _;\n", strings.Join(exports, ", "))
+				names := make([]string, 0, len(exports))
+				for _, name := range exports {
+					if ns, ok := strings.CutPrefix(name, "*:"); ok {
+						fmt.Fprintf(buf, "export * as %s from \"%s\";\n", ns, esm)
+					} else if name != "default" {
+						names = append(names, name)
+					}
+				}
+				if len(names) > 0 {
+					fmt.Fprintf(buf, "import _ from \"%s\";\n", esm)
+					fmt.Fprintf(buf, "export const { %s } = _;\n", strings.Join(names, ", "))
+				}
 			}
 			if !noDts && ret.Dts != "" {
-				ctx.SetHeader("X-TypeScript-Types", origin+ret.Dts)
-				ctx.SetHeader("Access-Control-Expose-Headers", "X-ESM-Path, X-TypeScript-Types")
-			} else {
-				ctx.SetHeader("Access-Control-Expose-Headers", "X-ESM-Path")
+				dtsUrl := origin + ret.Dts
+				if len(exports) > 0 {
+					dtsUrl += "?exports=" + strings.Join(exports, ",")
+				}
+				ctx.SetHeader("X-TypeScript-Types", dtsUrl)
+				exposeHeaders = append(exposeHeaders, "X-TypeScript-Types")
+			}
+			if len(ret.SkippedCSS) > 0 {
+				exposeHeaders = append(exposeHeaders, "X-ESM-Skipped-CSS")
+			}
+			var pkgJson *PackageJSON
+			if buildCtx.pkgJson != nil {
+				pkgJson = buildCtx.pkgJson
+			} else if !buildCtx.esm.GhPrefix && !buildCtx.esm.PrPrefix && !buildCtx.esm.TgzPrefix {
+				pkgJson, _ = npmrc.getPackageInfo(buildCtx.esm.PkgName, buildCtx.esm.PkgVersion)
+			}
+			var warnings []string
+			// warn that the internal files of the package are not part of its public API
+			if buildArgs.ignoreExports {
+				warnings = append(warnings, "exports-ignored")
+			}
+			// warn that the entry is resolved with the default conditions since none of the `?conditions` is exported
+			if conditions := parseConditionsQuery(query.Get("conditions"), false); len(conditions) > 0 && buildCtx.esm.SubModuleName == "" && pkgJson != nil {
+				if !matchExportConditions(pkgJson, conditions) {
+					warnings = append(warnings, "condition-not-matched")
+				}
+			}
+			if len(warnings) > 0 {
+				for _, warning := range warnings {
+					ctx.W.Header().Add("X-ESM-Warning", warning)
+				}
+				exposeHeaders = append(exposeHeaders, "X-ESM-Warning")
 			}
+			// report the number of the esbuild warnings, the full list is returned by the `?meta` query
+			if len(ret.Warnings) > 0 {
+				ctx.SetHeader("X-ESM-Warning-Count", strconv.Itoa(len(ret.Warnings)))
+				exposeHeaders = append(exposeHeaders, "X-ESM-Warning-Count")
+			}
+			// return the resolved versions of `?deps=locked`
+			if lockedDeps && len(buildCtx.args.deps) > 0 {
+				locked := make([]string, 0, len(buildCtx.args.deps))
+				for name, version := range buildCtx.args.deps {
+					locked = append(locked, name+"@"+version)
+				}
+				sort.Strings(locked)
+				ctx.SetHeader("X-ESM-Deps", strings.Join(locked, ", "))
+				exposeHeaders = append(exposeHeaders, "X-ESM-Deps")
+			}
+			// suggest externalizing the dependencies that are typically shared singletons
+			if !externalAll && pkgJson != nil {
+				if deps := getShareableDeps(pkgJson, buildCtx.args.external); len(deps) > 0 {
+					ctx.SetHeader("X-ESM-Shareable-Deps", strings.Join(deps, ", "))
+					exposeHeaders = append(exposeHeaders, "X-ESM-Shareable-Deps")
+				}
+			}
+			ctx.SetHeader("Access-Control-Expose-Headers", strings.Join(exposeHeaders, ", "))
 		}
 
 		if targetFromUA {
-			appendVaryHeader(ctx.W.Header(), "User-Agent")
+			appendVaryTargetHeaders(ctx.W.Header())
 		}
-		if isExactVersion {
+		if isExactVersion || cacheBusted {
 			ctx.SetHeader("Cache-Control", ccImmutable)
 		} else {
-			ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", config.NpmQueryCacheTTL))
+			ctx.SetHeader("Cache-Control", ccFloat())
 		}
 		ctx.SetHeader("Content-Type", ctJavaScript)
 		if ctx.R.Method == http.MethodHead {
@@ -1786,12 +2872,450 @@ func esmRouter(db DB, buildStorage storage.Storage, logger *log.Logger) rex.Hand
 	}
 }
 
+// parseExportsQuery parses the `?exports` query, the `*:NAME` item exports the
+// module namespace as `NAME`.
+func parseExportsQuery(value string) []string {
+	exportSet := set.New[string]()
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if isJsIdentifier(p) && !isReservedExportName(p) {
+			exportSet.Add(p)
+		} else if ns, ok := strings.CutPrefix(p, "*:"); ok && isJsIdentifier(strings.TrimSpace(ns)) && !isReservedExportName(strings.TrimSpace(ns)) {
+			exportSet.Add("*:" + strings.TrimSpace(ns))
+		}
+	}
+	exports := exportSet.Values()
+	sort.Strings(exports)
+	return exports
+}
+
+// validateExportsQuery checks the names of the `?exports` query, the reserved words except `default` can't be
+// exported by name, e.g. `export const { class } = _;` is a syntax error.
+func validateExportsQuery(value string) error {
+	for _, p := range strings.Split(value, ",") {
+		name := strings.TrimSpace(p)
+		if ns, ok := strings.CutPrefix(name, "*:"); ok {
+			name = strings.TrimSpace(ns)
+		}
+		if isReservedExportName(name) {
+			return fmt.Errorf("Invalid exports query: \"%s\" is a reserved word that can't be exported by name", name)
+		}
+	}
+	return nil
+}
+
+// isReservedExportName checks if the name is a reserved word that can't be used as an export name of the `?exports` query
+func isReservedExportName(name string) bool {
+	return name != "default" && isJsReservedWord(name)
+}
+
+// isExportsWildcard checks if the `?exports` query starts from all the named exports of the module,
+// e.g. `?exports=*,-internal`.
+func isExportsWildcard(value string) bool {
+	for _, p := range strings.Split(value, ",") {
+		if strings.TrimSpace(p) == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveExportsQuery resolves the `?exports` query with the `*` item against the named exports of the
+// built module code.
+func resolveExportsQuery(value string, code []byte) ([]string, error) {
+	_, namedExports, err := parseModuleExports("module.mjs", code)
+	if err != nil {
+		return nil, err
+	}
+	return expandExportsQuery(value, namedExports)
+}
+
+// expandExportsQuery expands the `*` item of the `?exports` query to the given named exports and
+// subtracts the `-NAME` items, e.g. `?exports=*,-internal,-deprecated`. The result is sorted so that
+// the tree-shaken build is deterministic.
+func expandExportsQuery(value string, namedExports []string) ([]string, error) {
+	exportSet := set.New[string]()
+	for _, name := range parseExportsQuery(value) {
+		exportSet.Add(name)
+	}
+	for _, name := range namedExports {
+		if isJsIdentifier(name) {
+			exportSet.Add(name)
+		}
+	}
+	for _, p := range strings.Split(value, ",") {
+		name, ok := strings.CutPrefix(strings.TrimSpace(p), "-")
+		if !ok {
+			continue
+		}
+		if !isJsIdentifier(name) || !stringInSlice(namedExports, name) {
+			return nil, fmt.Errorf("invalid exports query: %q is not exported by the module", name)
+		}
+		exportSet.Remove(name)
+	}
+	if exportSet.Len() == 0 {
+		return nil, errors.New("invalid exports query: no exports left")
+	}
+	exports := exportSet.Values()
+	sort.Strings(exports)
+	return exports, nil
+}
+
+// getUnusedAlias returns the alias names that are not applied to the build, e.g. a typo of the package name
+// or a dependency that is not imported by the module.
+func getUnusedAlias(names []string, applied []string) []string {
+	unused := []string{}
+	for _, name := range names {
+		if !stringInSlice(applied, name) {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+// getBuildPathTarget returns the target segment of the build path, e.g. "/react@19.0.0/es2022/react.mjs" -> "es2022"
+func getBuildPathTarget(pathname string) string {
+	for _, seg := range strings.Split(pathname, "/") {
+		if targets[seg] > 0 {
+			return seg
+		}
+	}
+	return ""
+}
+
+// parseConditionsQuery parses the `?conditions` query, the `worker` condition is added implicitly
+// for the `?worker` builds unless it's removed by the `-worker` item.
+func parseConditionsQuery(value string, worker bool) []string {
+	var conditions []string
+	conditionsSet := set.New[string]()
+	removed := set.New[string]()
+	for _, p := range strings.Split(value, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.ContainsRune(p, ' ') {
+			continue
+		}
+		if name, ok := strings.CutPrefix(p, "-"); ok {
+			removed.Add(name)
+			continue
+		}
+		if !conditionsSet.Has(p) {
+			conditionsSet.Add(p)
+			conditions = append(conditions, p)
+		}
+	}
+	if worker && !conditionsSet.Has("worker") {
+		conditions = append(conditions, "worker")
+	}
+	if removed.Len() > 0 {
+		filtered := conditions[:0]
+		for _, name := range conditions {
+			if !removed.Has(name) {
+				filtered = append(filtered, name)
+			}
+		}
+		conditions = filtered
+	}
+	return conditions
+}
+
+// parseDefineQuery parses the `?define` query into the esbuild defines, e.g. `?define=__FEATURE_X__:true,VERSION:"1.2.3"`,
+// the keys must be identifiers or member expressions and the values must be JSON literals.
+func parseDefineQuery(value string) (define map[string]string, err error) {
+	define = map[string]string{}
+	for _, p := range splitDefineQuery(value) {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		key, value := utils.SplitByFirstByte(p, ':')
+		key = strings.TrimSpace(key)
+		if !isDefineKey(key) {
+			return nil, fmt.Errorf("invalid define key %q", key)
+		}
+		literal, ok := toJSONLiteral(strings.TrimSpace(value))
+		if !ok {
+			return nil, fmt.Errorf("invalid define value of %q, it must be a JSON literal", key)
+		}
+		define[key] = literal
+	}
+	return define, nil
+}
+
+// parseTsconfigQuery parses the `?tsconfig` query that is a base64 encoded JSON of the `compilerOptions`,
+// e.g. `?tsconfig=eyJleHBlcmltZW50YWxEZWNvcmF0b3JzIjp0cnVlfQ` for `{"experimentalDecorators":true}`.
+func parseTsconfigQuery(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	if len(value) > 1024 {
+		return "", errors.New("too long")
+	}
+	// accept the standard base64 encoding (`btoa()`) as well, the unescaped "+" is decoded as a space in the query
+	value = strings.TrimRight(strings.NewReplacer("+", "-", " ", "-", "/", "_").Replace(value), "=")
+	data, err := atobUrl(value)
+	if err != nil {
+		return "", errors.New("invalid base64")
+	}
+	return normalizeTsconfig([]byte(data))
+}
+
+// splitDefineQuery splits the `?define` query by commas that are not in JSON strings.
+func splitDefineQuery(value string) []string {
+	var parts []string
+	inString := false
+	escaped := false
+	start := 0
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if inString {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		if c == '"' {
+			inString = true
+		} else if c == ',' {
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// isDefineKey checks if the key is an identifier or a member expression, e.g. `__DEV__` or `process.env.API_URL`.
+func isDefineKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, name := range strings.Split(key, ".") {
+		if !isJsIdentifier(name) || (i == 0 && isJsReservedWord(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// toJSONLiteral checks if the value is a JSON string, number, boolean or null, and returns the normalized literal.
+func toJSONLiteral(value string) (literal string, ok bool) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var v any
+	if decoder.Decode(&v) != nil || decoder.More() {
+		return "", false
+	}
+	switch v.(type) {
+	case nil, bool, json.Number, string:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(data), true
+	}
+	return "", false
+}
+
+// writeEntryImports writes the dependency imports of the entry module for preloading, the imports are
+// aggregated into a single `?imports` module of the build if there are more than `maxEntryImports`.
+func writeEntryImports(w io.Writer, buildPath string, imports []string) (aggregated bool) {
+	if len(imports) > int(config.MaxEntryImports) {
+		fmt.Fprintf(w, "import \"%s?imports\";\n", buildPath)
+		return true
+	}
+	for _, dep := range imports {
+		fmt.Fprintf(w, "import \"%s\";\n", dep)
+	}
+	return false
+}
+
+// entryPreloadLinks returns the `Link` header of the entry module that preloads the build module and its dependencies,
+// the dependencies are marked with the low priority, or the aggregated `?imports` module is preloaded instead.
+func entryPreloadLinks(origin string, esmPath string, buildPath string, imports []string, aggregated bool) string {
+	links := []string{fmt.Sprintf("<%s%s>; rel=modulepreload", origin, esmPath)}
+	if aggregated {
+		links = append(links, fmt.Sprintf("<%s%s?imports>; rel=modulepreload; priority=low", origin, buildPath))
+	} else {
+		for _, dep := range imports {
+			links = append(links, fmt.Sprintf("<%s%s>; rel=modulepreload; priority=low", origin, dep))
+		}
+	}
+	return strings.Join(links, ", ")
+}
+
+// dtsWithExports returns a `.d.ts` module that only re-exports the given names of the full declaration
+func dtsWithExports(dtsUrl string, exports []string) []byte {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "/* esm.sh - types with exports: %s */\n", strings.Join(exports, ","))
+	names := make([]string, 0, len(exports))
+	for _, name := range exports {
+		if ns, ok := strings.CutPrefix(name, "*:"); ok {
+			fmt.Fprintf(buf, "export * as %s from \"%s\";\n", ns, dtsUrl)
+		} else {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		fmt.Fprintf(buf, "export { %s } from \"%s\";\n", strings.Join(names, ", "), dtsUrl)
+	}
+	return buf.Bytes()
+}
+
+// workerDtsUrl returns the url of the types of the `?worker` module, the `$module` namespace is narrowed by the `?exports` query
+func workerDtsUrl(dtsUrl string, exports []string) string {
+	if len(exports) > 0 {
+		return dtsUrl + "?exports=" + strings.Join(exports, ",") + "&worker"
+	}
+	return dtsUrl + "?worker"
+}
+
+// dtsWorkerFactory returns a `.d.ts` module that types the `workerFactory` function of the `?worker` module
+func dtsWorkerFactory(dtsUrl string) []byte {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteString("/* esm.sh - types of the worker factory */\n")
+	fmt.Fprintf(buf, "import type * as $module from \"%s\";\n", dtsUrl)
+	buf.WriteString("/** The module that is imported as `$module` in the worker. */\n")
+	buf.WriteString("export type WorkerModule = typeof $module;\n")
+	buf.WriteString("export interface WorkerFactoryOptions {\n")
+	buf.WriteString("  /** The code to inject into the worker, the module is available as `$module`. */\n")
+	buf.WriteString("  inject?: string;\n")
+	buf.WriteString("  /** The name of the worker, default is the module url. */\n")
+	buf.WriteString("  name?: string;\n")
+	buf.WriteString("}\n")
+	buf.WriteString("declare function workerFactory(inject?: string): Worker;\n")
+	buf.WriteString("declare function workerFactory(options?: WorkerFactoryOptions): Worker;\n")
+	buf.WriteString("export default workerFactory;\n")
+	return buf.Bytes()
+}
+
+// getShareableDeps returns the dependencies of the package that are typically shared singletons and not external yet
+func getShareableDeps(pkgJson *PackageJSON, external set.ReadOnlySet[string]) []string {
+	deps := []string{}
+	for name := range shareableDeps {
+		if name == pkgJson.Name || isExternalSpecifier(external, name) {
+			continue
+		}
+		_, ok := pkgJson.Dependencies[name]
+		if !ok {
+			_, ok = pkgJson.PeerDependencies[name]
+		}
+		if ok {
+			deps = append(deps, name)
+		}
+	}
+	sort.Strings(deps)
+	return deps
+}
+
+// checkQueryListLength returns an error if the number of items in any of the list queries exceeds the `maxQueryListLength` config
+func checkQueryListLength(query url.Values, keys ...string) error {
+	for _, key := range keys {
+		if v := query.Get(key); v != "" && strings.Count(v, ",") >= int(config.MaxQueryListLength) {
+			return fmt.Errorf("Too many items in the `?%s` query, the maximum is %d", key, config.MaxQueryListLength)
+		}
+	}
+	return nil
+}
+
+// resolveOriginPlaceholder replaces the `{ESM_CDN_ORIGIN}` placeholder of the module with the origin, the placeholder
+// is used by the `import.meta.url` of the builds of the legacy targets that don't support `import.meta`.
+func resolveOriginPlaceholder(ctx *rex.Context, r io.ReadCloser, stat storage.Stat, savePath string, origin string) any {
+	defer r.Close()
+	code, err := io.ReadAll(r)
+	if err != nil {
+		return rex.Status(500, err.Error())
+	}
+	return respondContent(ctx, bytes.ReplaceAll(code, []byte("{ESM_CDN_ORIGIN}"), []byte(origin)), "resolved:"+origin+":"+savePath+":"+statETag(stat))
+}
+
+// parseDenoImports derives the aliases and externals from the `imports` of a `deno.json` that is sent by
+// the `X-Deno-Imports` header. A bare specifier remapped to another package of esm.sh becomes an alias, and
+// a bare specifier mapped to a non-esm.sh URL (`npm:`, `jsr:`, relative paths or other hosts) becomes an
+// external that is resolved by Deno. The prefix mappings with a trailing slash, e.g. `"preact/": "npm:/preact@10/"`,
+// are applied to the package of the prefix, the mappings of sub-modules are ignored.
+func parseDenoImports(value string, origin string) (alias map[string]string, external []string, err error) {
+	if len(value) > maxDenoImportsSize {
+		return nil, nil, fmt.Errorf("the header is too large, the maximum is %d bytes", maxDenoImportsSize)
+	}
+	var imports map[string]string
+	if err = json.Unmarshal([]byte(value), &imports); err != nil {
+		return nil, nil, errors.New("the header must be a JSON object of the `imports` field in deno.json")
+	}
+	alias = map[string]string{}
+	externalSet := set.New[string]()
+	for specifier, to := range imports {
+		pkgName := strings.TrimSuffix(specifier, "/")
+		if !validatePackageName(pkgName) || toPackageName(pkgName) != pkgName {
+			// not a bare specifier of a package, or a mapping of a sub-module
+			continue
+		}
+		var esmPath string
+		for _, prefix := range []string{origin + "/", "https://esm.sh/"} {
+			if p, ok := strings.CutPrefix(to, prefix); ok {
+				esmPath, _ = utils.SplitByFirstByte(p, '?')
+				break
+			}
+		}
+		if esmPath == "" {
+			externalSet.Add(pkgName)
+			continue
+		}
+		toPkgName, _, subPath, _ := splitEsmPath(strings.TrimPrefix(esmPath, "*"))
+		if !validatePackageName(toPkgName) || isNonNpmPathPrefix(toPkgName) {
+			// the github/jsr/legacy modules of esm.sh can't be aliased
+			continue
+		}
+		// e.g. `"react": "https://esm.sh/preact@10/compat"` or `"react/": "https://esm.sh/preact@10/compat/"`
+		if subPath = strings.TrimSuffix(subPath, "/"); subPath != "" {
+			toPkgName += "/" + subPath
+		}
+		if toPkgName != pkgName {
+			alias[pkgName] = toPkgName
+		}
+	}
+	if len(alias)+externalSet.Len() > int(config.MaxQueryListLength) {
+		return nil, nil, fmt.Errorf("too many aliases and externals, the maximum is %d", config.MaxQueryListLength)
+	}
+	external = externalSet.Values()
+	sort.Strings(external)
+	return alias, external, nil
+}
+
+// isNonNpmPathPrefix checks if the first segment of the esm.sh path is a prefix of the non-npm modules, e.g. `gh`, `jsr` or `v135`
+func isNonNpmPathPrefix(segment string) bool {
+	switch segment {
+	case "gh", "github.com", "pr", "pkg.pr.new", "tgz", "jsr", "jsr.io", "node":
+		return true
+	}
+	return len(segment) > 1 && segment[0] == 'v' && valid.IsDigtalOnlyString(segment[1:])
+}
+
+// parseEntriesQuery parses the `?entries` query into the sorted sub-module names
+func parseEntriesQuery(value string) []string {
+	entrySet := set.New[string]()
+	for _, p := range strings.Split(value, ",") {
+		p = stripEntryModuleExt(strings.TrimPrefix(strings.TrimSpace(p), "./"))
+		if p == "" || strings.HasPrefix(p, "/") || stringInSlice(strings.Split(p, "/"), "..") {
+			continue
+		}
+		entrySet.Add(p)
+	}
+	entries := entrySet.Values()
+	sort.Strings(entries)
+	return entries
+}
+
 func getOrigin(ctx *rex.Context) string {
 	origin := ctx.R.Header.Get("X-Real-Origin")
 	if origin != "" {
 		return origin
 	}
 	proto := "http:"
+	host := ctx.R.Host
 	if cfVisitor := ctx.R.Header.Get("CF-Visitor"); cfVisitor != "" {
 		if strings.Contains(cfVisitor, "\"https\"") {
 			proto = "https:"
@@ -1799,7 +3323,28 @@ func getOrigin(ctx *rex.Context) string {
 	} else if ctx.R.TLS != nil {
 		proto = "https:"
 	}
-	return proto + "//" + ctx.R.Host
+	// the `X-Forwarded-*` headers can be spoofed by clients, only use them if the server is behind a trusted proxy
+	if config.TrustForwarded {
+		if v := getForwardedHeader(ctx.R.Header, "X-Forwarded-Proto"); v == "http" || v == "https" {
+			proto = v + ":"
+		}
+		if v := getForwardedHeader(ctx.R.Header, "X-Forwarded-Host"); v != "" && !strings.ContainsAny(v, "/\\@?# ") {
+			host = v
+		}
+	}
+	return proto + "//" + host
+}
+
+// getForwardedHeader returns the first value of the `X-Forwarded-*` header, the
+// proxies append their own values to the header that is separated by comma.
+func getForwardedHeader(header http.Header, key string) string {
+	v, _, _ := strings.Cut(header.Get(key), ",")
+	return strings.ToLower(strings.TrimSpace(v))
+}
+
+// ccFloat returns the `Cache-Control` header for the responses that are not pinned to an exact version
+func ccFloat() string {
+	return fmt.Sprintf("public, max-age=%d", config.FloatCacheTTL)
 }
 
 func redirect(ctx *rex.Context, url string, isMovedPermanently bool) any {
@@ -1808,13 +3353,25 @@ func redirect(ctx *rex.Context, url string, isMovedPermanently bool) any {
 		code = http.StatusMovedPermanently
 		ctx.SetHeader("Cache-Control", ccImmutable)
 	} else {
-		ctx.SetHeader("Cache-Control", fmt.Sprintf("public, max-age=%d", config.NpmQueryCacheTTL))
+		ctx.SetHeader("Cache-Control", ccFloat())
 	}
 	ctx.SetHeader("Location", url)
 	return rex.Status(code, nil)
 }
 
-func errorJS(ctx *rex.Context, message string) any {
+// errorJS returns a JS module that throws the error, or a JSON error if the client accepts JSON
+func errorJS(ctx *rex.Context, code string, message string) any {
+	ctx.SetHeader("Cache-Control", ccImmutable)
+	appendVaryHeader(ctx.W.Header(), "Accept")
+	if acceptsJSON(ctx) {
+		query := ctx.Query()
+		return rex.Status(errorStatusCodes[code], map[string]any{
+			"error":    message,
+			"code":     code,
+			"name":     query.Get("name"),
+			"importer": query.Get("importer"),
+		})
+	}
 	buf, recycle := NewBuffer()
 	defer recycle()
 	buf.WriteString("/* esm.sh - error */\n")
@@ -1823,6 +3380,173 @@ func errorJS(ctx *rex.Context, message string) any {
 	buf.WriteString(");\n")
 	buf.WriteString("export default null;\n")
 	ctx.SetHeader("Content-Type", ctJavaScript)
-	ctx.SetHeader("Cache-Control", ccImmutable)
 	return buf.Bytes()
 }
+
+// forbiddenStatus returns the status of the package that is not allowed or banned, the packages that are
+// not allowed in the `strict` mode of the allow list are treated as non-existent.
+func forbiddenStatus(ctx *rex.Context, pkgName string) any {
+	if config.AllowList.Strict && !config.AllowList.IsPackageAllowed(pkgName) {
+		return errorStatus(ctx, 404, errCodeNotFound, "package \""+pkgName+"\" not found")
+	}
+	return rex.Status(403, "forbidden")
+}
+
+// errorStatus returns the error message in plain text, or a JSON error if the client accepts JSON
+func errorStatus(ctx *rex.Context, status int, code string, message string) any {
+	appendVaryHeader(ctx.W.Header(), "Accept")
+	if acceptsJSON(ctx) {
+		return rex.Status(status, map[string]any{
+			"error": message,
+			"code":  code,
+		})
+	}
+	return rex.Status(status, message)
+}
+
+// getIntegrity returns the SRI hash(sha384) of the stored file, the hash is cached in the storage alongside the file.
+// The builds of the legacy targets are served with the `{ESM_CDN_ORIGIN}` placeholder resolved, their hashes vary
+// by the origin and are cached in memory instead, the `origin` is empty for the other builds.
+func getIntegrity(buildStorage storage.Storage, savePath string, origin string) (string, error) {
+	stat, err := buildStorage.Stat(savePath)
+	if err != nil {
+		return "", err
+	}
+	if origin != "" {
+		return withLRUCache("integrity:"+origin+":"+savePath+":"+statETag(stat), func() (string, error) {
+			r, _, err := buildStorage.Get(savePath)
+			if err != nil {
+				return "", err
+			}
+			defer r.Close()
+			code, err := io.ReadAll(r)
+			if err != nil {
+				return "", err
+			}
+			h := sha512.Sum384(bytes.ReplaceAll(code, []byte("{ESM_CDN_ORIGIN}"), []byte(origin)))
+			return "sha384-" + base64.StdEncoding.EncodeToString(h[:]), nil
+		})
+	}
+	f, fi, err := buildStorage.Get(savePath + ".integrity")
+	if err == nil {
+		data, err := io.ReadAll(f)
+		f.Close()
+		// ignore the stale hash of the file that has been rebuilt
+		if err == nil && strings.HasPrefix(string(data), "sha384-") && !fi.ModTime().Before(stat.ModTime()) {
+			return string(data), nil
+		}
+	} else if err != storage.ErrNotFound {
+		return "", err
+	}
+	r, _, err := buildStorage.Get(savePath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	h := sha512.New384()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	integrity := "sha384-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+	buildStorage.Put(savePath+".integrity", strings.NewReader(integrity))
+	return integrity, nil
+}
+
+// statETag returns a weak etag of the file by the modification time and the size
+func statETag(stat storage.Stat) string {
+	return fmt.Sprintf(`W/"%x-%x"`, stat.ModTime().Unix(), stat.Size())
+}
+
+// respondStoredFile returns the stored file. The compressed size of the GET response is unknown before the body
+// is written, so the HEAD request gets the `Content-Encoding` and `Content-Length` headers of the compressed
+// response that are negotiated by the same rules of the compression middleware.
+func respondStoredFile(ctx *rex.Context, f io.ReadCloser, stat storage.Stat, savePath string) any {
+	if ctx.R.Method != http.MethodHead {
+		return f // auto closed
+	}
+	defer f.Close()
+	return respondHead(ctx, f, stat.Size(), savePath+":"+statETag(stat))
+}
+
+// respondContent returns the content that is transformed from the stored file, e.g. the build of the legacy target
+// with the origin resolved, the HEAD request gets the `Content-Length` of the transformed content. The encoded size
+// is cached by the `cacheKey` if it's not empty.
+func respondContent(ctx *rex.Context, content []byte, cacheKey string) any {
+	if ctx.R.Method != http.MethodHead {
+		return content
+	}
+	return respondHead(ctx, bytes.NewReader(content), int64(len(content)), cacheKey)
+}
+
+func respondHead(ctx *rex.Context, r io.Reader, size int64, cacheKey string) any {
+	if config.Compress && size >= 1024 && isCompressibleContentType(ctx.W.Header().Get("Content-Type")) {
+		encoding := ""
+		if acceptEncoding := ctx.R.Header.Get("Accept-Encoding"); strings.Contains(acceptEncoding, "br") {
+			encoding = "br"
+		} else if strings.Contains(acceptEncoding, "gzip") {
+			encoding = "gzip"
+		}
+		if encoding != "" {
+			var encodedSize int64
+			var err error
+			if cacheKey != "" {
+				encodedSize, err = withLRUCache("encoded-size:"+encoding+":"+cacheKey, func() (int64, error) {
+					return getEncodedSize(r, encoding)
+				})
+			} else {
+				encodedSize, err = getEncodedSize(r, encoding)
+			}
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			size = encodedSize
+			appendVaryHeader(ctx.W.Header(), "Accept-Encoding")
+			ctx.SetHeader("Content-Encoding", encoding)
+		}
+	}
+	ctx.SetHeader("Content-Length", strconv.FormatInt(size, 10))
+	return rex.Status(200, nil)
+}
+
+// getEncodedSize returns the size of the content that is compressed with the same level of the compression middleware
+func getEncodedSize(r io.Reader, encoding string) (int64, error) {
+	var cw countWriter
+	var zw io.WriteCloser
+	if encoding == "br" {
+		zw = brotli.NewWriterLevel(&cw, brotli.BestSpeed)
+	} else {
+		zw, _ = gzip.NewWriterLevel(&cw, gzip.BestSpeed)
+	}
+	_, err := io.Copy(zw, r)
+	if err != nil {
+		return 0, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+// isCompressibleContentType checks if the response of the content type is compressed by the compression middleware
+func isCompressibleContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.HasPrefix(contentType, "application/javascript") ||
+		strings.HasPrefix(contentType, "application/json") ||
+		strings.HasPrefix(contentType, "application/xml") ||
+		strings.HasPrefix(contentType, "application/wasm")
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func acceptsJSON(ctx *rex.Context) bool {
+	return strings.Contains(ctx.R.Header.Get("Accept"), "application/json")
+}
@@ -0,0 +1,684 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/esm-dev/esm.sh/server/storage"
+	"github.com/ije/gox/log"
+	"github.com/ije/gox/set"
+	"github.com/ije/rex"
+)
+
+func TestGetShareableDeps(t *testing.T) {
+	pkgJson := &PackageJSON{
+		Name: "some-ui-lib",
+		Dependencies: map[string]string{
+			"@emotion/react": "^11.0.0",
+			"clsx":           "^2.0.0",
+		},
+		PeerDependencies: map[string]string{
+			"react":     "^18.0.0",
+			"react-dom": "^18.0.0",
+		},
+	}
+	for _, tc := range []struct {
+		external []string
+		want     string
+	}{
+		{nil, "@emotion/react,react,react-dom"},
+		{[]string{"react", "react-dom"}, "@emotion/react"},
+		{[]string{"react", "react-dom", "@emotion/react"}, ""},
+	} {
+		deps := getShareableDeps(pkgJson, *set.NewReadOnly(tc.external...))
+		if strings.Join(deps, ",") != tc.want {
+			t.Fatalf("getShareableDeps(external=%v): expected [%s], got %v", tc.external, tc.want, deps)
+		}
+	}
+
+	// the package itself is not a shareable dependency
+	pkgJson = &PackageJSON{Name: "react-dom", PeerDependencies: map[string]string{"react": "^18.0.0"}}
+	if deps := getShareableDeps(pkgJson, set.ReadOnlySet[string]{}); strings.Join(deps, ",") != "react" {
+		t.Fatalf("unexpected shareable deps of react-dom: %v", deps)
+	}
+}
+
+func TestDtsWorkerFactory(t *testing.T) {
+	dtsUrl := "https://esm.sh/foo@1.0.0/X-ZHdvcmtlcg/index.d.ts"
+	if u := workerDtsUrl(dtsUrl, nil); u != dtsUrl+"?worker" {
+		t.Fatalf("unexpected worker types url: %s", u)
+	}
+	if u := workerDtsUrl(dtsUrl, []string{"a", "b"}); u != dtsUrl+"?exports=a,b&worker" {
+		t.Fatalf("unexpected worker types url: %s", u)
+	}
+	dts := string(dtsWorkerFactory(dtsUrl + "?exports=a,b"))
+	for _, s := range []string{
+		`import type * as $module from "` + dtsUrl + `?exports=a,b";`,
+		"export type WorkerModule = typeof $module;",
+		"declare function workerFactory(inject?: string): Worker;",
+		"declare function workerFactory(options?: WorkerFactoryOptions): Worker;",
+		"export default workerFactory;",
+	} {
+		if !strings.Contains(dts, s) {
+			t.Fatalf("missing %q in the worker types:\n%s", s, dts)
+		}
+	}
+}
+
+func TestEntryPreloadLinks(t *testing.T) {
+	origin := "https://esm.sh"
+	imports := []string{"/react@18.2.0/es2022/react.mjs", "/scheduler@0.23.0/es2022/scheduler.mjs"}
+	links := entryPreloadLinks(origin, "/react-dom@18.2.0/es2022/client.mjs?exports=createRoot", "/react-dom@18.2.0/es2022/client.mjs", imports, false)
+	expected := "<https://esm.sh/react-dom@18.2.0/es2022/client.mjs?exports=createRoot>; rel=modulepreload, " +
+		"<https://esm.sh/react@18.2.0/es2022/react.mjs>; rel=modulepreload; priority=low, " +
+		"<https://esm.sh/scheduler@0.23.0/es2022/scheduler.mjs>; rel=modulepreload; priority=low"
+	if links != expected {
+		t.Fatalf("unexpected links: %s", links)
+	}
+	links = entryPreloadLinks(origin, "/react-dom@18.2.0/es2022/client.mjs", "/react-dom@18.2.0/es2022/client.mjs", imports, true)
+	expected = "<https://esm.sh/react-dom@18.2.0/es2022/client.mjs>; rel=modulepreload, " +
+		"<https://esm.sh/react-dom@18.2.0/es2022/client.mjs?imports>; rel=modulepreload; priority=low"
+	if links != expected {
+		t.Fatalf("unexpected links of the aggregated imports: %s", links)
+	}
+}
+
+func TestValidateExportsQuery(t *testing.T) {
+	for _, value := range []string{"", "foo,bar", "default,*:ns", "*,-class"} {
+		if err := validateExportsQuery(value); err != nil {
+			t.Fatalf("validateExportsQuery(%q): unexpected error %v", value, err)
+		}
+	}
+	for _, value := range []string{"class", "foo, return", "*:import"} {
+		if err := validateExportsQuery(value); err == nil || !strings.Contains(err.Error(), "is a reserved word") {
+			t.Fatalf("validateExportsQuery(%q): expected a reserved word error, got %v", value, err)
+		}
+	}
+	if exports := parseExportsQuery("foo,class,default,*:import"); strings.Join(exports, ",") != "default,foo" {
+		t.Fatalf("unexpected exports %v", exports)
+	}
+}
+
+func TestClosureTypes(t *testing.T) {
+	origin := "https://esm.sh"
+	w := NewImportMapWalker(nil, origin, 0)
+	entry := &BuildContext{esm: EsmPath{PkgName: "react-dom", PkgVersion: "18.2.0", SubPath: "client", SubModuleName: "client"}, target: "es2022"}
+	react := &BuildContext{esm: EsmPath{PkgName: "react", PkgVersion: "18.2.0"}, target: "es2022"}
+	scheduler := &BuildContext{esm: EsmPath{PkgName: "scheduler", PkgVersion: "0.23.0"}, target: "es2022"}
+	w.importMap.Imports["react-dom/client"] = origin + entry.Path()
+	w.importMap.Imports["react"] = origin + react.Path()
+	w.importMap.Imports["scheduler"] = origin + scheduler.Path()
+	w.modules = []walkedModule{
+		{entry, &BuildMeta{Dts: "/@types/react-dom@18.2.0/client.d.ts"}},
+		{react, &BuildMeta{Dts: "/@types/react@18.2.0/index.d.ts", CJS: true}},
+		// modules without types are not declared
+		{scheduler, &BuildMeta{}},
+	}
+	dts := string(w.closureTypes(entry))
+	for _, s := range []string{
+		"/* esm.sh - the types of the dependency closure of react-dom@18.2.0/client */\n",
+		"declare module \"react-dom/client\" {\n  export * from \"https://esm.sh/@types/react-dom@18.2.0/client.d.ts\";\n}\n",
+		"declare module \"https://esm.sh/react-dom@18.2.0/client\" {\n",
+		"declare module \"https://esm.sh/react-dom@18.2.0/es2022/client.mjs\" {\n",
+		"declare module \"react\" {\n  export * from \"https://esm.sh/@types/react@18.2.0/index.d.ts\";\n  export { default } from \"https://esm.sh/@types/react@18.2.0/index.d.ts\";\n}\n",
+	} {
+		if !strings.Contains(dts, s) {
+			t.Fatalf("missing %q in the closure types:\n%s", s, dts)
+		}
+	}
+	if strings.Contains(dts, "scheduler") {
+		t.Fatalf("unexpected scheduler module in the closure types:\n%s", dts)
+	}
+}
+
+func TestGetIntegrity(t *testing.T) {
+	wd := t.TempDir()
+	buildStorage, err := storage.NewFSStorage(&storage.StorageOptions{Type: "fs", Endpoint: path.Join(wd, "storage")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sri := func(content string) string {
+		h := sha512.Sum384([]byte(content))
+		return "sha384-" + base64.StdEncoding.EncodeToString(h[:])
+	}
+
+	_, err = getIntegrity(buildStorage, "esm/foo@1.0.0/es2022/foo.mjs", "")
+	if err != storage.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	err = buildStorage.Put("esm/foo@1.0.0/es2022/foo.mjs", strings.NewReader("export default 1;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	integrity, err := getIntegrity(buildStorage, "esm/foo@1.0.0/es2022/foo.mjs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if integrity != sri("export default 1;") {
+		t.Fatalf("unexpected integrity: %s", integrity)
+	}
+	if _, err = buildStorage.Stat("esm/foo@1.0.0/es2022/foo.mjs.integrity"); err != nil {
+		t.Fatalf("the integrity should be cached: %v", err)
+	}
+
+	// the cached integrity is stale after the file is rebuilt
+	err = buildStorage.Put("esm/foo@1.0.0/es2022/foo.mjs", strings.NewReader("export default 2;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path.Join(wd, "storage", "esm/foo@1.0.0/es2022/foo.mjs"), future, future)
+	integrity, err = getIntegrity(buildStorage, "esm/foo@1.0.0/es2022/foo.mjs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if integrity != sri("export default 2;") {
+		t.Fatalf("unexpected integrity of the rebuilt file: %s", integrity)
+	}
+
+	// the integrity of the legacy build is the hash of the served code that the origin placeholder is resolved
+	err = buildStorage.Put("esm/foo@1.0.0/es2015/foo.mjs", strings.NewReader(`export const url = "{ESM_CDN_ORIGIN}/foo@1.0.0/es2015/foo.mjs";`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	integrity, err = getIntegrity(buildStorage, "esm/foo@1.0.0/es2015/foo.mjs", "https://esm.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if integrity != sri(`export const url = "https://esm.sh/foo@1.0.0/es2015/foo.mjs";`) {
+		t.Fatalf("unexpected integrity of the legacy build: %s", integrity)
+	}
+}
+
+func TestRespondStoredFileWithHeadRequest(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{Compress: true}
+
+	wd := t.TempDir()
+	buildStorage, err := storage.NewFSStorage(&storage.StorageOptions{Type: "fs", Endpoint: path.Join(wd, "storage")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	savePath := "modules/foo@1.0.0/es2022/foo.mjs"
+	err = buildStorage.Put(savePath, strings.NewReader(strings.Repeat("export const foo = 'bar';\n", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacySavePath := "modules/foo@1.0.0/es2015/foo.mjs"
+	err = buildStorage.Put(legacySavePath, strings.NewReader(strings.Repeat("export const url = '{ESM_CDN_ORIGIN}/foo@1.0.0/es2015/foo.mjs';\n", 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := rex.New()
+	mux.Use(rex.Compress(), func(ctx *rex.Context) any {
+		ctx.SetHeader("Content-Type", ctJavaScript)
+		// the legacy build is served with the origin placeholder resolved
+		if strings.Contains(ctx.R.URL.Path, "/es2015/") {
+			f, stat, err := buildStorage.Get(legacySavePath)
+			if err != nil {
+				return rex.Status(500, err.Error())
+			}
+			return resolveOriginPlaceholder(ctx, f, stat, legacySavePath, "https://cdn.example.com")
+		}
+		f, stat, err := buildStorage.Get(savePath)
+		if err != nil {
+			return rex.Status(500, err.Error())
+		}
+		return respondStoredFile(ctx, f, stat, savePath)
+	})
+	request := func(method string, pathname string, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://127.0.0.1:8080"+pathname, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, tc := range [][2]string{
+		{"/foo@1.0.0/es2022/foo.mjs", "br"},
+		{"/foo@1.0.0/es2022/foo.mjs", "gzip, deflate"},
+		{"/foo@1.0.0/es2022/foo.mjs", ""},
+		{"/foo@1.0.0/es2015/foo.mjs", "br"},
+		{"/foo@1.0.0/es2015/foo.mjs", ""},
+	} {
+		pathname, acceptEncoding := tc[0], tc[1]
+		get := request("GET", pathname, acceptEncoding)
+		head := request("HEAD", pathname, acceptEncoding)
+		if head.Code != 200 {
+			t.Fatalf("HEAD(%q): unexpected status %d", acceptEncoding, head.Code)
+		}
+		if e := head.Header().Get("Content-Encoding"); e != get.Header().Get("Content-Encoding") {
+			t.Fatalf("HEAD(%q): expected Content-Encoding %q, got %q", acceptEncoding, get.Header().Get("Content-Encoding"), e)
+		}
+		if l := head.Header().Get("Content-Length"); l != strconv.Itoa(get.Body.Len()) {
+			t.Fatalf("HEAD(%q): expected Content-Length %d, got %s", acceptEncoding, get.Body.Len(), l)
+		}
+		if head.Body.Len() != 0 {
+			t.Fatalf("HEAD(%q): the body should be empty", acceptEncoding)
+		}
+		if acceptEncoding == "" && strings.Contains(get.Body.String(), "{ESM_CDN_ORIGIN}") {
+			t.Fatalf("GET(%s): the origin placeholder should be resolved", pathname)
+		}
+	}
+}
+
+func TestFindLicenseFile(t *testing.T) {
+	for _, tc := range []struct {
+		files []string
+		want  string
+	}{
+		{[]string{"index.js", "LICENSE"}, "LICENSE"},
+		{[]string{"index.js", "license.md"}, "license.md"},
+		{[]string{"Licence.txt", "README.md"}, "Licence.txt"},
+		{[]string{"LICENSE-MIT", "LICENSE.md"}, "LICENSE.md"},
+		{[]string{"LICENSE-MIT"}, "LICENSE-MIT"},
+		{[]string{"index.js", "README.md"}, ""},
+	} {
+		pkgDir := t.TempDir()
+		for _, name := range tc.files {
+			if err := os.WriteFile(path.Join(pkgDir, name), []byte("MIT"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		filename, err := findLicenseFile(pkgDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if filename != tc.want {
+			t.Fatalf("findLicenseFile(%v): expected %q, got %q", tc.files, tc.want, filename)
+		}
+	}
+}
+
+func TestGetOriginWithForwardedHeaders(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+
+	newContext := func(header map[string]string) *rex.Context {
+		r := httptest.NewRequest("GET", "http://127.0.0.1:8080/react@18.3.1", nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		return &rex.Context{R: r}
+	}
+	forwarded := map[string]string{
+		"X-Forwarded-Proto": "https",
+		"X-Forwarded-Host":  "cdn.example.com",
+	}
+
+	config = &Config{}
+	if origin := getOrigin(newContext(forwarded)); origin != "http://127.0.0.1:8080" {
+		t.Fatalf("the forwarded headers should be ignored if they are not trusted, got %s", origin)
+	}
+
+	config = &Config{TrustForwarded: true}
+	for _, tc := range []struct {
+		header map[string]string
+		want   string
+	}{
+		{forwarded, "https://cdn.example.com"},
+		{map[string]string{"X-Forwarded-Proto": "https"}, "https://127.0.0.1:8080"},
+		{map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "cdn.example.com, proxy.internal"}, "https://cdn.example.com"},
+		{map[string]string{"X-Forwarded-Proto": "javascript", "X-Forwarded-Host": "evil.com/path"}, "http://127.0.0.1:8080"},
+		{map[string]string{"X-Real-Origin": "https://esm.sh", "X-Forwarded-Host": "cdn.example.com"}, "https://esm.sh"},
+	} {
+		if origin := getOrigin(newContext(tc.header)); origin != tc.want {
+			t.Fatalf("getOrigin(%v): expected %s, got %s", tc.header, tc.want, origin)
+		}
+	}
+}
+
+func TestDtsWithExports(t *testing.T) {
+	dts := string(dtsWithExports("https://esm.sh/lodash-es@4.17.21/lodash.d.ts", parseExportsQuery("debounce,*:fp,default,throttle")))
+	for _, line := range []string{
+		`export * as fp from "https://esm.sh/lodash-es@4.17.21/lodash.d.ts";`,
+		`export { debounce, default, throttle } from "https://esm.sh/lodash-es@4.17.21/lodash.d.ts";`,
+	} {
+		if !strings.Contains(dts, line+"\n") {
+			t.Fatalf("expected %q in the types:\n%s", line, dts)
+		}
+	}
+}
+
+func TestResolveExportsQuery(t *testing.T) {
+	code := []byte(`export const foo = 1, internal = 2; export function deprecated() {} export { foo as bar }; export default foo;`)
+	for _, tc := range []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{"*", "bar,default,deprecated,foo,internal", false},
+		{"*,-internal,-deprecated", "bar,default,foo", false},
+		{" -internal , * ", "bar,default,deprecated,foo", false},
+		{"*,-default,*:ns", "*:ns,bar,deprecated,foo,internal", false},
+		{"*,-unknown", "", true},
+		{"*,-bar,-default,-deprecated,-foo,-internal", "", true},
+	} {
+		if !isExportsWildcard(tc.value) {
+			t.Fatalf("isExportsWildcard(%q): expected true", tc.value)
+		}
+		exports, err := resolveExportsQuery(tc.value, code)
+		if tc.err {
+			if err == nil {
+				t.Fatalf("resolveExportsQuery(%q): expected an error, got %v", tc.value, exports)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(exports, ","); got != tc.want {
+			t.Fatalf("resolveExportsQuery(%q): expected %q, got %q", tc.value, tc.want, got)
+		}
+	}
+	if isExportsWildcard("foo,*:ns") {
+		t.Fatal("isExportsWildcard(\"foo,*:ns\"): expected false")
+	}
+}
+
+func TestGetBuildPathTarget(t *testing.T) {
+	for path, target := range map[string]string{
+		"/react@19.0.0/es2022/react.mjs":                   "es2022",
+		"/react-dom@19.0.0/X-ZXJlYWN0/denonext/client.mjs": "denonext",
+		"/*preact@10.23.2/deno/jsx-runtime.mjs":            "deno",
+		"/preact@10.23.2/src/index.d.ts":                   "",
+	} {
+		if got := getBuildPathTarget(path); got != target {
+			t.Fatalf("getBuildPathTarget(%s): expected %q, got %q", path, target, got)
+		}
+	}
+}
+
+func TestGetUnusedAlias(t *testing.T) {
+	// the alias that matches a dependency but is not imported by the module is unused as well
+	unused := getUnusedAlias([]string{"react", "raect", "react-dom"}, []string{"react"})
+	if !reflect.DeepEqual(unused, []string{"raect", "react-dom"}) {
+		t.Fatalf("unexpected unused alias %v", unused)
+	}
+	if unused := getUnusedAlias(nil, []string{"react"}); len(unused) != 0 {
+		t.Fatalf("unexpected unused alias %v", unused)
+	}
+}
+
+func TestParseConditionsQuery(t *testing.T) {
+	for _, tc := range []struct {
+		value  string
+		worker bool
+		want   string
+	}{
+		{"", false, ""},
+		{"", true, "worker"},
+		{"react-server, react-server,foo bar", false, "react-server"},
+		{"react-server", true, "react-server,worker"},
+		{"worker,browser", true, "worker,browser"},
+		{"-worker", true, ""},
+		{"browser,-browser", false, ""},
+	} {
+		conditions := parseConditionsQuery(tc.value, tc.worker)
+		if strings.Join(conditions, ",") != tc.want {
+			t.Fatalf("parseConditionsQuery(%q, %v): expected %q, got %q", tc.value, tc.worker, tc.want, strings.Join(conditions, ","))
+		}
+	}
+}
+
+func TestParseDefineQuery(t *testing.T) {
+	define, err := parseDefineQuery(`__FEATURE_X__:true, VERSION:"1,2.3", process.env.LEVEL:3, API:null`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(define) != 4 || define["__FEATURE_X__"] != "true" || define["VERSION"] != `"1,2.3"` || define["process.env.LEVEL"] != "3" || define["API"] != "null" {
+		t.Fatalf("invalid define %v", define)
+	}
+	for _, value := range []string{
+		`foo-bar:true`,
+		`this.x:1`,
+		`a..b:1`,
+		`X:alert(1)`,
+		`X:{"a":1}`,
+		`X:"a" + "b"`,
+		`X`,
+	} {
+		if _, err := parseDefineQuery(value); err == nil {
+			t.Fatalf("parseDefineQuery(%q) should fail", value)
+		}
+	}
+}
+
+func TestParseDenoImports(t *testing.T) {
+	alias, external, err := parseDenoImports(`{
+		"react": "https://esm.sh/preact@10.23.2/compat",
+		"react-dom/": "http://localhost:8080/*preact@10.23.2/compat/",
+		"preact": "https://esm.sh/preact@10.23.2",
+		"preact/": "https://esm.sh/preact@10.23.2/",
+		"@std/path": "jsr:@std/path@^1.0.0",
+		"lodash/": "npm:/lodash@4/",
+		"utils": "./src/utils.ts",
+		"cdn-lib": "https://cdn.example.com/lib.js",
+		"gh-lib": "https://esm.sh/gh/user/repo",
+		"preact/hooks": "npm:preact@10/hooks",
+		"./local.ts": "./src/local.ts",
+		"https://deno.land/x/oak/": "https://esm.sh/oak/"
+	}`, "http://localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alias) != 2 || alias["react"] != "preact/compat" || alias["react-dom"] != "preact/compat" {
+		t.Fatalf("unexpected alias %v", alias)
+	}
+	if strings.Join(external, ",") != "@std/path,cdn-lib,lodash,utils" {
+		t.Fatalf("unexpected external %v", external)
+	}
+
+	for _, value := range []string{
+		`["react"]`,
+		`{"react": 1}`,
+		`{"imports": {"react": "npm:react"}}`,
+		`{"a": "` + strings.Repeat("a", maxDenoImportsSize) + `"}`,
+	} {
+		if _, _, err := parseDenoImports(value, "http://localhost:8080"); err == nil {
+			t.Fatalf("parseDenoImports(%q) should fail", value[:min(len(value), 40)])
+		}
+	}
+}
+
+func TestRewritePackageAlias(t *testing.T) {
+	defer func(aliases map[string]string) { config.PackageAliases = aliases }(config.PackageAliases)
+	config.PackageAliases = map[string]string{
+		"ui":          "@myorg/ui-kit@^2",
+		"@vanity/lib": "some-lib",
+	}
+	for _, tc := range []struct {
+		pathname string
+		want     string
+	}{
+		{"/ui", "/@myorg/ui-kit@^2"},
+		{"/ui@2.1.0", "/@myorg/ui-kit@2.1.0"},
+		{"/ui/button", "/@myorg/ui-kit@^2/button"},
+		{"/ui@2.1.0/es2022/button.mjs", "/@myorg/ui-kit@2.1.0/es2022/button.mjs"},
+		{"/ui/styles.css", "/@myorg/ui-kit@^2/styles.css"},
+		{"/ui@2.1.0/index.d.ts", "/@myorg/ui-kit@2.1.0/index.d.ts"},
+		{"/ui&dev/button", "/@myorg/ui-kit@^2&dev/button"},
+		{"/@vanity/lib", "/some-lib"},
+		{"/@vanity/lib@1.0.0/sub", "/some-lib@1.0.0/sub"},
+	} {
+		rewritten, _, ok := rewritePackageAlias(tc.pathname)
+		if !ok || rewritten != tc.want {
+			t.Fatalf("rewritePackageAlias(%s): expected %s, got %s", tc.pathname, tc.want, rewritten)
+		}
+	}
+	for _, pathname := range []string{"/uikit", "/react@18/ui", "/@vanity/other", "/gh/ui/repo"} {
+		if _, _, ok := rewritePackageAlias(pathname); ok {
+			t.Fatalf("rewritePackageAlias(%s) should not be rewritten", pathname)
+		}
+	}
+
+	if u := restorePackageAlias("https://mirror.example/@myorg/ui-kit@2.1.0/es2022/button.mjs", "https://mirror.example", "ui", "@myorg/ui-kit"); u != "https://mirror.example/ui@2.1.0/es2022/button.mjs" {
+		t.Fatalf("unexpected restored url %s", u)
+	}
+	if u := restorePackageAlias("https://mirror.example/*@myorg/ui-kit@2.1.0", "https://mirror.example", "ui", "@myorg/ui-kit"); u != "https://mirror.example/*ui@2.1.0" {
+		t.Fatalf("unexpected restored url %s", u)
+	}
+	if u := restorePackageAlias("https://mirror.example/@myorg/ui-kit-icons@1.0.0", "https://mirror.example", "ui", "@myorg/ui-kit"); u != "https://mirror.example/@myorg/ui-kit-icons@1.0.0" {
+		t.Fatalf("the url of other packages should not be restored, got %s", u)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		to    string
+		valid bool
+	}{
+		{"ui", "@myorg/ui-kit@^2", true},
+		{"ui", "@myorg/ui-kit@next", true},
+		{"ui", "ui-kit", true},
+		{"ui", "ui", false},
+		{"gh", "ui-kit", false},
+		{"npm", "ui-kit", false},
+		{"UI Kit", "ui-kit", false},
+		{"ui", "@myorg/ui-kit@>>2", false},
+	} {
+		if validatePackageAlias(tc.name, tc.to) != tc.valid {
+			t.Fatalf("validatePackageAlias(%s, %s): expected %v", tc.name, tc.to, tc.valid)
+		}
+	}
+}
+
+func TestWriteEntryImports(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{MaxEntryImports: 2}
+
+	buf := bytes.NewBuffer(nil)
+	if writeEntryImports(buf, "/pkg@1.0.0/es2022/pkg.mjs", []string{"/a@1.0.0/es2022/a.mjs", "/b@1.0.0/es2022/b.mjs"}) {
+		t.Fatal("the imports should not be aggregated")
+	}
+	if buf.String() != "import \"/a@1.0.0/es2022/a.mjs\";\nimport \"/b@1.0.0/es2022/b.mjs\";\n" {
+		t.Fatalf("unexpected imports:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if !writeEntryImports(buf, "/pkg@1.0.0/es2022/pkg.mjs", []string{"/a@1.0.0/es2022/a.mjs", "/b@1.0.0/es2022/b.mjs", "/c@1.0.0/es2022/c.mjs"}) {
+		t.Fatal("the imports should be aggregated")
+	}
+	if buf.String() != "import \"/pkg@1.0.0/es2022/pkg.mjs?imports\";\n" {
+		t.Fatalf("unexpected imports:\n%s", buf.String())
+	}
+}
+
+func TestRebuildCorruptedS3Object(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = DefaultConfig()
+	config.WorkDir = t.TempDir()
+
+	// a minimal S3-compatible server that stores the objects with the checksum metadata in memory
+	type object struct {
+		data     []byte
+		checksum string
+	}
+	var lock sync.Mutex
+	objects := map[string]*object{}
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.Method {
+		case "PUT":
+			data, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = &object{data, r.Header.Get("X-Amz-Meta-Sha256")}
+		case "GET", "HEAD":
+			obj, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			w.Header().Set("X-Amz-Meta-Sha256", obj.checksum)
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("Content-Length", strconv.Itoa(len(obj.data)))
+			if r.Method == "GET" {
+				w.Write(obj.data)
+			}
+		case "DELETE":
+			delete(objects, r.URL.Path)
+		default:
+			w.WriteHeader(405)
+		}
+	}))
+	defer s3Server.Close()
+	buildStorage, err := storage.NewS3Storage(&storage.StorageOptions{
+		Type:            "s3",
+		Endpoint:        s3Server.URL,
+		Region:          "us-east-1",
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenDB(path.Join(config.WorkDir, "esm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	logger, err := log.New("file:" + path.Join(config.WorkDir, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the package is installed to the npm store, so the module is rebuilt without fetching the registry
+	npmrc := DefaultNpmRC()
+	writeFixturePackage(t, path.Join(npmrc.StoreDir(), "s3-pkg@1.0.0"), "s3-pkg", map[string]string{
+		"package.json": `{"name": "s3-pkg", "version": "1.0.0", "type": "module", "main": "./index.js"}`,
+		"index.js":     `export const message = "hello";`,
+	})
+	ctx := &BuildContext{
+		npmrc:   npmrc,
+		logger:  logger,
+		db:      db,
+		storage: buildStorage,
+		esm:     EsmPath{PkgName: "s3-pkg", PkgVersion: "1.0.0"},
+		target:  "es2022",
+	}
+	_, err = ctx.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// corrupt the stored build
+	key := "/" + ctx.getSavepath()
+	lock.Lock()
+	built := objects[key].data
+	objects[key].data = bytes.Replace(built, []byte("hello"), []byte("hullo"), 1)
+	lock.Unlock()
+
+	mux := rex.New()
+	mux.Use(esmRouter(db, buildStorage, logger))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "http://127.0.0.1:8080"+ctx.Path(), nil))
+	if w.Code != 200 {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "hello") || strings.Contains(w.Body.String(), "hullo") {
+		t.Fatalf("the corrupted build should be rebuilt, got:\n%s", w.Body.String())
+	}
+	lock.Lock()
+	rebuilt := objects[key].data
+	lock.Unlock()
+	if !bytes.Equal(rebuilt, built) {
+		t.Fatalf("the corrupted build should be replaced by the rebuilt one, got:\n%s", rebuilt)
+	}
+}
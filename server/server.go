@@ -110,7 +110,7 @@ func Serve() {
 	// setup rex server
 	rex.Use(
 		rex.Header("Server", "esm.sh"),
-		cors(config.CorsAllowOrigins),
+		cors(config.CorsAllowOrigins, config.CrossOriginResourcePolicy),
 		rex.Logger(logger),
 		rex.Optional(rex.AccessLogger(accessLogger), config.AccessLog),
 		rex.Optional(rex.Compress(), config.Compress),
@@ -146,12 +146,16 @@ func Serve() {
 	accessLogger.FlushBuffer()
 }
 
-func cors(allowOrigins []string) rex.Handle {
+func cors(allowOrigins []string, corpPolicy string) rex.Handle {
 	allowList := set.NewReadOnly[string](allowOrigins...)
 	return func(ctx *rex.Context) any {
 		origin := ctx.R.Header.Get("Origin")
 		isOptionsMethod := ctx.R.Method == "OPTIONS"
 		h := ctx.W.Header()
+		// allow the responses to be loaded by the cross-origin isolated pages (COEP: require-corp)
+		if corpPolicy != "" {
+			h.Set("Cross-Origin-Resource-Policy", corpPolicy)
+		}
 		if allowList.Len() > 0 {
 			if origin != "" {
 				if !allowList.Has(origin) {
@@ -16,6 +16,10 @@ type StorageOptions struct {
 	Region          string `json:"region"`
 	AccessKeyID     string `json:"accessKeyID"`
 	SecretAccessKey string `json:"secretAccessKey"`
+	// Routes is used by the "multi" storage only.
+	Routes []StorageRoute `json:"routes,omitempty"`
+	// Dedupe stores the identical contents only once.
+	Dedupe bool `json:"dedupe,omitempty"`
 }
 
 type Storage interface {
@@ -35,10 +39,19 @@ type Stat interface {
 func New(options *StorageOptions) (storage Storage, err error) {
 	switch options.Type {
 	case "fs":
-		return NewFSStorage(options)
+		storage, err = NewFSStorage(options)
 	case "s3":
-		return NewS3Storage(options)
+		storage, err = NewS3Storage(options)
+	case "multi":
+		if options.Dedupe {
+			return nil, errors.New("dedupe is not supported by the multi storage, enable it for the route storages instead")
+		}
+		return NewMultiStorage(options)
 	default:
 		return nil, errors.New("unsupported storage type")
 	}
+	if err == nil && options.Dedupe {
+		storage = newDedupeStorage(storage)
+	}
+	return
 }
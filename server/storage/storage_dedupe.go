@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// the files smaller than this size are stored as is, the pointer is not worth it
+	minDedupeSize = 1024
+	// the prefix of the blob keys
+	blobKeyPrefix = ".blobs/"
+	// the magic prefix of the pointer object that references a blob
+	blobPointerMagic = "esm.sh/blob:sha256:"
+	// the size of the pointer object, the magic prefix + the hex-encoded sha256 hash
+	blobPointerSize = len(blobPointerMagic) + sha256.Size*2
+	// the blobs that are younger than this age are not removed by the sweep
+	minBlobSweepAge = time.Hour
+)
+
+// newDedupeStorage creates a storage that stores the identical contents only once, the content is
+// stored in a content-addressed blob and the key stores a small pointer object that references the blob.
+// The blobs are not deleted with the keys since they may be referenced by other keys, the unreferenced
+// blobs are removed by `SweepBlobs`.
+func newDedupeStorage(storage Storage) Storage {
+	return &dedupeStorage{storage: storage}
+}
+
+// BlobSweeper is implemented by the storage that stores the contents in shared blobs.
+type BlobSweeper interface {
+	// SweepBlobs removes the blobs that are not referenced by any key.
+	SweepBlobs() (deletedBlobs int, deletedBytes int64, err error)
+}
+
+// BlobStat is the stat of the key that references a shared blob, the size is the size of the blob
+// that is not freed by deleting the key.
+type BlobStat interface {
+	Stat
+	Blob() string
+}
+
+type dedupeStorage struct {
+	storage Storage
+}
+
+type dedupeStat struct {
+	hash    string
+	size    int64
+	modTime time.Time
+}
+
+func (s *dedupeStat) Size() int64 {
+	return s.size
+}
+
+func (s *dedupeStat) ModTime() time.Time {
+	return s.modTime
+}
+
+func (s *dedupeStat) Blob() string {
+	return s.hash
+}
+
+func (d *dedupeStorage) Stat(key string) (stat Stat, err error) {
+	stat, err = d.storage.Stat(key)
+	if err != nil || stat.Size() != int64(blobPointerSize) {
+		return
+	}
+	hash, err := d.readPointer(key)
+	if err != nil || hash == "" {
+		return
+	}
+	// stat the blob directly instead of opening it
+	blobStat, err := d.storage.Stat(getBlobKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	return &dedupeStat{hash: hash, size: blobStat.Size(), modTime: stat.ModTime()}, nil
+}
+
+// readPointer reads the pointer object of the key, the hash is empty if the content is not a pointer object.
+func (d *dedupeStorage) readPointer(key string) (hash string, err error) {
+	content, _, err := d.storage.Get(key)
+	if err != nil {
+		return
+	}
+	defer content.Close()
+	data, err := io.ReadAll(io.LimitReader(content, int64(blobPointerSize)+1))
+	if err != nil {
+		return
+	}
+	if h, ok := strings.CutPrefix(string(data), blobPointerMagic); ok && len(data) == blobPointerSize {
+		hash = h
+	}
+	return
+}
+
+func (d *dedupeStorage) List(prefix string) (keys []string, err error) {
+	list, err := d.storage.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys = make([]string, 0, len(list))
+	for _, key := range list {
+		if !strings.HasPrefix(key, blobKeyPrefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (d *dedupeStorage) Get(key string) (content io.ReadCloser, stat Stat, err error) {
+	content, stat, err = d.storage.Get(key)
+	if err != nil || stat.Size() != int64(blobPointerSize) {
+		return
+	}
+	data, err := io.ReadAll(content)
+	content.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	hash, ok := strings.CutPrefix(string(data), blobPointerMagic)
+	if !ok {
+		// not a pointer object, just a file that happens to have the same size
+		return io.NopCloser(bytes.NewReader(data)), stat, nil
+	}
+	content, blobStat, err := d.storage.Get(getBlobKey(hash))
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, &dedupeStat{hash: hash, size: blobStat.Size(), modTime: stat.ModTime()}, nil
+}
+
+func (d *dedupeStorage) Put(key string, r io.Reader) error {
+	head := make([]byte, minDedupeSize)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return d.storage.Put(key, bytes.NewReader(head[:n]))
+	}
+	if err != nil {
+		return err
+	}
+
+	// stream the content to a temporary file while hashing, the blob key is known after the content is read
+	f, err := os.CreateTemp("", "esm-blob-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		return err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	blobKey := getBlobKey(hash)
+
+	// the existing blob is rewritten if it's old, so the sweep doesn't remove it before the pointer is written
+	stat, err := d.storage.Stat(blobKey)
+	if err == ErrNotFound || (err == nil && time.Since(stat.ModTime()) > minBlobSweepAge/2) {
+		_, err = f.Seek(0, io.SeekStart)
+		if err == nil {
+			err = d.storage.Put(blobKey, f)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return d.storage.Put(key, strings.NewReader(blobPointerMagic+hash))
+}
+
+func (d *dedupeStorage) Delete(keys ...string) error {
+	return d.storage.Delete(keys...)
+}
+
+func (d *dedupeStorage) DeleteAll(prefix string) (deletedKeys []string, err error) {
+	keys, err := d.storage.DeleteAll(prefix)
+	if err != nil {
+		return nil, err
+	}
+	deletedKeys = make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !strings.HasPrefix(key, blobKeyPrefix) {
+			deletedKeys = append(deletedKeys, key)
+		}
+	}
+	return deletedKeys, nil
+}
+
+// SweepBlobs removes the blobs that are not referenced by any pointer object. The blobs that are written
+// in the `minBlobSweepAge` are kept since the pointer object may not have been written yet.
+func (d *dedupeStorage) SweepBlobs() (deletedBlobs int, deletedBytes int64, err error) {
+	keys, err := d.storage.List("")
+	if err != nil {
+		return
+	}
+	blobKeys := []string{}
+	referenced := map[string]struct{}{}
+	for _, key := range keys {
+		if strings.HasPrefix(key, blobKeyPrefix) {
+			blobKeys = append(blobKeys, key)
+			continue
+		}
+		stat, e := d.storage.Stat(key)
+		if e != nil || stat.Size() != int64(blobPointerSize) {
+			continue
+		}
+		hash, e := d.readPointer(key)
+		if e != nil && e != ErrNotFound {
+			return 0, 0, e
+		}
+		if hash != "" {
+			referenced[getBlobKey(hash)] = struct{}{}
+		}
+	}
+	for _, blobKey := range blobKeys {
+		if _, ok := referenced[blobKey]; ok {
+			continue
+		}
+		// stat the blob right before deleting it, the blob may be rewritten by a concurrent put
+		stat, e := d.storage.Stat(blobKey)
+		if e != nil || time.Since(stat.ModTime()) < minBlobSweepAge {
+			continue
+		}
+		err = d.storage.Delete(blobKey)
+		if err != nil {
+			return
+		}
+		deletedBlobs++
+		deletedBytes += stat.Size()
+	}
+	return
+}
+
+// getBlobKey returns the key of the blob by the content hash, e.g. `.blobs/ab/abcdef...`
+func getBlobKey(hash string) string {
+	return blobKeyPrefix + hash[:2] + "/" + hash
+}
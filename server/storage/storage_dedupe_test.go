@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ije/gox/crypto/rand"
+)
+
+func TestDedupeStorage(t *testing.T) {
+	root := path.Join(os.TempDir(), "storage_test_"+rand.Hex.String(8))
+	defer os.RemoveAll(root)
+
+	s, err := New(&StorageOptions{Type: "fs", Endpoint: root, Dedupe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("export const foo = 'bar';\n", 100)
+	small := "export default 1;\n"
+	for key, content := range map[string]string{
+		"esm/foo@1.0.0/es2022/foo.mjs": large,
+		"esm/foo@1.0.1/es2022/foo.mjs": large,
+		"esm/foo@1.0.1/es2022/bar.mjs": small,
+	} {
+		err = s.Put(key, bytes.NewBufferString(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the large content is stored once in a blob, the small one is stored as is
+	blobs, err := findFiles(path.Join(root, ".blobs"), ".blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 {
+		t.Fatalf("invalid blobs %v", blobs)
+	}
+	fi, err := os.Stat(path.Join(root, "esm/foo@1.0.1/es2022/foo.mjs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(blobPointerSize) {
+		t.Fatalf("the key should store the pointer, got %d bytes", fi.Size())
+	}
+
+	for key, content := range map[string]string{
+		"esm/foo@1.0.0/es2022/foo.mjs": large,
+		"esm/foo@1.0.1/es2022/foo.mjs": large,
+		"esm/foo@1.0.1/es2022/bar.mjs": small,
+	} {
+		stat, err := s.Stat(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() != int64(len(content)) {
+			t.Fatalf("invalid size(%d) of '%s', shoud be %d", stat.Size(), key, len(content))
+		}
+		f, stat, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content || stat.Size() != int64(len(content)) {
+			t.Fatalf("invalid content of '%s'", key)
+		}
+	}
+
+	// a plain file that has the same size as the pointer is not resolved
+	plain := strings.Repeat("x", blobPointerSize)
+	err = s.Put("plain.txt", bytes.NewBufferString(plain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, err := s.Get("plain.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != plain {
+		t.Fatalf("invalid content %q", data)
+	}
+
+	keys, err := s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 4 {
+		t.Fatalf("the blobs should not be listed, got %v", keys)
+	}
+
+	deletedKeys, err := s.DeleteAll("esm/foo@1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deletedKeys) != 1 {
+		t.Fatalf("invalid deleted keys %v", deletedKeys)
+	}
+	// the blob is still referenced by the other key
+	f, _, err = s.Get("esm/foo@1.0.1/es2022/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(f)
+	f.Close()
+	if string(data) != large {
+		t.Fatal("invalid content after deleting the other key")
+	}
+
+	// the stat of the pointer is a blob stat
+	stat, err := s.Stat("esm/foo@1.0.1/es2022/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stat.(BlobStat); !ok {
+		t.Fatal("the stat of the pointer should be a blob stat")
+	}
+
+	// the blob is kept while it's referenced, or it's younger than the sweep age
+	sweeper := s.(BlobSweeper)
+	blobFile := path.Join(root, blobs[0])
+	old := time.Now().Add(-2 * minBlobSweepAge)
+	os.Chtimes(blobFile, old, old)
+	if n, _, err := sweeper.SweepBlobs(); err != nil || n != 0 {
+		t.Fatalf("the referenced blob should not be removed, removed %d (%v)", n, err)
+	}
+	err = s.Delete("esm/foo@1.0.1/es2022/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	os.Chtimes(blobFile, now, now)
+	if n, _, err := sweeper.SweepBlobs(); err != nil || n != 0 {
+		t.Fatalf("the new blob should not be removed, removed %d (%v)", n, err)
+	}
+	os.Chtimes(blobFile, old, old)
+	n, size, err := sweeper.SweepBlobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || size != int64(len(large)) {
+		t.Fatalf("the unreferenced blob should be removed, removed %d (%d bytes)", n, size)
+	}
+	if _, err = os.Stat(blobFile); !os.IsNotExist(err) {
+		t.Fatal("the blob file should be deleted")
+	}
+
+	_, err = New(&StorageOptions{Type: "multi", Dedupe: true, Routes: []StorageRoute{{Prefix: "", Storage: StorageOptions{Type: "fs", Endpoint: root}}}})
+	if err == nil {
+		t.Fatal("the multi storage should not support dedupe")
+	}
+}
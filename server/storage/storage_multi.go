@@ -0,0 +1,170 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+// NewMultiStorage creates a new storage that delegates every key to the sub-storage
+// of the route with the longest matching prefix, a route with empty prefix is the
+// fallback storage of the keys that are not matched by any other routes.
+func NewMultiStorage(options *StorageOptions) (Storage, error) {
+	if len(options.Routes) == 0 {
+		return nil, errors.New("missing routes")
+	}
+	routes := make([]multiStorageRoute, 0, len(options.Routes))
+	for _, r := range options.Routes {
+		prefix := strings.TrimPrefix(r.Prefix, "/")
+		for _, route := range routes {
+			if route.prefix == prefix {
+				return nil, errors.New("duplicate route prefix '" + r.Prefix + "'")
+			}
+		}
+		if r.Storage.Type == "multi" {
+			return nil, errors.New("nested multi storage is not supported")
+		}
+		storage, err := New(&r.Storage)
+		if err != nil {
+			return nil, errors.New("route '" + r.Prefix + "': " + err.Error())
+		}
+		routes = append(routes, multiStorageRoute{prefix: prefix, storage: storage})
+	}
+	// longest prefix first
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].prefix) > len(routes[j].prefix)
+	})
+	return &multiStorage{routes: routes}, nil
+}
+
+// StorageRoute routes the keys with the prefix to the storage.
+type StorageRoute struct {
+	Prefix  string         `json:"prefix"`
+	Storage StorageOptions `json:"storage"`
+}
+
+type multiStorageRoute struct {
+	prefix  string
+	storage Storage
+}
+
+// A storage that routes keys to sub-storages by the path prefix.
+type multiStorage struct {
+	routes []multiStorageRoute
+}
+
+// route returns the storage of the given key, or nil if no route matches the key.
+func (m *multiStorage) route(key string) Storage {
+	key = strings.TrimPrefix(key, "/")
+	for _, r := range m.routes {
+		if strings.HasPrefix(key, r.prefix) {
+			return r.storage
+		}
+	}
+	return nil
+}
+
+// overlapped returns the routes that own keys with the given prefix: the routes nested
+// in the prefix and the route with the longest prefix that matches the prefix.
+func (m *multiStorage) overlapped(prefix string) []multiStorageRoute {
+	prefix = strings.TrimPrefix(prefix, "/")
+	routes := []multiStorageRoute{}
+	for _, r := range m.routes {
+		if strings.HasPrefix(prefix, r.prefix) {
+			routes = append(routes, r)
+			break
+		}
+		if strings.HasPrefix(r.prefix, prefix) {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+func (m *multiStorage) Stat(key string) (stat Stat, err error) {
+	storage := m.route(key)
+	if storage == nil {
+		return nil, ErrNotFound
+	}
+	return storage.Stat(key)
+}
+
+func (m *multiStorage) List(prefix string) (keys []string, err error) {
+	keys = []string{}
+	for _, r := range m.overlapped(prefix) {
+		list, err := r.storage.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range list {
+			// skip the keys that are shadowed by a route with longer prefix
+			if m.route(key) == r.storage {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (m *multiStorage) Get(key string) (content io.ReadCloser, stat Stat, err error) {
+	storage := m.route(key)
+	if storage == nil {
+		return nil, nil, ErrNotFound
+	}
+	return storage.Get(key)
+}
+
+func (m *multiStorage) Put(key string, r io.Reader) error {
+	storage := m.route(key)
+	if storage == nil {
+		return errors.New("no storage route for key '" + key + "'")
+	}
+	return storage.Put(key, r)
+}
+
+func (m *multiStorage) Delete(keys ...string) error {
+	group := map[Storage][]string{}
+	for _, key := range keys {
+		if storage := m.route(key); storage != nil {
+			group[storage] = append(group[storage], key)
+		}
+	}
+	for storage, keys := range group {
+		if err := storage.Delete(keys...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *multiStorage) DeleteAll(prefix string) (deletedKeys []string, err error) {
+	deletedKeys = []string{}
+	for _, r := range m.overlapped(prefix) {
+		keys, err := r.storage.DeleteAll(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if m.route(key) == r.storage {
+				deletedKeys = append(deletedKeys, key)
+			}
+		}
+	}
+	return deletedKeys, nil
+}
+
+// SweepBlobs removes the unreferenced blobs of the route storages that enable dedupe.
+func (m *multiStorage) SweepBlobs() (deletedBlobs int, deletedBytes int64, err error) {
+	for _, r := range m.routes {
+		if sweeper, ok := r.storage.(BlobSweeper); ok {
+			n, size, err := sweeper.SweepBlobs()
+			if err != nil {
+				return deletedBlobs, deletedBytes, err
+			}
+			deletedBlobs += n
+			deletedBytes += size
+		}
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/ije/gox/crypto/rand"
+)
+
+func TestMultiStorage(t *testing.T) {
+	root := path.Join(os.TempDir(), "storage_test_"+rand.Hex.String(8))
+	defer os.RemoveAll(root)
+
+	s, err := New(&StorageOptions{
+		Type: "multi",
+		Routes: []StorageRoute{
+			{Prefix: "", Storage: StorageOptions{Type: "fs", Endpoint: path.Join(root, "default")}},
+			{Prefix: "esm/", Storage: StorageOptions{Type: "fs", Endpoint: path.Join(root, "esm")}},
+			{Prefix: "esm/react@", Storage: StorageOptions{Type: "fs", Endpoint: path.Join(root, "react")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"types/foo.d.ts", "esm/foo.mjs", "esm/react@19.0.0/es2022/react.mjs"} {
+		err = s.Put(key, bytes.NewBufferString(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for key, dir := range map[string]string{
+		"types/foo.d.ts":                    "default",
+		"esm/foo.mjs":                       "esm",
+		"esm/react@19.0.0/es2022/react.mjs": "react",
+	} {
+		if _, err := os.Stat(path.Join(root, dir, key)); err != nil {
+			t.Fatalf("key '%s' should be stored in '%s'", key, dir)
+		}
+		f, fi, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != key || fi.Size() != int64(len(key)) {
+			t.Fatalf("invalid file content('%s'), shoud be '%s'", string(data), key)
+		}
+	}
+
+	// the shadowed key in the fallback storage should be ignored
+	err = os.MkdirAll(path.Join(root, "default", "esm"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(root, "default", "esm", "stale.mjs"), []byte("stale"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Stat("esm/stale.mjs")
+	if err != ErrNotFound {
+		t.Fatalf("File should be not existent")
+	}
+
+	keys, err := s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "esm/foo.mjs,esm/react@19.0.0/es2022/react.mjs,types/foo.d.ts" {
+		t.Fatalf("invalid keys %v", keys)
+	}
+
+	keys, err = s.List("esm/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("invalid keys count(%d), shoud be 2", len(keys))
+	}
+
+	keys, err = s.List("types/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "types/foo.d.ts" {
+		t.Fatalf("invalid keys %v", keys)
+	}
+
+	err = s.Delete("types/foo.d.ts", "esm/foo.mjs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Stat("esm/foo.mjs"); err != ErrNotFound {
+		t.Fatalf("File should be not existent")
+	}
+
+	deletedKeys, err := s.DeleteAll("esm/react@19.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deletedKeys) != 1 || deletedKeys[0] != "esm/react@19.0.0/es2022/react.mjs" {
+		t.Fatalf("invalid deleted keys %v", deletedKeys)
+	}
+
+	keys, err = s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("invalid keys count(%d), shoud be 0", len(keys))
+	}
+}
+
+func TestMultiStorageOptions(t *testing.T) {
+	_, err := New(&StorageOptions{Type: "multi"})
+	if err == nil || err.Error() != "missing routes" {
+		t.Fatalf("should fail with 'missing routes', got %v", err)
+	}
+
+	_, err = New(&StorageOptions{
+		Type: "multi",
+		Routes: []StorageRoute{
+			{Prefix: "esm/", Storage: StorageOptions{Type: "fs", Endpoint: t.TempDir()}},
+			{Prefix: "/esm/", Storage: StorageOptions{Type: "fs", Endpoint: t.TempDir()}},
+		},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "duplicate route prefix") {
+		t.Fatalf("should fail with 'duplicate route prefix', got %v", err)
+	}
+
+	s, err := New(&StorageOptions{
+		Type:   "multi",
+		Routes: []StorageRoute{{Prefix: "esm/", Storage: StorageOptions{Type: "fs", Endpoint: t.TempDir()}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("types/foo.d.ts", bytes.NewBufferString("")); err == nil {
+		t.Fatal("should fail to put a key without route")
+	}
+}
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -9,6 +11,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -80,6 +83,17 @@ func (s *s3ObjectMeta) ModTime() time.Time {
 	return s.lastModified
 }
 
+// tempFile is the verified object content that is spooled to a temporary file, it's removed on close.
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
 type s3Error struct {
 	Code    string
 	Message string
@@ -201,32 +215,86 @@ func (s3 *s3Storage) Get(name string) (content io.ReadCloser, stat Stat, err err
 	}
 	size, _ := strconv.ParseInt(contentLengthHeader, 10, 64)
 	lastModified, _ := time.Parse(time.RFC1123, lastModifiedHeader)
-	return resp.Body, &s3ObjectMeta{
+	meta := &s3ObjectMeta{
 		contentLength: size,
 		lastModified:  lastModified,
-	}, nil
+	}
+	// verify the checksum of the object that is stored by the `Put` method before returning the content, the object is
+	// spooled to a temporary file while hashing, a truncated or corrupted object is treated as not found to trigger a rebuild
+	if checksum := resp.Header.Get("X-Amz-Meta-Sha256"); checksum != "" {
+		defer resp.Body.Close()
+		var f *os.File
+		f, err = os.CreateTemp("", "esm-s3-*")
+		if err != nil {
+			return
+		}
+		h := sha256.New()
+		var n int64
+		n, err = io.Copy(f, io.TeeReader(resp.Body, h))
+		if err == nil && (n != size || hex.EncodeToString(h.Sum(nil)) != checksum) {
+			err = ErrNotFound
+		}
+		if err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, nil, err
+		}
+		return &tempFile{f}, meta, nil
+	}
+	return resp.Body, meta, nil
 }
 
 func (s3 *s3Storage) Put(name string, content io.Reader) (err error) {
 	if name == "" {
 		return errors.New("name is required")
 	}
-	req, _ := http.NewRequest("PUT", s3.apiEndpoint+"/"+name, content)
-	s3.sign(req)
+	// the checksum is sent in the request header, so the content is hashed before it's uploaded
+	var size int64
+	h := sha256.New()
 	if buf, ok := content.(*bytes.Buffer); ok {
-		req.ContentLength = int64(buf.Len())
-	} else if seeker, ok := content.(io.Seeker); ok {
-		var size int64
-		size, err = seeker.Seek(0, io.SeekEnd)
+		h.Write(buf.Bytes())
+		size = int64(buf.Len())
+	} else if seeker, ok := content.(io.ReadSeeker); ok {
+		size, err = io.Copy(h, seeker)
+		if err != nil {
+			return
+		}
+		_, err = seeker.Seek(-size, io.SeekCurrent)
 		if err != nil {
 			return
 		}
-		_, err = seeker.Seek(0, io.SeekStart)
+	} else {
+		// stream the content to a temporary file while hashing
+		var f *os.File
+		f, err = os.CreateTemp("", "esm-s3-*")
 		if err != nil {
 			return
 		}
-		req.ContentLength = size
+		defer func() {
+			f.Close()
+			os.Remove(f.Name())
+		}()
+		size, err = io.Copy(f, io.TeeReader(content, h))
+		if err != nil {
+			return
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			return
+		}
+		content = f
 	}
+	req, _ := http.NewRequest("PUT", s3.apiEndpoint+"/"+name, content)
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	// store the checksum of the content in the object metadata, it's verified when reading the object
+	req.Header.Set("X-Amz-Meta-Sha256", hex.EncodeToString(h.Sum(nil)))
+	s3.sign(req)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return
@@ -3,8 +3,12 @@ package storage
 import (
 	"bytes"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestS3Storage(t *testing.T) {
@@ -135,3 +139,136 @@ func TestS3Storage(t *testing.T) {
 		t.Fatalf("invalid keys length(%d), expected 0", len(keys))
 	}
 }
+
+// a minimal S3-compatible server that stores objects in memory
+type mockS3Object struct {
+	data     []byte
+	checksum string
+}
+
+func newMockS3Server() (*httptest.Server, map[string]*mockS3Object, *sync.Mutex) {
+	objects := map[string]*mockS3Object{}
+	lock := &sync.Mutex{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.Method {
+		case "PUT":
+			data, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = &mockS3Object{data: data, checksum: r.Header.Get("X-Amz-Meta-Sha256")}
+			w.WriteHeader(200)
+		case "GET":
+			obj, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(404)
+				return
+			}
+			if obj.checksum != "" {
+				w.Header().Set("X-Amz-Meta-Sha256", obj.checksum)
+			}
+			w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Write(obj.data)
+		default:
+			w.WriteHeader(405)
+		}
+	}))
+	return server, objects, lock
+}
+
+func TestS3StorageChecksum(t *testing.T) {
+	server, objects, lock := newMockS3Server()
+	defer server.Close()
+
+	s3, err := NewS3Storage(&StorageOptions{
+		Type:            "s3",
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s3.Put("test/hello.txt", bytes.NewBufferString("Hello, world!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, stat, err := s3.Get("test/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "Hello, world!" {
+		t.Fatalf("invalid content(%s), expected 'Hello, world!'", string(data))
+	}
+	if stat.Size() != 13 {
+		t.Fatalf("invalid size(%d), expected 13", stat.Size())
+	}
+
+	// corrupt the stored object
+	lock.Lock()
+	objects["/test/hello.txt"].data = []byte("Hello, w0rld!")
+	lock.Unlock()
+
+	_, _, err = s3.Get("test/hello.txt")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for the corrupted object, got %v", err)
+	}
+
+	// truncate the stored object
+	lock.Lock()
+	objects["/test/hello.txt"].data = []byte("Hello")
+	lock.Unlock()
+
+	_, _, err = s3.Get("test/hello.txt")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound for the truncated object, got %v", err)
+	}
+
+	// the contents that are not buffered are hashed while streaming
+	for name, content := range map[string]io.Reader{
+		"test/reader.txt": bytes.NewReader([]byte("Hello, world!")),
+		"test/stream.txt": io.MultiReader(bytes.NewBufferString("Hello, "), bytes.NewBufferString("world!")),
+	} {
+		err = s3.Put(name, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.Lock()
+		checksum := objects["/"+name].checksum
+		lock.Unlock()
+		if checksum != "315f5bdb76d078c43b8ac0064e4a0164612b1fce77c869345bfc94c75894edd3" {
+			t.Fatalf("invalid checksum(%s) of %s", checksum, name)
+		}
+		f, _, err = s3.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err = io.ReadAll(f)
+		f.Close()
+		if err != nil || string(data) != "Hello, world!" {
+			t.Fatalf("invalid content(%s) of %s: %v", string(data), name, err)
+		}
+	}
+
+	// objects without checksum are served as is
+	lock.Lock()
+	objects["/test/legacy.txt"] = &mockS3Object{data: []byte("legacy")}
+	lock.Unlock()
+
+	f, _, err = s3.Get("test/legacy.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = io.ReadAll(f)
+	f.Close()
+	if string(data) != "legacy" {
+		t.Fatalf("invalid content(%s), expected 'legacy'", string(data))
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ije/gox/utils"
+	"github.com/ije/gox/valid"
+)
+
+// the length of the tarball digest that is used as the version of the `/tgz/<name>@<digest>` path
+const tarballDigestLength = 32
+
+// validateTarballUrl checks if the tarball url can be fetched by the server,
+// only the http(s) urls of the hosts listed in the `tarballHosts` config are allowed.
+func validateTarballUrl(tarballUrl string) (u *url.URL, err error) {
+	u, err = url.Parse(tarballUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return nil, errors.New("invalid tarball url")
+	}
+	if !isTarballHostAllowed(u) {
+		return nil, fmt.Errorf("tarball host '%s' is not allowed", u.Host)
+	}
+	return
+}
+
+// isTarballHostAllowed checks if the host of the url is listed in the `tarballHosts` config,
+// the `*.` prefix matches the subdomains, e.g. "*.example.com"
+func isTarballHostAllowed(u *url.URL) bool {
+	hostname := u.Hostname()
+	for _, host := range config.TarballHosts {
+		if host == u.Host || host == hostname || (strings.HasPrefix(host, "*.") && strings.HasSuffix(hostname, host[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTarballDigest(s string) bool {
+	return len(s) == tarballDigestLength && valid.IsHexString(s)
+}
+
+// installTarball fetches the tarball and installs it to the `tgz/<name>@<digest>` directory of the npm store,
+// the digest is derived from the sha256 hash of the tarball, so the same content is always installed to the same directory.
+// The url is fetched at most once in the `npmQueryCacheTTL` since the content of the url may change.
+func (npmrc *NpmRC) installTarball(tarballUrl string) (pkg Package, err error) {
+	u, err := validateTarballUrl(tarballUrl)
+	if err != nil {
+		return
+	}
+	return withCache("tgz "+u.String(), time.Duration(config.NpmQueryCacheTTL)*time.Second, func() (Package, string, error) {
+		pkg, err := npmrc.fetchTarball(u)
+		if err == nil && npmrc.db != nil {
+			// persist the tarball url of the digest, the package can be reinstalled after the npm store is cleared
+			if e := npmrc.db.Put(getTarballUrlKey(pkg), []byte(u.String())); e != nil && npmrc.logger != nil {
+				npmrc.logger.Errorf("db.put(%s): %v", getTarballUrlKey(pkg), e)
+			}
+		}
+		return pkg, "", err
+	})
+}
+
+func getTarballUrlKey(pkg Package) string {
+	return "tgz:" + pkg.Name + "@" + pkg.Version
+}
+
+func (npmrc *NpmRC) fetchTarball(u *url.URL) (pkg Package, err error) {
+	f, pkgName, digest, err := npmrc.downloadTarball(u)
+	if err != nil {
+		return
+	}
+	defer removeTempFile(f)
+
+	pkg = Package{
+		Name:    pkgName,
+		Version: digest,
+		Tarball: true,
+	}
+	installDir := path.Join(npmrc.StoreDir(), pkg.String())
+	packageJsonPath := path.Join(installDir, "node_modules", pkg.Name, "package.json")
+
+	// check if the tarball has been installed
+	if existsFile(packageJsonPath) {
+		return
+	}
+
+	unlock := installMutex.Lock(pkg.String())
+	defer unlock()
+
+	// skip installation if the tarball has been installed by another request
+	if existsFile(packageJsonPath) {
+		return
+	}
+
+	err = extractTarballFile(installDir, pkg.Name, f)
+	if err != nil {
+		err = fmt.Errorf("failed to install tarball '%s': %v", u.String(), err)
+	}
+	return
+}
+
+// reinstallTarball installs the tarball package of the `/tgz/<name>@<digest>` path that is not in the npm store,
+// e.g. the store has been cleared or the package was installed by another server. The tarball is fetched from the
+// url that is persisted by `installTarball`, and the content must match the digest.
+// The caller must hold the install lock of the package.
+func (npmrc *NpmRC) reinstallTarball(installDir string, pkg Package) (err error) {
+	notFound := fmt.Errorf("tarball of package '%s' not found", pkg.String())
+	if npmrc.db == nil {
+		return notFound
+	}
+	value, err := npmrc.db.Get(getTarballUrlKey(pkg))
+	if err != nil || value == nil {
+		return notFound
+	}
+	// the tarball hosts config may have been changed
+	u, err := validateTarballUrl(string(value))
+	if err != nil {
+		return notFound
+	}
+	f, pkgName, digest, err := npmrc.downloadTarball(u)
+	if err != nil {
+		return
+	}
+	defer removeTempFile(f)
+	if pkgName != pkg.Name || digest != pkg.Version {
+		return fmt.Errorf("the content of tarball '%s' has been changed", u.String())
+	}
+	err = extractTarballFile(installDir, pkg.Name, f)
+	if err != nil {
+		err = fmt.Errorf("failed to install tarball '%s': %v", u.String(), err)
+	}
+	return
+}
+
+// downloadTarball streams the tarball to a temporary file while hashing it, the caller should remove the file by
+// calling `removeTempFile`.
+func (npmrc *NpmRC) downloadTarball(u *url.URL) (f *os.File, pkgName string, digest string, err error) {
+	// don't follow redirects, the location may point to a host that is not allowed
+	fetchClient, recycle := NewFetchClient(30, config.UserAgent, true)
+	defer recycle()
+
+	res, err := fetchClient.FetchWithRetry(u, nil, int(config.InstallRetries), npmrc.onFetchRetry("tarball '"+u.String()+"'"))
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 || res.StatusCode == 401 {
+		err = fmt.Errorf("tarball '%s' not found", u.String())
+		return
+	}
+
+	if res.StatusCode != 200 {
+		err = fmt.Errorf("could not download tarball '%s' (%s)", u.String(), res.Status)
+		return
+	}
+
+	if res.ContentLength > maxPackageTarballSize {
+		err = fmt.Errorf("tarball '%s' is too large", u.String())
+		return
+	}
+
+	f, err = os.CreateTemp("", "esm-tarball-*.tgz")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			removeTempFile(f)
+			f = nil
+		}
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(res.Body, maxPackageTarballSize+1))
+	if err != nil {
+		return
+	}
+	if n > maxPackageTarballSize {
+		err = fmt.Errorf("tarball '%s' is too large", u.String())
+		return
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	pkgName, err = readTarballPackageName(f)
+	if err != nil {
+		err = fmt.Errorf("invalid tarball '%s': %v", u.String(), err)
+		return
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	digest = hex.EncodeToString(h.Sum(nil))[:tarballDigestLength]
+	return
+}
+
+// extractTarballFile extracts the downloaded tarball to the install directory, the directory is
+// removed if the extraction fails.
+func extractTarballFile(installDir string, pkgName string, f *os.File) (err error) {
+	err = extractPackageTarball(installDir, pkgName, f)
+	if err == nil && !existsFile(path.Join(installDir, "node_modules", pkgName, "package.json")) {
+		err = errors.New("package.json not found")
+	}
+	if err != nil {
+		// clear installDir if failed to extract tarball
+		os.RemoveAll(installDir)
+	}
+	return
+}
+
+func removeTempFile(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// readTarballPackageName reads the package name from the `package.json` file in the root directory of the tarball
+func readTarballPackageName(tarball io.Reader) (pkgName string, err error) {
+	unziped, err := gzip.NewReader(tarball)
+	if err != nil {
+		return
+	}
+	tr := tar.NewReader(unziped)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return "", errors.New("package.json not found")
+		}
+		if err != nil {
+			return "", err
+		}
+		// strip tarball root dir
+		_, name := utils.SplitByFirstByte(h.Name, '/')
+		if h.Typeflag != tar.TypeReg || name != "package.json" {
+			continue
+		}
+		var raw PackageJSONRaw
+		err = json.NewDecoder(io.LimitReader(tr, 4*MB)).Decode(&raw)
+		if err != nil {
+			return "", err
+		}
+		if !validatePackageName(raw.Name) {
+			return "", fmt.Errorf("invalid package name '%s'", raw.Name)
+		}
+		return raw.Name, nil
+	}
+}
@@ -69,6 +69,15 @@ func stringInSlice(a []string, s string) bool {
 	return false
 }
 
+// mapKeys returns the keys of the given map.
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
 // containsDigit returns true if the given string contains a digit.
 func containsDigit(s string) bool {
 	for _, r := range s {
@@ -147,6 +156,56 @@ func findFiles(root string, dir string, filter func(filename string) bool) ([]st
 	return files, nil
 }
 
+// levenshteinDistance returns the minimum number of single-character edits to change `a` into `b`.
+func levenshteinDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// findLicenseFile finds the license file in the package directory, the common filenames
+// (`LICENSE`, `LICENSE.md`, `LICENCE`, etc.) are matched case-insensitively.
+func findLicenseFile(pkgDir string) (filename string, err error) {
+	entries, err := os.ReadDir(pkgDir)
+	if err != nil {
+		return
+	}
+	files := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files[strings.ToLower(entry.Name())] = entry.Name()
+		}
+	}
+	for _, name := range []string{"license", "license.md", "license.txt", "licence", "licence.md", "licence.txt", "copying"} {
+		if name, ok := files[name]; ok {
+			return name, nil
+		}
+	}
+	// e.g. `LICENSE-MIT`, `LICENSE.BSD`
+	for _, entry := range entries {
+		name := strings.ToLower(entry.Name())
+		if !entry.IsDir() && (strings.HasPrefix(name, "license") || strings.HasPrefix(name, "licence")) {
+			return entry.Name(), nil
+		}
+	}
+	return "", nil
+}
+
 // btoaUrl converts a string to a base64 string.
 func btoaUrl(s string) string {
 	return base64.RawURLEncoding.EncodeToString([]byte(s))
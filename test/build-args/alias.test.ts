@@ -9,3 +9,16 @@ Deno.test("types with ?alias", async () => {
   const ts = await res.text();
   assertStringIncludes(ts, "preact@10.6.6/compat/src/index.d.ts");
 });
+
+Deno.test("report unused ?alias", async () => {
+  const res = await fetch("http://localhost:8080/swr@2.2.5?alias=raect:preact/compat,react:preact/compat&target=es2022");
+  await res.body?.cancel();
+  assertEquals(res.status, 200);
+  assertEquals(res.headers.get("X-ESM-Unused-Alias"), "raect");
+
+  const res2 = await fetch("http://localhost:8080/swr@2.2.5?alias=raect:preact/compat,react:preact/compat&target=es2022&meta");
+  assertEquals(res2.status, 200);
+  const meta = await res2.json();
+  assertEquals(meta.alias.unused, ["raect"]);
+  assertEquals(meta.alias.applied, ["react"]);
+});
@@ -0,0 +1,22 @@
+import { assertEquals, assertStringIncludes } from "jsr:@std/assert";
+
+Deno.test("`?v` cache-buster", async () => {
+  const res0 = await fetch("http://localhost:8080/preact?target=es2022");
+  const code0 = await res0.text();
+  assertEquals(res0.status, 200);
+  assertEquals(res0.headers.get("cache-control"), "public, max-age=600");
+
+  // the floating version is cached immutably with the `?v` param
+  const res1 = await fetch("http://localhost:8080/preact?target=es2022&v=a1b2c3d");
+  const code1 = await res1.text();
+  assertEquals(res1.status, 200);
+  assertEquals(res1.headers.get("cache-control"), "public, max-age=31536000, immutable");
+
+  // the `?v` param doesn't change the build id
+  assertEquals(code1, code0);
+  assertStringIncludes(code1, "/es2022/preact.mjs");
+
+  const res2 = await fetch("http://localhost:8080/preact?target=es2022&v=" + encodeURIComponent("<script>"));
+  res2.body?.cancel();
+  assertEquals(res2.status, 400);
+});
@@ -0,0 +1,20 @@
+import { assertEquals } from "jsr:@std/assert";
+
+Deno.test("?conditions fallback", async () => {
+  {
+    // react@18.2.0 exports the `react-server` condition
+    const res = await fetch("http://localhost:8080/react@18.2.0?conditions=react-server");
+    res.body?.cancel();
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("X-ESM-Warning"), null);
+  }
+  {
+    // preact@10.24.3 doesn't export the `react-server` condition, the default entry is used
+    const res = await fetch("http://localhost:8080/preact@10.24.3?conditions=react-server");
+    res.body?.cancel();
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("X-ESM-Warning"), "condition-not-matched");
+    const { h } = await import("http://localhost:8080/preact@10.24.3?conditions=react-server");
+    assertEquals(typeof h, "function");
+  }
+});
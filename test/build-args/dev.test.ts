@@ -1,4 +1,4 @@
-import { assertStringIncludes } from "jsr:@std/assert";
+import { assertNotEquals, assertStringIncludes } from "jsr:@std/assert";
 
 Deno.test("?dev", async () => {
   const res = await fetch("http://localhost:8080/react@18.2.0?dev&target=es2022");
@@ -15,3 +15,16 @@ Deno.test("using `development` condition in `exports`", async () => {
     `console.warn("You appear to have multiple instances of Solid. This can lead to unexpected behavior.")`,
   );
 });
+
+Deno.test("react-dom?dev", async () => {
+  const prodCode = await fetch("http://localhost:8080/react-dom@18.3.1/es2022/react-dom.mjs").then((res) => res.text());
+  const devCode = await fetch("http://localhost:8080/react-dom@18.3.1/es2022/react-dom.development.mjs").then((res) => res.text());
+  assertNotEquals(devCode, prodCode);
+  assertStringIncludes(devCode, "__REACT_DEVTOOLS_GLOBAL_HOOK__");
+  assertStringIncludes(devCode, "react-dom.development.js");
+  // the dev builds are not minified
+  assertStringIncludes(devCode, `from "/react@18.3.1/es2022/react.development.mjs"`);
+
+  const res = await fetch("http://localhost:8080/react-dom@18.3.1?dev&target=es2022");
+  assertStringIncludes(await res.text(), `"/react-dom@18.3.1/es2022/react-dom.development.mjs"`);
+});
@@ -1,7 +1,20 @@
-import { assertEquals } from "jsr:@std/assert";
+import { assertEquals, assertStringIncludes } from "jsr:@std/assert";
 
 import * as tslib from "http://localhost:8080/tslib?exports=__await,__spread";
+import * as tslibNs from "http://localhost:8080/tslib?exports=*:tslib,__await";
 
 Deno.test("?exports", () => {
   assertEquals(Object.keys(tslib), ["__await", "__spread"]);
 });
+
+Deno.test("?exports with namespace", () => {
+  assertEquals(Object.keys(tslibNs), ["__await", "tslib"]);
+  assertEquals(typeof tslibNs.tslib.__rest, "function");
+  assertEquals(tslibNs.tslib.__await, tslibNs.__await);
+});
+
+Deno.test("?exports with reserved words", async () => {
+  const res = await fetch("http://localhost:8080/tslib?exports=__await,class");
+  assertEquals(res.status, 400);
+  assertStringIncludes(await res.text(), `"class" is a reserved word`);
+});
@@ -66,6 +66,16 @@ Deno.test("`?external` query", async () => {
   }
 });
 
+Deno.test("`?external=peers`", async () => {
+  const res = await fetch("http://localhost:8080/swr@2.2.5?target=es2022&external=peers");
+  res.body?.cancel();
+  assertEquals(res.status, 200);
+  const res2 = await fetch("http://localhost:8080/swr@2.2.5?target=es2022&external=react");
+  res2.body?.cancel();
+  assertEquals(res.headers.get("x-esm-path"), res2.headers.get("x-esm-path"));
+  assertStringIncludes(res.headers.get("x-esm-path")!, "/X-");
+});
+
 Deno.test("drop invalid `?external`", async () => {
   {
     const res = await fetch("http://localhost:8080/react-dom@18.3.1?target=es2022&external=foo,bar,react");
@@ -102,3 +112,34 @@ Deno.test("external nodejs builtin modules", async () => {
   assertEquals(res3.status, 200);
   assertStringIncludes(await res3.text(), ` from "node:buffer"`);
 });
+
+Deno.test("`?external` persists across nested builds", async () => {
+  const res = await fetch("http://localhost:8080/react-dom@18.3.1/client?target=es2022&external=react");
+  res.body?.cancel();
+  assertEquals(res.status, 200);
+
+  const visited = new Set<string>();
+  const queue = [res.headers.get("x-esm-path")!];
+  while (queue.length > 0) {
+    const pathname = queue.shift()!;
+    if (visited.has(pathname)) {
+      continue;
+    }
+    visited.add(pathname);
+    const code = await fetch("http://localhost:8080" + pathname).then((res) => res.text());
+    assertEquals(code.includes('from"/react@'), false, `${pathname} imports react from esm.sh`);
+    for (const [, specifier] of code.matchAll(/from\s*"(\/[^"]+\.mjs)"/g)) {
+      queue.push(specifier);
+    }
+  }
+  assertEquals(visited.size > 1, true);
+});
+
+Deno.test("`?importmap` query of external modules", async () => {
+  const res = await fetch("http://localhost:8080/*react-dom@19.0.0/client?target=es2022&importmap");
+  assertEquals(res.status, 200);
+  assertEquals(res.headers.get("Content-Type")?.startsWith("application/json"), true);
+  const { imports } = await res.json();
+  assertEquals(imports["react"].startsWith("http://localhost:8080/react@19."), true);
+  assertEquals(imports["scheduler"].startsWith("http://localhost:8080/scheduler@0."), true);
+});
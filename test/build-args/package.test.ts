@@ -0,0 +1,30 @@
+import { assertEquals } from "jsr:@std/assert";
+
+Deno.test("?package", async () => {
+  {
+    const res = await fetch("http://localhost:8080/react@18.3.1?package");
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("Content-Type"), "application/json; charset=utf-8");
+    assertEquals(res.headers.get("Cache-Control"), "public, max-age=31536000, immutable");
+    const pkg = await res.json();
+    assertEquals(pkg.name, "react");
+    assertEquals(pkg.version, "18.3.1");
+    assertEquals(typeof pkg.exports, "object");
+  }
+  {
+    const res = await fetch("http://localhost:8080/react@18?package");
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("Cache-Control"), "public, max-age=600");
+    const pkg = await res.json();
+    assertEquals(pkg.version.startsWith("18."), true);
+  }
+});
+
+Deno.test("package.json", async () => {
+  const res = await fetch("http://localhost:8080/react@18.3.1/package.json");
+  assertEquals(res.status, 200);
+  assertEquals(res.headers.get("Content-Type"), "application/json; charset=utf-8");
+  const pkg = await res.json();
+  assertEquals(pkg.name, "react");
+  assertEquals(pkg.version, "18.3.1");
+});
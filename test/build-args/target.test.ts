@@ -65,3 +65,46 @@ Deno.test("target from query", async () => {
     assertStringIncludes(await res.text(), "/es2024/");
   }
 });
+
+Deno.test("target from path segment", async () => {
+  {
+    const res = await fetch("http://localhost:8080/react@18.3.1/es2020");
+    assertEquals(res.status, 200);
+    assert(!res.headers.get("Vary")?.includes("User-Agent"));
+    assertStringIncludes(await res.text(), "/es2020/");
+  }
+  {
+    const res = await fetch("http://localhost:8080/react@18.3.1/es2020?target=es2024");
+    assertEquals(res.status, 200);
+    assertStringIncludes(await res.text(), "/es2020/");
+  }
+  {
+    const res = await fetch("http://localhost:8080/react@18/es2020", { redirect: "manual" });
+    res.body?.cancel();
+    assertEquals(res.status, 302);
+    assertEquals(res.headers.get("Location"), "http://localhost:8080/react@18.3.1/es2020");
+  }
+});
+
+Deno.test("X-ESM-Target header", async () => {
+  for (
+    const [ua, target] of [
+      ["Deno/1.33.2", "denonext"],
+      ["Node.js/22.0.0", "node"],
+      ["ES/2024", "es2024"],
+      ["Mozilla/5.0", "es2022"],
+    ]
+  ) {
+    const res = await fetch("http://localhost:8080/react@18.3.1", { headers: { "User-Agent": ua } });
+    res.body?.cancel();
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("X-ESM-Target"), target);
+    assertStringIncludes(res.headers.get("Access-Control-Expose-Headers")!, "X-ESM-Target");
+  }
+  {
+    const res = await fetch("http://localhost:8080/react@18.3.1/es2020/react.mjs");
+    res.body?.cancel();
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("X-ESM-Target"), "es2020");
+  }
+});
@@ -42,3 +42,22 @@ Deno.test("web-worker", async () => {
   assertEquals(hashText, "502b0c5fc4a5704c");
   worker.terminate();
 });
+
+Deno.test("web-worker with `?target`", async () => {
+  const res = await fetch("http://localhost:8080/xxhash-wasm@1.0.2?worker&target=es2020");
+  assertEquals(res.status, 200);
+  const code = await res.text();
+  assertEquals(code.includes(`import * as $module from "http://localhost:8080/xxhash-wasm@1.0.2/es2020/xxhash-wasm.mjs";`), true);
+});
+
+Deno.test("web-worker types", async () => {
+  const res = await fetch("http://localhost:8080/xxhash-wasm@1.0.2?worker&target=es2020");
+  res.body?.cancel();
+  const dtsUrl = res.headers.get("X-TypeScript-Types")!;
+  assertEquals(dtsUrl.endsWith(".d.ts?worker"), true);
+
+  const dts = await fetch(dtsUrl).then((res) => res.text());
+  assertEquals(dts.includes(`import type * as $module from "${dtsUrl.slice(0, -"?worker".length)}";`), true);
+  assertEquals(dts.includes("declare function workerFactory(options?: WorkerFactoryOptions): Worker;"), true);
+  assertEquals(dts.includes("export default workerFactory;"), true);
+});
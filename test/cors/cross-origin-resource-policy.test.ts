@@ -0,0 +1,16 @@
+import { assertEquals } from "jsr:@std/assert";
+
+Deno.test("Cross-Origin-Resource-Policy", async () => {
+  for (
+    const url of [
+      "http://localhost:8080/react@18.2.0",
+      "http://localhost:8080/react@18.2.0/es2022/react.mjs",
+      "http://localhost:8080/react@18.2.0/package.json",
+      "http://localhost:8080/react@18.2.0?raw",
+    ]
+  ) {
+    const res = await fetch(url);
+    res.body?.cancel();
+    assertEquals(res.headers.get("Cross-Origin-Resource-Policy"), "cross-origin");
+  }
+});
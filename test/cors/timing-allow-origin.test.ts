@@ -0,0 +1,19 @@
+import { assertEquals } from "jsr:@std/assert";
+
+Deno.test("Timing-Allow-Origin", async () => {
+  {
+    const res = await fetch("http://localhost:8080/react@18.2.0");
+    res.body?.cancel();
+    assertEquals(res.headers.get("Timing-Allow-Origin"), "*");
+  }
+  {
+    const res = await fetch("http://localhost:8080/react@18.2.0/es2022/react.mjs");
+    res.body?.cancel();
+    assertEquals(res.headers.get("Timing-Allow-Origin"), "*");
+  }
+  {
+    const res = await fetch("http://localhost:8080/react@18.2.0/package.json");
+    res.body?.cancel();
+    assertEquals(res.headers.get("Timing-Allow-Origin"), "*");
+  }
+});
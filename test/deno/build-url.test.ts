@@ -0,0 +1,36 @@
+import { assertEquals, assertStringIncludes } from "jsr:@std/assert";
+
+Deno.test("redirect the deno module loader to the build url", async () => {
+  const res = await fetch("http://localhost:8080/preact@10.23.2", {
+    headers: { "Accept": "application/typescript, application/javascript" },
+    redirect: "manual",
+  });
+  res.body?.cancel();
+  assertEquals(res.status, 302);
+  assertEquals(res.headers.get("Location"), "http://localhost:8080/preact@10.23.2/denonext/preact.mjs");
+  assertStringIncludes(res.headers.get("Vary")!, "User-Agent");
+
+  const res2 = await fetch(res.headers.get("Location")!);
+  res2.body?.cancel();
+  assertEquals(res2.status, 200);
+  assertEquals(res2.headers.get("Cache-Control"), "public, max-age=31536000, immutable");
+  assertEquals(res2.headers.get("X-TypeScript-Types"), "http://localhost:8080/preact@10.23.2/src/index.d.ts");
+
+  // the `fetch` API doesn't accept the typescript modules
+  const res3 = await fetch("http://localhost:8080/preact@10.23.2");
+  assertEquals(res3.status, 200);
+  assertEquals(res3.headers.get("X-TypeScript-Types"), "http://localhost:8080/preact@10.23.2/src/index.d.ts");
+  assertStringIncludes(await res3.text(), `export * from "/preact@10.23.2/denonext/preact.mjs";`);
+});
+
+Deno.test("keep the entry module for browsers", async () => {
+  const res = await fetch("http://localhost:8080/preact@10.23.2", {
+    headers: {
+      "Accept": "application/typescript, application/javascript",
+      "User-Agent": "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Safari/605.1.15",
+    },
+    redirect: "manual",
+  });
+  assertEquals(res.status, 200);
+  assertStringIncludes(await res.text(), `export * from "/preact@10.23.2/es20`);
+});
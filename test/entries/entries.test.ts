@@ -0,0 +1,33 @@
+import { assertEquals, assertStringIncludes } from "jsr:@std/assert";
+
+import { hooks, jsx_runtime } from "http://localhost:8080/preact@10.23.2?entries=hooks,jsx-runtime";
+
+Deno.test("`?entries` query", async () => {
+  assertEquals(typeof hooks.useState, "function");
+  assertEquals(typeof jsx_runtime.jsx, "function");
+
+  const res = await fetch("http://localhost:8080/preact@10.23.2?entries=jsx-runtime,hooks&target=es2022");
+  res.body?.cancel();
+  assertEquals(res.status, 200);
+  const barrelPath = res.headers.get("x-esm-path")!;
+  assertStringIncludes(barrelPath, "/preact@10.23.2/X-");
+
+  // the barrel is built and cached as a unit, the same set of entries gives the same build
+  const res2 = await fetch("http://localhost:8080/preact@10.23.2?entries=hooks,jsx-runtime&target=es2022");
+  res2.body?.cancel();
+  assertEquals(res2.headers.get("x-esm-path"), barrelPath);
+
+  const code = await fetch("http://localhost:8080" + barrelPath).then((res) => res.text());
+  assertStringIncludes(code, `export * as hooks from "/preact@10.23.2/es2022/hooks.mjs";`);
+  assertStringIncludes(code, `export * as jsx_runtime from "/preact@10.23.2/es2022/jsx-runtime.mjs";`);
+
+  const res3 = await fetch("http://localhost:8080/preact@10.23.2?entries=not-exists");
+  res3.body?.cancel();
+  assertEquals(res3.status, 404);
+
+  const res4 = await fetch(
+    "http://localhost:8080/preact@10.23.2?entries=" + Array.from({ length: 17 }, (_, i) => "e" + i).join(","),
+  );
+  res4.body?.cancel();
+  assertEquals(res4.status, 400);
+});
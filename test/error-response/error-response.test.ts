@@ -0,0 +1,36 @@
+import { assertEquals, assertStringIncludes } from "jsr:@std/assert";
+
+Deno.test("JSON error responses", async () => {
+  {
+    const res = await fetch("http://localhost:8080/error.js?type=resolve&name=foo&importer=bar");
+    assertEquals(res.status, 200);
+    assertStringIncludes(res.headers.get("Content-Type")!, "application/javascript");
+    assertStringIncludes(await res.text(), `throw new Error("Could not resolve \\"foo\\" (Imported by \\"bar\\")")`);
+  }
+  {
+    const res = await fetch("http://localhost:8080/error.js?type=resolve&name=foo&importer=bar", {
+      headers: { "Accept": "application/json" },
+    });
+    assertEquals(res.status, 404);
+    assertEquals(await res.json(), {
+      error: `Could not resolve "foo" (Imported by "bar")`,
+      code: "E_RESOLVE",
+      name: "foo",
+      importer: "bar",
+    });
+  }
+  {
+    const res = await fetch("http://localhost:8080/error.js?type=unsupported-node-native-module&name=foo.node&importer=bar", {
+      headers: { "Accept": "application/json" },
+    });
+    assertEquals(res.status, 422);
+    assertEquals((await res.json()).code, "E_UNSUPPORTED");
+  }
+  {
+    const res = await fetch("http://localhost:8080/react@18.2.0/not-exists?target=es2022", {
+      headers: { "Accept": "application/json" },
+    });
+    assertEquals(res.status, 404);
+    assertEquals((await res.json()).code, "E_NOT_FOUND");
+  }
+});
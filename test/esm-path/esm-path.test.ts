@@ -0,0 +1,16 @@
+import { assertEquals } from "jsr:@std/assert";
+
+Deno.test("`X-ESM-Path` header", async () => {
+  {
+    const res = await fetch("http://localhost:8080/react@18.2.0?target=es2022", { method: "HEAD" });
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("X-ESM-Path"), "/react@18.2.0/es2022/react.mjs");
+  }
+  {
+    const res = await fetch("http://localhost:8080/react@18.2.0/not-exists?target=es2022");
+    res.body?.cancel();
+    assertEquals(res.status, 404);
+    assertEquals(res.headers.get("X-ESM-Path"), "/react@18.2.0/es2022/not-exists.mjs");
+    assertEquals(res.headers.get("Access-Control-Expose-Headers"), "X-ESM-Path");
+  }
+});
@@ -0,0 +1,26 @@
+import { assert, assertEquals, assertStringIncludes } from "jsr:@std/assert";
+
+Deno.test("`/importmap` endpoint", async () => {
+  {
+    const res = await fetch("http://localhost:8080/importmap?entry=react-dom@18.2.0/client&target=es2022");
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("Content-Type"), "application/json; charset=utf-8");
+    assertEquals(res.headers.get("Cache-Control"), "public, max-age=600");
+    const { imports } = await res.json();
+    assertEquals(imports["react-dom/client"], "http://localhost:8080/react-dom@18.2.0/es2022/client.mjs");
+    assertEquals(imports["react-dom"], "http://localhost:8080/react-dom@18.2.0/es2022/react-dom.mjs");
+    assertEquals(imports["react"], "http://localhost:8080/react@18.2.0/es2022/react.mjs");
+    assertStringIncludes(imports["scheduler"], "http://localhost:8080/scheduler@0.23.");
+    for (const url of Object.values(imports) as string[]) {
+      assert(url.endsWith(".mjs"));
+      const res = await fetch(url);
+      res.body?.cancel();
+      assertEquals(res.status, 200);
+    }
+  }
+  {
+    const res = await fetch("http://localhost:8080/importmap?entry=");
+    res.body?.cancel();
+    assertEquals(res.status, 400);
+  }
+});
@@ -0,0 +1,20 @@
+import { assert, assertEquals } from "jsr:@std/assert";
+
+Deno.test("`?module-graph` query", async () => {
+  const res = await fetch("http://localhost:8080/react-dom@18.2.0/client?module-graph&target=es2022");
+  assertEquals(res.status, 200);
+  assertEquals(res.headers.get("Content-Type"), "application/json; charset=utf-8");
+  assertEquals(res.headers.get("Cache-Control"), "public, max-age=600");
+  const { entry, modules, truncated } = await res.json();
+  assertEquals(entry, "/react-dom@18.2.0/es2022/client.mjs");
+  assertEquals(truncated, undefined);
+  assert(modules[entry].includes("/react-dom@18.2.0/es2022/react-dom.mjs"));
+  const react = modules["/react-dom@18.2.0/es2022/react-dom.mjs"].find((dep: string) => dep.startsWith("/react@18."));
+  assert(react);
+  assertEquals(modules[react], []);
+  for (const deps of Object.values(modules) as string[][]) {
+    for (const dep of deps) {
+      assert(dep in modules, `${dep} is not in the graph`);
+    }
+  }
+});
@@ -0,0 +1,22 @@
+import { assert, assertEquals } from "jsr:@std/assert";
+
+Deno.test("`/npm/PKG` registry metadata proxy", async () => {
+  {
+    const res = await fetch("http://localhost:8080/npm/react");
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("Content-Type"), "application/json; charset=utf-8");
+    assertEquals(res.headers.get("Access-Control-Allow-Origin"), "*");
+    assertEquals(res.headers.get("Cache-Control"), "public, max-age=600");
+    const metadata = await res.json();
+    assertEquals(metadata.name, "react");
+    assert(metadata.versions.includes("18.3.1"));
+    assert(metadata.versions.indexOf("16.0.0") < metadata.versions.indexOf("18.3.1"));
+    assertEquals(typeof metadata["dist-tags"].latest, "string");
+    assertEquals(typeof metadata.time["18.3.1"], "string");
+  }
+  {
+    const res = await fetch("http://localhost:8080/npm/@esm.sh/react-dom-server-mock-404");
+    res.body?.cancel();
+    assertEquals(res.status, 404);
+  }
+});
@@ -0,0 +1,54 @@
+import { assertEquals } from "jsr:@std/assert";
+
+Deno.test("purge a single build by the build id", async () => {
+  const res = await fetch("http://localhost:8080/react@18.2.0?target=es2022");
+  res.body?.cancel();
+  assertEquals(res.status, 200);
+  const buildId = res.headers.get("X-ESM-Path")!;
+  assertEquals(buildId, "/react@18.2.0/es2022/react.mjs");
+
+  const res2 = await fetch("http://localhost:8080/purge", {
+    method: "POST",
+    body: new URLSearchParams({ buildId }),
+  });
+  assertEquals(res2.status, 200);
+  const { deleted } = await res2.json();
+  assertEquals(deleted.includes("modules/react@18.2.0/es2022/react.mjs"), true);
+
+  const res3 = await fetch("http://localhost:8080/purge", {
+    method: "POST",
+    body: new URLSearchParams({ buildId: "react@18.2.0" }),
+  });
+  res3.body?.cancel();
+  assertEquals(res3.status, 400);
+
+  // rebuild the module
+  const res4 = await fetch("http://localhost:8080/react@18.2.0/es2022/react.mjs");
+  res4.body?.cancel();
+  assertEquals(res4.status, 200);
+});
+
+Deno.test("purge a build with `If-Match` header", async () => {
+  const res = await fetch("http://localhost:8080/react@18.2.0/es2022/jsx-runtime.mjs");
+  res.body?.cancel();
+  assertEquals(res.status, 200);
+  const etag = res.headers.get("Etag")!;
+  assertEquals(etag.startsWith(`W/"`), true);
+
+  const res2 = await fetch("http://localhost:8080/purge", {
+    method: "POST",
+    headers: { "If-Match": `W/"0-0"` },
+    body: new URLSearchParams({ buildId: "/react@18.2.0/es2022/jsx-runtime.mjs" }),
+  });
+  res2.body?.cancel();
+  assertEquals(res2.status, 412);
+
+  const res3 = await fetch("http://localhost:8080/purge", {
+    method: "POST",
+    headers: { "If-Match": etag },
+    body: new URLSearchParams({ buildId: "/react@18.2.0/es2022/jsx-runtime.mjs" }),
+  });
+  assertEquals(res3.status, 200);
+  const { deleted } = await res3.json();
+  assertEquals(deleted.includes("modules/react@18.2.0/es2022/jsx-runtime.mjs"), true);
+});
@@ -46,6 +46,104 @@ Deno.test("transform", async (t) => {
     assertEquals(res3.headers.get("Content-Type"), "application/json; charset=utf-8");
     const map = await res3.text();
     assertEquals(map, transformOut.map);
+
+    assertEquals(res1.headers.get("X-ESM-Transform-Hash"), hash);
+
+    const res4 = await fetch(`http://localhost:8080/transform/${hash}`, { method: "HEAD" });
+    assertEquals(res4.status, 200);
+
+    const res5 = await fetch(`http://localhost:8080/transform/${hash}`);
+    assertEquals(res5.status, 200);
+    assertEquals(await res5.json(), transformOut);
+
+    const res6 = await fetch(`http://localhost:8080/transform/${"0".repeat(40)}`, { method: "HEAD" });
+    assertEquals(res6.status, 404);
+
+    const res7 = await fetch(`http://localhost:8080/+${"0".repeat(40)}.mjs`);
+    res7.body?.cancel();
+    assertEquals(res7.status, 404);
+  });
+
+  await t.step("transform API with gzip-encoded body", async () => {
+    const options = {
+      lang: "ts",
+      code: `export const msg: string = "Hello esm.sh";`,
+      target: "es2022",
+    };
+    const gzip = (data: string) => new Response(new Blob([data]).stream().pipeThrough(new CompressionStream("gzip"))).arrayBuffer();
+    const res1 = await fetch("http://localhost:8080/transform", {
+      method: "POST",
+      headers: { "Content-Type": "application/json", "Content-Encoding": "gzip" },
+      body: await gzip(JSON.stringify(options)),
+    });
+    assertEquals(res1.status, 200);
+    const transformOut = await res1.json();
+    assertStringIncludes(transformOut.code, `const msg = "Hello esm.sh"`);
+
+    const res2 = await fetch("http://localhost:8080/transform", {
+      method: "POST",
+      headers: { "Content-Type": "application/json", "Content-Encoding": "gzip" },
+      body: JSON.stringify(options),
+    });
+    res2.body?.cancel();
+    assertEquals(res2.status, 400);
+
+    const res3 = await fetch("http://localhost:8080/transform", {
+      method: "POST",
+      headers: { "Content-Type": "application/json", "Content-Encoding": "gzip" },
+      body: await gzip(JSON.stringify({ ...options, code: "//" + "x".repeat(3 * 1024 * 1024) })),
+    });
+    res3.body?.cancel();
+    assertEquals(res3.status, 413);
+  });
+
+  await t.step("transform API in safe mode", async () => {
+    const options = {
+      lang: "ts",
+      code: `import fs from "node:fs"; import a from "a"; import b from "b"; console.log(fs, a, b);`,
+      target: "es2022",
+      importMap: {
+        imports: {
+          "a": "file:///etc/passwd",
+          "b": "https://esm.sh/b@1.0.0",
+        },
+      },
+    };
+    const res = await fetch("http://localhost:8080/transform?safe", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(options),
+    });
+    assertEquals(res.status, 200);
+    const transformOut = await res.json();
+    assertEquals(transformOut.rejected, ["a", "node:fs"]);
+    assertStringIncludes(transformOut.code, `"https://esm.sh/b@1.0.0"`);
+    assertEquals(transformOut.code.includes("file:"), false);
+    assertEquals(transformOut.code.includes(`from "node:fs"`), false);
+  });
+
+  await t.step("transform API with conditions", async () => {
+    const options = {
+      lang: "ts",
+      code: `import { h } from "preact@10.13.2"; import b from "b"; console.log(h, b);`,
+      target: "es2022",
+      importMap: {
+        imports: {
+          "b": "https://esm.sh/b@1.0.0",
+        },
+      },
+      conditions: ["react-server"],
+    };
+    const res = await fetch("http://localhost:8080/transform", {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify(options),
+    });
+    assertEquals(res.status, 200);
+    const transformOut = await res.json();
+    assertEquals(transformOut.imports, {
+      "preact@10.13.2": "http://localhost:8080/preact@10.13.2?target=es2022&conditions=react-server",
+    });
   });
 
   const modUrl = new URL(import.meta.url);
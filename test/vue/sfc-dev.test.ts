@@ -0,0 +1,21 @@
+import { assertEquals, assertStringIncludes } from "jsr:@std/assert";
+
+async function fetchBuild(query: string) {
+  const res = await fetch(
+    "http://localhost:8080/gh/phosphor-icons/vue@v2.2.0/src/icons/PhAirplay.vue?deps=vue@3.5.8&target=es2022" + query,
+  );
+  assertEquals(res.status, 200);
+  res.body?.cancel();
+  const esmPath = res.headers.get("x-esm-path")!;
+  const res2 = await fetch("http://localhost:8080" + esmPath);
+  assertEquals(res2.status, 200);
+  return res2.text();
+}
+
+Deno.test("Compile SFC in development mode", async () => {
+  const devCode = await fetchBuild("&dev");
+  assertStringIncludes(devCode, "__isScriptSetup");
+
+  const prodCode = await fetchBuild("");
+  assertEquals(prodCode.includes("__isScriptSetup"), false);
+});
@@ -0,0 +1,22 @@
+import { assertEquals } from "jsr:@std/assert";
+
+Deno.test("serve raw `.wasm` files with `application/wasm` content type", async () => {
+  const wasmUrl = "http://localhost:8080/esm-compiler@0.7.2/pkg/esm_compiler_bg.wasm";
+  {
+    const res = await fetch(wasmUrl);
+    res.body?.cancel();
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("Content-Type"), "application/wasm");
+  }
+  {
+    const res = await fetch(wasmUrl + "?raw");
+    res.body?.cancel();
+    assertEquals(res.status, 200);
+    assertEquals(res.headers.get("Content-Type"), "application/wasm");
+  }
+  {
+    // streaming compilation requires the `application/wasm` content type
+    const mod = await WebAssembly.compileStreaming(fetch(wasmUrl));
+    assertEquals(mod instanceof WebAssembly.Module, true);
+  }
+});